@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/apply"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/state"
+)
+
+// runApply implements `mcis apply --target hosts|nftables|dnsmasq`: it
+// points the chosen system integration at the winning IPs of a saved
+// search, or with -rollback restores what the last apply replaced.
+func runApply(args []string) int {
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	target := fs.String("target", "", "Integration to update: hosts | nftables | dnsmasq")
+	dir := fs.String("state-dir", "", "State directory whose latest result is applied")
+	in := fs.String("in", "", "Result file to apply instead (JSON as saved in a state directory or written by --out debug)")
+	count := fs.Int("count", 1, "Number of winning IPs applied: the recommended IP, then its fallbacks (the hosts file takes the best one per address family)")
+	names := fs.String("name", "", "Comma-separated host names pointed at the IPs (hosts, dnsmasq)")
+	path := fs.String("path", "", "File to update (default "+apply.DefaultHostsPath+" for hosts, "+apply.DefaultDnsmasqPath+" for dnsmasq)")
+	set := fs.String("set", "", "nftables set receiving the IPv4 addresses, as \"family table name\" (e.g. \"inet mcis best4\")")
+	set6 := fs.String("set6", "", "nftables set receiving the IPv6 addresses")
+	backup := fs.String("backup", "", "Where the replaced configuration is kept (default: <path>.mcis.bak, or mcis-nftables.bak in the state directory or current directory)")
+	reloadCmd := fs.String("reload", "", "Command run after the update (e.g. \"systemctl reload dnsmasq\"); if it fails the update is rolled back")
+	rollback := fs.Bool("rollback", false, "Restore the configuration replaced by the last apply")
+	dryRun := fs.Bool("dry-run", false, "Print what would be written without changing anything")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mcis apply -target hosts|nftables|dnsmasq (-state-dir dir | -in result.json) [-name host,...] [-set \"family table name\"]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *target == "" || fs.NArg() > 0 || (!*rollback && (*dir == "") == (*in == "")) {
+		fs.Usage()
+		return 2
+	}
+
+	cfg := apply.Config{
+		Target: *target,
+		Names:  parseHostNames(*names),
+		Path:   *path,
+		Set:    *set,
+		Set6:   *set6,
+		Backup: *backup,
+		Reload: strings.Fields(*reloadCmd),
+	}
+	if cfg.Target == apply.TargetNFTables && cfg.Backup == "" && *dir != "" {
+		cfg.Backup = filepath.Join(*dir, "mcis-nftables.bak")
+	}
+
+	ctx := context.Background()
+	if *rollback {
+		if *dryRun {
+			fmt.Fprintln(os.Stderr, "error: -dry-run cannot be combined with -rollback")
+			return 2
+		}
+		if err := apply.Rollback(ctx, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		fmt.Printf("%s: rolled back\n", cfg.Target)
+		return 0
+	}
+
+	src := *in
+	if src == "" {
+		src = filepath.Join(*dir, state.LatestName)
+	}
+	ips, err := winningIPs(src, *count)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	if *dryRun {
+		plan, err := apply.Plan(cfg, ips)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		fmt.Print(plan)
+		return 0
+	}
+	if err := apply.Apply(ctx, cfg, ips); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	fmt.Printf("%s: applied %s\n", cfg.Target, strings.Join(s, ", "))
+	return 0
+}
+
+// winningIPs reads the result file at path and returns up to n of its
+// winning IPs: the recommended one and its fallbacks, else the working
+// results in rank order.
+func winningIPs(path string, n int) ([]netip.Addr, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var res engine.Response
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var ips []netip.Addr
+	if res.Meta != nil && res.Meta.Recommended.IsValid() {
+		ips = append([]netip.Addr{res.Meta.Recommended}, res.Meta.Fallbacks...)
+	}
+	for _, r := range res.Top {
+		if r.OK && !slices.Contains(ips, r.IP) {
+			ips = append(ips, r.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.New(path + ": no working IP to apply")
+	}
+	return ips[:min(max(n, 1), len(ips))], nil
+}
+
+// parseHostNames parses a comma-separated list of host names.
+func parseHostNames(s string) []string {
+	var names []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.ToLower(strings.TrimSpace(f)); f != "" {
+			names = append(names, f)
+		}
+	}
+	return names
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/cache"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/priors"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/store"
+)
+
+// Keys under which a remote --state-backend holds the IP cache, the
+// newest results (the same JSON as <state-dir>/latest.json) and the
+// checkpoint of what the searches learned about each prefix (a prior pack,
+// see mcis priors).
+const (
+	backendCacheKey      = "cache"
+	backendLatestKey     = "latest"
+	backendCheckpointKey = "checkpoint"
+)
+
+// checkpointMinSamples is the fewest probes a prefix needs to make it into
+// the checkpoint, as for mcis priors export.
+const checkpointMinSamples = 3
+
+// saveLatest stores the results of a run as the backend's latest results.
+// A SQLite backend also adds them to its run history (the newest keep runs),
+// which mcis report -db charts.
+func saveLatest(b store.Backend, res engine.Response, keep int) error {
+	data, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if err := b.Put(backendLatestKey, data); err != nil {
+		return err
+	}
+	if s, ok := b.(*store.SQLite); ok {
+		return s.AddRun(time.Now(), data, keep)
+	}
+	return nil
+}
+
+// loadCheckpoint returns the backend's checkpoint aged to now, or nil if
+// there is none yet. An encrypted checkpoint is decrypted with key.
+func loadCheckpoint(b store.Backend, key *[cache.KeySize]byte, halfLife time.Duration) (*priors.Pack, error) {
+	data, err := b.Get(backendCheckpointKey)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data, err = cache.Decrypt(data, key); err != nil {
+		return nil, fmt.Errorf("checkpoint: %w", err)
+	}
+	p, err := priors.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint: %w", err)
+	}
+	p = p.Decayed(time.Now(), halfLife)
+	return &p, nil
+}
+
+// saveCheckpoint folds what the search of eng learned into the backend's
+// checkpoint, so the next search on any host sharing the backend starts
+// from it, and returns the new checkpoint. It is encrypted with key, like
+// the cache, unless key is nil.
+func saveCheckpoint(b store.Backend, key *[cache.KeySize]byte, eng *engine.Engine, halfLife time.Duration) (priors.Pack, error) {
+	now := time.Now()
+	pack := priors.FromTree(eng.TreeSnapshot().Roots, checkpointMinSamples, now)
+	old, err := loadCheckpoint(b, key, halfLife)
+	if err != nil {
+		return priors.Pack{}, err
+	}
+	if old != nil {
+		pack = priors.Merge(now, *old, pack)
+	}
+	data, err := json.Marshal(pack)
+	if err != nil {
+		return priors.Pack{}, err
+	}
+	if data, err = cache.Encrypt(append(data, '\n'), key); err != nil {
+		return priors.Pack{}, err
+	}
+	return pack, b.Put(backendCheckpointKey, data)
+}
+
+// withPack returns the priors of a and b pooled; a may be nil.
+func withPack(a *priors.Pack, b priors.Pack) *priors.Pack {
+	if a == nil {
+		return &b
+	}
+	m := priors.Merge(time.Now(), *a, b)
+	return &m
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/probe"
+)
+
+// baselineProbes is how many probes the baseline latency is the median of.
+const baselineProbes = 3
+
+// exitNoImprovement is the exit code when no result beats the baseline by
+// --min-improvement-pct, so scripts can tell "keep the current setup" from
+// a failed run.
+const exitNoImprovement = 3
+
+var errNoImprovement = errors.New("no result beats the default route by --min-improvement-pct")
+
+// measureBaseline probes host the way any client on this machine would
+// reach it: at the first address the system resolver gives, with the same
+// probe as the search, so the results can be compared with the default
+// path.
+func measureBaseline(ctx context.Context, prober *probe.Prober, host string, timeout time.Duration) engine.Baseline {
+	b := engine.Baseline{Host: host}
+	lctx, cancel := context.WithTimeout(ctx, timeout)
+	addrs, err := net.DefaultResolver.LookupNetIP(lctx, "ip", host)
+	cancel()
+	if err != nil {
+		b.Error = err.Error()
+		return b
+	}
+	if len(addrs) == 0 {
+		b.Error = fmt.Sprintf("no address for %s", host)
+		return b
+	}
+	b.IP = addrs[0].Unmap()
+
+	var ms []float64
+	for i := 0; i < baselineProbes && ctx.Err() == nil; i++ {
+		pctx, pcancel := context.WithTimeout(ctx, timeout)
+		r := prober.ProbeHTTPTrace(pctx, b.IP)
+		pcancel()
+		b.Probes++
+		if !r.OK {
+			b.Error = r.Error
+			continue
+		}
+		ms = append(ms, float64(r.TotalMS))
+	}
+	if len(ms) == 0 {
+		return b
+	}
+	sort.Float64s(ms)
+	b.OK, b.ScoreMS, b.Error = true, ms[len(ms)/2], ""
+	return b
+}
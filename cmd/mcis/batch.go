@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// batchReserved are the flags a batch job may not set: batch sets them
+// itself, or they would keep the job from finishing (--serve, --interval,
+// --schedule) or from writing its output.
+var batchReserved = map[string]bool{
+	"config": true, "exit-summary": true, "serve": true, "dry-run": true,
+	"interval": true, "schedule": true,
+}
+
+// batchJob is one [name] section of a jobs file.
+type batchJob struct {
+	name     string
+	line     int
+	settings []configSetting
+	outPath  string
+
+	// cachePath is the job's own IP cache, unless it chose one: cached
+	// IPs are re-tested whatever the CIDRs, so jobs must not share one.
+	cachePath string
+}
+
+// batchResult is how a job went, as written to the combined summary.
+type batchResult struct {
+	Job       string       `json:"job"`
+	OK        bool         `json:"ok"`
+	Skipped   bool         `json:"skipped,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	ExitCode  int          `json:"exit_code"`
+	DurationS float64      `json:"duration_s"`
+	Output    string       `json:"output"`
+	Summary   *exitSummary `json:"summary,omitempty"`
+}
+
+// readJobsFile reads a jobs file: config file settings (see
+// readConfigFile) grouped into named jobs by "[name]" headers. Settings
+// before the first header apply to every job; a job that sets a flag
+// itself replaces all of their values for it, so a job's --cidr lines are
+// its whole CIDR set.
+func readJobsFile(path string) ([]*batchJob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var common []configSetting
+	var jobs []*batchJob
+	names := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := configLine(sc.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			name, ok := strings.CutSuffix(line[1:], "]")
+			name = strings.TrimSpace(name)
+			if !ok || name == "" || strings.ContainsAny(name, `/\`) {
+				return nil, fmt.Errorf("%s:%d: invalid job header %q", path, n, line)
+			}
+			if names[name] {
+				return nil, fmt.Errorf("%s:%d: duplicate job %q", path, n, name)
+			}
+			names[name] = true
+			jobs = append(jobs, &batchJob{name: name, line: n})
+			continue
+		}
+		s, err := parseConfigSetting(line, n)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%w", path, err)
+		}
+		if batchReserved[s.name] {
+			return nil, fmt.Errorf("%s:%d: jobs cannot set --%s", path, n, s.name)
+		}
+		if len(jobs) == 0 {
+			common = append(common, s)
+		} else {
+			j := jobs[len(jobs)-1]
+			j.settings = append(j.settings, s)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("%s: no jobs (start each with a [name] line)", path)
+	}
+
+	for _, j := range jobs {
+		own := make(map[string]bool)
+		for _, s := range j.settings {
+			own[s.name] = true
+		}
+		var merged []configSetting
+		for _, s := range common {
+			if !own[s.name] {
+				merged = append(merged, s)
+			}
+		}
+		j.settings = append(merged, j.settings...)
+	}
+	return jobs, nil
+}
+
+// args returns the command line that runs the job.
+func (j *batchJob) args() []string {
+	args := []string{"--exit-summary", "--out-file=" + j.outPath}
+	if j.cachePath != "" {
+		args = append(args, "--cache-file="+j.cachePath)
+	}
+	for _, s := range j.settings {
+		if s.name != "out-file" {
+			args = append(args, "--"+s.name+"="+s.value)
+		}
+	}
+	return args
+}
+
+// batchExt is the file extension of each --out format.
+func batchExt(format string) string {
+	switch format {
+	case "jsonl", "csv":
+		return "." + format
+	case "footprint", "rotation":
+		return ".json"
+	default:
+		return ".txt"
+	}
+}
+
+// runBatch implements `mcis batch jobs.conf`: it runs the searches defined
+// in a jobs file one after another (or -parallel at a time), each as its
+// own mcis process writing its own output file, and ends with a combined
+// summary of all of them. A failed job does not stop the others unless
+// -fail-fast is given; the exit status is 1 if any job failed.
+func runBatch(args []string) int {
+	fs := flag.NewFlagSet("batch", flag.ContinueOnError)
+	parallel := fs.Int("parallel", 1, "How many jobs to run at once")
+	dir := fs.String("dir", ".", "Directory for the output of jobs that set no out-file (<job>.<format extension>)")
+	summaryPath := fs.String("summary", "", "Also write the combined summary as JSON to this file")
+	failFast := fs.Bool("fail-fast", false, "Start no further jobs once one has failed")
+	only := fs.String("jobs", "", "Run only these jobs (comma-separated names)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mcis batch [-parallel N] [-dir DIR] [-summary FILE] [-fail-fast] [-jobs a,b] jobs.conf")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != 1 || *parallel < 1 {
+		fs.Usage()
+		return 2
+	}
+
+	jobs, err := readJobsFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 2
+	}
+	if *only != "" {
+		want := make(map[string]bool)
+		for _, name := range strings.Split(*only, ",") {
+			want[strings.TrimSpace(name)] = true
+		}
+		var kept []*batchJob
+		for _, j := range jobs {
+			if want[j.name] {
+				kept = append(kept, j)
+				delete(want, j.name)
+			}
+		}
+		for name := range want {
+			fmt.Fprintf(os.Stderr, "error: -jobs: no job %q in %s\n", name, fs.Arg(0))
+			return 2
+		}
+		jobs = kept
+	}
+
+	outputs := make(map[string]string)
+	for _, j := range jobs {
+		values := configValues(j.settings)
+		j.outPath = values["out-file"]
+		if j.outPath == "" {
+			format := values["out"]
+			if format == "" {
+				format = "jsonl"
+			}
+			j.outPath = filepath.Join(*dir, j.name+batchExt(format))
+		}
+		if other, dup := outputs[filepath.Clean(j.outPath)]; dup {
+			fmt.Fprintf(os.Stderr, "error: jobs %q and %q both write %s\n", other, j.name, j.outPath)
+			return 2
+		}
+		outputs[filepath.Clean(j.outPath)] = j.name
+		if values["cache-file"] == "" && values["state-dir"] == "" {
+			j.cachePath = filepath.Join(*dir, "."+j.name+".mcis_cache.json")
+		}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	// Catch mistakes in any job before the first one spends its budget.
+	bad := false
+	for _, j := range jobs {
+		if err := checkBatchJob(ctx, exe, j); err != nil {
+			fmt.Fprintf(os.Stderr, "error: job %q (line %d): %v\n", j.name, j.line, err)
+			bad = true
+		}
+	}
+	if bad {
+		return 2
+	}
+
+	results := make([]batchResult, len(jobs))
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed bool
+	)
+	sem := make(chan struct{}, *parallel)
+	for i, j := range jobs {
+		sem <- struct{}{}
+		mu.Lock()
+		stop := failed && *failFast
+		mu.Unlock()
+		if stop || ctx.Err() != nil {
+			<-sem
+			results[i] = batchResult{Job: j.name, Skipped: true, ExitCode: -1, Output: j.outPath}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			fmt.Fprintf(os.Stderr, "batch: %s: started\n", j.name)
+			res := runBatchJob(ctx, exe, j)
+			if res.OK {
+				fmt.Fprintf(os.Stderr, "batch: %s: done in %.1fs\n", j.name, res.DurationS)
+			} else {
+				fmt.Fprintf(os.Stderr, "batch: %s: failed: %s\n", j.name, res.Error)
+			}
+			mu.Lock()
+			results[i] = res
+			if !res.OK {
+				failed = true
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	writeBatchSummary(os.Stdout, results)
+	if *summaryPath != "" {
+		if err := writeBatchSummaryFile(*summaryPath, results); err != nil {
+			fmt.Fprintln(os.Stderr, "error: -summary:", err)
+			return 1
+		}
+	}
+	if failed || ctx.Err() != nil {
+		return 1
+	}
+	return 0
+}
+
+// checkBatchJob runs a job with --dry-run, which checks its flags and
+// CIDRs without probing, and returns the first line of its error output if
+// that fails.
+func checkBatchJob(ctx context.Context, exe string, j *batchJob) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, exe, append(j.args(), "--dry-run")...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if line, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n"); line != "" {
+			return errors.New(line)
+		}
+		return err
+	}
+	return nil
+}
+
+// runBatchJob runs one job to completion. Its output is passed through
+// with the job's name in front of each line, except for the --exit-summary
+// line, which is parsed into the result.
+func runBatchJob(ctx context.Context, exe string, j *batchJob) batchResult {
+	res := batchResult{Job: j.name, Output: j.outPath}
+	for _, path := range []string{j.outPath, j.cachePath} {
+		if dir := filepath.Dir(path); path != "" && dir != "." {
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				res.Error, res.ExitCode = err.Error(), -1
+				return res
+			}
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, exe, j.args()...)
+	// Let the job write what it has on Ctrl-C, as it would when run alone.
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = 10 * time.Second
+	stdout := &prefixWriter{w: os.Stdout, prefix: "[" + j.name + "] "}
+	stderr := &prefixWriter{w: os.Stderr, prefix: "[" + j.name + "] ", summary: true}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	stdout.flush()
+	stderr.flush()
+	res.DurationS = time.Since(start).Seconds()
+	res.Summary = stderr.parsed
+	res.ExitCode = cmd.ProcessState.ExitCode()
+	switch {
+	case err != nil && res.Summary != nil && res.Summary.Error != "":
+		res.Error = res.Summary.Error
+	case err != nil:
+		res.Error = err.Error()
+	default:
+		res.OK = true
+	}
+	return res
+}
+
+// prefixWriter copies a job's output line by line with prefix in front.
+// With summary set, it keeps the job's --exit-summary line to itself.
+type prefixWriter struct {
+	w       io.Writer
+	prefix  string
+	summary bool
+	parsed  *exitSummary
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		p.line(p.buf[:i+1])
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+func (p *prefixWriter) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.buf) > 0 {
+		p.line(append(p.buf, '\n'))
+		p.buf = nil
+	}
+}
+
+func (p *prefixWriter) line(l []byte) {
+	if p.summary && bytes.HasPrefix(l, []byte(`{"ok":`)) {
+		var s exitSummary
+		if json.Unmarshal(l, &s) == nil {
+			p.parsed = &s
+			return
+		}
+	}
+	_, _ = fmt.Fprintf(p.w, "%s%s", p.prefix, l)
+}
+
+// writeBatchSummary prints the combined summary of a batch as a table.
+func writeBatchSummary(w io.Writer, results []batchResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "JOB\tSTATUS\tPROBES\tDURATION\tBEST IP\tSCORE\tOUTPUT")
+	var probes int64
+	ok := 0
+	for _, r := range results {
+		status := "ok"
+		switch {
+		case r.Skipped:
+			status = "skipped"
+		case !r.OK:
+			status = "FAILED"
+		default:
+			ok++
+		}
+		line := fmt.Sprintf("%s\t%s", r.Job, status)
+		if s := r.Summary; s != nil {
+			probes += s.Probes
+			best, score := "-", "-"
+			if s.BestIP.IsValid() {
+				best, score = s.BestIP.String(), fmt.Sprintf("%.1fms", s.BestScoreMS)
+			}
+			line += fmt.Sprintf("\t%d\t%.1fs\t%s\t%s", s.Probes, r.DurationS, best, score)
+		} else {
+			line += fmt.Sprintf("\t-\t%.1fs\t-\t-", r.DurationS)
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", line, r.Output)
+	}
+	_ = tw.Flush()
+	fmt.Fprintf(w, "batch: %d/%d jobs ok, %d probes\n", ok, len(results), probes)
+}
+
+// writeBatchSummaryFile writes the combined summary as a JSON array.
+func writeBatchSummaryFile(path string, results []batchResult) error {
+	b, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
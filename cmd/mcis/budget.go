@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/speedtest"
+)
+
+// Shares of a --time-budget given to the phases around the search.
+const (
+	// cacheShare caps the time spent re-testing cached IPs.
+	cacheShare = 0.25
+	// minSearchShare is the part of the time left after the cache phase
+	// that the search keeps, however slow the download tests are.
+	minSearchShare = 0.25
+)
+
+// runBudget shares one --time-budget between the phases of a run:
+// re-testing cached IPs, the search, the download tests and the checks
+// after them. The search ends early enough for the download tests to fit,
+// as estimated from the downloads done so far, so a slow link shortens the
+// search instead of pushing the run past its budget. A nil runBudget sets
+// no limits.
+type runBudget struct {
+	start, end time.Time
+	// slack is kept back for the search probes still in flight when it
+	// ends and for the checks after the download tests.
+	slack time.Duration
+}
+
+// newRunBudget starts a budget of total (nil for 0); slack is the probe
+// timeout.
+func newRunBudget(total, slack time.Duration) *runBudget {
+	if total <= 0 {
+		return nil
+	}
+	now := time.Now()
+	return &runBudget{start: now, end: now.Add(total), slack: min(slack, total/10)}
+}
+
+// cacheDone reports whether re-testing cached IPs has used its share.
+func (b *runBudget) cacheDone() bool {
+	if b == nil {
+		return false
+	}
+	return time.Since(b.start) >= time.Duration(cacheShare*float64(b.end.Sub(b.start)))
+}
+
+// searchDeadline returns when the search has to end for the given number
+// of download tests by speed to still fit in the budget.
+func (b *runBudget) searchDeadline(downloads int, speed *speedtest.Runner) time.Time {
+	if b == nil {
+		return time.Time{}
+	}
+	left := time.Until(b.end) - 2*b.slack
+	var need time.Duration
+	if downloads > 0 {
+		waves := (downloads + speed.Parallel() - 1) / speed.Parallel()
+		need = time.Duration(waves) * speed.Estimate()
+	}
+	need = min(need, time.Duration((1-minSearchShare)*float64(max(left, 0))))
+	return b.end.Add(-b.slack - need)
+}
+
+// downloadDeadline returns when the download tests have to be done.
+func (b *runBudget) downloadDeadline() time.Time {
+	if b == nil {
+		return time.Time{}
+	}
+	return b.end.Add(-b.slack)
+}
+
+// context bounds ctx by the end of the budget.
+func (b *runBudget) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if b == nil {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, b.end)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/probe"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/resolver"
+)
+
+// checkConcurrency bounds how many post-search checks run in parallel.
+const checkConcurrency = 8
+
+// forEachResult runs fn for every row with bounded concurrency.
+func forEachResult(rows []engine.TopResult, fn func(r *engine.TopResult)) {
+	sem := make(chan struct{}, checkConcurrency)
+	var wg sync.WaitGroup
+	for i := range rows {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(r *engine.TopResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(r)
+		}(&rows[i])
+	}
+	wg.Wait()
+}
+
+// runFrontingCheck probes every row with mismatched SNI and Host header (as
+// configured in cfg) and records whether the edge accepted the request.
+func runFrontingCheck(ctx context.Context, rows []engine.TopResult, cfg probe.Config, verbose bool) {
+	prober := probe.NewProber(cfg)
+	defer prober.Close()
+	forEachResult(rows, func(r *engine.TopResult) {
+		pctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+		pr := prober.ProbeHTTPTrace(pctx, r.IP)
+		cancel()
+
+		r.FrontingTested = true
+		r.FrontingOK = pr.OK
+		r.FrontingError = pr.Error
+		if verbose {
+			fmt.Fprintf(os.Stderr, "fronting: ip=%s sni=%s host=%s ok=%v status=%d err=%s\n",
+				r.IP.String(), cfg.SNI, cfg.HostHeader, pr.OK, pr.Status, pr.Error)
+		}
+	})
+}
+
+// runResumeCheck re-probes every successful row that lacks a resumed
+// handshake time over a fresh connection, so it resumes the TLS session
+// cached by the search probe (cfg.Sessions), and records tls_resume_ms.
+func runResumeCheck(ctx context.Context, rows []engine.TopResult, cfg probe.Config, verbose bool) {
+	cfg.Warm = false
+	prober := probe.NewProber(cfg) // own connection pool: no reuse of search connections
+	defer prober.Close()
+	forEachResult(rows, func(r *engine.TopResult) {
+		if !r.OK || r.TLSResumeMS > 0 {
+			return
+		}
+		pctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+		pr := prober.ProbeHTTPTrace(pctx, r.IP)
+		cancel()
+
+		if pr.TLSResumed {
+			r.TLSResumeMS = pr.TLSMS
+		}
+		if verbose {
+			fmt.Fprintf(os.Stderr, "tls-resume: ip=%s full=%dms resumed=%v resume=%dms err=%s\n",
+				r.IP.String(), r.TLSMS, pr.TLSResumed, r.TLSResumeMS, pr.Error)
+		}
+	})
+}
+
+// runECHCheck fetches sni's ECH configuration from its HTTPS record and tries
+// an ECH handshake against every row.
+func runECHCheck(ctx context.Context, rows []engine.TopResult, sni string, res *resolver.Resolver, timeout time.Duration, verbose bool) {
+	lctx, cancel := context.WithTimeout(ctx, timeout)
+	echConfig, err := probe.LookupECHConfig(lctx, sni, res)
+	cancel()
+	if err != nil {
+		if verbose {
+			fmt.Fprintf(os.Stderr, "ech: lookup HTTPS record for %s failed: %v\n", sni, err)
+		}
+		for i := range rows {
+			rows[i].ECHTested = true
+			rows[i].ECHError = err.Error()
+		}
+		return
+	}
+
+	forEachResult(rows, func(r *engine.TopResult) {
+		cctx, cancel := context.WithTimeout(ctx, timeout)
+		ok, err := probe.CheckECH(cctx, r.IP, sni, echConfig, timeout)
+		cancel()
+
+		r.ECHTested = true
+		r.ECHSupported = ok
+		if err != nil {
+			r.ECHError = err.Error()
+		}
+		if verbose {
+			fmt.Fprintf(os.Stderr, "ech: ip=%s supported=%v err=%s\n", r.IP.String(), ok, r.ECHError)
+		}
+	})
+}
+
+// runCertCheck verifies the certificate chain every row serves for sni and
+// records the result, the leaf's expiry and the stapled OCSP status.
+func runCertCheck(ctx context.Context, rows []engine.TopResult, sni string, timeout time.Duration, verbose bool) {
+	forEachResult(rows, func(r *engine.TopResult) {
+		cctx, cancel := context.WithTimeout(ctx, timeout)
+		cr := probe.CheckCert(cctx, r.IP, sni, timeout)
+		cancel()
+
+		r.CertTested = true
+		r.CertOK = cr.OK
+		r.CertError = cr.Error
+		r.CertExpiry = cr.NotAfter
+		r.CertOCSP = cr.OCSP
+		if verbose {
+			fmt.Fprintf(os.Stderr, "cert: ip=%s ok=%v expires=%s ocsp=%s err=%s\n",
+				r.IP.String(), cr.OK, cr.NotAfter.Format(time.DateOnly), cr.OCSP, cr.Error)
+		}
+	})
+}
+
+// defaultCheckPorts are the ports Cloudflare proxies: HTTP (80, 8080, 8880,
+// 2052, 2082, 2086, 2095) and HTTPS (443, 2053, 2083, 2087, 2096, 8443).
+const defaultCheckPorts = "80,443,2052,2053,2082,2083,2086,2087,2095,2096,8080,8443,8880"
+
+// parseColos parses a comma-separated list of data center codes.
+func parseColos(s string) []string {
+	var colos []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.ToUpper(strings.TrimSpace(f)); f != "" {
+			colos = append(colos, f)
+		}
+	}
+	return colos
+}
+
+// parseHeaderNames parses a comma-separated list of header names.
+func parseHeaderNames(s string) []string {
+	var names []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.ToLower(strings.TrimSpace(f)); f != "" {
+			names = append(names, f)
+		}
+	}
+	return names
+}
+
+// parsePorts parses a comma-separated port list, dropping duplicates.
+func parsePorts(s string) ([]int, error) {
+	seen := make(map[int]bool)
+	var ports []int
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		p, err := strconv.Atoi(f)
+		if err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("invalid port %q", f)
+		}
+		if !seen[p] {
+			seen[p] = true
+			ports = append(ports, p)
+		}
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no ports given")
+	}
+	sort.Ints(ports)
+	return ports, nil
+}
+
+// runPortCheck tests a TCP connection to each port on every row and records
+// the reachability matrix in the rows.
+func runPortCheck(ctx context.Context, rows []engine.TopResult, ports []int, timeout time.Duration, verbose bool) {
+	forEachResult(rows, func(r *engine.TopResult) {
+		res := make([]engine.PortResult, len(ports))
+		var wg sync.WaitGroup
+		for i, port := range ports {
+			wg.Add(1)
+			go func(i, port int) {
+				defer wg.Done()
+				rtt, err := probe.DialRTT(ctx, r.IP, port, timeout)
+				res[i] = engine.PortResult{Port: port, OK: err == nil}
+				if err == nil {
+					res[i].ConnectMS = rtt.Milliseconds()
+				}
+			}(i, port)
+		}
+		wg.Wait()
+
+		r.Ports = res
+		if verbose {
+			var open []string
+			for _, pr := range res {
+				if pr.OK {
+					open = append(open, strconv.Itoa(pr.Port))
+				}
+			}
+			fmt.Fprintf(os.Stderr, "ports: ip=%s open=%s\n", r.IP.String(), strings.Join(open, ","))
+		}
+	})
+}
+
+// cachePreference maps --prefer to engine.Config.PreferCache: "" for any,
+// else the cache status to score (validated by the engine).
+func cachePreference(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "any" {
+		return ""
+	}
+	return s
+}
+
+// defaultV6Suffixes are the interface IDs most often assigned by hand to
+// servers and gateways.
+const defaultV6Suffixes = "::1,::2,::3,::4,::5,::10,::100,::1000"
+
+// parseV6Suffixes parses a comma-separated list of IPv6 interface IDs
+// written as addresses in ::/64 (e.g. "::1,::a:1").
+func parseV6Suffixes(s string) ([]uint64, error) {
+	seen := make(map[uint64]bool)
+	var ids []uint64
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		a, err := netip.ParseAddr(f)
+		if err != nil || !a.Is6() {
+			return nil, fmt.Errorf("invalid interface ID %q", f)
+		}
+		b := a.As16()
+		if binary.BigEndian.Uint64(b[:8]) != 0 {
+			return nil, fmt.Errorf("interface ID %q sets bits above the low 64", f)
+		}
+		if id := binary.BigEndian.Uint64(b[8:]); !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/cidr"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+)
+
+// reloadableFlags are the flags a config reload (SIGHUP or POST /api/reload)
+// applies to a running daemon. Everything else is read once at startup,
+// either because it is wired up before the first run (--serve, --state-dir,
+// --stream) or because other settings are derived from it (--host).
+var reloadableFlags = map[string]bool{
+	"cidr": true, "cidr-file": true,
+	"budget": true, "budget-unit": true, "time-budget": true, "top": true, "concurrency": true, "max-inflight": true, "slow-start": true,
+	"max-probes-per-second": true, "max-bandwidth": true, "heads": true, "heads-v4": true, "heads-v6": true, "beam": true,
+	"timeout": true, "path": true, "warm": true, "follow-redirects": true, "max-redirects": true, "capture-headers": true,
+	"split-step-v4": true, "split-step-v6": true, "split-policy": true, "split-on-throughput": true, "throughput-every": true, "throughput-bytes": true, "colo": true, "prefer": true, "baseline": true, "min-improvement-pct": true, "group-by": true, "per-group": true, "min-samples-split": true,
+	"max-bits-v4": true, "max-bits-v6": true, "deep-drill": true, "v6-phase-bits": true, "v6-drill-after": true, "v6-subnets-per-prefix": true,
+	"diversity-weight": true, "min-coverage": true, "split-interval": true,
+	"min-concurrency": true, "breaker-threshold": true, "breaker-cooldown": true, "fail-fast-threshold": true, "max-waste": true,
+	"failure-model": true, "timeout-penalty": true, "refusal-penalty": true,
+	"download-top": true, "download-bytes": true, "download-timeout": true, "download-parallel": true, "download-retries": true, "rank-weight": true,
+	"interval": true, "max-runs": true, "lang": true, "rotation-size": true,
+	"cache-count": true, "dns-upload-count": true,
+}
+
+// configSetting is one "name value" line of a config file.
+type configSetting struct {
+	name  string
+	value string
+	line  int
+}
+
+// resetter is implemented by repeatable flags so a reload replaces their
+// values instead of appending to them.
+type resetter interface {
+	Reset()
+}
+
+// readConfigFile reads a config file of flag settings, one per line, as
+// "name = value" or "name value". Leading dashes on the name are optional,
+// blank lines and "#" comments are ignored, and repeatable flags (--cidr)
+// may appear several times.
+func readConfigFile(path string) ([]configSetting, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var settings []configSetting
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := configLine(sc.Text())
+		if line == "" {
+			continue
+		}
+		s, err := parseConfigSetting(line, n)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%w", path, err)
+		}
+		settings = append(settings, s)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// configLine returns a config file line without its comment and the
+// surrounding space.
+func configLine(line string) string {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+// parseConfigSetting parses line n of a config file, "name = value" or
+// "name value".
+func parseConfigSetting(line string, n int) (configSetting, error) {
+	name, value, ok := strings.Cut(line, "=")
+	if !ok {
+		name, value, _ = strings.Cut(line, " ")
+	}
+	name = strings.TrimLeft(strings.TrimSpace(name), "-")
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+	if name == "" {
+		return configSetting{}, fmt.Errorf("%d: missing flag name", n)
+	}
+	return configSetting{name: name, value: value, line: n}, nil
+}
+
+// checkConfig verifies that every setting names a known flag that may be set
+// from a config file.
+func checkConfig(fs *flag.FlagSet, settings []configSetting) error {
+	for _, s := range settings {
+		if s.name == "config" {
+			return fmt.Errorf("line %d: config files cannot set --config", s.line)
+		}
+		if fs.Lookup(s.name) == nil {
+			return fmt.Errorf("line %d: unknown flag --%s", s.line, s.name)
+		}
+	}
+	return nil
+}
+
+// checkOfflineReload rejects a reloaded config that turns on a reloadable
+// flag --offline cannot honour: the baseline needs a DNS lookup of the
+// default route, which the allow-list blocks.
+func checkOfflineReload(settings []configSetting) error {
+	for _, s := range settings {
+		var on bool
+		switch s.name {
+		case "baseline":
+			on, _ = strconv.ParseBool(s.value)
+		case "min-improvement-pct":
+			pct, _ := strconv.ParseFloat(s.value, 64)
+			on = pct > 0
+		}
+		if on {
+			return fmt.Errorf("line %d: --%s cannot be used with --offline", s.line, s.name)
+		}
+	}
+	return nil
+}
+
+// applyConfig sets flags from settings. Flags in skip (those given on the
+// command line, which always win) are left alone; when allow is non-nil only
+// flags in allow are set. Allowed flags that were applied last time (prev)
+// but are missing now revert to their defaults. It returns the flags now set
+// from the config.
+func applyConfig(fs *flag.FlagSet, settings []configSetting, skip, allow, prev map[string]bool) (map[string]bool, error) {
+	applied := make(map[string]bool)
+	for _, s := range settings {
+		if skip[s.name] || (allow != nil && !allow[s.name]) {
+			continue
+		}
+		f := fs.Lookup(s.name)
+		if !applied[s.name] {
+			if r, ok := f.Value.(resetter); ok {
+				r.Reset()
+			}
+		}
+		if err := f.Value.Set(s.value); err != nil {
+			return applied, fmt.Errorf("line %d: invalid value %q for --%s: %v", s.line, s.value, s.name, err)
+		}
+		applied[s.name] = true
+	}
+
+	for name := range prev {
+		if applied[name] || skip[name] || (allow != nil && !allow[name]) {
+			continue
+		}
+		f := fs.Lookup(name)
+		if r, ok := f.Value.(resetter); ok {
+			r.Reset()
+		} else if err := f.Value.Set(f.DefValue); err != nil {
+			return applied, err
+		}
+	}
+	return applied, nil
+}
+
+// configValues returns the last value of each setting.
+func configValues(settings []configSetting) map[string]string {
+	m := make(map[string]string, len(settings))
+	for _, s := range settings {
+		m[s.name] = s.value
+	}
+	return m
+}
+
+// restartOnly returns the non-reloadable settings whose value changed since
+// the config was loaded at startup (startup); they need a restart.
+func restartOnly(settings []configSetting, skip map[string]bool, startup map[string]string) []string {
+	var names []string
+	now := configValues(settings)
+	for name, v := range now {
+		if skip[name] || reloadableFlags[name] {
+			continue
+		}
+		if old, ok := startup[name]; !ok || old != v {
+			names = append(names, name)
+		}
+	}
+	for name := range startup {
+		if _, ok := now[name]; !ok && !skip[name] && !reloadableFlags[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadRoots parses the search roots given by --cidr and --cidr-file values.
+func loadRoots(cidrs []string, cidrFile string) ([]netip.Prefix, error) {
+	roots, err := cidr.ParseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	if cidrFile != "" {
+		ps, err := cidr.ReadCIDRsFromFile(cidrFile)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, ps...)
+	}
+	return roots, nil
+}
+
+// configRoots returns the roots listed in a config file, or ok=false if it
+// sets neither cidr nor cidr-file.
+func configRoots(settings []configSetting) (roots []netip.Prefix, ok bool, err error) {
+	var cidrs []string
+	var cidrFile string
+	for _, s := range settings {
+		switch s.name {
+		case "cidr":
+			cidrs = append(cidrs, s.value)
+			ok = true
+		case "cidr-file":
+			cidrFile = s.value
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	roots, err = loadRoots(cidrs, cidrFile)
+	return roots, true, err
+}
+
+// liveRun is the search in progress, so a reload can change its roots
+// without waiting for the next run.
+type liveRun struct {
+	mu    sync.Mutex
+	eng   *engine.Engine
+	roots []netip.Prefix
+}
+
+func (l *liveRun) set(eng *engine.Engine, roots []netip.Prefix) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.eng = eng
+	l.roots = roots
+}
+
+// updateRoots adds roots the running search lacks and removes the ones no
+// longer listed. It is a no-op when no search is running.
+func (l *liveRun) updateRoots(roots []netip.Prefix) (added, removed int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.eng == nil || !l.eng.Running() {
+		return 0, 0, nil
+	}
+
+	want := make(map[netip.Prefix]bool, len(roots))
+	for _, p := range roots {
+		want[p.Masked()] = true
+	}
+	have := make(map[netip.Prefix]bool, len(l.roots))
+	for _, p := range l.roots {
+		have[p.Masked()] = true
+	}
+
+	// Removals go first, so a root can be replaced by one overlapping it
+	// (e.g. a /16 by the /15 around it).
+	for p := range have {
+		if want[p] {
+			continue
+		}
+		if _, err := l.eng.RemovePrefix(p); err != nil {
+			return added, removed, ignoreNotRunning(err)
+		}
+		removed++
+	}
+	var toAdd []netip.Prefix
+	for p := range want {
+		if !have[p] {
+			toAdd = append(toAdd, p)
+		}
+	}
+	if len(toAdd) > 0 {
+		if added, err = l.eng.AddRoots(toAdd); err != nil {
+			return 0, removed, ignoreNotRunning(err)
+		}
+	}
+	l.roots = roots
+	return added, removed, nil
+}
+
+// ignoreNotRunning drops ErrNotRunning: a search that just ended simply
+// picks the new roots up on its next run.
+func ignoreNotRunning(err error) error {
+	if errors.Is(err, engine.ErrNotRunning) {
+		return nil
+	}
+	return err
+}
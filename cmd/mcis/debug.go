@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/atomicfile"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/output"
+)
+
+// dumpTree writes the search tree of eng to path as indented JSON.
+func dumpTree(path string, eng *engine.Engine) error {
+	var buf bytes.Buffer
+	if err := writeTree(&buf, eng); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// writePrefixMetrics writes the per-prefix statistics of eng's last run to
+// path as OpenMetrics text. The file is replaced atomically, so a collector
+// picking it up never sees half of it.
+func writePrefixMetrics(path string, eng *engine.Engine) error {
+	var buf bytes.Buffer
+	if err := output.WritePrefixMetrics(&buf, eng.TreeSnapshot()); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// writeTimeline writes the epochs of a run to path as CSV.
+func writeTimeline(path string, epochs []engine.Epoch) error {
+	var buf bytes.Buffer
+	if err := output.WriteTimelineCSV(&buf, epochs); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// openSamples opens the --export-samples file for appending, so monitor
+// mode keeps one growing data set across runs and restarts.
+func openSamples(path string) (*os.File, error) {
+	if strings.EqualFold(filepath.Ext(path), ".parquet") {
+		return nil, errors.New("only CSV is supported; use a .csv file")
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+}
+
+func writeTree(w io.Writer, eng *engine.Engine) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(eng.TreeSnapshot())
+}
+
+// handleIntrospection serves the runtime introspection signals for the
+// current engine, so a long search is not opaque once started:
+//
+//   - SIGUSR1 prints a status line to stderr and, with --dump-tree, writes
+//     the tree to dumpPath.
+//   - SIGQUIT writes the tree (to dumpPath, or stderr without --dump-tree)
+//     and the stack traces of all goroutines to stderr, without exiting.
+func handleIntrospection(dumpPath string, cur *atomic.Pointer[engine.Engine]) {
+	if len(statusSignals)+len(stackSignals) == 0 {
+		return
+	}
+	status := make(chan os.Signal, 1)
+	stacks := make(chan os.Signal, 1)
+	signal.Notify(status, statusSignals...)
+	signal.Notify(stacks, stackSignals...)
+	go func() {
+		for {
+			select {
+			case <-status:
+				eng := cur.Load()
+				if eng == nil {
+					fmt.Fprintln(os.Stderr, "status: no search started yet")
+					continue
+				}
+				fmt.Fprintln(os.Stderr, formatStatus(eng.Status()))
+				if dumpPath != "" {
+					if err := dumpTree(dumpPath, eng); err != nil {
+						fmt.Fprintf(os.Stderr, "dump-tree: %v\n", err)
+					} else {
+						fmt.Fprintf(os.Stderr, "dump-tree: wrote %s\n", dumpPath)
+					}
+				}
+			case <-stacks:
+				if eng := cur.Load(); eng != nil {
+					var err error
+					if dumpPath != "" {
+						err = dumpTree(dumpPath, eng)
+					} else {
+						err = writeTree(os.Stderr, eng)
+					}
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "dump-tree: %v\n", err)
+					}
+				}
+				fmt.Fprintf(os.Stderr, "goroutine dump:\n%s\n", allStacks())
+			}
+		}
+	}()
+}
+
+// formatStatus renders a status snapshot as a single log line.
+func formatStatus(st engine.Status) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "status: running=%v completed=%d/%d nodes=%d", st.Running, st.Completed, st.Budget, st.Nodes)
+	if st.CompletedV4 > 0 && st.CompletedV6 > 0 {
+		fmt.Fprintf(&b, " ipv4=%d ipv6=%d", st.CompletedV4, st.CompletedV6)
+	}
+	if st.Best != nil {
+		fmt.Fprintf(&b, " best=%s score=%.1fms prefix=%s", st.Best.IP, st.Best.ScoreMS, st.Best.Prefix)
+	}
+	if len(st.Heads) > 0 {
+		heads := make([]string, len(st.Heads))
+		for i, p := range st.Heads {
+			heads[i] = fmt.Sprintf("%d:%s", i, p)
+		}
+		fmt.Fprintf(&b, " heads=%s", strings.Join(heads, ","))
+	}
+	fmt.Fprintf(&b, " goroutines=%d", runtime.NumGoroutine())
+	if n := openFDs(); n >= 0 {
+		fmt.Fprintf(&b, " fds=%d", n)
+	}
+	return b.String()
+}
+
+// allStacks returns the stack traces of all goroutines.
+func allStacks() []byte {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// openFDs returns the number of open file descriptors, or -1 where that
+// can't be determined.
+func openFDs() int {
+	entries, err := os.ReadDir("/dev/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries) - 1 // the directory handle itself
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/kube"
+)
+
+// k8sPublisher publishes the results of each run to Kubernetes
+// (--k8s-publish) and elects, through a Lease of the same name, the one
+// replica that runs the searches.
+type k8sPublisher struct {
+	client    *kube.Client
+	namespace string
+	name      string
+	endpoints bool
+	elector   *kube.Elector
+}
+
+func newK8sPublisher(ref string, endpoints bool) (*k8sPublisher, error) {
+	ns, name, err := kube.ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	c, err := kube.InCluster()
+	if err != nil {
+		return nil, err
+	}
+	return &k8sPublisher{
+		client:    c,
+		namespace: ns,
+		name:      name,
+		endpoints: endpoints,
+		elector:   kube.NewElector(c, ns, name),
+	}, nil
+}
+
+// elect keeps taking part in the leader election until ctx is done.
+func (p *k8sPublisher) elect(ctx context.Context, verbose bool) {
+	p.elector.Run(ctx, func(leading bool, err error) {
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "k8s: leader election: %v\n", err)
+		case verbose && leading:
+			fmt.Fprintf(os.Stderr, "k8s: %s is now the leader (lease %s/%s)\n", p.elector.Identity(), p.namespace, p.name)
+		case verbose:
+			fmt.Fprintf(os.Stderr, "k8s: %s is no longer the leader (lease %s/%s)\n", p.elector.Identity(), p.namespace, p.name)
+		}
+	})
+}
+
+// publish writes res to the ConfigMap and, with --k8s-endpoints, the
+// Endpoints object.
+func (p *k8sPublisher) publish(ctx context.Context, res engine.Response) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	var ips []string
+	for _, r := range res.Top {
+		if r.OK {
+			ips = append(ips, r.IP.String())
+		}
+	}
+	cm := map[string]string{
+		"ips":          strings.Join(ips, "\n"),
+		"results.json": string(data),
+		"updated":      time.Now().UTC().Format(time.RFC3339),
+	}
+	if res.Meta != nil && res.Meta.Recommended.IsValid() {
+		cm["recommended"] = res.Meta.Recommended.String()
+	}
+	if err := p.client.PublishConfigMap(ctx, p.namespace, p.name, cm); err != nil {
+		return err
+	}
+	if !p.endpoints {
+		return nil
+	}
+
+	// One port per Endpoints subset: that of the best result (set when
+	// --search-ports picked it), else HTTPS.
+	port := 0
+	var addrs []netip.Addr
+	for _, r := range res.Top {
+		if !r.OK {
+			continue
+		}
+		if port == 0 {
+			port = int(r.Port)
+			if port == 0 {
+				port = 443
+			}
+		}
+		if r.Port == 0 || int(r.Port) == port {
+			addrs = append(addrs, r.IP)
+		}
+	}
+	if port == 0 {
+		port = 443
+	}
+	return p.client.PublishEndpoints(ctx, p.namespace, p.name, addrs, port)
+}
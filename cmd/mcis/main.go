@@ -1,23 +1,44 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net/netip"
 	"os"
 	"os/signal"
+	"regexp"
+	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/bandit"
 	"github.com/zhaiiker/montecarlo-ip-searcher/internal/cache"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/cidr"
 	"github.com/zhaiiker/montecarlo-ip-searcher/internal/dns"
 	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/netguard"
 	"github.com/zhaiiker/montecarlo-ip-searcher/internal/output"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/priors"
 	"github.com/zhaiiker/montecarlo-ip-searcher/internal/probe"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/resolver"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/server"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/sign"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/speedtest"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/state"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/store"
 )
 
 type repeatStringFlag []string
@@ -27,35 +48,167 @@ func (r *repeatStringFlag) Set(v string) error {
 	*r = append(*r, v)
 	return nil
 }
+func (r *repeatStringFlag) Reset() { *r = nil }
+
+// autoConcurrencyCap is the most workers --concurrency auto grows to.
+const autoConcurrencyCap = 1000
+
+// concurrencyFlag is --concurrency: a number of workers, or "auto" to tune
+// it from the probe outcomes.
+type concurrencyFlag struct {
+	n    int
+	auto bool
+}
+
+func (c *concurrencyFlag) String() string {
+	if c.auto {
+		return "auto"
+	}
+	return strconv.Itoa(c.n)
+}
+
+func (c *concurrencyFlag) Set(v string) error {
+	if v == "auto" {
+		c.n, c.auto = autoConcurrencyCap, true
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return errors.New(`want a positive number or "auto"`)
+	}
+	c.n, c.auto = n, false
+	return nil
+}
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			os.Exit(runVerify(os.Args[2:]))
+		case "keygen":
+			os.Exit(runKeygen(os.Args[2:]))
+		case "priors":
+			os.Exit(runPriors(os.Args[2:]))
+		case "report":
+			os.Exit(runReport(os.Args[2:]))
+		case "apply":
+			os.Exit(runApply(os.Args[2:]))
+		case "selftest":
+			os.Exit(runSelftest(os.Args[2:]))
+		case "batch":
+			os.Exit(runBatch(os.Args[2:]))
+		case "version":
+			os.Exit(runVersion(os.Args[2:]))
+		case "self-update":
+			os.Exit(runSelfUpdate(os.Args[2:]))
+		case "refine":
+			args, err := refineArgs(os.Args[2:])
+			if errors.Is(err, flag.ErrHelp) {
+				os.Exit(0)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+				os.Exit(2)
+			}
+			// The second pass is an ordinary search over the generated roots.
+			os.Args = append([]string{os.Args[0]}, args...)
+		}
+	}
+
 	var (
-		cidrs     repeatStringFlag
-		cidrFile  string
-		budget    int
-		topN      int
-		concur    int
-		heads     int
-		beam      int
-		timeout   time.Duration
-		host      string
-		sni       string
-		hostHdr   string
-		path      string
-		dlTop     int
-		dlBytes   int64
-		dlTimeout time.Duration
-		outFmt    string
-		outPath   string
-		splitV4   int
-		splitV6   int
-		minSplit  int
-		maxBitsV4 int
-		maxBitsV6 int
-		seed      int64
-		verbose   bool
-		interval  time.Duration
-		maxRuns   int
+		cidrs       repeatStringFlag
+		cidrFile    string
+		budget      int
+		budgetBy    string
+		timeBudget  time.Duration
+		topN        int
+		concur      = concurrencyFlag{n: 200}
+		inflight    int
+		slowStart   bool
+		maxMemoryMB int
+		heads       int
+		headsV4     int
+		headsV6     int
+		beam        int
+		timeout     time.Duration
+		host        string
+		sni         string
+		hostHdr     string
+		paths       repeatStringFlag
+		targets     repeatStringFlag
+		targetBy    string
+		probeExec   string
+		dlTop       int
+		dlBytes     int64
+		dlTimeout   time.Duration
+		dlParallel  int
+		dlRetries   int
+		dlUnique    bool
+		tputSplit   bool
+		tputEvery   int
+		tputBytes   int64
+		rankWeight  float64
+		outFmt      string
+		rotateN     int
+		lang        string
+		outPath     string
+		splitV4     int
+		splitV6     int
+		splitBy     string
+		coloList    string
+		phaseV6     int
+		drillAfter  float64
+		subnetsV6   int
+		suffixesV6  string
+		groupBy     string
+		perGroup    int
+		minSplit    int
+		maxBitsV4   int
+		maxBitsV6   int
+		deepDrill   int
+		seed        int64
+		verbose     bool
+		interval    time.Duration
+		schedExpr   string
+		quietWin    string
+		schedJitter time.Duration
+		maxRuns     int
+		serveAddr   string
+		staleAft    time.Duration
+		stream      bool
+		earlyRes    bool
+		global      bool
+		validate    string
+		objective   string
+		frontSNI    string
+		frontHost   string
+		tlsFP       string
+		clientCert  string
+		clientKey   string
+		caFile      string
+		insecure    bool
+		envProxy    bool
+		wgConf      string
+		followRedir bool
+		maxRedir    int
+		capHeaders  string
+		preferCache string
+		baseline    bool
+		minImprove  float64
+		wgReserved  string
+		searchPort  string
+		warm        bool
+		tlsResume   bool
+		certCheck   bool
+		echCheck    bool
+		echOnly     bool
+		echDNS      string
+		dnsSpec     string
+		dnsBoot     string
+		portCheck   bool
+		portList    string
+		rankV4      int
+		rankV6      int
 
 		// DNS upload flags
 		dnsProvider    string
@@ -67,40 +220,155 @@ func main() {
 
 		// New engine parameters
 		diversityWeight float64
+		minCoverage     int
 		splitInterval   int
+		backpressure    bool
+		bpInterval      time.Duration
+		minConcur       int
+		referenceIP     string
+		refInterval     time.Duration
+		breakerThresh   int
+		breakerCooldown time.Duration
+		failFast        int
+		maxWaste        float64
+		failureModel    string
+		timeoutPenalty  float64
+		refusalPenalty  float64
 
 		// Cache flags
 		cacheFile    string
 		cacheDisable bool
 		cacheCount   int
+		cacheKeyPath string
+
+		// Metered link flags
+		maxPPS       float64
+		maxBandwidth float64
+		metered      bool
+		meteredMaxDL int64
+
+		// State directory flags
+		stateDir  string
+		stateKeep int
+		backendBy string
+
+		// Kubernetes flags
+		k8sPublish   string
+		k8sEndpoints bool
+
+		// Prior flags
+		priorsPath     string
+		priorsHalfLife time.Duration
+
+		configPath string
+		signPath   string
+		offline    bool
+		dumpPath   string
+		metricsOut string
+		timelineTo string
+		samplesTo  string
+		dryRun     bool
+		progress   string
+		exitSumm   bool
 	)
 
 	flag.Var(&cidrs, "cidr", "CIDR to search (repeatable). Example: 1.1.0.0/16 or 2606:4700::/32")
 	flag.StringVar(&cidrFile, "cidr-file", "", "Path to a file containing CIDRs (one per line, # comment supported)")
-	flag.IntVar(&budget, "budget", 2000, "Total probe budget (number of IPs to probe)")
+	flag.IntVar(&budget, "budget", 0, "Total probe budget (number of IPs to probe; 0 = derive from the size of the CIDRs)")
+	flag.StringVar(&budgetBy, "budget-unit", engine.BudgetProbes, "What --budget counts: probes (every attempt) | successes (keep probing until that many succeed, at most 10 probes each)")
 	flag.IntVar(&topN, "top", 20, "Top N IPs to output")
-	flag.IntVar(&concur, "concurrency", 200, "Probe concurrency")
-	flag.IntVar(&heads, "heads", 4, "Number of search heads (diversification)")
+	flag.StringVar(&objective, "objective", "ip", "Search objective: ip (best IPs) | prefix-ranking (best prefixes with confidence)")
+	flag.IntVar(&rankV4, "rank-bits-v4", 24, "IPv4 prefix length ranked by --objective=prefix-ranking")
+	flag.IntVar(&rankV6, "rank-bits-v6", 48, "IPv6 prefix length ranked by --objective=prefix-ranking")
+	flag.Var(&concur, "concurrency", "Probe concurrency, or auto: start at --min-concurrency and grow while timeouts and latency stay level, halving when timeouts spike (up to "+strconv.Itoa(autoConcurrencyCap)+")")
+	flag.IntVar(&inflight, "max-inflight", 0, "Max submitted but unfinished probes, which also sizes the task queue (0 = 2x --concurrency)")
+	flag.IntVar(&maxMemoryMB, "max-memory", 0, "Memory cap in MiB: near it the search drops its dedup set, prunes the worst prefixes and throttles probes instead of running out of memory; also the garbage collector's soft limit (0 = no cap)")
+	flag.BoolVar(&slowStart, "slow-start", true, "Ramp in-flight probes up gradually at the start of a run instead of bursting")
+	flag.Float64Var(&maxPPS, "max-probes-per-second", 0, "Ceiling on probes started per second (0 = unlimited)")
+	flag.Float64Var(&maxBandwidth, "max-bandwidth", 0, "Average bandwidth ceiling in Mbps for probes and download tests (0 = unlimited)")
+	flag.BoolVar(&metered, "metered", false, "Metered/LTE profile: defaults --max-bandwidth to 1 and --max-probes-per-second to 20, and skips download tests larger than --metered-max-download")
+	flag.Int64Var(&meteredMaxDL, "metered-max-download", 1_000_000, "Largest --download-bytes still tested with --metered")
+	flag.DurationVar(&timeBudget, "time-budget", 0, "Wall-clock limit per run, shared by re-testing cached IPs, the search and the download tests: the search ends early enough for the downloads to fit (0 = no limit)")
+	flag.IntVar(&heads, "heads", 0, "Number of search heads (diversification; 0 = one per cluster of roots, 4-16)")
+	flag.IntVar(&headsV4, "heads-v4", 0, "Heads dedicated to IPv4 prefixes when v4 and v6 roots are mixed (added to --heads if it is smaller)")
+	flag.IntVar(&headsV6, "heads-v6", 0, "Heads dedicated to IPv6 prefixes, so IPv6 exploration is not starved by quicker IPv4 wins")
 	flag.IntVar(&beam, "beam", 32, "Beam width per head (kept candidate prefixes)")
 	flag.DurationVar(&timeout, "timeout", 3*time.Second, "Per-probe timeout")
 	flag.StringVar(&host, "host", "example.com", "Host name used for BOTH TLS SNI and HTTP Host header (recommended)")
 	flag.StringVar(&sni, "sni", "", "TLS SNI server name (deprecated: use --host)")
 	flag.StringVar(&hostHdr, "host-header", "", "HTTP Host header (deprecated: use --host)")
-	flag.StringVar(&path, "path", "/cdn-cgi/trace", "HTTP path to request")
+	flag.Var(&paths, "path", "HTTP path to request (repeatable: rotated per probe; "+probe.RandToken+" expands to a random token) (default /cdn-cgi/trace)")
+	flag.Var(&targets, "target", "Probe target [sni@]host[/path] (repeatable): every IP is probed against each target and must pass all of them (replaces --host/--path for probing)")
+	flag.StringVar(&targetBy, "target-score", probe.TargetScoreWorst, "How per-target latencies combine into an IP's score with --target: worst|avg")
+	flag.StringVar(&probeExec, "probe-exec", "", "Probe with an external plugin instead of HTTPS, e.g. './myprobe {ip}': run once per probe ({ip}, {timeout_ms} and {host} are expanded) and print a JSON result on stdout")
+	flag.BoolVar(&global, "global", false, "Search the entire routable IPv4 space (bogons excluded) with a coarse /8 -> /16 drill-down")
+	flag.BoolVar(&tlsResume, "tls-resume", false, "Cache TLS sessions per IP: re-probes resume instead of doing a full handshake, and top results report the resumed handshake time (tls_resume_ms)")
+	flag.BoolVar(&followRedir, "follow-redirects", false, "Follow redirects on the probed IP (never to another host), recording each hop's timing; off by default, a 30x then fails the probe with its location recorded")
+	flag.IntVar(&maxRedir, "max-redirects", 5, "Most redirects a probe follows with --follow-redirects")
+	flag.StringVar(&capHeaders, "capture-headers", "", "Comma-separated response headers stored per result (e.g. cf-ray,server,age) and emitted in JSONL as headers")
+	flag.BoolVar(&warm, "warm", false, "Probe each IP twice over the same connection and report cold and warm TTFB")
+	flag.StringVar(&tlsFP, "tls-fingerprint", "", "Present a browser TLS ClientHello: chrome|firefox|ios|safari|edge (default: Go's own)")
+	flag.StringVar(&clientCert, "client-cert", "", "PEM client certificate presented to probed endpoints that require mutual TLS (with --client-key)")
+	flag.StringVar(&clientKey, "client-key", "", "PEM private key of --client-cert")
+	flag.StringVar(&caFile, "ca-file", "", "PEM CA bundle trusted in addition to the system roots, for probe and download endpoints signed by a private CA")
+	flag.BoolVar(&insecure, "insecure", false, "Skip server certificate verification for probes and download tests (results are marked tls_unverified)")
+	flag.BoolVar(&envProxy, "use-env-proxy", false, "Send probes and download tests through the proxy in HTTP(S)_PROXY/NO_PROXY (default: always connect directly; a proxy distorts every measurement)")
+	flag.StringVar(&wgConf, "wg-handshake", "", "Probe with WireGuard handshakes instead of HTTPS, using the keys of this wg-quick config file (e.g. a WARP account), to find the best UDP endpoints; download tests are skipped")
+	flag.StringVar(&wgReserved, "wg-reserved", "", "Reserved bytes sent in --wg-handshake initiations, as three comma-separated numbers (WARP client ID)")
+	flag.StringVar(&searchPort, "search-ports", "", "Comma-separated ports searched as arms next to the prefixes (default with --wg-handshake: "+defaultWGPorts+")")
+	flag.BoolVar(&echCheck, "ech-check", false, "Check Encrypted ClientHello support for each result IP (fetches the ECH config from the SNI host's HTTPS record)")
+	flag.BoolVar(&echOnly, "require-ech", false, "Drop results that don't support ECH (implies --ech-check)")
+	flag.StringVar(&echDNS, "ech-resolver", "1.1.1.1:53", "DNS server used to fetch HTTPS records for --ech-check when --resolver is not set")
+	flag.BoolVar(&certCheck, "cert-check", false, "Verify the certificate chain each result IP serves for the SNI against the system roots and check any stapled OCSP response (cert_ok)")
+	flag.StringVar(&dnsSpec, "resolver", "", "DNS upstream for all internal lookups: 1.1.1.1:53 | tcp://... | tls://1.1.1.1 | https://cloudflare-dns.com/dns-query (default: system resolver)")
+	flag.StringVar(&dnsBoot, "resolver-bootstrap", "", "Comma-separated IPs used to reach a --resolver given by host name (avoids system DNS)")
+	flag.BoolVar(&portCheck, "port-check", false, "Test TCP reachability of --ports on each result IP and output a port matrix")
+	flag.StringVar(&portList, "ports", defaultCheckPorts, "Comma-separated ports tested by --port-check")
+	flag.StringVar(&frontSNI, "front-sni", "", "Domain fronting check: TLS SNI to present (requires --front-host)")
+	flag.StringVar(&frontHost, "front-host", "", "Domain fronting check: HTTP Host header to send with --front-sni")
+	flag.StringVar(&validate, "validate", "", "Regexp the response body must match for a probe to count as OK")
 	flag.IntVar(&dlTop, "download-top", 5, "After search, run download speed test for top N IPs (0 to disable)")
 	flag.Int64Var(&dlBytes, "download-bytes", 50_000_000, "Download test size in bytes (speed.cloudflare.com/__down?bytes=...)")
 	flag.DurationVar(&dlTimeout, "download-timeout", 45*time.Second, "Per-IP download test timeout")
-	flag.StringVar(&outFmt, "out", "jsonl", "Output format: jsonl|csv|text")
+	flag.IntVar(&dlRetries, "download-retries", 1, "Extra attempts for a failed or suspiciously slow download before the IP is recorded as bad (best attempt kept)")
+	flag.Float64Var(&rankWeight, "rank-weight", 0.5, "Weight of latency against download speed when ranking results after download tests (1 = latency only, 0 = speed only)")
+	flag.BoolVar(&dlUnique, "download-unique-colo", false, "Download-test only the best IP of each colo among --download-top (IPs in one colo share the bottleneck link, so more tests there mostly waste data)")
+	flag.BoolVar(&tputSplit, "split-on-throughput", false, "Integrated bandwidth phase: during the search, follow one in --throughput-every successful probes with a short download, and also split prefixes whose throughput varies widely")
+	flag.IntVar(&tputEvery, "throughput-every", 20, "Successful probes per in-search download with --split-on-throughput")
+	flag.Int64Var(&tputBytes, "throughput-bytes", 2_000_000, "Size in bytes of the in-search downloads of --split-on-throughput")
+	flag.IntVar(&dlParallel, "download-parallel", 1, "Number of download tests run at once (parallel tests share the link, so speeds are less comparable)")
+	flag.StringVar(&outFmt, "out", "jsonl", "Output format: jsonl|csv|text|colo-summary|footprint|rotation")
+	flag.IntVar(&rotateN, "rotation-size", 10, "IPs in the --out rotation list (0 = every successful result)")
+	flag.StringVar(&lang, "lang", output.LangEN, "Language of the summary that ends --out text: en|zh|fa|ru (result rows, jsonl and csv are not translated)")
 	flag.StringVar(&outPath, "out-file", "", "Write output to file (default: stdout)")
+	flag.BoolVar(&stream, "stream", false, "Stream every completed probe to stdout as JSONL (type=probe), then a type=summary line")
+	flag.BoolVar(&earlyRes, "progressive", false, "Write the latency-ranked results to stdout as JSONL (type=result) as soon as the search ends, then a type=update line per finished download test and a type=summary line (implied by --stream)")
 	flag.IntVar(&splitV4, "split-step-v4", 2, "When splitting an IPv4 prefix, increase prefix bits by this step")
 	flag.IntVar(&splitV6, "split-step-v6", 4, "When splitting an IPv6 prefix, increase prefix bits by this step")
+	flag.IntVar(&phaseV6, "v6-phase-bits", 48, "IPv6 two-phase search: first find responsive prefixes of this length, then drill below them (0 = single phase)")
+	flag.Float64Var(&drillAfter, "v6-drill-after", 0.3, "Share of the budget the first IPv6 phase gets before drilling starts")
+	flag.StringVar(&suffixesV6, "v6-suffix-list", defaultV6Suffixes, "Comma-separated IPv6 interface IDs (e.g. ::1,::2,::100) probed in every /64 before random host bits (empty = random only)")
+	flag.IntVar(&subnetsV6, "v6-subnets-per-prefix", 16, "Most distinct /64s sampled per IPv6 prefix at the phase depth or longer; later samples revisit them (0 = unlimited)")
+	flag.StringVar(&coloList, "colo", "", "Comma-separated Cloudflare data centers (IATA codes, e.g. SJC,LAX) results must be served by; probes answered elsewhere count as failures")
+	flag.BoolVar(&baseline, "baseline", false, "Before the search, probe the host at its regular DNS address (the default path) and report how much faster the best result is")
+	flag.Float64Var(&minImprove, "min-improvement-pct", 0, "Only report and apply (--dns-provider) results at least this many percent faster than the --baseline (implied); if none is, exit with code 3")
+	flag.StringVar(&preferCache, "prefer", "any", "Score only responses served from the edge cache (hit) or not (miss), judged by cf-cache-status/X-Cache/Age; other responses are skipped: any|hit|miss")
+	flag.StringVar(&groupBy, "group-by", "", "Keep at most --per-group results per trace field value: colo|loc|http|warp (empty = no grouping)")
+	flag.IntVar(&perGroup, "per-group", 1, "Results kept per group with --group-by")
+	flag.StringVar(&splitBy, "split-policy", bandit.SplitHybrid, "Which prefixes to split first: best (fast, reliable) | uncertain (least known) | variance (spread-out or bimodal latencies) | hybrid")
 	flag.IntVar(&minSplit, "min-samples-split", 5, "Minimum samples on a prefix before it can be split")
 	flag.IntVar(&maxBitsV4, "max-bits-v4", 24, "Maximum IPv4 prefix bits to drill down to")
 	flag.IntVar(&maxBitsV6, "max-bits-v6", 56, "Maximum IPv6 prefix bits to drill down to")
+	flag.IntVar(&deepDrill, "deep-drill", 0, "Let excellent but high-variance IPv4 prefixes drill past --max-bits-v4 down to this many bits, e.g. 28 or 32 (0 = off)")
 	flag.Int64Var(&seed, "seed", 0, "Random seed (0 = time-based)")
 	flag.BoolVar(&verbose, "v", false, "Verbose progress to stderr")
 	flag.DurationVar(&interval, "interval", 0, "Run periodically at this interval (0 = run once)")
-	flag.IntVar(&maxRuns, "max-runs", 0, "Maximum number of runs when --interval is set (0 = unlimited)")
+	flag.IntVar(&maxRuns, "max-runs", 0, "Maximum number of runs when --interval or --schedule is set (0 = unlimited)")
+	flag.StringVar(&schedExpr, "schedule", "", "Run at the times of a cron expression in local time (e.g. \"0 */6 * * *\", or @hourly/@daily/@weekly) instead of every --interval")
+	flag.StringVar(&quietWin, "no-scan-between", "", "Daily local time window HH:MM-HH:MM (e.g. 09:00-18:00) in which no run starts; runs due then wait for its end")
+	flag.DurationVar(&schedJitter, "schedule-jitter", 0, "Delay each scheduled run by a random duration up to this, so many installs don't scan at the same moment (e.g. 10m)")
+	flag.StringVar(&serveAddr, "serve", "", "Serve the HTTP control API on this address (e.g. 127.0.0.1:8080)")
+	flag.DurationVar(&staleAft, "health-stale", server.DefaultStaleAfter, "With --serve: /healthz fails when the scan loop makes no progress for this long")
 
 	// DNS upload flags
 	flag.StringVar(&dnsProvider, "dns-provider", "", "DNS provider for uploading results (cloudflare|vercel)")
@@ -112,15 +380,79 @@ func main() {
 
 	// New engine parameters
 	flag.Float64Var(&diversityWeight, "diversity-weight", 0.3, "Weight for head diversity (0-1, higher = more exploration)")
+	flag.IntVar(&minCoverage, "min-coverage", 8, "Distinct /24s (/48s for IPv6) of each CIDR to sample before concentrating on the best prefixes found; concentration starts at half the budget regardless (0 = from the start)")
 	flag.IntVar(&splitInterval, "split-interval", 20, "Check for split opportunities every N samples")
+	flag.BoolVar(&backpressure, "backpressure", false, "Lower concurrency automatically when local congestion inflates latency")
+	flag.DurationVar(&bpInterval, "backpressure-interval", 2*time.Second, "How often to sample the reference RTT for --backpressure")
+	flag.IntVar(&minConcur, "min-concurrency", 8, "Lower bound for concurrency with --backpressure or --concurrency auto")
+	flag.StringVar(&referenceIP, "reference-ip", "", "Known-good IP probed periodically to normalize scores against local latency drift")
+	flag.DurationVar(&refInterval, "reference-interval", 30*time.Second, "How often to probe --reference-ip")
+	flag.IntVar(&breakerThresh, "breaker-threshold", 5, "Suspend a prefix after N consecutive refused/reset connections (0 = disabled)")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", 30*time.Second, "How long a suspended prefix is skipped before retrying")
+	flag.StringVar(&failureModel, "failure-model", engine.FailureBetaOnly, "How failed probes affect a prefix's latency estimate: beta-only (only its success rate) | pseudo-latency (also count as twice --timeout) | hazard-model (timeouts count as latencies beyond --timeout)")
+	flag.Float64Var(&timeoutPenalty, "timeout-penalty", 0.5, "Weight (0-1) with which a timed-out probe pulls its prefix's latency estimate up (pseudo-latency and hazard-model)")
+	flag.Float64Var(&refusalPenalty, "refusal-penalty", 0.05, "Weight (0-1) with which a refused or reset connection does the same (pseudo-latency); such failures mostly just count as failures")
+	flag.Float64Var(&maxWaste, "max-waste", 0.2, "End a run early once re-probes of already tested IPs reach this fraction of --budget, i.e. the ranges are sampled out (0 = never)")
+	flag.IntVar(&failFast, "fail-fast-threshold", 50, "Abort a run with a diagnostic if its first N probes all fail, e.g. due to a wrong --host or a firewalled port (0 = disabled; default off with --global)")
 
 	// Cache flags
 	flag.StringVar(&cacheFile, "cache-file", ".mcis_cache.json", "Path to cache file for storing optimized IPs")
 	flag.BoolVar(&cacheDisable, "no-cache", false, "Disable cache (don't load or save cached IPs)")
 	flag.IntVar(&cacheCount, "cache-count", 10, "Maximum number of IPs to keep in cache")
+	flag.StringVar(&cacheKeyPath, "cache-encrypt-key", "", "Encrypt the cache, and the checkpoint of a --state-backend, at rest with this 32-byte key file (raw, hex or base64)")
+
+	// State directory flags
+	flag.StringVar(&stateDir, "state-dir", "", "Manage cache, logs and results under this directory; the newest result is always at <dir>/latest.json")
+	flag.IntVar(&stateKeep, "state-keep", state.DefaultKeep, "Number of result and log files kept in --state-dir, and of runs kept in the history of a sqlite --state-backend")
+	flag.StringVar(&k8sPublish, "k8s-publish", "", "Publish each run's results as the Kubernetes ConfigMap namespace/name (in-cluster service account); replicas elect one leader through a Lease of the same name and only it searches")
+	flag.BoolVar(&k8sEndpoints, "k8s-endpoints", false, "With --k8s-publish, also publish the working IPs as an Endpoints object of the same name, for a Service without selector")
+	flag.StringVar(&backendBy, "state-backend", "file", "Where the cache, latest results and search checkpoint are kept: file | redis://[:password@]host:port[/db][?prefix=mcis:] (rediss:// for TLS) | sqlite:///path/state.db, so hosts can share them")
+
+	flag.StringVar(&priorsPath, "priors", "", "Seed the search with a prior pack (see mcis priors import), so it starts from what earlier searches learned about each prefix")
+	flag.DurationVar(&priorsHalfLife, "priors-half-life", priors.DefaultHalfLife, "Age at which the --priors pack counts half")
+
+	flag.BoolVar(&offline, "offline", false, "Refuse every network connection except to the searched CIDRs and --reference-ip (enforced at the dialer)")
+	flag.StringVar(&signPath, "sign-key", "", "Sign --out-file (and --state-dir results) with this ed25519 private key (PEM), writing <file>.sig")
+	flag.StringVar(&progress, "progress", progressLines, "Progress display: lines (verbose progress lines with -v) | bar (single-line bar with rate, ETA and best; plain lines when stderr is not a terminal) | none")
+	flag.BoolVar(&exitSumm, "exit-summary", false, "On exit, write a single-line JSON summary (probes, successes, duration, best score/IP, output path) to stderr for wrapper scripts")
+	flag.BoolVar(&dryRun, "dry-run", false, "Print the sampling plan (roots, address-space size, effective config, sample addresses) and exit without sending any probes")
+	flag.StringVar(&samplesTo, "export-samples", "", "Append every raw probe (ip, prefix, head, phase timings, outcome, time) as one CSV row to this file, for analysis or model training")
+	flag.StringVar(&timelineTo, "timeline-out", "", "Write a per-second timeline of each run (completed probes, success rate, best score, tree size, head focuses) as CSV to this file")
+	flag.StringVar(&metricsOut, "prefix-metrics-out", "", "Write the final per-prefix statistics (probes, success ratio, latency mean/stddev/histogram, throughput) as OpenMetrics text to this file after each run, labelled by prefix, family and root")
+	flag.StringVar(&dumpPath, "dump-tree", "", "Write the full search tree (posteriors, sample counts, split lineage) as JSON to this file after each run and on SIGUSR1/SIGQUIT")
+	flag.StringVar(&configPath, "config", "", "Read flags from this file (one \"name = value\" per line); reloaded on SIGHUP or POST /api/reload")
 
 	flag.Parse()
 
+	// Command-line flags always win over the config file.
+	cmdline := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { cmdline[f.Name] = true })
+
+	explicit := make(map[string]bool)
+	for name := range cmdline {
+		explicit[name] = true
+	}
+
+	var fromConfig map[string]bool
+	var startupConfig map[string]string
+	if configPath != "" {
+		settings, err := readConfigFile(configPath)
+		if err == nil {
+			err = checkConfig(flag.CommandLine, settings)
+		}
+		if err == nil {
+			fromConfig, err = applyConfig(flag.CommandLine, settings, cmdline, nil, nil)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: config %s: %v\n", configPath, err)
+			os.Exit(1)
+		}
+		for name := range fromConfig {
+			explicit[name] = true
+		}
+		startupConfig = configValues(settings)
+	}
+
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
@@ -132,17 +464,761 @@ func main() {
 		hostHdr = host
 	}
 
-	runOnce := func(ctx context.Context, runIndex int) error {
+	var bar *progressRenderer
+	switch progress {
+	case progressLines, progressNone:
+	case progressBar:
+		bar = newProgressRenderer(os.Stderr)
+	default:
+		fmt.Fprintf(os.Stderr, "error: --progress must be %s, %s or %s\n", progressLines, progressBar, progressNone)
+		os.Exit(1)
+	}
+
+	if !output.ValidLang(lang) {
+		fmt.Fprintf(os.Stderr, "error: --lang must be %s, %s, %s or %s\n", output.LangEN, output.LangZH, output.LangFA, output.LangRU)
+		os.Exit(1)
+	}
+
+	if rankWeight < 0 || rankWeight > 1 {
+		fmt.Fprintln(os.Stderr, "error: --rank-weight must be between 0 and 1")
+		os.Exit(1)
+	}
+
+	if err := probe.ValidateTLSFingerprint(tlsFP); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+
+	var clientCertPair *tls.Certificate
+	if clientCert != "" || clientKey != "" {
+		var err error
+		if clientCertPair, err = probe.LoadClientCert(clientCert, clientKey); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+	}
+
+	var rootCAs *x509.CertPool
+	if caFile != "" {
+		var err error
+		if rootCAs, err = probe.LoadCAFile(caFile); err != nil {
+			fmt.Fprintln(os.Stderr, "error: --ca-file:", err)
+			os.Exit(1)
+		}
+	}
+	if insecure && verbose {
+		fmt.Fprintln(os.Stderr, "warning: --insecure: server certificates are not verified")
+	}
+
+	var probeTargets []probe.Target
+	for _, spec := range targets {
+		t, err := probe.ParseTarget(spec)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: --target:", err)
+			os.Exit(1)
+		}
+		probeTargets = append(probeTargets, t)
+	}
+	if targetBy != probe.TargetScoreWorst && targetBy != probe.TargetScoreAvg {
+		fmt.Fprintf(os.Stderr, "error: --target-score must be %s or %s\n", probe.TargetScoreWorst, probe.TargetScoreAvg)
+		os.Exit(1)
+	}
+
+	var execArgs []string
+	if probeExec != "" {
+		var err error
+		if execArgs, err = probe.ParseExec(probeExec); err != nil {
+			fmt.Fprintln(os.Stderr, "error: --probe-exec:", err)
+			os.Exit(1)
+		}
+		if len(probeTargets) > 0 || warm || tlsFP != "" || tlsResume {
+			fmt.Fprintln(os.Stderr, "error: --probe-exec cannot be combined with --target, --warm, --tls-fingerprint or --tls-resume")
+			os.Exit(1)
+		}
+	}
+
+	if envProxy && (tlsFP != "" || tlsResume) {
+		fmt.Fprintln(os.Stderr, "error: --use-env-proxy cannot be combined with --tls-fingerprint or --tls-resume")
+		os.Exit(1)
+	}
+
+	var wgCfg *probe.WireGuardConfig
+	if wgConf != "" {
+		if probeExec != "" || len(probeTargets) > 0 || warm || tlsFP != "" || tlsResume {
+			fmt.Fprintln(os.Stderr, "error: --wg-handshake cannot be combined with --probe-exec, --target, --warm, --tls-fingerprint or --tls-resume")
+			os.Exit(1)
+		}
+		var err error
+		if wgCfg, err = readWireGuard(wgConf, wgReserved); err != nil {
+			fmt.Fprintln(os.Stderr, "error: --wg-handshake:", err)
+			os.Exit(1)
+		}
+		// Handshakes say nothing about HTTPS throughput.
+		if explicit["download-top"] && dlTop > 0 {
+			fmt.Fprintln(os.Stderr, "error: --wg-handshake cannot be combined with --download-top")
+			os.Exit(1)
+		}
+		if tputSplit {
+			fmt.Fprintln(os.Stderr, "error: --wg-handshake cannot be combined with --split-on-throughput")
+			os.Exit(1)
+		}
+		dlTop = 0
+		if searchPort == "" {
+			searchPort = defaultWGPorts
+		}
+	} else if wgReserved != "" {
+		fmt.Fprintln(os.Stderr, "error: --wg-reserved requires --wg-handshake")
+		os.Exit(1)
+	}
+
+	v6Suffixes, err := parseV6Suffixes(suffixesV6)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: --v6-suffix-list:", err)
+		os.Exit(1)
+	}
+
+	var armPorts []uint16
+	if searchPort != "" {
+		ports, err := parsePorts(searchPort)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: --search-ports:", err)
+			os.Exit(1)
+		}
+		for _, p := range ports {
+			armPorts = append(armPorts, uint16(p))
+		}
+	}
+
+	// Sessions outlive a single run so monitor mode re-probes resume.
+	var sessions *probe.SessionCache
+	if tlsResume {
+		if tlsFP != "" {
+			fmt.Fprintln(os.Stderr, "error: --tls-resume cannot be combined with --tls-fingerprint")
+			os.Exit(1)
+		}
+		sessions = probe.NewSessionCache(4096)
+	}
+
+	var checkPorts []int
+	if portCheck {
+		var err error
+		if checkPorts, err = parsePorts(portList); err != nil {
+			fmt.Fprintln(os.Stderr, "error: --ports:", err)
+			os.Exit(1)
+		}
+	}
+
+	var validateRe *regexp.Regexp
+	if validate != "" {
+		re, err := regexp.Compile(validate)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: invalid --validate:", err)
+			os.Exit(1)
+		}
+		validateRe = re
+	}
+
+	// Metered mode caps data usage unless the limits are given explicitly.
+	if metered {
+		if !explicit["max-bandwidth"] {
+			maxBandwidth = 1
+		}
+		if !explicit["max-probes-per-second"] {
+			maxPPS = 20
+		}
+	}
+	throttle := &probe.Throttle{}
+
+	if maxMemoryMB < 0 {
+		fmt.Fprintln(os.Stderr, "error: --max-memory must be >= 0")
+		os.Exit(1)
+	}
+	if maxMemoryMB > 0 {
+		// Make the garbage collector work harder before the search has to
+		// shed state.
+		debug.SetMemoryLimit(int64(maxMemoryMB) << 20)
+	}
+
+	// Global mode drills down coarsely: /8 roots split straight into /16s.
+	// Most of the space doesn't answer, so early failures are expected.
+	if global {
+		if !explicit["split-step-v4"] {
+			splitV4 = 8
+		}
+		if !explicit["max-bits-v4"] {
+			maxBitsV4 = 16
+		}
+		if !explicit["fail-fast-threshold"] {
+			failFast = 0
+		}
+	}
+
+	var refAddr netip.Addr
+	if referenceIP != "" {
+		a, err := netip.ParseAddr(referenceIP)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: invalid --reference-ip:", err)
+			os.Exit(1)
+		}
+		refAddr = a
+	}
+
+	var srv *server.Server
+	if serveAddr != "" {
+		srv = server.New(serveAddr)
+		srv.SetHealth(interval, staleAft)
+		if err := srv.Start(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, "error: serve:", err)
+			os.Exit(1)
+		}
+		if verbose {
+			fmt.Fprintf(os.Stderr, "serve: listening on %s\n", serveAddr)
+		}
+	}
+
+	// Offline mode: only the searched ranges (and the reference IP) may be
+	// dialed. Features that need third-party services are refused up front.
+	restrictOffline := func(roots []netip.Prefix) {
+		allow := append([]netip.Prefix{}, roots...)
+		if refAddr.IsValid() {
+			allow = append(allow, netip.PrefixFrom(refAddr, refAddr.BitLen()))
+		}
+		netguard.Restrict(allow)
+	}
+	if offline {
+		switch {
+		case dnsProvider != "":
+			fmt.Fprintln(os.Stderr, "error: --offline cannot be used with --dns-provider")
+			os.Exit(1)
+		case echCheck || echOnly:
+			fmt.Fprintln(os.Stderr, "error: --offline cannot be used with --ech-check (needs a DNS resolver)")
+			os.Exit(1)
+		case !store.Local(backendBy):
+			fmt.Fprintln(os.Stderr, "error: --offline cannot be used with a remote --state-backend")
+			os.Exit(1)
+		case probeExec != "":
+			fmt.Fprintln(os.Stderr, "error: --offline cannot be used with --probe-exec (the plugin's connections bypass the dialer)")
+			os.Exit(1)
+		case k8sPublish != "":
+			fmt.Fprintln(os.Stderr, "error: --offline cannot be used with --k8s-publish (the API server is outside the allow-list)")
+			os.Exit(1)
+		case baseline || minImprove > 0:
+			fmt.Fprintln(os.Stderr, "error: --offline cannot be used with --baseline or --min-improvement-pct (the default route needs a DNS lookup)")
+			os.Exit(1)
+		}
+		// Nothing may connect out before the first run sets the real list.
+		restrictOffline(nil)
+	}
+
+	var dnsRes *resolver.Resolver
+	if dnsSpec != "" {
+		boot, err := resolver.ParseBootstrap(dnsBoot)
+		if err == nil {
+			dnsRes, err = resolver.New(dnsSpec, boot)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: --resolver:", err)
+			os.Exit(1)
+		}
+		dnsRes.InstallDefault()
+	}
+	echRes := dnsRes
+	if (echCheck || echOnly) && echRes == nil {
+		r, err := resolver.New(echDNS, nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: --ech-resolver:", err)
+			os.Exit(1)
+		}
+		echRes = r
+	}
+
+	var cacheKey *[cache.KeySize]byte
+	if cacheKeyPath != "" {
+		k, err := cache.ReadKeyFile(cacheKeyPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: --cache-encrypt-key:", err)
+			os.Exit(1)
+		}
+		cacheKey = k
+	}
+
+	var signKey ed25519.PrivateKey
+	if signPath != "" {
+		if outPath == "" && stateDir == "" {
+			fmt.Fprintln(os.Stderr, "error: --sign-key requires --out-file or --state-dir")
+			os.Exit(1)
+		}
+		k, err := sign.LoadPrivateKey(signPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: --sign-key:", err)
+			os.Exit(1)
+		}
+		signKey = k
+	}
+
+	// A remote backend replaces the cache file and also receives the latest
+	// results; the file backend keeps the usual files.
+	var backend store.Backend
+	if b, err := store.Open(backendBy); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	} else if _, local := b.(store.File); !local {
+		backend = b
+		defer func() { _ = backend.Close() }()
+	}
+
+	var k8s *k8sPublisher
+	if k8sPublish != "" {
+		p, err := newK8sPublisher(k8sPublish, k8sEndpoints)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: --k8s-publish:", err)
+			os.Exit(1)
+		}
+		k8s = p
+		go k8s.elect(ctx, verbose)
+	} else if k8sEndpoints {
+		fmt.Fprintln(os.Stderr, "error: --k8s-endpoints requires --k8s-publish")
+		os.Exit(1)
+	}
+
+	var priorPack *priors.Pack
+	if priorsPath != "" {
+		var err error
+		if priorPack, err = loadPriors(priorsPath, priorsHalfLife); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		if verbose {
+			fmt.Fprintf(os.Stderr, "priors: %d prefixes from %s\n", len(priorPack.Priors), priorsPath)
+		}
+	}
+
+	// A remote backend also keeps a checkpoint of what earlier searches
+	// learned, saved after each run; it seeds the search along with --priors.
+	var curPriors atomic.Pointer[priors.Pack]
+	curPriors.Store(priorPack)
+	if backend != nil {
+		cp, err := loadCheckpoint(backend, cacheKey, priorsHalfLife)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "state backend: failed to load checkpoint: %v\n", err)
+		} else if cp != nil {
+			curPriors.Store(withPack(priorPack, *cp))
+			if verbose {
+				fmt.Fprintf(os.Stderr, "state backend: checkpoint with %d prefixes from %s\n", len(cp.Priors), backend.String())
+			}
+		}
+	}
+
+	var st *state.Dir
+	restoreStderr := func() {}
+	if stateDir != "" {
+		var err error
+		if st, err = state.Open(stateDir, stateKeep); err != nil {
+			fmt.Fprintln(os.Stderr, "error: state dir:", err)
+			os.Exit(1)
+		}
+		if restoreStderr, err = st.TeeStderr(time.Now()); err != nil {
+			fmt.Fprintln(os.Stderr, "error: state dir:", err)
+			os.Exit(1)
+		}
+		defer restoreStderr()
+		if !explicit["cache-file"] {
+			cacheFile = st.CachePath()
+		}
+		if signKey != nil {
+			st.Sign = func(path string) (string, error) { return sign.SignFile(signKey, path) }
+		}
+	}
+
+	var streamW *output.StreamWriter
+	if stream || earlyRes {
+		streamW = output.NewStreamWriter(os.Stdout)
+	}
+
+	var samplesW *output.SampleWriter
+	if samplesTo != "" {
+		f, err := openSamples(samplesTo)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: --export-samples:", err)
+			os.Exit(1)
+		}
+		defer func() { _ = f.Close() }()
+		fi, err := f.Stat()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: --export-samples:", err)
+			os.Exit(1)
+		}
+		samplesW = output.NewSampleWriter(f, fi.Size() == 0)
+	}
+
+	// Config reloads are parsed immediately; changed CIDRs are pushed into the
+	// running search, everything else is applied before the next run.
+	var (
+		live        liveRun
+		reloadMu    sync.Mutex
+		pending     []configSetting
+		havePending bool
+		reloaded    = make(chan struct{}, 1)
+	)
+	reload := func() error {
+		if configPath == "" {
+			return errors.New("no --config file to reload")
+		}
+		settings, err := readConfigFile(configPath)
+		if err != nil {
+			return err
+		}
+		if err := checkConfig(flag.CommandLine, settings); err != nil {
+			return err
+		}
+		if offline {
+			if err := checkOfflineReload(settings); err != nil {
+				return err
+			}
+		}
+		if names := restartOnly(settings, cmdline, startupConfig); len(names) > 0 {
+			fmt.Fprintf(os.Stderr, "config: changes to %s take effect after a restart\n", strings.Join(names, ", "))
+		}
+
+		if !global && !cmdline["cidr"] && !cmdline["cidr-file"] {
+			roots, ok, err := configRoots(settings)
+			if err != nil {
+				return err
+			}
+			if ok {
+				if offline {
+					restrictOffline(roots)
+				}
+				added, removed, err := live.updateRoots(roots)
+				if err != nil {
+					return err
+				}
+				if verbose && added+removed > 0 {
+					fmt.Fprintf(os.Stderr, "config: running search roots added=%d removed=%d\n", added, removed)
+				}
+			}
+		}
+
+		reloadMu.Lock()
+		pending, havePending = settings, true
+		reloadMu.Unlock()
+		select {
+		case reloaded <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	// applyPending applies a reloaded config; it only runs between runs so
+	// runOnce never sees flags change underneath it.
+	applyPending := func() {
+		reloadMu.Lock()
+		settings, ok := pending, havePending
+		havePending = false
+		reloadMu.Unlock()
+		if !ok {
+			return
+		}
+		applied, err := applyConfig(flag.CommandLine, settings, cmdline, reloadableFlags, fromConfig)
+		for name := range fromConfig {
+			if reloadableFlags[name] && !applied[name] {
+				delete(fromConfig, name)
+				delete(explicit, name)
+			}
+		}
+		if fromConfig == nil {
+			fromConfig = make(map[string]bool)
+		}
+		for name := range applied {
+			fromConfig[name] = true
+			explicit[name] = true
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "config: reload %s: %v\n", configPath, err)
+			return
+		}
+		if verbose {
+			fmt.Fprintf(os.Stderr, "config: reloaded %s\n", configPath)
+		}
+	}
+
+	if configPath != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := reload(); err != nil {
+					fmt.Fprintf(os.Stderr, "config: reload %s: %v\n", configPath, err)
+				}
+			}
+		}()
+		if srv != nil {
+			srv.SetReloader(reload)
+		}
+	}
+
+	var curEng atomic.Pointer[engine.Engine]
+	handleIntrospection(dumpPath, &curEng)
+
+	var summary *exitSummary
+	if exitSumm {
+		summary = newExitSummary(outPath)
+	}
+	finish := func(err error) {
+		if summary != nil {
+			summary.write(os.Stderr, err)
+		}
+	}
+
+	// With --serve, the main search and the jobs started through the API
+	// share one probe pool of --concurrency workers and a negative cache.
+	var shared *engine.Shared
+	if srv != nil {
+		shared = engine.NewShared(concur.n)
+	}
+
+	// engineConfig builds the engine configuration from the flags; each
+	// run and each API job starts from a fresh copy.
+	engineConfig := func() engine.Config {
+		return engine.Config{
+			Budget:          budget,
+			TopN:            topN,
+			Concurrency:     concur.n,
+			MaxInflight:     inflight,
+			MaxMemory:       int64(maxMemoryMB) << 20,
+			SlowStart:       slowStart,
+			Throttle:        throttle,
+			Shared:          shared,
+			Priors:          curPriors.Load(),
+			Heads:           heads,
+			HeadsV4:         headsV4,
+			HeadsV6:         headsV6,
+			Beam:            beam,
+			SplitStepV4:     splitV4,
+			SplitStepV6:     splitV6,
+			SplitPolicy:     splitBy,
+			MinSamplesSplit: minSplit,
+			MaxBitsV4:       maxBitsV4,
+			MaxBitsV6:       maxBitsV6,
+			DeepDrillV4:     deepDrill,
+			Seed:            seed,
+			Verbose:         verbose,
+			QuietProgress:   progress != progressLines,
+			DiversityWeight: diversityWeight,
+			MinCoverage:     minCoverage,
+			SplitInterval:   splitInterval,
+
+			Backpressure:         backpressure,
+			BackpressureInterval: bpInterval,
+			MinConcurrency:       minConcur,
+			AutoConcurrency:      concur.auto,
+
+			ReferenceIP:       refAddr,
+			ReferenceInterval: refInterval,
+
+			BreakerThreshold: breakerThresh,
+			BreakerCooldown:  breakerCooldown,
+
+			FailFastThreshold: failFast,
+			MaxWaste:          maxWaste,
+			FailureModel:      failureModel,
+			TimeoutPenalty:    timeoutPenalty,
+			RefusalPenalty:    refusalPenalty,
+
+			PhaseBitsV6:        phaseV6,
+			DrillAfter:         drillAfter,
+			SubnetsPerPrefixV6: subnetsV6,
+			SuffixesV6:         v6Suffixes,
+
+			Colos:       parseColos(coloList),
+			PreferCache: cachePreference(preferCache),
+			Ports:       armPorts,
+			GroupBy:     groupBy,
+			PerGroup:    perGroup,
+
+			Objective:  objective,
+			RankBitsV4: rankV4,
+			RankBitsV6: rankV6,
+
+			BudgetUnit:  budgetBy,
+			AutoBudget:  budget <= 0,
+			AutoMaxBits: !global && !explicit["max-bits-v4"] && !explicit["max-bits-v6"],
+			AutoHeads:   heads <= 0,
+		}
+	}
+
+	// probeConfig builds the probe configuration from the flags.
+	probeConfig := func() probe.Config {
+		redirects := 0
+		if followRedir {
+			redirects = max(maxRedir, 0)
+		}
+		return probe.Config{
+			Timeout:    timeout,
+			SNI:        sni,
+			HostHeader: hostHdr,
+			Paths:      paths,
+			Warm:       warm,
+			Sessions:   sessions,
+
+			Targets:     probeTargets,
+			TargetScore: targetBy,
+
+			Exec:      execArgs,
+			WireGuard: wgCfg,
+
+			MaxRedirects:   redirects,
+			CaptureHeaders: parseHeaderNames(capHeaders),
+
+			TLSFingerprint: tlsFP,
+			ClientCert:     clientCertPair,
+
+			RootCAs:            rootCAs,
+			InsecureSkipVerify: insecure,
+			UseEnvProxy:        envProxy,
+		}
+	}
+
+	if srv != nil {
+		srv.SetJobBuilder(func(spec server.JobSpec) (*engine.Engine, engine.Request, error) {
+			if spec.SNI == "" {
+				return nil, engine.Request{}, errors.New("sni is required")
+			}
+			cfg := engineConfig()
+			cfg.Verbose = false
+			cfg.QuietProgress = true
+			if spec.Budget > 0 {
+				cfg.Budget, cfg.AutoBudget = spec.Budget, false
+			}
+			if spec.Top > 0 {
+				cfg.TopN = spec.Top
+			}
+			pc := probeConfig()
+			pc.SNI, pc.HostHeader = spec.SNI, spec.SNI
+			if spec.Host != "" {
+				pc.HostHeader = spec.Host
+			}
+			req := engine.Request{CIDRs: spec.CIDRs, Probe: pc}
+			if len(spec.CIDRs) == 0 {
+				req.CIDRs, req.CIDRFile = cidrs, cidrFile
+				if global {
+					req.Prefixes, req.Exclude = cidr.GlobalIPv4(), cidr.BogonsV4
+				}
+			}
+			return engine.New(cfg, pc), req, nil
+		})
+	}
+
+	runOnce := func(ctx context.Context, runIndex int) (err error) {
+		// Only the elected replica searches; the others stand by.
+		if k8s != nil && !k8s.elector.Leading(ctx) {
+			if verbose {
+				fmt.Fprintf(os.Stderr, "k8s: %s is not the leader, skipping run %d\n", k8s.elector.Identity(), runIndex)
+			}
+			return nil
+		}
+		if srv != nil {
+			srv.RunStarted()
+			defer func() { srv.RunFinished(err) }()
+		}
 		if verbose && interval > 0 {
 			fmt.Fprintf(os.Stderr, "run %d start: %s\n", runIndex, time.Now().Format(time.RFC3339))
 		}
 
+		if offline {
+			roots := cidr.GlobalIPv4()
+			if !global {
+				if roots, err = loadRoots(cidrs, cidrFile); err != nil {
+					return err
+				}
+			}
+			restrictOffline(roots)
+		}
+
+		// Metered links skip download tests above the size threshold.
+		runDlTop := dlTop
+		if metered && dlBytes > meteredMaxDL && runDlTop > 0 {
+			runDlTop = 0
+			if verbose {
+				fmt.Fprintf(os.Stderr, "metered: skipping download tests (--download-bytes %d > --metered-max-download %d)\n", dlBytes, meteredMaxDL)
+			}
+		}
+		throttle.SetLimits(maxPPS, maxBandwidth*1e6/8)
+		runTime := newRunBudget(timeBudget, timeout)
+
+		// One runner for the cached IPs and the search results alike, so
+		// they share connections and rate limit backoff.
+		var onTest func(int, engine.TopResult)
+		if streamW != nil {
+			onTest = streamW.WriteUpdate
+		}
+		download := probe.DownloadConfig{
+			Timeout:  dlTimeout,
+			Bytes:    dlBytes,
+			SNI:      "speed.cloudflare.com",
+			HostName: "speed.cloudflare.com",
+			Path:     "/__down",
+
+			TLSFingerprint: tlsFP,
+
+			RootCAs:            rootCAs,
+			InsecureSkipVerify: insecure,
+			UseEnvProxy:        envProxy,
+		}
+		speed := speedtest.New(speedtest.Config{
+			Download:   download,
+			Parallel:   dlParallel,
+			Retries:    1,
+			Confirm:    dlRetries,
+			UniqueColo: dlUnique,
+			Throttle:   throttle,
+			OnTest:     onTest,
+			Verbose:    verbose,
+		})
+		defer speed.Close()
+
+		// Short downloads during the search, for the integrated bandwidth
+		// phase; a runner of their own so they don't count towards the
+		// download tests' median speed or time estimate.
+		var tput *speedtest.Runner
+		if tputSplit && !dryRun {
+			sample := download
+			sample.Bytes = tputBytes
+			tput = speedtest.New(speedtest.Config{Download: sample, Retries: 1, Throttle: throttle, Verbose: verbose})
+			defer tput.Close()
+		}
+
+		// Default path latency, the point of comparison for the results
+		var base *engine.Baseline
+		if (baseline || minImprove > 0) && !dryRun {
+			prober := probe.NewProber(probeConfig())
+			defer prober.Close()
+			b := measureBaseline(ctx, prober, sni, timeout)
+			base = &b
+			if verbose {
+				if b.OK {
+					fmt.Fprintf(os.Stderr, "baseline: host=%s ip=%s %.0fms\n", b.Host, b.IP, b.ScoreMS)
+				} else {
+					fmt.Fprintf(os.Stderr, "baseline: host=%s failed: %s\n", b.Host, b.Error)
+				}
+			}
+		}
+
 		// Load cache
 		var ipCache *cache.Cache
 		var cachedResults []engine.TopResult
 		if !cacheDisable {
 			var err error
-			ipCache, err = cache.Load(cacheFile)
+			cacheName := cacheFile
+			if backend != nil {
+				ipCache, err = cache.LoadFrom(backend, backendCacheKey, cacheKey)
+				cacheName = backend.String()
+			} else {
+				ipCache, err = cache.LoadWithKey(cacheFile, cacheKey)
+			}
+			if errors.Is(err, cache.ErrEncrypted) || errors.Is(err, cache.ErrDecrypt) {
+				// Don't overwrite a cache we can't read.
+				return fmt.Errorf("%s: %w", cacheName, err)
+			}
 			if err != nil {
 				if verbose {
 					fmt.Fprintf(os.Stderr, "cache: failed to load cache: %v\n", err)
@@ -154,59 +1230,96 @@ func main() {
 		}
 
 		// Test cached IPs first
-		if ipCache != nil && !ipCache.IsEmpty() {
-			probeCfg := probe.Config{
-				Timeout:    timeout,
-				SNI:        sni,
-				HostHeader: hostHdr,
-				Path:       path,
-			}
-			prober := probe.NewProber(probeCfg)
-			dlp := probe.NewDownloadProber(probe.DownloadConfig{
-				Timeout:  dlTimeout,
-				Bytes:    dlBytes,
-				SNI:      "speed.cloudflare.com",
-				HostName: "speed.cloudflare.com",
-				Path:     "/__down",
-			})
+		if ipCache != nil && !ipCache.IsEmpty() && !dryRun {
+			prober := probe.NewProber(probeConfig())
+			defer prober.Close()
 
 			for _, cachedIP := range ipCache.IPs {
+				// In monitor mode, stable IPs are re-checked less often than
+				// flappy ones; until then their last results are reused.
+				if interval > 0 && cachedIP.OK && !cachedIP.Due(time.Now(), interval) {
+					if verbose {
+						fmt.Fprintf(os.Stderr, "cache: ip=%s stable, next check in %s\n", cachedIP.IP.String(),
+							time.Until(cachedIP.LastTested.Add(cachedIP.RefreshAfter(interval))).Round(time.Second))
+					}
+					cachedResults = append(cachedResults, engine.TopResult{
+						IP:           cachedIP.IP,
+						Label:        cachedIP.Label,
+						OK:           true,
+						ScoreMS:      cachedIP.ScoreMS,
+						DownloadOK:   cachedIP.DownloadOK,
+						DownloadMbps: cachedIP.DownloadMbps,
+						TraceInfo:    probe.TraceInfo{Colo: cachedIP.Colo},
+						Reused:       true,
+					})
+					continue
+				}
+				if runTime.cacheDone() {
+					if verbose {
+						fmt.Fprintln(os.Stderr, "cache: time budget share used up, skipping the remaining cached IPs")
+					}
+					break
+				}
+
 				// Probe test
+				if err := throttle.WaitProbe(ctx); err != nil {
+					return err
+				}
 				pctx, pcancel := context.WithTimeout(ctx, timeout)
 				probeResult := prober.ProbeHTTPTrace(pctx, cachedIP.IP)
 				pcancel()
 
 				if !probeResult.OK {
+					ipCache.MarkFailed(cachedIP.IP, time.Now())
 					if verbose {
 						fmt.Fprintf(os.Stderr, "cache: ip=%s probe failed: %s\n", cachedIP.IP.String(), probeResult.Error)
 					}
 					continue
 				}
+				if want := cachePreference(preferCache); want != "" && probeResult.CacheStatus != "" && probeResult.CacheStatus != want {
+					if verbose {
+						fmt.Fprintf(os.Stderr, "cache: ip=%s skipped: edge cache %s\n", cachedIP.IP.String(), probeResult.CacheStatus)
+					}
+					continue
+				}
 
 				score := float64(probeResult.TotalMS)
+				tlsMS, resumeMS := probeResult.TLSMS, int64(0)
+				if probeResult.TLSResumed {
+					tlsMS, resumeMS = 0, probeResult.TLSMS
+				}
 				result := engine.TopResult{
 					IP:        cachedIP.IP,
+					Label:     cachedIP.Label,
 					OK:        probeResult.OK,
 					Status:    probeResult.Status,
 					Error:     probeResult.Error,
 					ConnectMS: probeResult.ConnectMS,
-					TLSMS:     probeResult.TLSMS,
+					TLSMS:     tlsMS,
 					TTFBMS:    probeResult.TTFBMS,
 					TotalMS:   probeResult.TotalMS,
 					ScoreMS:   score,
 					Trace:     probeResult.Trace,
+					TraceInfo: probeResult.TraceInfo,
+					Path:      probeResult.Path,
+
+					WarmTTFBMS:  probeResult.WarmTTFBMS,
+					WarmTotalMS: probeResult.WarmTotalMS,
+					TLSResumeMS: resumeMS,
+					Targets:     probeResult.Targets,
+
+					BandwidthHintMbps: probeResult.BandwidthHintMbps,
+					RemoteAddr:        probeResult.RemoteAddr,
+					Location:          probeResult.Location,
+					Redirects:         probeResult.Redirects,
+					Headers:           probeResult.Headers,
+					CacheStatus:       probeResult.CacheStatus,
 				}
 
 				// Download test for cached IPs
-				if dlTop > 0 && dlBytes > 0 {
-					dctx, dcancel := context.WithTimeout(ctx, dlTimeout)
-					dr := dlp.Download(dctx, cachedIP.IP)
-					dcancel()
-					result.DownloadOK = dr.OK
-					result.DownloadBytes = dr.Bytes
-					result.DownloadMS = dr.TotalMS
-					result.DownloadMbps = dr.Mbps
-					result.DownloadError = dr.Error
+				if runDlTop > 0 && dlBytes > 0 {
+					dr := speed.Test(ctx, cachedIP.IP)
+					speedtest.Apply(&result, dr)
 					if verbose {
 						fmt.Fprintf(os.Stderr, "cache: ip=%s probe=%.1fms dl_ok=%v dl_mbps=%.2f\n",
 							cachedIP.IP.String(), score, dr.OK, dr.Mbps)
@@ -223,151 +1336,284 @@ func main() {
 			}
 		}
 
-		// Build engine config
-		cfg := engine.Config{
-			Budget:          budget,
-			TopN:            topN,
-			Concurrency:     concur,
-			Heads:           heads,
-			Beam:            beam,
-			SplitStepV4:     splitV4,
-			SplitStepV6:     splitV6,
-			MinSamplesSplit: minSplit,
-			MaxBitsV4:       maxBitsV4,
-			MaxBitsV6:       maxBitsV6,
-			Seed:            seed,
-			Verbose:         verbose,
-			DiversityWeight: diversityWeight,
-			SplitInterval:   splitInterval,
+		cfg := engineConfig()
+		planned := 0
+		if runDlTop > 0 && dlBytes > 0 {
+			planned = runDlTop
 		}
+		cfg.Deadline = runTime.searchDeadline(planned, speed)
 
-		probeCfg := probe.Config{
-			Timeout:    timeout,
-			SNI:        sni,
-			HostHeader: hostHdr,
-			Path:       path,
+		if stream || samplesW != nil {
+			cfg.OnProbe = func(r engine.ProbeResult) {
+				if stream {
+					streamW.WriteProbe(r)
+				}
+				if samplesW != nil {
+					samplesW.Write(runIndex, r)
+				}
+			}
+		}
+		var epochs []engine.Epoch
+		if stream || timelineTo != "" || bar != nil {
+			cfg.OnEpoch = func(ep engine.Epoch) {
+				if timelineTo != "" {
+					epochs = append(epochs, ep)
+				}
+				if stream {
+					streamW.WriteEpoch(ep)
+				}
+				if bar != nil {
+					bar.update(ep, budgetBy == engine.BudgetSuccesses)
+				}
+			}
+		}
+		if tput != nil {
+			cfg.SplitOnThroughput = true
+			cfg.ThroughputEvery = tputEvery
+			cfg.ThroughputFunc = func(ctx context.Context, ip netip.Addr) (float64, bool) {
+				dr := tput.Test(ctx, ip)
+				return dr.Mbps, dr.OK
+			}
+		}
+		if validateRe != nil {
+			cfg.RewardFunc = func(r probe.Result) (float64, bool) {
+				return float64(r.TotalMS), r.OK && validateRe.MatchString(r.Body)
+			}
 		}
 
+		probeCfg := probeConfig()
+
 		req := engine.Request{
 			CIDRs:    []string(cidrs),
 			CIDRFile: cidrFile,
 			Probe:    probeCfg,
 		}
+		if global {
+			req.Prefixes = cidr.GlobalIPv4()
+			req.Exclude = cidr.BogonsV4
+		}
+
+		if dryRun {
+			plan, err := engine.New(cfg, probeCfg).Plan(req, dryRunSamples)
+			if err != nil {
+				return err
+			}
+			cached := 0
+			if ipCache != nil {
+				cached = ipCache.Len()
+			}
+			writePlan(os.Stdout, plan, probeCfg, cached)
+			return nil
+		}
 
 		// Create and run engine
 		if verbose {
 			fmt.Fprintf(os.Stderr, "search: starting new IP search...\n")
 		}
 		eng := engine.New(cfg, probeCfg)
+		curEng.Store(eng)
+		if srv != nil {
+			srv.SetEngine(eng)
+		}
+		if !global {
+			if roots, err := loadRoots(cidrs, cidrFile); err == nil {
+				live.set(eng, roots)
+			}
+		}
 		res, err := eng.Run(ctx, req)
+		if summary != nil {
+			summary.addRun(eng.Status())
+		}
+		if bar != nil {
+			bar.finish()
+		}
+		if dumpPath != "" {
+			if derr := dumpTree(dumpPath, eng); derr != nil {
+				fmt.Fprintf(os.Stderr, "dump-tree: %v\n", derr)
+			} else if verbose {
+				fmt.Fprintf(os.Stderr, "dump-tree: wrote %s\n", dumpPath)
+			}
+		}
+		if metricsOut != "" {
+			if merr := writePrefixMetrics(metricsOut, eng); merr != nil {
+				fmt.Fprintf(os.Stderr, "prefix-metrics-out: %v\n", merr)
+			} else if verbose {
+				fmt.Fprintf(os.Stderr, "prefix-metrics-out: wrote %s\n", metricsOut)
+			}
+		}
+		if samplesW != nil {
+			if serr := samplesW.Flush(); serr != nil {
+				fmt.Fprintf(os.Stderr, "export-samples: %v\n", serr)
+			}
+		}
+		if timelineTo != "" {
+			if terr := writeTimeline(timelineTo, epochs); terr != nil {
+				fmt.Fprintf(os.Stderr, "timeline-out: %v\n", terr)
+			} else if verbose {
+				fmt.Fprintf(os.Stderr, "timeline-out: wrote %d epochs to %s\n", len(epochs), timelineTo)
+			}
+		}
 		if err != nil {
 			return err
 		}
+		if backend != nil {
+			if cp, cerr := saveCheckpoint(backend, cacheKey, eng, priorsHalfLife); cerr != nil {
+				fmt.Fprintf(os.Stderr, "state backend: failed to save checkpoint: %v\n", cerr)
+			} else {
+				curPriors.Store(withPack(priorPack, cp))
+				if verbose {
+					fmt.Fprintf(os.Stderr, "state backend: saved checkpoint with %d prefixes to %s\n", len(cp.Priors), backend.String())
+				}
+			}
+		}
+
+		// Show the latency ranking before the download tests update it.
+		if streamW != nil {
+			if err := streamW.WriteResults(res.Top); err != nil {
+				return err
+			}
+		}
 
 		// Download speed test
-		runDlTop := dlTop
 		if runDlTop < 0 {
 			runDlTop = 0
 		}
 		if runDlTop > 0 && dlBytes > 0 {
-			if runDlTop > len(res.Top) {
-				runDlTop = len(res.Top)
-			}
-			dlp := probe.NewDownloadProber(probe.DownloadConfig{
-				Timeout:  dlTimeout,
-				Bytes:    dlBytes,
-				SNI:      "speed.cloudflare.com",
-				HostName: "speed.cloudflare.com",
-				Path:     "/__down",
-			})
-			for i := 0; i < runDlTop; i++ {
-				r := &res.Top[i]
-				dctx, dcancel := context.WithTimeout(ctx, dlTimeout)
-				dr := dlp.Download(dctx, r.IP)
-				dcancel()
-				r.DownloadOK = dr.OK
-				r.DownloadBytes = dr.Bytes
-				r.DownloadMS = dr.TotalMS
-				r.DownloadMbps = dr.Mbps
-				r.DownloadError = dr.Error
-				if verbose {
-					fmt.Fprintf(os.Stderr, "download: rank=%d ip=%s ok=%v mbps=%.2f ms=%d bytes=%d err=%s\n",
-						i+1, r.IP.String(), dr.OK, dr.Mbps, dr.TotalMS, dr.Bytes, dr.Error)
-				}
+			if skipped := speed.RunBy(ctx, res.Top, runDlTop, runTime.downloadDeadline()); skipped > 0 {
+				fmt.Fprintf(os.Stderr, "warning: --time-budget: skipped %d of %d download tests\n", skipped, min(runDlTop, len(res.Top)))
 			}
 		}
 
-		// Merge cached results with new results
-		allResults := append(cachedResults, res.Top...)
+		// Merge cached results with new results, keeping the best N by
+		// latency and download speed combined
+		res.Top = speedtest.Merge(append(cachedResults, res.Top...), topN, rankWeight)
+		res.SearchOrder = speedtest.ScoreOrder(res.Top)
+		meta := engine.Recommend(res.Top)
+		meta.Version = versionString()
+		if base != nil {
+			meta.SetBaseline(*base)
+		}
+		res.Meta = &meta
+		if summary != nil {
+			summary.setResults(res.Top)
+		}
+
+		// The checks below stop at the end of the time budget.
+		checkCtx, checkCancel := runTime.context(ctx)
+		defer checkCancel()
 
-		// Deduplicate by IP, keeping the better result
-		ipMap := make(map[netip.Addr]engine.TopResult)
-		for _, r := range allResults {
-			existing, exists := ipMap[r.IP]
-			if !exists {
-				ipMap[r.IP] = r
-				continue
-			}
-			// Keep the better one (prefer download OK, then higher Mbps, then lower score)
-			if r.DownloadOK && !existing.DownloadOK {
-				ipMap[r.IP] = r
-			} else if r.DownloadOK && existing.DownloadOK && r.DownloadMbps > existing.DownloadMbps {
-				ipMap[r.IP] = r
-			} else if !r.DownloadOK && !existing.DownloadOK && r.ScoreMS < existing.ScoreMS {
-				ipMap[r.IP] = r
-			}
+		// Resumed handshake timing, using the sessions from the search
+		if sessions != nil {
+			runResumeCheck(checkCtx, res.Top, probeCfg, verbose)
 		}
 
-		// Convert back to slice and sort
-		mergedResults := make([]engine.TopResult, 0, len(ipMap))
-		for _, r := range ipMap {
-			mergedResults = append(mergedResults, r)
+		// Domain fronting check
+		if frontSNI != "" && frontHost != "" {
+			runFrontingCheck(checkCtx, res.Top, probe.Config{
+				Timeout:    timeout,
+				SNI:        frontSNI,
+				HostHeader: frontHost,
+				Paths:      paths,
+
+				TLSFingerprint: tlsFP,
+
+				RootCAs:            rootCAs,
+				InsecureSkipVerify: insecure,
+				UseEnvProxy:        envProxy,
+			}, verbose)
 		}
 
-		// Sort by download speed (for those with download test) then by score
-		sort.Slice(mergedResults, func(i, j int) bool {
-			if mergedResults[i].DownloadOK && mergedResults[j].DownloadOK {
-				return mergedResults[i].DownloadMbps > mergedResults[j].DownloadMbps
-			}
-			if mergedResults[i].DownloadOK {
-				return true
-			}
-			if mergedResults[j].DownloadOK {
-				return false
+		// Encrypted ClientHello check
+		if echCheck || echOnly {
+			runECHCheck(checkCtx, res.Top, sni, echRes, timeout, verbose)
+			if echOnly {
+				kept := res.Top[:0]
+				for _, r := range res.Top {
+					if r.ECHSupported {
+						kept = append(kept, r)
+					}
+				}
+				res.Top = kept
 			}
-			return mergedResults[i].ScoreMS < mergedResults[j].ScoreMS
-		})
+		}
 
-		// Keep top N
-		if len(mergedResults) > topN {
-			mergedResults = mergedResults[:topN]
+		// Certificate chain and revocation health
+		if certCheck {
+			runCertCheck(checkCtx, res.Top, sni, timeout, verbose)
+		}
+
+		// Port reachability matrix
+		if portCheck {
+			runPortCheck(checkCtx, res.Top, checkPorts, timeout, verbose)
 		}
-		res.Top = mergedResults
 
 		// Update cache with best results
 		if !cacheDisable && ipCache != nil {
 			var newCachedIPs []cache.CachedIP
-			for _, r := range mergedResults {
-				colo := ""
-				if r.Trace != nil {
-					colo = r.Trace["colo"]
+			for _, r := range res.Top {
+				if r.Reused {
+					continue // not re-checked; keep the cached entry as is
 				}
 				newCachedIPs = append(newCachedIPs, cache.CachedIP{
 					IP:           r.IP,
 					ScoreMS:      r.ScoreMS,
 					DownloadMbps: r.DownloadMbps,
 					DownloadOK:   r.DownloadOK,
-					Colo:         colo,
+					Colo:         r.Colo,
+					Label:        r.Label,
 					LastTested:   time.Now(),
+					OK:           r.OK,
 				})
 			}
 			ipCache.Update(newCachedIPs, cacheCount)
-			if err := ipCache.Save(cacheFile); err != nil {
+
+			// Annotate results with their learned stability
+			for i := range res.Top {
+				c, ok := ipCache.Lookup(res.Top[i].IP)
+				if !ok {
+					continue
+				}
+				if c.OK && !c.GoodSince.IsZero() {
+					res.Top[i].StableForS = int64(c.LastTested.Sub(c.GoodSince).Seconds())
+				}
+				res.Top[i].RefreshAfterS = int64(c.RefreshAfter(interval).Seconds())
+			}
+			saveTo := cacheFile
+			var err error
+			if backend != nil {
+				err = ipCache.SaveTo(backend, backendCacheKey, cacheKey)
+				saveTo = backend.String()
+			} else {
+				err = ipCache.SaveWithKey(cacheFile, cacheKey)
+			}
+			if err != nil {
 				if verbose {
 					fmt.Fprintf(os.Stderr, "cache: failed to save cache: %v\n", err)
 				}
 			} else if verbose {
-				fmt.Fprintf(os.Stderr, "cache: saved %d IPs to %s\n", ipCache.Len(), cacheFile)
+				fmt.Fprintf(os.Stderr, "cache: saved %d IPs to %s\n", ipCache.Len(), saveTo)
+			}
+		}
+
+		// Keep only what beats the default path by the required margin, so
+		// nothing worse gets reported or applied
+		if minImprove > 0 && base != nil {
+			res.Top = engine.ImprovedOver(res.Top, *base, minImprove)
+			res.SearchOrder = speedtest.ScoreOrder(res.Top)
+			meta := engine.Recommend(res.Top)
+			if len(res.Top) == 0 {
+				meta = engine.NoImprovement(*base, minImprove)
+				defer func() {
+					if err == nil {
+						err = errNoImprovement
+					}
+				}()
+			}
+			meta.Version = versionString()
+			meta.SetBaseline(*base)
+			res.Meta = &meta
+			if summary != nil {
+				summary.setResults(res.Top)
 			}
 		}
 
@@ -443,69 +1689,193 @@ func main() {
 			}
 		}
 
-		// Output
-		var w *os.File = os.Stdout
-		if outPath != "" {
-			f, err := os.Create(outPath)
+		if st != nil {
+			p, err := st.SaveResult(res, time.Now())
 			if err != nil {
-				return err
+				return fmt.Errorf("state dir: %w", err)
+			}
+			if verbose {
+				fmt.Fprintf(os.Stderr, "state: saved %s\n", p)
 			}
-			defer func() {
-				_ = f.Close()
-			}()
-			w = f
 		}
 
-		switch outFmt {
-		case "jsonl":
-			if err := output.WriteJSONL(w, res.Top); err != nil {
-				return err
+		if backend != nil {
+			if err := saveLatest(backend, res, stateKeep); err != nil {
+				fmt.Fprintf(os.Stderr, "state backend: failed to save results: %v\n", err)
+			} else if verbose {
+				fmt.Fprintf(os.Stderr, "state backend: saved results to %s\n", backend.String())
 			}
-		case "csv":
-			if err := output.WriteCSV(w, res.Top); err != nil {
-				return err
+		}
+
+		if k8s != nil {
+			if err := k8s.publish(ctx, res); err != nil {
+				fmt.Fprintf(os.Stderr, "k8s: failed to publish results: %v\n", err)
+			} else if verbose {
+				fmt.Fprintf(os.Stderr, "k8s: published results to %s/%s\n", k8s.namespace, k8s.name)
 			}
-		case "text":
-			if err := output.WriteText(w, res.Top); err != nil {
-				return err
+		}
+
+		// Output
+		if streamW != nil && outPath == "" {
+			// stdout already carries the stream; finish it with the summary.
+			return streamW.WriteSummary(res.Top)
+		}
+
+		if outPath == "" {
+			return writeResults(os.Stdout, res, outFmt, objective, lang, rotateN)
+		}
+
+		f, err := os.Create(outPath)
+		if err != nil {
+			return err
+		}
+		err = writeResults(f, res, outFmt, objective, lang, rotateN)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+
+		if signKey != nil {
+			sigPath, err := sign.SignFile(signKey, outPath)
+			if err != nil {
+				return fmt.Errorf("sign: %w", err)
 			}
-		case "debug":
-			enc := json.NewEncoder(w)
-			enc.SetIndent("", "  ")
-			if err := enc.Encode(res); err != nil {
-				return err
+			if verbose {
+				fmt.Fprintf(os.Stderr, "sign: wrote %s\n", sigPath)
 			}
-		default:
-			return fmt.Errorf("unknown -out: %s", outFmt)
 		}
-
 		return nil
 	}
 
-	if interval <= 0 {
-		if err := runOnce(ctx, 1); err != nil {
+	sched, err := newSchedule(schedExpr, quietWin, schedJitter)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+	monitor := interval > 0 || sched.cron != nil
+	if sched.active() && !monitor && !dryRun {
+		fmt.Fprintln(os.Stderr, "error: --no-scan-between and --schedule-jitter require --interval or --schedule")
+		os.Exit(1)
+	}
+
+	if !monitor || dryRun {
+		err := runOnce(ctx, 1)
+		if errors.Is(err, errNoImprovement) {
+			fmt.Fprintln(os.Stderr, err)
+		} else if err != nil {
 			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+		finish(err)
+		if errors.Is(err, errNoImprovement) {
+			restoreStderr()
+			os.Exit(exitNoImprovement)
+		}
+		if err != nil {
+			restoreStderr()
 			os.Exit(1)
 		}
 		return
 	}
 
+	if start := sched.first(time.Now()); start.IsZero() {
+		fmt.Fprintln(os.Stderr, "error: --schedule never matches")
+		os.Exit(1)
+	} else if start.After(time.Now()) {
+		if verbose {
+			fmt.Fprintf(os.Stderr, "schedule: first run at %s\n", start.Format(time.RFC3339))
+		}
+		if !sleepUntil(ctx, start) {
+			finish(nil)
+			return
+		}
+	}
+
 	runIndex := 0
 	for {
+		applyPending()
 		runIndex++
-		if err := runOnce(ctx, runIndex); err != nil {
+		err := runOnce(ctx, runIndex)
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "run %d error: %v\n", runIndex, err)
 		}
-		if maxRuns > 0 && runIndex >= maxRuns {
-			return
+		lastEnd := time.Now()
+
+		// A reload may change --interval or --max-runs while we wait.
+		for waiting := true; waiting; {
+			if (interval <= 0 && sched.cron == nil) || (maxRuns > 0 && runIndex >= maxRuns) {
+				finish(err)
+				return
+			}
+			start := sched.next(lastEnd, interval)
+			if start.IsZero() {
+				finish(err)
+				return
+			}
+			if verbose && sched.active() {
+				fmt.Fprintf(os.Stderr, "schedule: next run at %s\n", start.Format(time.RFC3339))
+			}
+			timer := time.NewTimer(time.Until(start))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				finish(err)
+				return
+			case <-timer.C:
+				waiting = false
+			case <-reloaded:
+				timer.Stop()
+				applyPending()
+			}
 		}
+	}
+}
 
-		timer := time.NewTimer(interval)
-		select {
-		case <-ctx.Done():
-			timer.Stop()
-			return
-		case <-timer.C:
+// writeResults writes res to w in the given output format, through a
+// buffer so that rows are not written one syscall at a time; with a large
+// --top this is most of the output time.
+func writeResults(w io.Writer, res engine.Response, format, objective, lang string, rotationSize int) error {
+	bw := bufio.NewWriterSize(w, 64<<10)
+	if err := formatResults(bw, res, format, objective, lang, rotationSize); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// formatResults writes res to w in the given output format, with the text
+// summary in lang and rotation lists of rotationSize IPs.
+func formatResults(w io.Writer, res engine.Response, format, objective, lang string, rotationSize int) error {
+	if objective == engine.ObjectivePrefixRanking {
+		switch format {
+		case "jsonl":
+			return output.WritePrefixJSONL(w, res.Prefixes)
+		case "csv":
+			return output.WritePrefixCSV(w, res.Prefixes)
+		case "text":
+			return output.WritePrefixText(w, res.Prefixes)
+		}
+	}
+
+	switch format {
+	case "jsonl", "csv":
+		return output.WriteRows(w, format, res.Top)
+	case "text":
+		if err := output.WriteText(w, res.Top); err != nil {
+			return err
 		}
+		return output.WriteVerdict(w, res.Meta, lang)
+	case "colo-summary":
+		return output.WriteColoSummary(w, res.Top)
+	case "footprint":
+		return output.WriteFootprint(w, res.Footprint)
+	case "rotation":
+		return output.WriteRotation(w, res.Top, rotationSize)
+	case "debug":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	default:
+		return fmt.Errorf("unknown -out: %s", format)
 	}
 }
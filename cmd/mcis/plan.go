@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/probe"
+)
+
+// dryRunSamples is how many sample addresses --dry-run prints.
+const dryRunSamples = 20
+
+// dryRunMaxRoots is how many roots --dry-run lists before summarizing.
+const dryRunMaxRoots = 50
+
+// writePlan prints the sampling plan of a search for --dry-run: the roots,
+// the size of the search space, the effective configuration and a sample of
+// the addresses that would be probed. cached is the number of cached IPs
+// that would be re-tested first.
+func writePlan(w io.Writer, plan engine.Plan, pc probe.Config, cached int) {
+	fmt.Fprintf(w, "roots: %d\n", len(plan.Roots))
+	for i, en := range plan.Roots {
+		if i == dryRunMaxRoots {
+			fmt.Fprintf(w, "  ... %d more\n", len(plan.Roots)-i)
+			break
+		}
+		line := "  " + en.Prefix.String()
+		if en.Label != "" {
+			line += "\tlabel=" + en.Label
+		}
+		if en.Weight > 0 && en.Weight != 1 {
+			line += fmt.Sprintf("\tweight=%g", en.Weight)
+		}
+		if en.MaxBits > 0 {
+			line += fmt.Sprintf("\tmaxbits=%d", en.MaxBits)
+		}
+		fmt.Fprintln(w, line)
+	}
+
+	fmt.Fprintf(w, "space: ipv4=%s ipv6=%s units=%.0f (recommended budget %d)\n",
+		formatCount(plan.AddressesV4), formatCount(plan.AddressesV6), plan.Scale.Units, plan.Scale.Budget)
+
+	c := plan.Config
+	fmt.Fprintln(w, "config:")
+	fmt.Fprintf(w, "  budget=%d top=%d objective=%s\n", c.Budget, c.TopN, c.Objective)
+	fmt.Fprintf(w, "  concurrency=%d max-inflight=%d slow-start=%v heads=%d heads-v4=%d heads-v6=%d beam=%d\n",
+		c.Concurrency, c.MaxInflight, c.SlowStart, c.Heads, c.HeadsV4, c.HeadsV6, c.Beam)
+	fmt.Fprintf(w, "  split-step-v4=%d split-step-v6=%d max-bits-v4=%d max-bits-v6=%d min-samples-split=%d split-interval=%d split-policy=%s\n",
+		c.SplitStepV4, c.SplitStepV6, c.MaxBitsV4, c.MaxBitsV6, c.MinSamplesSplit, c.SplitInterval, c.SplitPolicy)
+	fmt.Fprintf(w, "  diversity-weight=%.2f min-coverage=%d breaker-threshold=%d fail-fast-threshold=%d max-waste=%.2f seed=%d\n",
+		c.DiversityWeight, c.MinCoverage, c.BreakerThreshold, c.FailFastThreshold, c.MaxWaste, c.Seed)
+	fmt.Fprintf(w, "  failure-model=%s timeout-penalty=%.2f refusal-penalty=%.2f\n", c.FailureModel, c.TimeoutPenalty, c.RefusalPenalty)
+	if c.DeepDrillV4 > 0 {
+		fmt.Fprintf(w, "  deep-drill=%d\n", c.DeepDrillV4)
+	}
+	if c.MaxMemory > 0 {
+		fmt.Fprintf(w, "  max-memory=%dMiB\n", c.MaxMemory>>20)
+	}
+	if plan.AddressesV6 > 0 {
+		fmt.Fprintf(w, "  v6-phase-bits=%d v6-drill-after=%.2f v6-subnets-per-prefix=%d\n", c.PhaseBitsV6, c.DrillAfter, c.SubnetsPerPrefixV6)
+	}
+	if len(c.Colos) > 0 || c.GroupBy != "" {
+		fmt.Fprintf(w, "  colo=%s group-by=%s per-group=%d\n", strings.Join(c.Colos, ","), c.GroupBy, c.PerGroup)
+	}
+	paths := strings.Join(pc.Paths, ",")
+	if paths == "" {
+		paths = "/cdn-cgi/trace"
+	}
+	fmt.Fprintf(w, "  timeout=%s sni=%s host-header=%s paths=%s\n", pc.Timeout, pc.SNI, pc.HostHeader, paths)
+	if len(pc.Targets) > 0 {
+		targets := make([]string, len(pc.Targets))
+		for i, t := range pc.Targets {
+			targets[i] = t.String()
+		}
+		fmt.Fprintf(w, "  targets=%s target-score=%s\n", strings.Join(targets, ","), pc.TargetScore)
+	}
+	if len(pc.Exec) > 0 {
+		fmt.Fprintf(w, "  probe-exec=%q\n", pc.Exec)
+	}
+	if cached > 0 {
+		fmt.Fprintf(w, "cache: %d cached IPs would be re-tested first\n", cached)
+	}
+
+	fmt.Fprintf(w, "sample addresses (%d):\n", len(plan.Samples))
+	for _, a := range plan.Samples {
+		fmt.Fprintln(w, "  "+a.String())
+	}
+}
+
+// formatCount formats an address count exactly when it is small and as a
+// power of two otherwise.
+func formatCount(n float64) string {
+	if n < 1<<40 {
+		return fmt.Sprintf("%.0f", n)
+	}
+	return fmt.Sprintf("2^%.1f", math.Log2(n))
+}
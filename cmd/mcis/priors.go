@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/priors"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/sign"
+)
+
+// defaultPriorsPath is where `mcis priors import` collects packs.
+const defaultPriorsPath = ".mcis_priors.json"
+
+// runPriors implements `mcis priors export|import`, which share what one
+// host's searches learned with others as prior packs (see package priors).
+func runPriors(args []string) int {
+	usage := "usage: mcis priors export -in tree.json -out pack.json [-sign-key key.pem]\n" +
+		"       mcis priors import -in pack.json [-key pub.pem] [-out " + defaultPriorsPath + "]"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	switch args[0] {
+	case "export":
+		return runPriorsExport(args[1:])
+	case "import":
+		return runPriorsImport(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+}
+
+// runPriorsExport turns a --dump-tree file into a prior pack, optionally
+// signed so importers can check where it came from.
+func runPriorsExport(args []string) int {
+	fs := flag.NewFlagSet("priors export", flag.ContinueOnError)
+	in := fs.String("in", "", "Search tree written by --dump-tree")
+	out := fs.String("out", "priors.json", "Prior pack output path")
+	keyPath := fs.String("sign-key", "", "ed25519 private key (PEM) to sign the pack with, writing <out>.sig")
+	minSamples := fs.Int("min-samples", 3, "Leave out prefixes probed fewer times than this")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mcis priors export -in tree.json [-out pack.json] [-sign-key key.pem] [-min-samples N]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *in == "" {
+		fs.Usage()
+		return 2
+	}
+
+	data, err := os.ReadFile(*in)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	var tree engine.TreeDump
+	if err := json.Unmarshal(data, &tree); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s: %v\n", *in, err)
+		return 1
+	}
+	created := tree.Time
+	if created.IsZero() {
+		created = time.Now()
+	}
+	pack := priors.FromTree(tree.Roots, *minSamples, created)
+	if len(pack.Priors) == 0 {
+		fmt.Fprintf(os.Stderr, "error: %s has no prefixes with at least %d samples\n", *in, *minSamples)
+		return 1
+	}
+	if err := pack.Save(*out); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	fmt.Printf("%s: %d prefixes\n", *out, len(pack.Priors))
+
+	if *keyPath != "" {
+		priv, err := sign.LoadPrivateKey(*keyPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		sigPath, err := sign.SignFile(priv, *out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		fmt.Printf("signature: %s\n", sigPath)
+	}
+	return 0
+}
+
+// runPriorsImport merges packs into the local priors file, decaying each by
+// its age first so stale knowledge counts for less.
+func runPriorsImport(args []string) int {
+	fs := flag.NewFlagSet("priors import", flag.ContinueOnError)
+	keyPath := fs.String("key", "", "ed25519 public key (PEM); packs must carry a valid <pack>.sig")
+	out := fs.String("out", defaultPriorsPath, "Priors file to merge into (use with --priors)")
+	halfLife := fs.Duration("half-life", priors.DefaultHalfLife, "Age at which a pack counts half")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mcis priors import [-key pub.pem] [-out file] [-half-life 168h] pack.json...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	now := time.Now()
+	var packs []priors.Pack
+	if cur, err := priors.Load(*out); err == nil {
+		packs = append(packs, cur.Decayed(now, *halfLife))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	if *keyPath != "" {
+		pub, err := sign.LoadPublicKey(*keyPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		for _, path := range fs.Args() {
+			if err := sign.VerifyFile(pub, path, ""); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: error: %v\n", path, err)
+				return 1
+			}
+		}
+	}
+	for _, path := range fs.Args() {
+		p, err := priors.Load(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		packs = append(packs, p.Decayed(now, *halfLife))
+	}
+
+	merged := priors.Merge(now, packs...)
+	if err := merged.Save(*out); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	fmt.Printf("%s: %d prefixes from %d packs\n", *out, len(merged.Priors), fs.NArg())
+	return 0
+}
+
+// loadPriors loads the --priors file, decayed to now.
+func loadPriors(path string, halfLife time.Duration) (*priors.Pack, error) {
+	p, err := priors.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	p = p.Decayed(time.Now(), halfLife)
+	return &p, nil
+}
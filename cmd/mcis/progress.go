@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+)
+
+// --progress modes.
+const (
+	progressLines = "lines" // the engine's verbose progress lines (with -v)
+	progressBar   = "bar"   // a single-line progress bar on stderr
+	progressNone  = "none"  // no progress output
+)
+
+// progressRenderer draws the --progress=bar line from the engine's epoch
+// summaries. When stderr is not a terminal it prints one plain line per
+// epoch instead, so logs and pipes don't fill up with carriage returns.
+type progressRenderer struct {
+	w     io.Writer
+	tty   bool
+	width int
+	prev  engine.Epoch
+	drawn bool
+}
+
+func newProgressRenderer(f *os.File) *progressRenderer {
+	width := terminalWidth(f)
+	return &progressRenderer{w: f, tty: width > 0, width: width}
+}
+
+// update renders the progress after ep. successes measures progress in
+// successful probes (--budget-unit=successes) rather than completed ones.
+func (p *progressRenderer) update(ep engine.Epoch, successes bool) {
+	rate := 0.0
+	if dt := ep.ElapsedS - p.prev.ElapsedS; dt > 0 {
+		rate = float64(ep.Completed-p.prev.Completed) / dt
+	}
+	p.prev = ep
+
+	spent := ep.Completed
+	if successes {
+		spent = ep.Succeeded
+	}
+	pct := 0.0
+	if ep.Budget > 0 {
+		pct = min(1, float64(spent)/float64(ep.Budget))
+	}
+	eta := "-"
+	if spent > 0 && ep.ElapsedS > 0 && ep.Budget > spent {
+		// The average rate is steadier than the last epoch's.
+		left := float64(ep.Budget-spent) / (float64(spent) / ep.ElapsedS)
+		eta = (time.Duration(left) * time.Second).String()
+	} else if ep.Budget > 0 && spent >= ep.Budget {
+		eta = "0s"
+	}
+	best := "-"
+	if ep.BestIP.IsValid() {
+		best = fmt.Sprintf("%.1fms %s", ep.BestScoreMS, ep.BestIP)
+	}
+	stats := fmt.Sprintf(" %3.0f%% %d/%d %.0f/s ETA %s best=%s",
+		pct*100, spent, ep.Budget, rate, eta, best)
+
+	if !p.tty {
+		fmt.Fprintln(p.w, "progress:"+stats)
+		return
+	}
+
+	// Leave a column free so the line never wraps.
+	barWidth := min(40, p.width-len(stats)-3)
+	line := stats
+	if barWidth >= 10 {
+		filled := int(pct * float64(barWidth))
+		line = "[" + strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled) + "]" + stats
+	}
+	if len(line) >= p.width {
+		line = line[:p.width-1]
+	}
+	fmt.Fprint(p.w, "\r\033[K"+line)
+	p.drawn = true
+}
+
+// finish ends the progress line so later output starts on a fresh line.
+func (p *progressRenderer) finish() {
+	if p.drawn {
+		fmt.Fprintln(p.w)
+		p.drawn = false
+	}
+	p.prev = engine.Epoch{}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"strconv"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/output"
+)
+
+// refineArgs implements `mcis refine -in results.jsonl`: it turns the
+// results of an earlier search into the arguments of a focused second pass.
+// The prefixes the winners were found in become the only roots, each
+// allowed to drill deeper than the first pass did, and the winners
+// themselves are added as single-address roots so they are probed again
+// next to their neighbours. Arguments after "--" are passed on to the
+// search and override the generated ones.
+func refineArgs(args []string) ([]string, error) {
+	fs := flag.NewFlagSet("refine", flag.ContinueOnError)
+	in := fs.String("in", "", "Results of an earlier search (--out jsonl, or a --stream capture)")
+	budget := fs.Int("budget", 1000, "Probe budget of the second pass")
+	prefixes := fs.Int("prefixes", 10, "Winning prefixes to search within, best first")
+	extraV4 := fs.Int("extra-bits-v4", 4, "How many bits deeper than its winning prefix each IPv4 root may drill")
+	extraV6 := fs.Int("extra-bits-v6", 8, "How many bits deeper than its winning prefix each IPv6 root may drill")
+	verify := fs.Bool("verify", true, "Probe the earlier winners again alongside their prefixes")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mcis refine -in results.jsonl [-budget N] [-prefixes N] [-- search flags...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *in == "" {
+		fs.Usage()
+		return nil, errors.New("refine: -in is required")
+	}
+	if *prefixes <= 0 || *extraV4 < 0 || *extraV6 < 0 {
+		return nil, errors.New("refine: -prefixes must be > 0 and -extra-bits-v4/-extra-bits-v6 >= 0")
+	}
+
+	rows, err := output.ReadJSONLFile(*in)
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []string
+	var kept []netip.Prefix
+	var winners []string
+	for _, r := range rows {
+		if !r.OK || !r.IP.IsValid() {
+			continue
+		}
+		if *verify {
+			winners = append(winners, refineRoot(netip.PrefixFrom(r.IP, r.IP.BitLen()), 0, r.Label))
+		}
+
+		p := r.Prefix.Masked()
+		if !p.IsValid() || len(kept) == *prefixes || refineCovered(p, kept) {
+			continue
+		}
+		kept = append(kept, p)
+		extra := *extraV6
+		if p.Addr().Is4() {
+			extra = *extraV4
+		}
+		roots = append(roots, refineRoot(p, min(p.Bits()+extra, p.Addr().BitLen()), r.Label))
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("refine: %s has no successful results to refine", *in)
+	}
+
+	out := []string{"--budget", strconv.Itoa(*budget)}
+	for _, root := range append(roots, winners...) {
+		out = append(out, "--cidr", root)
+	}
+	return append(out, fs.Args()...), nil
+}
+
+// refineRoot formats a root as a CIDR list line (see cidr.ParseLine).
+func refineRoot(p netip.Prefix, maxBits int, label string) string {
+	line := p.String()
+	if maxBits > 0 {
+		line += " maxbits=" + strconv.Itoa(maxBits)
+	}
+	if label != "" {
+		line += " label=" + label
+	}
+	return line
+}
+
+// refineCovered reports whether p lies within one of kept.
+func refineCovered(p netip.Prefix, kept []netip.Prefix) bool {
+	for _, k := range kept {
+		if k.Bits() <= p.Bits() && k.Contains(p.Addr()) {
+			return true
+		}
+	}
+	return false
+}
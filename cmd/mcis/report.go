@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/output"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/state"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/store"
+)
+
+// runReport implements `mcis report -state-dir dir -html report.html`: it
+// charts the latency and speed trends of the current best IPs and prefixes
+// over the runs saved in a state directory, or in the run history of a
+// SQLite state backend (-db).
+func runReport(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	dir := fs.String("state-dir", "", "State directory whose saved runs are compared (see --state-keep to keep more of them)")
+	db := fs.String("db", "", "SQLite --state-backend database whose run history is compared, instead of -state-dir")
+	htmlPath := fs.String("html", "report.html", "HTML report output path (- for stdout)")
+	series := fs.Int("series", 20, "Number of IPs (and at most as many prefixes) charted, from the last run's results")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mcis report (-state-dir dir | -db state.db) [-html report.html]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if (*dir == "") == (*db == "") || fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var runs []output.ReportRun
+	var err error
+	if *db != "" {
+		runs, err = loadReportDB(*db)
+	} else {
+		runs, err = loadReportRuns(*dir)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	w := os.Stdout
+	if *htmlPath != "-" {
+		if w, err = os.Create(*htmlPath); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+	}
+	err = output.WriteTrendReport(w, runs, *series)
+	if w != os.Stdout {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if w != os.Stdout {
+		fmt.Printf("%s: %d runs\n", *htmlPath, len(runs))
+	}
+	return 0
+}
+
+// loadReportRuns reads the results saved in the state directory at dir,
+// oldest first.
+func loadReportRuns(dir string) ([]output.ReportRun, error) {
+	files, err := state.ListResults(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New(dir + ": no saved results")
+	}
+	runs := make([]output.ReportRun, 0, len(files))
+	for _, f := range files {
+		data, err := os.ReadFile(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		var res engine.Response
+		if err := json.Unmarshal(data, &res); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Path, err)
+		}
+		runs = append(runs, output.ReportRun{When: f.When, Top: res.Top})
+	}
+	return runs, nil
+}
+
+// loadReportDB reads the run history of the SQLite state backend at path,
+// oldest first.
+func loadReportDB(path string) ([]output.ReportRun, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := store.OpenSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = db.Close() }()
+	history, err := db.Runs()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(history) == 0 {
+		return nil, errors.New(path + ": no saved runs")
+	}
+	runs := make([]output.ReportRun, 0, len(history))
+	for i, r := range history {
+		var res engine.Response
+		if err := json.Unmarshal(r.Data, &res); err != nil {
+			return nil, fmt.Errorf("%s: run %d: %w", path, i+1, err)
+		}
+		runs = append(runs, output.ReportRun{When: r.When, Top: res.Top})
+	}
+	return runs, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec is a standard five-field cron expression (minute hour
+// day-of-month month day-of-week) in local time. Each field is *, a
+// number, a range a-b, either with a /step, or a comma-separated list of
+// these; day-of-week 0 and 7 are Sunday. As in cron, when both day fields
+// are restricted a day matching either one matches.
+type cronSpec struct {
+	minute, hour, dom, month, dow [64]bool
+
+	domAny, dowAny bool
+}
+
+// cronAliases are the shorthands cron accepts for common schedules.
+var cronAliases = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+func parseCron(s string) (*cronSpec, error) {
+	if alias, ok := cronAliases[strings.TrimSpace(s)]; ok {
+		s = alias
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q: want 5 fields (minute hour day-of-month month day-of-week)", s)
+	}
+	c := &cronSpec{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	for i, f := range []struct {
+		set      *[64]bool
+		min, max int
+	}{
+		{&c.minute, 0, 59}, {&c.hour, 0, 23}, {&c.dom, 1, 31}, {&c.month, 1, 12}, {&c.dow, 0, 7},
+	} {
+		if err := parseCronField(fields[i], f.min, f.max, f.set); err != nil {
+			return nil, fmt.Errorf("%q: %w", s, err)
+		}
+	}
+	if c.dow[7] {
+		c.dow[0] = true
+	}
+	return c, nil
+}
+
+func parseCronField(f string, lo, hi int, set *[64]bool) error {
+	for _, part := range strings.Split(f, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid step %q", part)
+			}
+			step = n
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = strconv.Atoi(a); err != nil {
+				return fmt.Errorf("invalid value %q", part)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(b); err != nil {
+					return fmt.Errorf("invalid range %q", part)
+				}
+			} else if hasStep {
+				to = hi // "5/15" means from 5 on
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return fmt.Errorf("%q out of range %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// next returns the first matching minute after t, or the zero time if
+// none comes within five years (e.g. "0 0 31 2 *").
+func (c *cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case !c.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !c.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !c.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// quietHours is a daily window of local time, "HH:MM-HH:MM", in which no
+// run starts; it wraps past midnight when the end is before the start.
+type quietHours struct {
+	start, end time.Duration // since midnight
+}
+
+func parseQuietHours(s string) (*quietHours, error) {
+	a, b, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("%q: want HH:MM-HH:MM", s)
+	}
+	var q quietHours
+	for _, p := range []struct {
+		s   string
+		dst *time.Duration
+	}{{a, &q.start}, {b, &q.end}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(p.s))
+		if err != nil {
+			return nil, fmt.Errorf("%q: want HH:MM-HH:MM", s)
+		}
+		*p.dst = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if q.start == q.end {
+		return nil, fmt.Errorf("%q: empty window", s)
+	}
+	return &q, nil
+}
+
+// after returns t, or the end of the window if t falls inside it.
+func (q *quietHours) after(t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	since := t.Sub(midnight)
+	switch {
+	case q.start < q.end && since >= q.start && since < q.end:
+		return midnight.Add(q.end)
+	case q.start > q.end && since >= q.start:
+		return midnight.AddDate(0, 0, 1).Add(q.end)
+	case q.start > q.end && since < q.end:
+		return midnight.Add(q.end)
+	}
+	return t
+}
+
+// schedule decides when monitor mode starts its runs: at the times of a
+// cron expression, else --interval after the previous run ended, in
+// either case delayed by a random jitter and moved out of quiet hours.
+type schedule struct {
+	cron   *cronSpec
+	quiet  *quietHours
+	jitter time.Duration
+	rng    *rand.Rand
+}
+
+func newSchedule(cronExpr, quiet string, jitter time.Duration) (*schedule, error) {
+	s := &schedule{jitter: jitter, rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	var err error
+	if cronExpr != "" {
+		if s.cron, err = parseCron(cronExpr); err != nil {
+			return nil, fmt.Errorf("--schedule: %w", err)
+		}
+	}
+	if quiet != "" {
+		if s.quiet, err = parseQuietHours(quiet); err != nil {
+			return nil, fmt.Errorf("--no-scan-between: %w", err)
+		}
+	}
+	if jitter < 0 {
+		return nil, fmt.Errorf("--schedule-jitter must be >= 0")
+	}
+	return s, nil
+}
+
+// active reports whether the schedule changes when runs start.
+func (s *schedule) active() bool {
+	return s.cron != nil || s.quiet != nil || s.jitter > 0
+}
+
+// first returns when the first run starts, from now.
+func (s *schedule) first(now time.Time) time.Time {
+	t := now
+	if s.cron != nil {
+		t = s.cron.next(now)
+	}
+	return s.adjust(t)
+}
+
+// next returns when the run after one that ended at lastEnd starts.
+func (s *schedule) next(lastEnd time.Time, interval time.Duration) time.Time {
+	t := lastEnd.Add(interval)
+	if s.cron != nil {
+		t = s.cron.next(lastEnd)
+	}
+	return s.adjust(t)
+}
+
+func (s *schedule) adjust(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	if s.jitter > 0 {
+		t = t.Add(time.Duration(s.rng.Int63n(int64(s.jitter))))
+	}
+	if s.quiet != nil {
+		t = s.quiet.after(t)
+	}
+	return t
+}
+
+// sleepUntil waits until t, reporting false if ctx ends first.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
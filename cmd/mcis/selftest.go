@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/testserver"
+)
+
+// runSelftest implements `mcis selftest`: it runs engine.Selftest, a search
+// against a fake edge on localhost that must find the fast ranges hidden in
+// the slow ones, and prints its checks, so a build can be verified without
+// touching a real network. go test ./internal/engine runs the same checks.
+func runSelftest(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	def := engine.DefaultSelftestConfig()
+	budget := fs.Int("budget", def.Budget, "Probe budget of the search")
+	concurrency := fs.Int("concurrency", def.Concurrency, "Probe concurrency")
+	timeout := fs.Duration("timeout", def.Timeout, "Probe timeout")
+	seed := fs.Int64("seed", def.Seed, "Seed of the search and of the fake edge's losses and jitter (0 = time-based)")
+	verbose := fs.Bool("v", false, "Verbose search output")
+	faultSpec := fs.String("fault-inject", "", "Faults injected mid-run, comma-separated kind@start+duration[=latency][/prefix] with kind timeout | latency | ratelimit (e.g. \"timeout@3s+2s,latency@5s+2s=300ms,ratelimit@8s+1s\")")
+	faultLog := fs.String("fault-log", "", "Write the injected faults as JSON lines to this file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mcis selftest [-budget N] [-seed N] [-fault-inject spec] [-v]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	faults, err := testserver.ParseFaults(*faultSpec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: -fault-inject:", err)
+		return 2
+	}
+
+	sc := engine.SelftestConfig{
+		Budget:      *budget,
+		Concurrency: *concurrency,
+		Timeout:     *timeout,
+		Seed:        *seed,
+		Verbose:     *verbose,
+		Faults:      faults,
+	}
+	res, err := engine.Selftest(context.Background(), sc)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	fmt.Printf("search: %d probes in %s\n", res.Response.Stats.TotalProbes, res.Elapsed.Round(100*time.Millisecond))
+	if len(faults) > 0 {
+		fmt.Printf("faults: timeout=%d latency=%d ratelimit=%d\n", res.Injected(testserver.FaultTimeout),
+			res.Injected(testserver.FaultLatency), res.Injected(testserver.FaultRateLimit))
+	}
+	if *faultLog != "" {
+		if err := writeFaultLog(*faultLog, res.Events); err != nil {
+			fmt.Fprintln(os.Stderr, "error: -fault-log:", err)
+			return 1
+		}
+	}
+
+	for _, c := range res.Checks {
+		status := "PASS"
+		if !c.OK {
+			status = "FAIL"
+		}
+		fmt.Printf("%s  %s\n", status, c.Desc)
+	}
+	if failed := res.Failed(); failed > 0 {
+		fmt.Printf("selftest: %d check(s) failed\n", failed)
+		return 1
+	}
+	fmt.Println("selftest: ok")
+	return 0
+}
+
+// writeFaultLog writes events to path as JSON lines.
+func writeFaultLog(path string, events []testserver.Event) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statusSignals print a status snapshot (and write --dump-tree);
+// stackSignals dump the tree and all goroutine stacks. Catching SIGQUIT
+// keeps the Go runtime from exiting on it.
+var (
+	statusSignals = []os.Signal{syscall.SIGUSR1}
+	stackSignals  = []os.Signal{syscall.SIGQUIT}
+)
@@ -0,0 +1,12 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// Windows has no SIGUSR1/SIGQUIT, so runtime introspection is unavailable;
+// --dump-tree is still written at the end of each run.
+var (
+	statusSignals []os.Signal
+	stackSignals  []os.Signal
+)
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/netip"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+)
+
+// exitSummary is the single-line JSON summary --exit-summary writes to
+// stderr on exit, for wrapper scripts. Probe counts add up over all runs;
+// the results and best IP are those of the last run.
+type exitSummary struct {
+	start time.Time
+
+	OK          bool       `json:"ok"`
+	Error       string     `json:"error,omitempty"`
+	Runs        int        `json:"runs"`
+	Probes      int64      `json:"probes"`
+	ProbesV4    int64      `json:"probes_v4"`
+	ProbesV6    int64      `json:"probes_v6"`
+	Successes   int64      `json:"successes"`
+	Wasted      int64      `json:"wasted"`
+	DurationS   float64    `json:"duration_s"`
+	Results     int        `json:"results"`
+	BestIP      netip.Addr `json:"best_ip,omitzero"`
+	BestScoreMS float64    `json:"best_score_ms,omitempty"`
+	Output      string     `json:"output"`
+	Version     string     `json:"version"`
+}
+
+func newExitSummary(output string) *exitSummary {
+	if output == "" {
+		output = "stdout"
+	}
+	return &exitSummary{start: time.Now(), Output: output, Version: versionString()}
+}
+
+// addRun records the probes of a finished search.
+func (s *exitSummary) addRun(st engine.Status) {
+	s.Runs++
+	s.Probes += st.Completed
+	s.ProbesV4 += st.CompletedV4
+	s.ProbesV6 += st.CompletedV6
+	s.Successes += st.Succeeded
+	s.Wasted += st.Waste.Wasted()
+}
+
+// setResults records the final results of a run.
+func (s *exitSummary) setResults(rows []engine.TopResult) {
+	s.Results = len(rows)
+	s.BestIP, s.BestScoreMS = netip.Addr{}, 0
+	for _, r := range rows {
+		if r.OK {
+			s.BestIP, s.BestScoreMS = r.IP, r.ScoreMS
+			break
+		}
+	}
+}
+
+// write writes the summary as one JSON line; err is the error the program
+// exits with, if any.
+func (s *exitSummary) write(w io.Writer, err error) {
+	s.OK = err == nil
+	if err != nil {
+		s.Error = err.Error()
+	}
+	s.DurationS = time.Since(s.start).Seconds()
+	_ = json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/sign"
+)
+
+// runVerify implements `mcis verify -key pub.pem file...`: it checks each
+// file against its detached .sig and exits non-zero if any fails.
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	keyPath := fs.String("key", "", "ed25519 public key (PEM) to verify with")
+	sigPath := fs.String("sig", "", "Signature file (default: <file>.sig; only with a single file)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mcis verify -key pub.pem [-sig file.sig] file...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *keyPath == "" || fs.NArg() == 0 || (*sigPath != "" && fs.NArg() > 1) {
+		fs.Usage()
+		return 2
+	}
+
+	pub, err := sign.LoadPublicKey(*keyPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	status := 0
+	for _, path := range fs.Args() {
+		err := sign.VerifyFile(pub, path, *sigPath)
+		switch {
+		case err == nil:
+			fmt.Printf("%s: OK\n", path)
+		case errors.Is(err, sign.ErrBadSignature):
+			fmt.Printf("%s: BAD SIGNATURE\n", path)
+			status = 1
+		default:
+			fmt.Fprintf(os.Stderr, "%s: error: %v\n", path, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// runKeygen implements `mcis keygen -out name`, writing name (private key)
+// and name.pub (public key).
+func runKeygen(args []string) int {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	out := fs.String("out", "mcis-sign.pem", "Private key output path; the public key is written to <out>.pub")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := sign.GenerateKey(*out, *out+".pub"); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	fmt.Printf("private key: %s\npublic key:  %s.pub\n", *out, *out)
+	return 0
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/sign"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/update"
+)
+
+// Build information, set at link time:
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse --short HEAD)" ./cmd/mcis
+//
+// Without them the commit is taken from the VCS stamp Go embeds.
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// buildVersion returns the version and commit of this binary.
+func buildVersion() (string, string) {
+	v, c := version, commit
+	if info, ok := debug.ReadBuildInfo(); ok {
+		// `go install ...@vX.Y.Z` stamps the tag; local builds stamp a
+		// pseudo-version ("v0.0.0-<date>-<rev>") and stay "dev".
+		if mv := info.Main.Version; v == "dev" && update.IsRelease(mv) && !strings.ContainsAny(mv, "-+") {
+			v = mv
+		}
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && c == "" {
+				c = s.Value
+			}
+		}
+	}
+	// Release builds inject the full hash; show both the same way.
+	if len(c) > 12 {
+		c = c[:12]
+	}
+	return v, c
+}
+
+// versionString is the one-line version shown by `mcis version` and
+// recorded in results.
+func versionString() string {
+	v, c := buildVersion()
+	if c != "" {
+		v += " (" + c + ")"
+	}
+	return v
+}
+
+// updateTimeout bounds the release queries and downloads of version
+// checks and self-updates.
+const updateTimeout = 2 * time.Minute
+
+// runVersion implements `mcis version [-check]`.
+func runVersion(args []string) int {
+	fs := flag.NewFlagSet("version", flag.ContinueOnError)
+	check := fs.Bool("check", false, "Check GitHub releases for a newer version")
+	repo := fs.String("repo", update.DefaultRepo, "GitHub repository to check")
+	offline := fs.Bool("offline", false, "Never connect out (with -check, fail instead)")
+	configPath := fs.String("config", "", "Take --offline from this mcis config file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := applyOfflineConfig(fs, *configPath); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 2
+	}
+
+	fmt.Printf("mcis %s %s/%s %s\n", versionString(), runtime.GOOS, runtime.GOARCH, runtime.Version())
+	if !*check {
+		return 0
+	}
+	if *offline {
+		fmt.Fprintln(os.Stderr, "error: -check needs network access (-offline)")
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+	defer cancel()
+	rel, err := update.Latest(ctx, http.DefaultClient, *repo)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	cur, _ := buildVersion()
+	if update.Newer(rel.Tag, cur) {
+		fmt.Printf("a newer version is available: %s (%s)\nrun `mcis self-update` to install it\n", rel.Tag, rel.URL)
+		return 0
+	}
+	fmt.Printf("up to date (latest release: %s)\n", rel.Tag)
+	return 0
+}
+
+// applyOfflineConfig sets the -offline flag of fs from the config file of a
+// search, so a config with "offline = true" also keeps version checks and
+// self-updates from connecting out. As for a search, the command line wins.
+func applyOfflineConfig(fs *flag.FlagSet, path string) error {
+	if path == "" {
+		return nil
+	}
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	cmdline := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { cmdline[f.Name] = true })
+	if _, err := applyConfig(fs, settings, cmdline, map[string]bool{"offline": true}, nil); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	return nil
+}
+
+// runSelfUpdate implements `mcis self-update`, replacing the running
+// binary with the build of the latest release for this platform.
+func runSelfUpdate(args []string) int {
+	fs := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	repo := fs.String("repo", update.DefaultRepo, "GitHub repository to update from")
+	force := fs.Bool("force", false, "Install the latest release even if it is not newer (e.g. over a development build)")
+	offline := fs.Bool("offline", false, "Never connect out (fail instead)")
+	keyPath := fs.String("key", "", "ed25519 public key (PEM) the release archive must be signed with")
+	configPath := fs.String("config", "", "Take --offline from this mcis config file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := applyOfflineConfig(fs, *configPath); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 2
+	}
+	if *offline {
+		fmt.Fprintln(os.Stderr, "error: self-update needs network access (-offline)")
+		return 1
+	}
+	var pub ed25519.PublicKey
+	if *keyPath != "" {
+		k, err := sign.LoadPublicKey(*keyPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: -key:", err)
+			return 1
+		}
+		pub = k
+	}
+	if err := selfUpdate(*repo, *force, pub); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+// selfUpdate installs the latest release of repo. The archive must match
+// its SHA-256 checksum and, if pub is set, carry a signature by pub.
+func selfUpdate(repo string, force bool, pub ed25519.PublicKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+	defer cancel()
+
+	rel, err := update.Latest(ctx, http.DefaultClient, repo)
+	if err != nil {
+		return err
+	}
+	cur, _ := buildVersion()
+	if !force && !update.Newer(rel.Tag, cur) {
+		if !update.IsRelease(cur) {
+			return fmt.Errorf("this is a development build (%s); use -force to replace it with %s", cur, rel.Tag)
+		}
+		fmt.Printf("already up to date (%s)\n", cur)
+		return nil
+	}
+
+	archive, sum, sig, err := rel.Archive(runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		return err
+	}
+	data, err := update.Download(ctx, http.DefaultClient, archive, sum, sig, pub)
+	if err != nil {
+		return err
+	}
+	name := "mcis"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	bin, err := update.Extract(data, runtime.GOOS == "windows", name)
+	if err != nil {
+		return fmt.Errorf("%s: %w", archive.Name, err)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// Replace the installed binary, not a symlink to it (e.g. in
+	// /usr/local/bin).
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	if err := update.Replace(exe, bin); err != nil {
+		return fmt.Errorf("replace %s: %w", exe, err)
+	}
+	fmt.Printf("updated %s: %s -> %s\n", exe, cur, rel.Tag)
+	return nil
+}
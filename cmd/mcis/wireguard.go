@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/probe"
+)
+
+// defaultWGPorts are the UDP ports Cloudflare WARP endpoints answer on.
+const defaultWGPorts = "500,854,859,864,878,880,890,891,894,903,908,928,934,939,942,943,945,946,955,968,987,988,1002,1010,1014,1018,1070,1074,1180,1387,1701,1843,2371,2408,2506,3138,3476,3581,3854,4177,4198,4233,4500,5279,5956,7103,7152,7156,7281,7559,8319,8742,8854,8886"
+
+// readWireGuard builds the --wg-handshake probe configuration from a
+// wg-quick file and the --wg-reserved bytes.
+func readWireGuard(path, reserved string) (*probe.WireGuardConfig, error) {
+	wc := &probe.WireGuardConfig{}
+	if err := readWireGuardKeys(path, wc); err != nil {
+		return nil, err
+	}
+	if reserved == "" {
+		return wc, nil
+	}
+	parts := strings.Split(reserved, ",")
+	if len(parts) != len(wc.Reserved) {
+		return nil, fmt.Errorf("--wg-reserved wants %d numbers, got %d", len(wc.Reserved), len(parts))
+	}
+	for i, f := range parts {
+		b, err := strconv.ParseUint(strings.TrimSpace(f), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("--wg-reserved: invalid byte %q", f)
+		}
+		wc.Reserved[i] = byte(b)
+	}
+	return wc, nil
+}
+
+// readWireGuardKeys reads the interface's PrivateKey and the peer's
+// PublicKey from a wg-quick style file with a single [Peer] section. The
+// other keys (Address, Endpoint, PostUp, ...) are ignored.
+func readWireGuardKeys(path string, wc *probe.WireGuardConfig) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	var havePrivate, havePublic bool
+	section, peers := "", 0
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if section == "peer" {
+				peers++
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		switch section + "." + strings.ToLower(strings.TrimSpace(key)) {
+		case "interface.privatekey":
+			err = parseWireGuardKey(&wc.PrivateKey, value)
+			havePrivate = true
+		case "peer.publickey":
+			err = parseWireGuardKey(&wc.PeerPublicKey, value)
+			havePublic = true
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", path, n, strings.TrimSpace(key), err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	switch {
+	case peers != 1:
+		return fmt.Errorf("%s: want exactly one [Peer] section, found %d", path, peers)
+	case !havePrivate:
+		return fmt.Errorf("%s: missing PrivateKey", path)
+	case !havePublic:
+		return fmt.Errorf("%s: missing PublicKey", path)
+	}
+	return nil
+}
+
+// parseWireGuardKey decodes a base64 WireGuard key into dst.
+func parseWireGuardKey(dst *[32]byte, s string) error {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != len(dst) {
+		return errors.New("not a base64 32-byte key")
+	}
+	copy(dst[:], b)
+	return nil
+}
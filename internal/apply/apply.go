@@ -0,0 +1,208 @@
+// Package apply writes the winning IPs of a search into the local system's
+// configuration: a block of the hosts file, a dnsmasq config file or
+// nftables sets. Every change is atomic and keeps a backup of what it
+// replaced, so a failed reload is rolled back and an applied change can be
+// undone later.
+package apply
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/atomicfile"
+)
+
+// Targets.
+const (
+	TargetHosts    = "hosts"
+	TargetNFTables = "nftables"
+	TargetDnsmasq  = "dnsmasq"
+)
+
+// Default paths of the file targets.
+const (
+	DefaultHostsPath   = "/etc/hosts"
+	DefaultDnsmasqPath = "/etc/dnsmasq.d/mcis.conf"
+)
+
+// Config selects the integration a change is applied to.
+type Config struct {
+	Target string
+
+	// Names are the host names pointed at the IPs (hosts, dnsmasq).
+	Names []string
+
+	// Path is the file written (hosts, dnsmasq; empty = the default).
+	Path string
+
+	// Set and Set6 are the nftables sets ("family table name") that
+	// receive the IPv4 and IPv6 addresses; at least one is required.
+	Set  string
+	Set6 string
+
+	// Backup is where the replaced configuration is kept (empty =
+	// Path + ".mcis.bak", or "mcis-nftables.bak" for nftables).
+	Backup string
+
+	// Reload, if set, is run after the change (e.g. "systemctl reload
+	// dnsmasq"); if it fails the change is rolled back.
+	Reload []string
+}
+
+// Validate checks c and fills in the default paths.
+func (c *Config) Validate() error {
+	switch c.Target {
+	case TargetHosts, TargetDnsmasq:
+		if len(c.Names) == 0 {
+			return fmt.Errorf("%s: no host names to point at the IPs", c.Target)
+		}
+		for _, n := range c.Names {
+			if strings.ContainsAny(n, " \t\n,/#") {
+				return fmt.Errorf("invalid host name %q", n)
+			}
+		}
+		if c.Path == "" {
+			c.Path = DefaultHostsPath
+			if c.Target == TargetDnsmasq {
+				c.Path = DefaultDnsmasqPath
+			}
+		}
+		if c.Backup == "" {
+			c.Backup = c.Path + ".mcis.bak"
+		}
+	case TargetNFTables:
+		if c.Set == "" && c.Set6 == "" {
+			return fmt.Errorf("nftables: no set given")
+		}
+		for _, s := range []string{c.Set, c.Set6} {
+			if s != "" && len(strings.Fields(s)) != 3 {
+				return fmt.Errorf("nftables set %q: want \"family table name\"", s)
+			}
+		}
+		if c.Backup == "" {
+			c.Backup = "mcis-nftables.bak"
+		}
+	default:
+		return fmt.Errorf("unknown target %q (want %s, %s or %s)", c.Target, TargetHosts, TargetNFTables, TargetDnsmasq)
+	}
+	return nil
+}
+
+// Plan returns the configuration Apply would write for ips, best first,
+// without changing anything.
+func Plan(c Config, ips []netip.Addr) (string, error) {
+	if err := c.Validate(); err != nil {
+		return "", err
+	}
+	switch c.Target {
+	case TargetNFTables:
+		return nftScript(c, ips), nil
+	case TargetDnsmasq:
+		return dnsmasqConfig(c.Names, ips), nil
+	default:
+		old, err := os.ReadFile(c.Path)
+		if err != nil {
+			return "", err
+		}
+		return hostsFile(string(old), c.Names, ips), nil
+	}
+}
+
+// Apply points the configuration at ips, best first, after backing up
+// what it replaces. If the reload command fails, the backup is restored
+// and the error returned.
+func Apply(ctx context.Context, c Config, ips []netip.Addr) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("no IPs to apply")
+	}
+	var err error
+	switch c.Target {
+	case TargetNFTables:
+		err = applyNFT(ctx, c, ips)
+	case TargetDnsmasq:
+		err = applyFile(c, func([]byte) []byte { return []byte(dnsmasqConfig(c.Names, ips)) })
+	default:
+		err = applyFile(c, func(old []byte) []byte { return []byte(hostsFile(string(old), c.Names, ips)) })
+	}
+	if err != nil {
+		return err
+	}
+	if rerr := reload(ctx, c); rerr != nil {
+		if err := restore(ctx, c); err != nil {
+			return fmt.Errorf("%w; rollback failed: %v", rerr, err)
+		}
+		return fmt.Errorf("%w (rolled back)", rerr)
+	}
+	return nil
+}
+
+// Rollback restores the configuration saved by the last Apply and runs the
+// reload command.
+func Rollback(ctx context.Context, c Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if err := restore(ctx, c); err != nil {
+		return err
+	}
+	return reload(ctx, c)
+}
+
+func restore(ctx context.Context, c Config) error {
+	if c.Target == TargetNFTables {
+		return nft(ctx, c.Backup)
+	}
+	data, err := os.ReadFile(c.Backup)
+	if os.IsNotExist(err) && c.Target == TargetDnsmasq {
+		// The file did not exist before the first apply.
+		if err := os.Remove(c.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	return atomicfile.WriteFile(c.Path, data, 0o644)
+}
+
+func reload(ctx context.Context, c Config) error {
+	if len(c.Reload) == 0 {
+		return nil
+	}
+	out, err := exec.CommandContext(ctx, c.Reload[0], c.Reload[1:]...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		err = fmt.Errorf("%v: %s", err, msg)
+	}
+	return fmt.Errorf("reload %q: %w", strings.Join(c.Reload, " "), err)
+}
+
+// applyFile backs up c.Path, if it exists, and replaces it with the
+// result of edit.
+func applyFile(c Config, edit func(old []byte) []byte) error {
+	old, err := os.ReadFile(c.Path)
+	switch {
+	case err == nil:
+		if err := atomicfile.WriteFile(c.Backup, old, 0o644); err != nil {
+			return fmt.Errorf("backup: %w", err)
+		}
+	case os.IsNotExist(err) && c.Target == TargetDnsmasq:
+		// A fresh file: rolling back removes it.
+		if err := os.Remove(c.Backup); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("backup: %w", err)
+		}
+	default:
+		return err
+	}
+	return atomicfile.WriteFile(c.Path, edit(old), 0o644)
+}
@@ -0,0 +1,57 @@
+package apply
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// Markers of the block of the hosts file owned by mcis; the rest of the
+// file is left as it is.
+const (
+	hostsBegin = "# BEGIN mcis (managed by mcis apply; changes inside are overwritten)"
+	hostsEnd   = "# END mcis"
+)
+
+// hostsFile returns old with its mcis block replaced by one pointing names
+// at the best IPv4 and the best IPv6 address of ips (a hosts file resolves
+// a name to its first entry per family only).
+func hostsFile(old string, names []string, ips []netip.Addr) string {
+	var b strings.Builder
+	skipping := false
+	for _, line := range strings.SplitAfter(old, "\n") {
+		switch {
+		case strings.HasPrefix(line, "# BEGIN mcis"):
+			skipping = true
+		case skipping && strings.HasPrefix(line, hostsEnd):
+			skipping = false
+		case !skipping:
+			b.WriteString(line)
+		}
+	}
+	if s := b.String(); s != "" && !strings.HasSuffix(s, "\n") {
+		b.WriteString("\n")
+	}
+
+	b.WriteString(hostsBegin + "\n")
+	var seen4, seen6 bool
+	for _, ip := range ips {
+		if ip.Is4() && seen4 || ip.Is6() && seen6 {
+			continue
+		}
+		seen4, seen6 = seen4 || ip.Is4(), seen6 || ip.Is6()
+		b.WriteString(ip.String() + "\t" + strings.Join(names, " ") + "\n")
+	}
+	b.WriteString(hostsEnd + "\n")
+	return b.String()
+}
+
+// dnsmasqConfig returns a dnsmasq config file answering for names with all
+// of ips.
+func dnsmasqConfig(names []string, ips []netip.Addr) string {
+	var b strings.Builder
+	b.WriteString("# Managed by mcis apply; overwritten on every apply.\n")
+	for _, ip := range ips {
+		b.WriteString("host-record=" + strings.Join(names, ",") + "," + ip.String() + "\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,154 @@
+package apply
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/atomicfile"
+)
+
+// applyNFT saves the current elements of the sets to c.Backup as an nft
+// script restoring them, then replaces them with ips in one nft
+// transaction.
+func applyNFT(ctx context.Context, c Config, ips []netip.Addr) error {
+	var backup strings.Builder
+	for _, set := range []string{c.Set, c.Set6} {
+		if set == "" {
+			continue
+		}
+		elems, err := nftElements(ctx, set)
+		if err != nil {
+			return err
+		}
+		backup.WriteString(nftReplace(set, elems))
+	}
+	if err := atomicfile.WriteFile(c.Backup, []byte(backup.String()), 0o644); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	return nftRun(ctx, nftScript(c, ips))
+}
+
+// nftScript returns the nft script pointing the sets of c at ips.
+func nftScript(c Config, ips []netip.Addr) string {
+	var v4, v6 []string
+	for _, ip := range ips {
+		if ip.Is4() {
+			v4 = append(v4, ip.String())
+		} else {
+			v6 = append(v6, ip.String())
+		}
+	}
+	var b strings.Builder
+	if c.Set != "" {
+		b.WriteString(nftReplace(c.Set, v4))
+	}
+	if c.Set6 != "" {
+		b.WriteString(nftReplace(c.Set6, v6))
+	}
+	return b.String()
+}
+
+// nftReplace returns the nft commands setting the elements of set.
+func nftReplace(set string, elems []string) string {
+	s := "flush set " + set + "\n"
+	if len(elems) > 0 {
+		s += "add element " + set + " { " + strings.Join(elems, ", ") + " }\n"
+	}
+	return s
+}
+
+// nftElements returns the elements of set, which must hold plain addresses
+// or prefixes.
+func nftElements(ctx context.Context, set string) ([]string, error) {
+	args := append([]string{"-j", "list", "set"}, strings.Fields(set)...)
+	out, err := nftCommand(ctx, args...).Output()
+	if err != nil {
+		return nil, nftError(set, err)
+	}
+	var doc struct {
+		Nftables []struct {
+			Set *struct {
+				Elem []json.RawMessage `json:"elem"`
+			} `json:"set"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(out, &doc); err != nil {
+		return nil, fmt.Errorf("nft list set %s: %w", set, err)
+	}
+	var elems []string
+	for _, item := range doc.Nftables {
+		if item.Set == nil {
+			continue
+		}
+		for _, raw := range item.Set.Elem {
+			e, err := nftElement(raw)
+			if err != nil {
+				return nil, fmt.Errorf("nft set %s: %w", set, err)
+			}
+			elems = append(elems, e)
+		}
+	}
+	return elems, nil
+}
+
+// nftElement decodes a set element of nft's JSON output: an address, a
+// prefix, or either wrapped with options such as a timeout (dropped).
+func nftElement(raw json.RawMessage) (string, error) {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s, nil
+	}
+	var obj struct {
+		Prefix *struct {
+			Addr string `json:"addr"`
+			Len  int    `json:"len"`
+		} `json:"prefix"`
+		Elem *struct {
+			Val json.RawMessage `json:"val"`
+		} `json:"elem"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return "", err
+	}
+	switch {
+	case obj.Prefix != nil:
+		return fmt.Sprintf("%s/%d", obj.Prefix.Addr, obj.Prefix.Len), nil
+	case obj.Elem != nil:
+		return nftElement(obj.Elem.Val)
+	}
+	return "", fmt.Errorf("unsupported element %s", raw)
+}
+
+// nft runs the nft script file at path.
+func nft(ctx context.Context, path string) error {
+	if out, err := nftCommand(ctx, "-f", path).CombinedOutput(); err != nil {
+		return fmt.Errorf("nft -f %s: %v: %s", path, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// nftRun runs script as one nft transaction.
+func nftRun(ctx context.Context, script string) error {
+	cmd := nftCommand(ctx, "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func nftCommand(ctx context.Context, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, "nft", args...)
+}
+
+func nftError(set string, err error) error {
+	if ee, ok := err.(*exec.ExitError); ok && len(bytes.TrimSpace(ee.Stderr)) > 0 {
+		return fmt.Errorf("nft list set %s: %s", set, bytes.TrimSpace(ee.Stderr))
+	}
+	return fmt.Errorf("nft list set %s: %w", set, err)
+}
@@ -0,0 +1,93 @@
+// Package atomicfile replaces files so readers see either the old or the
+// new content, never half of it.
+package atomicfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// rename is os.Rename, replaced in tests.
+var rename = os.Rename
+
+// WriteFile writes data to a temporary file next to path, syncs it and
+// renames it into place. A file being replaced keeps its mode; a new one
+// gets perm.
+//
+// A path that is a mount point of its own (Docker bind-mounts /etc/hosts
+// into containers) cannot be renamed over and fails with EBUSY; it is then
+// overwritten in place instead, which is not atomic.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if err := fill(tmp, data, perm); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	err = rename(tmp.Name(), path)
+	if errors.Is(err, syscall.EBUSY) {
+		_ = os.Remove(tmp.Name())
+		return writeInPlace(path, data)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// fill sets the mode of the temporary file f, writes data to it, syncs and
+// closes it.
+func fill(f *os.File, data []byte, perm os.FileMode) error {
+	// CreateTemp uses 0600, but results are meant to be read by other
+	// services.
+	if err := f.Chmod(perm); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeInPlace truncates the existing file at path and writes data to it.
+func writeInPlace(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes the directory entry of a rename to disk. It is best
+// effort: directories cannot be synced on every platform (Windows).
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
@@ -0,0 +1,70 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hosts")
+	if err := WriteFile(path, []byte("one\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(path, []byte("two\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "two\n" {
+		t.Fatalf("content = %q, %v; want \"two\\n\"", data, err)
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if runtime.GOOS != "windows" && fi.Mode().Perm() != 0o600 {
+		t.Errorf("mode = %v, want the replaced file's 0600", fi.Mode().Perm())
+	}
+	assertOnly(t, dir, "hosts")
+}
+
+func TestWriteFileBusy(t *testing.T) {
+	// A bind-mounted file refuses the rename, so it is written in place.
+	rename = func(_, _ string) error {
+		return &os.LinkError{Op: "rename", Err: syscall.EBUSY}
+	}
+	defer func() { rename = os.Rename }()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(path, []byte("a much longer old content\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(path, []byte("new\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "new\n" {
+		t.Fatalf("content = %q, %v; want \"new\\n\"", data, err)
+	}
+	assertOnly(t, dir, "hosts")
+}
+
+// assertOnly fails unless dir holds just the named file, i.e. no temporary
+// file was left behind.
+func assertOnly(t *testing.T, dir, name string) {
+	t.Helper()
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 1 || ents[0].Name() != name {
+		var names []string
+		for _, e := range ents {
+			names = append(names, e.Name())
+		}
+		t.Errorf("directory holds %v, want only %s", names, name)
+	}
+}
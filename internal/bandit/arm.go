@@ -6,6 +6,7 @@ import (
 	"math"
 	"net/netip"
 	"sync"
+	"time"
 )
 
 // ArmNode represents a single arm in the hierarchical bandit tree.
@@ -39,14 +40,71 @@ type ArmNode struct {
 	SumLatency float64
 	SumSqDiff  float64 // Sum of squared differences from mean (for Welford)
 
-	// Split state
-	IsSplit bool
+	// Histogram counts successful probes by latency (see
+	// LatencyBucketBounds).
+	Histogram [LatencyBuckets]int
+
+	// Normal-Gamma parameters and raw statistics for throughput in Mbps,
+	// analogous to the latency ones. They only change when throughput is
+	// measured (see UpdateThroughput).
+	MuMbps        float64
+	LambdaMbps    float64
+	AlphaMbps     float64
+	BetaMbps      float64
+	MbpsSamples   int
+	SumMbps       float64
+	SumSqDiffMbps float64
+
+	// Split state: SplitAt and SplitSamples record when the arm was split
+	// and how many samples it had at that point.
+	IsSplit      bool
+	SplitAt      time.Time
+	SplitSamples int
+
+	// Merge state: Merges counts how often the arm's children were folded
+	// back into it as indistinguishable (see ArmTree.MergeUniform); each
+	// merge doubles the step of its next split. MergedAt and MergedSamples
+	// record the last merge.
+	Merges        int
+	MergedAt      time.Time
+	MergedSamples int
+
+	// Circuit breaker state: consecutive hard failures (connection
+	// refused/reset) and the time until which sampling is suspended.
+	FailStreak     int
+	SuspendedUntil time.Time
+
+	// Frozen arms are no longer sampled because their outcome has been
+	// decided (e.g. their rank is known with enough confidence).
+	Frozen bool
+
+	// Weight biases selection towards (>1) or away from (<1) this arm;
+	// children inherit it from their parent.
+	Weight float64
+
+	// Label tags the arm with its source (e.g. the input list it came
+	// from); children inherit it from their parent.
+	Label string
+
+	// MaxBits overrides the tree's maximum depth for this arm (0 = unset);
+	// children inherit it from their parent.
+	MaxBits int
 
 	mu sync.RWMutex
 }
 
 // NewArmNode creates a new arm node with uninformative priors.
 func NewArmNode(prefix netip.Prefix, parent *ArmNode) *ArmNode {
+	weight := 1.0
+	label := ""
+	maxBits := 0
+	if parent != nil {
+		if parent.Weight > 0 {
+			weight = parent.Weight
+		}
+		label = parent.Label
+		maxBits = parent.MaxBits
+	}
 	return &ArmNode{
 		Prefix:   prefix.Masked(),
 		Parent:   parent,
@@ -63,13 +121,24 @@ func NewArmNode(prefix netip.Prefix, parent *ArmNode) *ArmNode {
 		Lambda:  0.001,
 		AlphaNG: 1.0,
 		BetaNG:  1.0,
+
+		// Same weak prior for throughput
+		LambdaMbps: 0.001,
+		AlphaMbps:  1.0,
+		BetaMbps:   1.0,
+
+		Weight:  weight,
+		Label:   label,
+		MaxBits: maxBits,
 	}
 }
 
 // Update updates the arm statistics with a new probe result.
 // latencyMS is the observed latency in milliseconds (ignored if success=false).
-// timeoutMS is the timeout value used for failed probes.
-func (a *ArmNode) Update(success bool, latencyMS float64, timeoutMS float64) {
+// timeoutMS is the timeout value used for failed probes, and penalty the
+// weight (0-1) with which a failure pulls the latency estimate towards
+// twice the timeout; 0 leaves the latency posterior alone.
+func (a *ArmNode) Update(success bool, latencyMS, timeoutMS, penalty float64) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
@@ -78,6 +147,7 @@ func (a *ArmNode) Update(success bool, latencyMS float64, timeoutMS float64) {
 	if success {
 		a.Successes++
 		a.Alpha++
+		a.Histogram[latencyBucket(latencyMS)]++
 
 		// Update Normal-Gamma posterior using Bayesian update
 		// See: https://www.cs.ubc.ca/~murphyk/Papers/bayesGauss.pdf
@@ -108,14 +178,56 @@ func (a *ArmNode) Update(success bool, latencyMS float64, timeoutMS float64) {
 
 		// For failed probes, we use the timeout as a pessimistic latency estimate
 		// but with lower weight to avoid dominating the posterior
-		penaltyLatency := timeoutMS * 2
-		oldMu := a.Mu
-		oldLambda := a.Lambda
+		if penalty > 0 {
+			penaltyLatency := timeoutMS * 2
+			oldMu := a.Mu
+			oldLambda := a.Lambda
+			a.Lambda = oldLambda + penalty
+			a.Mu = (oldLambda*oldMu + penalty*penaltyLatency) / a.Lambda
+		}
+	}
+}
+
+// UpdateCensored records a probe that timed out as a failure and as a
+// censored latency: all that is known is that it exceeded timeoutMS. Under
+// an exponential tail the latency expected beyond the timeout is the
+// timeout plus the arm's mean latency (the timeout again before any
+// success), and the latency estimate is pulled towards it with weight.
+func (a *ArmNode) UpdateCensored(timeoutMS, weight float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-		// Weaker update for failures (0.5 weight)
-		weight := 0.5
-		a.Lambda = oldLambda + weight
-		a.Mu = (oldLambda*oldMu + weight*penaltyLatency) / a.Lambda
+	a.Samples++
+	a.Failures++
+	a.Beta++
+
+	if weight <= 0 {
+		return
+	}
+	tail := timeoutMS
+	if a.Successes > 0 {
+		tail = min(a.SumLatency/float64(a.Successes), timeoutMS)
+	}
+	oldLambda := a.Lambda
+	a.Lambda = oldLambda + weight
+	a.Mu = (oldLambda*a.Mu + weight*(timeoutMS+tail)) / a.Lambda
+}
+
+// SetPrior replaces the arm's uninformative priors with pseudo-observations
+// from earlier searches: successes and failures for the success rate, and
+// their mean and variance for the latency. The raw statistics stay those of
+// real probes. It must be called before the first Update.
+func (a *ArmNode) SetPrior(successes, failures, meanMS, varMS float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.Alpha = 1 + successes
+	a.Beta = 1 + failures
+	if successes > 0 && meanMS > 0 {
+		a.Mu = meanMS
+		a.Lambda = 0.001 + successes
+		a.AlphaNG = 1 + successes/2
+		a.BetaNG = 1 + successes/2*varMS
 	}
 }
 
@@ -129,6 +241,11 @@ func (a *ArmNode) Stats() ArmStats {
 		variance = a.SumSqDiff / float64(a.Successes-1)
 	}
 
+	var varMbps float64
+	if a.MbpsSamples > 1 {
+		varMbps = a.SumSqDiffMbps / float64(a.MbpsSamples-1)
+	}
+
 	successRate := a.Alpha / (a.Alpha + a.Beta)
 
 	return ArmStats{
@@ -140,6 +257,9 @@ func (a *ArmNode) Stats() ArmStats {
 		VarLatency:  variance,
 		SuccessRate: successRate,
 		IsSplit:     a.IsSplit,
+		MbpsSamples: a.MbpsSamples,
+		MeanMbps:    a.MuMbps,
+		VarMbps:     varMbps,
 	}
 }
 
@@ -150,11 +270,62 @@ func (a *ArmNode) GetPosteriorParams() (alpha, beta, mu, lambda, alphaNG, betaNG
 	return a.Alpha, a.Beta, a.Mu, a.Lambda, a.AlphaNG, a.BetaNG
 }
 
+// RecordOutcome updates the hard-failure streak and trips the circuit breaker
+// once the streak reaches threshold. A node whose cool-down has expired is
+// half-open: the next hard failure suspends it again immediately, while any
+// other outcome closes the breaker. Returns true if the breaker tripped.
+func (a *ArmNode) RecordOutcome(hardFail bool, threshold int, cooldown time.Duration, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !hardFail {
+		a.FailStreak = 0
+		return false
+	}
+
+	a.FailStreak++
+	if threshold <= 0 || a.FailStreak < threshold {
+		return false
+	}
+	a.SuspendedUntil = now.Add(cooldown)
+	return true
+}
+
+// Suspended returns true if the circuit breaker is open at the given time.
+func (a *ArmNode) Suspended(now time.Time) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return now.Before(a.SuspendedUntil)
+}
+
+// Freeze stops this arm from being sampled.
+func (a *ArmNode) Freeze() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Frozen = true
+}
+
+// IsFrozen returns true if this arm has been frozen.
+func (a *ArmNode) IsFrozen() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.Frozen
+}
+
+// MergeCount returns how often the arm's children were merged back into it.
+func (a *ArmNode) MergeCount() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.Merges
+}
+
 // MarkSplit marks this arm as having been split into children.
 func (a *ArmNode) MarkSplit() {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 	a.IsSplit = true
+	a.SplitAt = time.Now()
+	a.SplitSamples = a.Samples
 }
 
 // AddChild adds a child node to this arm.
@@ -164,6 +335,18 @@ func (a *ArmNode) AddChild(child *ArmNode) {
 	a.Children = append(a.Children, child)
 }
 
+// removeChild detaches a child node from this arm.
+func (a *ArmNode) removeChild(child *ArmNode) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, c := range a.Children {
+		if c == child {
+			a.Children = append(a.Children[:i], a.Children[i+1:]...)
+			return
+		}
+	}
+}
+
 // CanSplit returns true if this arm can be split (has enough samples and isn't already split).
 func (a *ArmNode) CanSplit(minSamples int, maxBitsV4, maxBitsV6 int) bool {
 	a.mu.RLock()
@@ -172,7 +355,8 @@ func (a *ArmNode) CanSplit(minSamples int, maxBitsV4, maxBitsV6 int) bool {
 	if a.IsSplit {
 		return false
 	}
-	if a.Samples < minSamples {
+	// A merged arm needs fresh samples of its own before it is split again.
+	if a.Samples < a.MergedSamples+minSamples {
 		return false
 	}
 
@@ -217,6 +401,11 @@ type ArmStats struct {
 	VarLatency  float64
 	SuccessRate float64
 	IsSplit     bool
+
+	// Throughput samples and their mean and variance in Mbps.
+	MbpsSamples int
+	MeanMbps    float64
+	VarMbps     float64
 }
 
 // Score returns a deterministic score for this arm (lower is better).
@@ -226,7 +415,13 @@ func (s ArmStats) Score(timeoutMS float64) float64 {
 		return timeoutMS * 2
 	}
 
+	// Without a success there is no latency to go by: assume the worst
+	latency := s.MeanLatency
+	if s.Successes == 0 {
+		latency = timeoutMS * 2
+	}
+
 	// Combine latency and failure rate
 	failPenalty := (1 - s.SuccessRate) * timeoutMS
-	return s.MeanLatency + failPenalty
+	return latency + failPenalty
 }
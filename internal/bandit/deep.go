@@ -0,0 +1,72 @@
+package bandit
+
+import "math"
+
+// Deep drill. MaxBitsV4 normally stops the search at a /24, which is as far
+// as it needs to go when the addresses of a prefix perform alike. Some
+// prefixes are excellent overall yet spread out, a few standout addresses
+// among average ones; with DeepBitsV4 set, such prefixes may keep splitting
+// past MaxBitsV4, down to DeepBitsV4, so the search can single out the
+// standouts.
+
+const (
+	// deepMinSuccessRate is the success rate a prefix needs to drill deep.
+	deepMinSuccessRate = 0.9
+	// deepLatencyRatio bounds the mean latency of a deep prefix relative to
+	// the best leaf's.
+	deepLatencyRatio = 1.25
+	// deepMinDispersion is the dispersion (see dispersion) a prefix needs
+	// for a deeper split to be worth its samples.
+	deepMinDispersion = 0.3
+)
+
+// splitDepth returns the depth node may be split to: DeepBitsV4 if it is
+// an IPv4 node that qualifies for a deep drill, its maximum depth (see
+// maxBitsFor) otherwise.
+func (t *ArmTree) splitDepth(node *ArmNode) int {
+	maxBits := t.maxBitsFor(node)
+	if !node.Prefix.Addr().Is4() || t.deepBitsV4 <= maxBits || node.Prefix.Bits() < maxBits || !t.deepWorthy(node) {
+		return maxBits
+	}
+	return t.deepBitsV4
+}
+
+// deepWorthy reports whether node is consistently excellent but varied:
+// reliable, about as fast as the best leaf, and dispersed.
+func (t *ArmTree) deepWorthy(node *ArmNode) bool {
+	stats := node.Stats()
+	if stats.Successes < t.minSamples || stats.SuccessRate < deepMinSuccessRate {
+		return false
+	}
+	best := math.Float64frombits(t.deepBest.Load())
+	if best <= 0 || stats.MeanLatency > deepLatencyRatio*best {
+		return false
+	}
+	return dispersion(node, stats) >= deepMinDispersion
+}
+
+// canSplit reports whether node may be split now, taking the two-phase IPv6
+// search and deep drilling into account.
+func (t *ArmTree) canSplit(node *ArmNode) bool {
+	if t.phaseHeld(node) {
+		return false
+	}
+	maxBits := t.splitDepth(node)
+	return node.CanSplit(t.minSamples, maxBits, maxBits)
+}
+
+// updateDeepBest records the lowest mean latency among leaves, the
+// reference deepWorthy compares against.
+func (t *ArmTree) updateDeepBest(leaves []*ArmNode) {
+	if t.deepBitsV4 <= t.maxBitsV4 {
+		return
+	}
+	best := 0.0
+	for _, node := range leaves {
+		stats := node.Stats()
+		if stats.Successes >= t.minSamples && (best == 0 || stats.MeanLatency < best) {
+			best = stats.MeanLatency
+		}
+	}
+	t.deepBest.Store(math.Float64bits(best))
+}
@@ -12,6 +12,10 @@ type SearchHead struct {
 	ID      int
 	Sampler *ThompsonSampler
 
+	// Family restricts the head to IPv4 (4) or IPv6 (6) prefixes; 0 lets
+	// it roam over both.
+	Family int
+
 	// Current focus area (the prefix this head is exploring)
 	CurrentFocus netip.Prefix
 
@@ -32,6 +36,17 @@ func NewSearchHead(id int, seed int64, timeoutMS float64, historySize int) *Sear
 	}
 }
 
+// Accepts reports whether the head may explore prefix.
+func (h *SearchHead) Accepts(prefix netip.Prefix) bool {
+	switch h.Family {
+	case 4:
+		return prefix.Addr().Is4()
+	case 6:
+		return prefix.Addr().Is6()
+	}
+	return true
+}
+
 // SetFocus updates the current focus prefix.
 func (h *SearchHead) SetFocus(prefix netip.Prefix) {
 	h.mu.Lock()
@@ -80,6 +95,11 @@ type HeadManagerConfig struct {
 	HistorySize     int
 	DiversityWeight float64
 	RepulsionDecay  float64
+
+	// HeadsV4 and HeadsV6 dedicate the first heads to one address family
+	// each; the remaining heads roam over both.
+	HeadsV4 int
+	HeadsV6 int
 }
 
 // DefaultHeadManagerConfig returns sensible defaults.
@@ -101,6 +121,12 @@ func NewHeadManager(cfg HeadManagerConfig) *HeadManager {
 		// Each head gets a different seed for independent sampling
 		seed := cfg.BaseSeed + int64(i*9973)
 		heads[i] = NewSearchHead(i, seed, cfg.TimeoutMS, cfg.HistorySize)
+		switch {
+		case i < cfg.HeadsV4:
+			heads[i].Family = 4
+		case i < cfg.HeadsV4+cfg.HeadsV6:
+			heads[i].Family = 6
+		}
 	}
 
 	return &HeadManager{
@@ -126,8 +152,10 @@ func (m *HeadManager) GetHead(idx int) *SearchHead {
 // SelectNextPrefix selects the next prefix for a head to explore,
 // considering both Thompson Sampling scores and diversity penalties.
 // It also gives a bonus to finer prefixes (children of good parents).
+// Each call draws one posterior sample per active leaf, O(L) for L leaves;
+// this is the dominant scheduling cost once the tree has many leaves.
 func (m *HeadManager) SelectNextPrefix(head *SearchHead, tree *ArmTree, beamWidth int) netip.Prefix {
-	candidates := tree.LeafNodes()
+	candidates := headCandidates(head, tree)
 	if len(candidates) == 0 {
 		return netip.Prefix{}
 	}
@@ -168,6 +196,9 @@ func (m *HeadManager) SelectNextPrefix(head *SearchHead, tree *ArmTree, beamWidt
 		// Combined score (lower is better)
 		// Apply diversity penalty and depth bonus
 		combined := tsScore * (1 + m.diversityWeight*penalty) * (1 - depthBonus)
+		if node.Weight > 0 {
+			combined /= node.Weight
+		}
 
 		scored[i] = scoredCandidate{
 			node:     node,
@@ -189,9 +220,11 @@ func (m *HeadManager) SelectNextPrefix(head *SearchHead, tree *ArmTree, beamWidt
 	return best.node.Prefix
 }
 
-// SelectBeam selects a beam of prefixes for a head to explore.
+// SelectBeam selects a beam of prefixes for a head to explore. Like
+// SelectNextPrefix it samples every active leaf once, and keeps the best
+// beamWidth in O(L log beamWidth) for L leaves.
 func (m *HeadManager) SelectBeam(head *SearchHead, tree *ArmTree, beamWidth int) []netip.Prefix {
-	candidates := tree.LeafNodes()
+	candidates := headCandidates(head, tree)
 	if len(candidates) == 0 {
 		return nil
 	}
@@ -228,6 +261,9 @@ func (m *HeadManager) SelectBeam(head *SearchHead, tree *ArmTree, beamWidth int)
 		// Combined score (lower is better)
 		// Apply diversity penalty and depth bonus
 		combined := tsScore * (1 + m.diversityWeight*penalty) * (1 - depthBonus)
+		if node.Weight > 0 {
+			combined /= node.Weight
+		}
 
 		scored[i] = scoredCandidate{
 			prefix:   node.Prefix,
@@ -235,24 +271,11 @@ func (m *HeadManager) SelectBeam(head *SearchHead, tree *ArmTree, beamWidth int)
 		}
 	}
 
-	// Partial sort to get top beamWidth
-	for i := 0; i < beamWidth && i < len(scored); i++ {
-		minIdx := i
-		for j := i + 1; j < len(scored); j++ {
-			if scored[j].combined < scored[minIdx].combined {
-				minIdx = j
-			}
-		}
-		scored[i], scored[minIdx] = scored[minIdx], scored[i]
-	}
-
-	if beamWidth > len(scored) {
-		beamWidth = len(scored)
-	}
+	best := smallestK(scored, beamWidth, func(c scoredCandidate) float64 { return c.combined })
 
-	result := make([]netip.Prefix, beamWidth)
-	for i := 0; i < beamWidth; i++ {
-		result[i] = scored[i].prefix
+	result := make([]netip.Prefix, len(best))
+	for i, c := range best {
+		result[i] = c.prefix
 	}
 
 	// Update focus to best
@@ -263,6 +286,21 @@ func (m *HeadManager) SelectBeam(head *SearchHead, tree *ArmTree, beamWidth int)
 	return result
 }
 
+// headCandidates returns the active leaves the head may explore.
+func headCandidates(head *SearchHead, tree *ArmTree) []*ArmNode {
+	leaves := tree.ActiveLeafNodes()
+	if head.Family == 0 {
+		return leaves
+	}
+	candidates := leaves[:0]
+	for _, node := range leaves {
+		if head.Accepts(node.Prefix) {
+			candidates = append(candidates, node)
+		}
+	}
+	return candidates
+}
+
 // getOtherHeadFocuses returns the current focus of all other heads.
 func (m *HeadManager) getOtherHeadFocuses(excludeID int) []netip.Prefix {
 	m.mu.RLock()
@@ -402,6 +440,9 @@ func (m *HeadManager) RebalanceHeads(tree *ArmTree) {
 		// Assign each head to a different part of the search space
 		for i, head := range m.heads {
 			idx := (i * len(leaves)) / len(m.heads)
+			if !head.Accepts(leaves[idx].Prefix) {
+				continue
+			}
 			head.SetFocus(leaves[idx].Prefix)
 		}
 	}
@@ -0,0 +1,63 @@
+package bandit
+
+// LatencyBuckets is the number of buckets in an arm's latency histogram.
+const LatencyBuckets = 8
+
+// LatencyBucketBounds are the upper bounds in ms of the first
+// LatencyBuckets-1 histogram buckets, doubling from 25ms; the last bucket
+// holds everything slower. Log spacing keeps a prefix that mixes 30ms and
+// 600ms IPs visibly bimodal where its mean and variance would not be.
+var LatencyBucketBounds = [LatencyBuckets - 1]float64{25, 50, 100, 200, 400, 800, 1600}
+
+// latencyBucket returns the histogram bucket of a latency in ms.
+func latencyBucket(latencyMS float64) int {
+	for i, bound := range LatencyBucketBounds {
+		if latencyMS < bound {
+			return i
+		}
+	}
+	return LatencyBuckets - 1
+}
+
+// bimodalityMinSuccesses is how many successful probes a histogram needs
+// before its shape is trusted.
+const bimodalityMinSuccesses = 4
+
+// Bimodality measures how far the arm's latencies fall into two separate
+// groups, from 0 (one tight group) to 1 (half the probes in the fastest
+// bucket, half in the slowest). It is Otsu's between-class variance of the
+// histogram over bucket indices at the best two-way cut, normalized by its
+// maximum. Because buckets are log-spaced, a prefix mixing 30ms and 600ms
+// IPs scores high while one spread evenly around 100ms scores low.
+func (a *ArmNode) Bimodality() float64 {
+	a.mu.RLock()
+	h := a.Histogram
+	a.mu.RUnlock()
+
+	total, sum := 0.0, 0.0
+	for i, n := range h {
+		total += float64(n)
+		sum += float64(i * n)
+	}
+	if total < bimodalityMinSuccesses {
+		return 0
+	}
+
+	best := 0.0
+	w0, sum0 := 0.0, 0.0
+	for k := 0; k < LatencyBuckets-1; k++ {
+		w0 += float64(h[k])
+		sum0 += float64(k * h[k])
+		w1 := total - w0
+		if w0 == 0 || w1 == 0 {
+			continue
+		}
+		m0, m1 := sum0/w0, (sum-sum0)/w1
+		between := (w0 / total) * (w1 / total) * (m1 - m0) * (m1 - m0)
+		if between > best {
+			best = between
+		}
+	}
+	const maxBetween = 0.25 * (LatencyBuckets - 1) * (LatencyBuckets - 1)
+	return best / maxBetween
+}
@@ -0,0 +1,273 @@
+package bandit
+
+import (
+	"math"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// mergeZ is how many standard errors apart two children must be on
+// success rate or latency to count as distinguishable.
+const mergeZ = 2.0
+
+// MergeUniform folds the children of every split whose children all turned
+// out statistically indistinguishable back into their parent. Such a split
+// was uninformative: the range behaves the same throughout at that
+// granularity, and its children only cost selection time. The parent
+// becomes a leaf again, keeps the children's samples, and once it has
+// gathered another MinSamples of its own it may be split again with twice
+// the step (see SplitNode), looking for structure at a finer scale.
+//
+// Only splits whose children are all leaves with at least MinSamples
+// samples each, and whose range can still be split with a larger step, are
+// considered. Returns the merged nodes.
+func (t *ArmTree) MergeUniform() []*ArmNode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var merged []*ArmNode
+	for _, node := range t.nodeMap {
+		maxBits := t.maxBitsFor(node)
+		children := node.mergeableChildren(t.minSamples, maxBits, maxBits)
+		if children == nil || !childrenUniform(children) {
+			continue
+		}
+		for _, c := range children {
+			node.absorb(c)
+			delete(t.nodeMap, c.Prefix)
+		}
+		node.unsplit()
+		merged = append(merged, node)
+	}
+	return merged
+}
+
+// Owner returns the prefix whose arm should receive a result sampled from
+// prefix: prefix itself if it still has a node, otherwise the leaf its
+// children were merged into, if any.
+func (t *ArmTree) Owner(prefix netip.Prefix) netip.Prefix {
+	prefix = prefix.Masked()
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if _, exists := t.nodeMap[prefix]; exists {
+		return prefix
+	}
+	for bits := prefix.Bits() - 1; bits >= 0; bits-- {
+		p, _ := prefix.Addr().Prefix(bits)
+		if node, exists := t.nodeMap[p]; exists {
+			if !node.Stats().IsSplit {
+				return p
+			}
+			break
+		}
+	}
+	return prefix
+}
+
+// mergeableChildren returns the children of a split arm if they may be
+// merged back into it, nil otherwise.
+func (a *ArmNode) mergeableChildren(minSamples, maxBitsV4, maxBitsV6 int) []*ArmNode {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if !a.IsSplit || len(a.Children) < 2 || a.Frozen {
+		return nil
+	}
+	maxBits := maxBitsV6
+	if a.Prefix.Addr().Is4() {
+		maxBits = maxBitsV4
+	}
+	for _, c := range a.Children {
+		s := c.Stats()
+		if s.IsSplit || s.Samples < minSamples || c.IsFrozen() {
+			return nil
+		}
+		// Children at full depth are final; a larger step could not
+		// split the range any differently.
+		if c.Prefix.Bits() >= maxBits {
+			return nil
+		}
+	}
+	children := make([]*ArmNode, len(a.Children))
+	copy(children, a.Children)
+	return children
+}
+
+// childrenUniform reports whether no two children differ by more than
+// mergeZ standard errors in success rate or in mean latency.
+func childrenUniform(children []*ArmNode) bool {
+	obs := make([]observed, len(children))
+	for i, c := range children {
+		obs[i] = c.observed()
+	}
+	for i := range obs {
+		for j := i + 1; j < len(obs); j++ {
+			if distinguishable(obs[i], obs[j]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// observed holds an arm's raw sample statistics, free of the priors and
+// failure penalties folded into its posterior.
+type observed struct {
+	samples   int
+	successes int
+	mean      float64 // latency of successful probes
+	variance  float64
+
+	mbpsSamples int
+	mbpsMean    float64
+	mbpsVar     float64
+}
+
+func (a *ArmNode) observed() observed {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	o := observed{samples: a.Samples, successes: a.Successes}
+	if a.Successes > 0 {
+		o.mean = a.SumLatency / float64(a.Successes)
+	}
+	if a.Successes > 1 {
+		o.variance = a.SumSqDiff / float64(a.Successes-1)
+	}
+	if a.MbpsSamples > 1 {
+		o.mbpsSamples = a.MbpsSamples
+		o.mbpsMean = a.SumMbps / float64(a.MbpsSamples)
+		o.mbpsVar = a.SumSqDiffMbps / float64(a.MbpsSamples-1)
+	}
+	return o
+}
+
+func distinguishable(a, b observed) bool {
+	pa := float64(a.successes) / float64(a.samples)
+	pb := float64(b.successes) / float64(b.samples)
+	se := math.Sqrt(pa*(1-pa)/float64(a.samples) + pb*(1-pb)/float64(b.samples))
+	if math.Abs(pa-pb) > mergeZ*se {
+		return true
+	}
+	if a.mbpsSamples > 1 && b.mbpsSamples > 1 {
+		se := math.Sqrt(a.mbpsVar/float64(a.mbpsSamples) + b.mbpsVar/float64(b.mbpsSamples))
+		if math.Abs(a.mbpsMean-b.mbpsMean) > mergeZ*se {
+			return true
+		}
+	}
+	if a.successes < 2 || b.successes < 2 {
+		return false
+	}
+	se = math.Sqrt(a.variance/float64(a.successes) + b.variance/float64(b.successes))
+	return math.Abs(a.mean-b.mean) > mergeZ*se
+}
+
+// absorb adds a child's observations to the arm. The posterior of the
+// latency is combined by precision; the variance ignores the spread between
+// the children's means, which is small for children worth merging.
+func (a *ArmNode) absorb(c *ArmNode) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	a.Samples += c.Samples
+	a.Successes += c.Successes
+	a.Failures += c.Failures
+	a.SumLatency += c.SumLatency
+	a.SumSqDiff += c.SumSqDiff
+	for i, n := range c.Histogram {
+		a.Histogram[i] += n
+	}
+
+	a.Alpha += c.Alpha - 1
+	a.Beta += c.Beta - 1
+	if extra := c.Lambda - 0.001; extra > 0 {
+		a.Mu = (a.Lambda*a.Mu + extra*c.Mu) / (a.Lambda + extra)
+		a.Lambda += extra
+	}
+	a.AlphaNG += c.AlphaNG - 1
+	a.BetaNG += c.BetaNG - 1
+
+	a.MbpsSamples += c.MbpsSamples
+	a.SumMbps += c.SumMbps
+	a.SumSqDiffMbps += c.SumSqDiffMbps
+	if extra := c.LambdaMbps - 0.001; extra > 0 {
+		a.MuMbps = (a.LambdaMbps*a.MuMbps + extra*c.MuMbps) / (a.LambdaMbps + extra)
+		a.LambdaMbps += extra
+	}
+	a.AlphaMbps += c.AlphaMbps - 1
+	a.BetaMbps += c.BetaMbps - 1
+}
+
+// unsplit turns a merged arm back into a leaf.
+func (a *ArmNode) unsplit() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.IsSplit = false
+	a.Children = nil
+	a.Merges++
+	a.MergedAt = time.Now()
+	a.MergedSamples = a.Samples
+}
+
+// Prune folds splits back into their parents until at least n nodes are
+// gone, to shrink the tree when memory runs short, the worst-scoring ranges
+// first: their children are the least likely to matter. Only splits whose children are all
+// leaves and none of them frozen are folded; unlike MergeUniform, a pruned
+// parent is split again with its usual step. Returns the number of nodes
+// removed from the tree.
+func (t *ArmTree) Prune(n int, timeoutMS float64) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	type candidate struct {
+		node     *ArmNode
+		children []*ArmNode
+		score    float64
+	}
+	var cands []candidate
+	for _, node := range t.nodeMap {
+		if children := node.prunableChildren(); children != nil {
+			cands = append(cands, candidate{node, children, node.Stats().Score(timeoutMS)})
+		}
+	}
+	sort.Slice(cands, func(i, j int) bool { return cands[i].score > cands[j].score })
+
+	removed := 0
+	for _, c := range cands {
+		if removed >= n {
+			break
+		}
+		for _, child := range c.children {
+			c.node.absorb(child)
+			delete(t.nodeMap, child.Prefix)
+		}
+		c.node.mu.Lock()
+		c.node.IsSplit = false
+		c.node.Children = nil
+		c.node.mu.Unlock()
+		removed += len(c.children)
+	}
+	return removed
+}
+
+// prunableChildren returns the children of a split arm if they are all
+// unfrozen leaves, nil otherwise.
+func (a *ArmNode) prunableChildren() []*ArmNode {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if !a.IsSplit || len(a.Children) == 0 || a.Frozen {
+		return nil
+	}
+	for _, c := range a.Children {
+		if c.Stats().IsSplit || c.IsFrozen() {
+			return nil
+		}
+	}
+	children := make([]*ArmNode, len(a.Children))
+	copy(children, a.Children)
+	return children
+}
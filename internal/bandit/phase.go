@@ -0,0 +1,54 @@
+package bandit
+
+// Two-phase IPv6 search. Random samples from a large IPv6 prefix land in a
+// fresh /64 nearly every time, so a search that drills freely keeps
+// spreading over new subnets and never concentrates. With PhaseBitsV6 set,
+// the first phase only splits IPv6 prefixes down to PhaseBitsV6 (a /48 by
+// default) to find the responsive ones; once StartDrill is called, the
+// second phase drills below that depth, but only inside prefixes that have
+// answered at least once.
+
+// StartDrill ends the first phase of the IPv6 search.
+func (t *ArmTree) StartDrill() {
+	t.drilling.Store(true)
+}
+
+// Drilling reports whether the second phase has started.
+func (t *ArmTree) Drilling() bool {
+	return t.phaseBitsV6 == 0 || t.drilling.Load()
+}
+
+// phaseHeld reports whether the two-phase strategy keeps node from being
+// split: an IPv6 prefix at the phase depth or longer during the first
+// phase, or one that never answered during the second.
+func (t *ArmTree) phaseHeld(node *ArmNode) bool {
+	if t.phaseBitsV6 == 0 || node.Prefix.Addr().Is4() || node.Prefix.Bits() < t.phaseBitsV6 {
+		return false
+	}
+	if !t.drilling.Load() {
+		return true
+	}
+	return node.Stats().Successes == 0
+}
+
+// phaseStep limits a split step during the first phase so IPv6 children
+// stop at the phase depth instead of stepping past it.
+func (t *ArmTree) phaseStep(node *ArmNode, step int) int {
+	bits := node.Prefix.Bits()
+	if t.phaseBitsV6 == 0 || t.drilling.Load() || node.Prefix.Addr().Is4() || bits >= t.phaseBitsV6 {
+		return step
+	}
+	return min(step, t.phaseBitsV6-bits)
+}
+
+// ResponsiveLeaves returns the number of IPv6 leaves at the phase depth or
+// longer that have answered at least once.
+func (t *ArmTree) ResponsiveLeaves() int {
+	n := 0
+	for _, node := range t.LeafNodes() {
+		if node.Prefix.Addr().Is6() && node.Prefix.Bits() >= t.phaseBitsV6 && node.Stats().Successes > 0 {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,65 @@
+package bandit
+
+import "net/netip"
+
+// PortArms is a bandit over the ports a search tries on each address, for
+// services whose endpoints answer on several ports of varying quality
+// (e.g. WireGuard endpoints). Every port is an arm with the same
+// posteriors as a prefix arm, and is chosen by Thompson Sampling
+// independently of the prefix, so the search learns which ports work
+// while the tree learns which addresses do.
+type PortArms struct {
+	ports []uint16
+	arms  []*ArmNode
+}
+
+// PortStats are the statistics of one port arm.
+type PortStats struct {
+	Port        uint16  `json:"port"`
+	Samples     int     `json:"samples"`
+	Successes   int     `json:"successes"`
+	SuccessRate float64 `json:"success_rate"`
+	MeanMS      float64 `json:"mean_ms"`
+}
+
+// NewPortArms creates one arm per port.
+func NewPortArms(ports []uint16) *PortArms {
+	p := &PortArms{ports: ports, arms: make([]*ArmNode, len(ports))}
+	for i := range ports {
+		p.arms[i] = NewArmNode(netip.Prefix{}, nil)
+	}
+	return p
+}
+
+// Select picks the port to probe next with s.
+func (p *PortArms) Select(s *ThompsonSampler) uint16 {
+	best, _ := s.SelectBest(p.arms)
+	for i, a := range p.arms {
+		if a == best {
+			return p.ports[i]
+		}
+	}
+	return 0
+}
+
+// Update records a probe of port. Failures only count against its success
+// rate.
+func (p *PortArms) Update(port uint16, success bool, latencyMS, timeoutMS float64) {
+	for i, pt := range p.ports {
+		if pt == port {
+			p.arms[i].Update(success, latencyMS, timeoutMS, 0)
+			return
+		}
+	}
+}
+
+// Stats returns the statistics of every port, in the order given to
+// NewPortArms.
+func (p *PortArms) Stats() []PortStats {
+	out := make([]PortStats, len(p.ports))
+	for i, port := range p.ports {
+		st := p.arms[i].Stats()
+		out[i] = PortStats{Port: port, Samples: st.Samples, Successes: st.Successes, SuccessRate: st.SuccessRate, MeanMS: st.MeanLatency}
+	}
+	return out
+}
@@ -0,0 +1,115 @@
+package bandit
+
+import (
+	"net/netip"
+	"time"
+)
+
+// NodeSnapshot is a point-in-time copy of an arm node and its subtree, for
+// debugging why a search converged where it did.
+type NodeSnapshot struct {
+	Prefix netip.Prefix `json:"prefix"`
+	Label  string       `json:"label,omitempty"`
+	Weight float64      `json:"weight"`
+
+	Samples     int     `json:"samples"`
+	Successes   int     `json:"successes"`
+	Failures    int     `json:"failures"`
+	SuccessRate float64 `json:"success_rate"`
+	MeanLatency float64 `json:"mean_latency,omitempty"`
+	VarLatency  float64 `json:"var_latency"`
+
+	// Histogram counts successful probes by latency bucket (see
+	// LatencyBucketBounds); nil before the first success.
+	Histogram []int `json:"latency_histogram,omitempty"`
+
+	// Throughput measurements and their mean and variance in Mbps.
+	MbpsSamples int     `json:"mbps_samples,omitempty"`
+	MeanMbps    float64 `json:"mean_mbps,omitempty"`
+	VarMbps     float64 `json:"var_mbps,omitempty"`
+
+	// Posterior parameters (see ArmNode).
+	Alpha   float64 `json:"alpha"`
+	Beta    float64 `json:"beta"`
+	Mu      float64 `json:"mu"`
+	Lambda  float64 `json:"lambda"`
+	AlphaNG float64 `json:"alpha_ng"`
+	BetaNG  float64 `json:"beta_ng"`
+
+	// Split lineage: when the node was split and how many samples it had
+	// then. Its children were created by that split.
+	Split        bool      `json:"split"`
+	SplitAt      time.Time `json:"split_at,omitzero"`
+	SplitSamples int       `json:"split_samples,omitempty"`
+
+	// Merges counts the splits of this node that were undone as
+	// uninformative; MergedAt is when the last one was.
+	Merges   int       `json:"merges,omitempty"`
+	MergedAt time.Time `json:"merged_at,omitzero"`
+
+	Frozen         bool      `json:"frozen,omitempty"`
+	FailStreak     int       `json:"fail_streak,omitempty"`
+	SuspendedUntil time.Time `json:"suspended_until,omitzero"`
+
+	Children []NodeSnapshot `json:"children,omitempty"`
+}
+
+// Snapshot returns a copy of the node and all its descendants.
+func (a *ArmNode) Snapshot() NodeSnapshot {
+	a.mu.RLock()
+	s := NodeSnapshot{
+		Prefix:         a.Prefix,
+		Label:          a.Label,
+		Weight:         a.Weight,
+		Samples:        a.Samples,
+		Successes:      a.Successes,
+		Failures:       a.Failures,
+		SuccessRate:    a.Alpha / (a.Alpha + a.Beta),
+		Alpha:          a.Alpha,
+		Beta:           a.Beta,
+		Mu:             a.Mu,
+		Lambda:         a.Lambda,
+		AlphaNG:        a.AlphaNG,
+		BetaNG:         a.BetaNG,
+		Split:          a.IsSplit,
+		SplitAt:        a.SplitAt,
+		SplitSamples:   a.SplitSamples,
+		Merges:         a.Merges,
+		MergedAt:       a.MergedAt,
+		Frozen:         a.Frozen,
+		FailStreak:     a.FailStreak,
+		SuspendedUntil: a.SuspendedUntil,
+	}
+	if a.Successes > 1 {
+		s.VarLatency = a.SumSqDiff / float64(a.Successes-1)
+	}
+	if a.MbpsSamples > 0 {
+		s.MbpsSamples = a.MbpsSamples
+		s.MeanMbps = a.SumMbps / float64(a.MbpsSamples)
+	}
+	if a.MbpsSamples > 1 {
+		s.VarMbps = a.SumSqDiffMbps / float64(a.MbpsSamples-1)
+	}
+	if a.Successes > 0 {
+		s.MeanLatency = a.SumLatency / float64(a.Successes)
+		s.Histogram = append([]int(nil), a.Histogram[:]...)
+	}
+	children := make([]*ArmNode, len(a.Children))
+	copy(children, a.Children)
+	a.mu.RUnlock()
+
+	for _, c := range children {
+		s.Children = append(s.Children, c.Snapshot())
+	}
+	return s
+}
+
+// Snapshot returns a copy of the whole tree, one entry per root.
+func (t *ArmTree) Snapshot() []NodeSnapshot {
+	roots := t.Roots()
+	out := make([]NodeSnapshot, 0, len(roots))
+	for _, r := range roots {
+		out = append(out, r.Snapshot())
+	}
+	return out
+}
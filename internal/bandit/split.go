@@ -0,0 +1,77 @@
+package bandit
+
+import "math"
+
+// Split policies: how GetSplitCandidates orders the prefixes it may split.
+const (
+	// SplitBest splits the fastest, most reliable prefixes first.
+	SplitBest = "best"
+	// SplitUncertain splits the prefixes whose posteriors are least
+	// settled first.
+	SplitUncertain = "uncertain"
+	// SplitVariance splits the prefixes whose latencies are most spread
+	// out or bimodal first: a prefix mixing great and terrible IPs is
+	// exactly where splitting reveals a hidden fast sub-block.
+	SplitVariance = "variance"
+	// SplitHybrid weighs speed and reliability like SplitBest, with strong
+	// bonuses for dispersion and a mild one for uncertainty (default).
+	SplitHybrid = "hybrid"
+)
+
+// ValidSplitPolicy reports whether p names a split policy.
+func ValidSplitPolicy(p string) bool {
+	switch p {
+	case SplitBest, SplitUncertain, SplitVariance, SplitHybrid:
+		return true
+	}
+	return false
+}
+
+// dispersion is how much a prefix's latencies vary inside it: their
+// coefficient of variation plus twice their bimodality (see Bimodality).
+// Prefixes with fewer than two successes have none.
+func dispersion(node *ArmNode, stats ArmStats) float64 {
+	if stats.Successes < 2 || stats.MeanLatency <= 0 {
+		return 0
+	}
+	cv := math.Sqrt(stats.VarLatency) / stats.MeanLatency
+	return cv + 2*node.Bimodality()
+}
+
+// splitPriority scores a split candidate under the tree's policy; lower
+// scores are split first.
+func (t *ArmTree) splitPriority(node *ArmNode) float64 {
+	stats := node.Stats()
+
+	// Base priority is mean latency (lower = better)
+	latencyScore := stats.MeanLatency
+	if stats.Successes == 0 {
+		latencyScore = 10000 // Penalty for no successes
+	}
+
+	// Bonus for high success rate (up to 500ms reduction)
+	successBonus := stats.SuccessRate * 500
+
+	// Throughput dispersion counts like latency dispersion, if enabled
+	spread := dispersion(node, stats)
+	if t.splitOnThroughput {
+		spread += throughputDispersion(stats)
+	}
+
+	switch t.splitPolicy {
+	case SplitBest:
+		return latencyScore - successBonus
+	case SplitUncertain:
+		return -node.InformationGain()
+	case SplitVariance:
+		// Break ties between equally dispersed (or unknown) prefixes by
+		// speed, far below the weight of any real dispersion.
+		return -spread*10000 + latencyScore - successBonus
+	default:
+		// Bonus for uncertainty (encourage exploring uncertain nodes)
+		uncertaintyBonus := node.InformationGain() * 50
+		// Bonus for dispersion: up to ~1500ms for a strongly bimodal prefix
+		dispersionBonus := spread * 500
+		return latencyScore - successBonus - uncertaintyBonus - dispersionBonus
+	}
+}
@@ -103,7 +103,8 @@ func (s *ThompsonSampler) SelectBest(candidates []*ArmNode) (*ArmNode, float64)
 }
 
 // SelectBestN selects the top N arms from candidates using Thompson Sampling.
-// Returns the selected nodes sorted by sampled score (best first).
+// Returns the selected nodes sorted by sampled score (best first). It costs
+// one posterior sample per candidate plus O(len(candidates) log n).
 func (s *ThompsonSampler) SelectBestN(candidates []*ArmNode, n int) []*ArmNode {
 	if len(candidates) == 0 {
 		return nil
@@ -119,24 +120,11 @@ func (s *ThompsonSampler) SelectBestN(candidates []*ArmNode, n int) []*ArmNode {
 		scored_nodes[i] = scored{node: node, score: s.SampleScore(node)}
 	}
 
-	// Partial sort to get top N
-	for i := 0; i < n && i < len(scored_nodes); i++ {
-		minIdx := i
-		for j := i + 1; j < len(scored_nodes); j++ {
-			if scored_nodes[j].score < scored_nodes[minIdx].score {
-				minIdx = j
-			}
-		}
-		scored_nodes[i], scored_nodes[minIdx] = scored_nodes[minIdx], scored_nodes[i]
-	}
-
-	if n > len(scored_nodes) {
-		n = len(scored_nodes)
-	}
+	best := smallestK(scored_nodes, n, func(c scored) float64 { return c.score })
 
-	result := make([]*ArmNode, n)
-	for i := 0; i < n; i++ {
-		result[i] = scored_nodes[i].node
+	result := make([]*ArmNode, len(best))
+	for i, c := range best {
+		result[i] = c.node
 	}
 	return result
 }
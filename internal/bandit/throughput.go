@@ -0,0 +1,71 @@
+package bandit
+
+import (
+	"math"
+	"net/netip"
+)
+
+// Throughput. Latency alone doesn't tell apart the /24s of a /16 that ride
+// congested transit from the ones that don't: both answer a small probe
+// quickly, but one delivers a fraction of the other's bandwidth. When
+// throughput is measured during the search, each arm keeps a second
+// Normal-Gamma posterior over it, and with SplitOnThroughput set arms whose
+// throughput varies widely are split early, like arms with dispersed
+// latency.
+
+// UpdateThroughput adds a throughput measurement in Mbps to the arm's
+// throughput posterior.
+func (a *ArmNode) UpdateThroughput(mbps float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.MbpsSamples++
+	a.SumMbps += mbps
+
+	oldMu := a.MuMbps
+	oldLambda := a.LambdaMbps
+	a.LambdaMbps = oldLambda + 1
+	a.MuMbps = (oldLambda*oldMu + mbps) / a.LambdaMbps
+
+	if a.MbpsSamples > 1 {
+		d := (mbps - oldMu) * (mbps - a.MuMbps) * oldLambda / a.LambdaMbps
+		a.SumSqDiffMbps += d
+		a.AlphaMbps += 0.5
+		a.BetaMbps += 0.5 * d
+	}
+}
+
+// throughputDispersion is the coefficient of variation of an arm's
+// throughput, 0 until it has two measurements.
+func throughputDispersion(stats ArmStats) float64 {
+	if stats.MbpsSamples < 2 || stats.MeanMbps <= 0 {
+		return 0
+	}
+	return math.Sqrt(stats.VarMbps) / stats.MeanMbps
+}
+
+// Leaf returns the deepest arm containing addr, or nil if no root does.
+func (t *ArmTree) Leaf(addr netip.Addr) *ArmNode {
+	addr = addr.Unmap()
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for bits := addr.BitLen(); bits >= 0; bits-- {
+		p, _ := addr.Prefix(bits)
+		if node, ok := t.nodeMap[p]; ok {
+			return node
+		}
+	}
+	return nil
+}
+
+// UpdateThroughput adds a throughput measurement of addr to the arm that
+// owns it. It reports whether one did.
+func (t *ArmTree) UpdateThroughput(addr netip.Addr, mbps float64) bool {
+	node := t.Leaf(addr)
+	if node == nil {
+		return false
+	}
+	node.UpdateThroughput(mbps)
+	return true
+}
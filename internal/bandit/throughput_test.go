@@ -0,0 +1,50 @@
+package bandit
+
+import (
+	"math"
+	"net/netip"
+	"testing"
+)
+
+// TestSplitOnThroughput checks that a prefix whose throughput varies
+// widely (half its subnets congested) is split before a slightly faster
+// prefix with steady throughput, and only with SplitOnThroughput set.
+func TestSplitOnThroughput(t *testing.T) {
+	mixed := netip.MustParsePrefix("198.18.0.0/16")
+	steady := netip.MustParsePrefix("198.19.0.0/16")
+
+	first := func(splitOnThroughput bool) (*ArmTree, *ArmNode) {
+		cfg := DefaultTreeConfig()
+		cfg.SplitOnThroughput = splitOnThroughput
+		tree := NewArmTree([]netip.Prefix{mixed, steady}, cfg)
+		for i := range 20 {
+			tree.Update(mixed, true, 50, 1000, 0)
+			tree.Update(steady, true, 45, 1000, 0)
+			mbps := 5.0
+			if i%2 == 0 {
+				mbps = 95
+			}
+			tree.UpdateThroughput(mixed.Addr().Next(), mbps)
+			tree.UpdateThroughput(steady.Addr().Next(), 50)
+		}
+		c := tree.GetSplitCandidates(1)
+		if len(c) != 1 {
+			t.Fatalf("%d split candidates, want 1", len(c))
+		}
+		return tree, c[0]
+	}
+
+	if _, n := first(false); n.Prefix != steady {
+		t.Fatalf("without SplitOnThroughput %s is split first, want the faster %s", n.Prefix, steady)
+	}
+	tree, n := first(true)
+	if n.Prefix != mixed {
+		t.Fatalf("with SplitOnThroughput %s is split first, want %s", n.Prefix, mixed)
+	}
+	if children := tree.SplitNode(n); len(children) == 0 {
+		t.Fatalf("%s did not split", mixed)
+	}
+	if st := tree.GetNode(mixed).Stats(); st.MbpsSamples != 20 || math.Abs(st.MeanMbps-50) > 1 {
+		t.Errorf("throughput posterior: %d samples, mean %.1f; want 20, 50", st.MbpsSamples, st.MeanMbps)
+	}
+}
@@ -0,0 +1,48 @@
+package bandit
+
+import "sort"
+
+// smallestK returns the k items with the lowest score, lowest first,
+// reordering items in place. It keeps a max-heap of the best k seen so far,
+// which is O(n log k); with tens of thousands of leaves and a beam of 32
+// that is far cheaper than a partial selection sort's O(n·k).
+func smallestK[T any](items []T, k int, score func(T) float64) []T {
+	if k <= 0 {
+		return nil
+	}
+	if k >= len(items) {
+		sort.Slice(items, func(i, j int) bool { return score(items[i]) < score(items[j]) })
+		return items
+	}
+
+	h := items[:k]
+	for i := k/2 - 1; i >= 0; i-- {
+		siftDown(h, i, score)
+	}
+	for i := k; i < len(items); i++ {
+		if score(items[i]) < score(h[0]) {
+			h[0], items[i] = items[i], h[0]
+			siftDown(h, 0, score)
+		}
+	}
+	sort.Slice(h, func(i, j int) bool { return score(h[i]) < score(h[j]) })
+	return h
+}
+
+// siftDown restores the max-heap property of h below i.
+func siftDown[T any](h []T, i int, score func(T) float64) {
+	for {
+		largest := i
+		if l := 2*i + 1; l < len(h) && score(h[l]) > score(h[largest]) {
+			largest = l
+		}
+		if r := 2*i + 2; r < len(h) && score(h[r]) > score(h[largest]) {
+			largest = r
+		}
+		if largest == i {
+			return
+		}
+		h[i], h[largest] = h[largest], h[i]
+		i = largest
+	}
+}
@@ -0,0 +1,54 @@
+package bandit
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestSmallestK(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 7, 100} {
+		for _, k := range []int{0, 1, 5, 100, 200} {
+			items := make([]float64, n)
+			for i := range items {
+				items[i] = rng.Float64()
+			}
+			want := append([]float64(nil), items...)
+			sort.Float64s(want)
+			want = want[:min(k, n)]
+
+			got := smallestK(items, k, func(v float64) float64 { return v })
+			if len(got) != len(want) {
+				t.Fatalf("n=%d k=%d: got %d items, want %d", n, k, len(got), len(want))
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("n=%d k=%d: item %d = %v, want %v", n, k, i, got[i], want[i])
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkSmallestK measures picking a beam from the leaves of a large tree.
+func BenchmarkSmallestK(b *testing.B) {
+	for _, n := range []int{1000, 50000} {
+		for _, k := range []int{1, 32, 256} {
+			b.Run("n="+strconv.Itoa(n)+"/k="+strconv.Itoa(k), func(b *testing.B) {
+				rng := rand.New(rand.NewSource(1))
+				src := make([]float64, n)
+				for i := range src {
+					src[i] = rng.Float64()
+				}
+				items := make([]float64, n)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					copy(items, src)
+					smallestK(items, k, func(v float64) float64 { return v })
+				}
+			})
+		}
+	}
+}
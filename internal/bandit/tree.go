@@ -1,9 +1,13 @@
 package bandit
 
 import (
+	"errors"
+	"fmt"
 	"net/netip"
-	"sort"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/zhaiiker/montecarlo-ip-searcher/internal/cidr"
 )
@@ -21,15 +25,36 @@ type ArmTree struct {
 	maxBitsV4   int
 	maxBitsV6   int
 	minSamples  int
+	splitPolicy string
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	phaseBitsV6 int
+	drilling    atomic.Bool
+
+	deepBitsV4 int
+	deepBest   atomic.Uint64 // float64 bits of the best leaf mean latency
+
+	splitOnThroughput bool
 }
 
 // TreeConfig holds configuration for the arm tree.
 type TreeConfig struct {
-	SplitStepV4 int // Prefix bits to add when splitting IPv4
-	SplitStepV6 int // Prefix bits to add when splitting IPv6
-	MaxBitsV4   int // Maximum prefix length for IPv4
-	MaxBitsV6   int // Maximum prefix length for IPv6
-	MinSamples  int // Minimum samples before splitting
+	SplitStepV4 int    // Prefix bits to add when splitting IPv4
+	SplitStepV6 int    // Prefix bits to add when splitting IPv6
+	MaxBitsV4   int    // Maximum prefix length for IPv4
+	MaxBitsV6   int    // Maximum prefix length for IPv6
+	MinSamples  int    // Minimum samples before splitting
+	SplitPolicy string // Order of split candidates (SplitHybrid if empty)
+
+	BreakerThreshold int           // Consecutive hard failures that suspend a prefix (0 = disabled)
+	BreakerCooldown  time.Duration // How long a tripped prefix stays suspended
+
+	PhaseBitsV6 int // Depth the first phase of an IPv6 search stops at (0 = single phase, see StartDrill)
+	DeepBitsV4  int // Depth excellent but dispersed IPv4 prefixes may drill to past MaxBitsV4 (0 = off)
+
+	SplitOnThroughput bool // Also split arms whose measured throughput varies widely (see UpdateThroughput)
 }
 
 // DefaultTreeConfig returns sensible defaults.
@@ -40,6 +65,10 @@ func DefaultTreeConfig() TreeConfig {
 		MaxBitsV4:   24,
 		MaxBitsV6:   56,
 		MinSamples:  5, // Lower for faster drill-down
+		SplitPolicy: SplitHybrid,
+
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
 	}
 }
 
@@ -53,6 +82,15 @@ func NewArmTree(prefixes []netip.Prefix, cfg TreeConfig) *ArmTree {
 		maxBitsV4:   cfg.MaxBitsV4,
 		maxBitsV6:   cfg.MaxBitsV6,
 		minSamples:  cfg.MinSamples,
+		splitPolicy: cfg.SplitPolicy,
+
+		breakerThreshold: cfg.BreakerThreshold,
+		breakerCooldown:  cfg.BreakerCooldown,
+
+		phaseBitsV6: cfg.PhaseBitsV6,
+		deepBitsV4:  cfg.DeepBitsV4,
+
+		splitOnThroughput: cfg.SplitOnThroughput,
 	}
 
 	for _, p := range prefixes {
@@ -136,6 +174,135 @@ func (t *ArmTree) findParentLocked(node *ArmNode, target netip.Prefix) *ArmNode
 	return node
 }
 
+// ErrOverlap is returned by AddRoots for a prefix that overlaps a root
+// without being one: its addresses would be counted twice.
+var ErrOverlap = errors.New("overlapping roots")
+
+// AddRoots adds new root prefixes to a live tree and returns their nodes.
+// Prefixes that already are roots are skipped. If a prefix overlaps an
+// existing root, or another of prefixes, nothing is added and the error
+// wraps ErrOverlap.
+func (t *ArmTree) AddRoots(prefixes []netip.Prefix) ([]*ArmNode, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var fresh []netip.Prefix
+	for _, p := range prefixes {
+		p = p.Masked()
+		if n, exists := t.nodeMap[p]; exists && n.Parent == nil {
+			continue
+		}
+		for _, root := range t.roots {
+			if root.Prefix.Overlaps(p) {
+				return nil, fmt.Errorf("%w: %s and %s", ErrOverlap, p, root.Prefix)
+			}
+		}
+		for _, q := range fresh {
+			if q == p {
+				continue
+			}
+			if q.Overlaps(p) {
+				return nil, fmt.Errorf("%w: %s and %s", ErrOverlap, p, q)
+			}
+		}
+		if !slices.Contains(fresh, p) {
+			fresh = append(fresh, p)
+		}
+	}
+
+	nodes := make([]*ArmNode, 0, len(fresh))
+	for _, p := range fresh {
+		node := NewArmNode(p, nil)
+		t.roots = append(t.roots, node)
+		t.nodeMap[p] = node
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// RemovePrefix removes every node inside prefix (including prefix itself)
+// from the tree, detaching them from their parents. Returns the number of
+// nodes removed.
+func (t *ArmTree) RemovePrefix(prefix netip.Prefix) int {
+	prefix = prefix.Masked()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	removed := 0
+	for p, node := range t.nodeMap {
+		if p.Bits() < prefix.Bits() || !prefix.Contains(p.Addr()) {
+			continue
+		}
+		delete(t.nodeMap, p)
+		removed++
+
+		if node.Parent != nil {
+			node.Parent.removeChild(node)
+		}
+	}
+
+	roots := t.roots[:0]
+	for _, root := range t.roots {
+		if _, exists := t.nodeMap[root.Prefix]; exists {
+			roots = append(roots, root)
+		}
+	}
+	t.roots = roots
+
+	return removed
+}
+
+// SetWeight sets the selection weight of the node for prefix and its
+// existing descendants. Returns false if the prefix is not in the tree.
+func (t *ArmTree) SetWeight(prefix netip.Prefix, weight float64) bool {
+	return t.setSubtree(prefix, func(n *ArmNode) { n.Weight = weight })
+}
+
+// SetLabel sets the label of the node for prefix and its existing
+// descendants. Returns false if the prefix is not in the tree.
+func (t *ArmTree) SetLabel(prefix netip.Prefix, label string) bool {
+	return t.setSubtree(prefix, func(n *ArmNode) { n.Label = label })
+}
+
+// SetMaxBits overrides the maximum depth of the node for prefix and its
+// existing descendants (0 restores the tree default). Returns false if the
+// prefix is not in the tree.
+func (t *ArmTree) SetMaxBits(prefix netip.Prefix, maxBits int) bool {
+	return t.setSubtree(prefix, func(n *ArmNode) { n.MaxBits = maxBits })
+}
+
+// maxBitsFor returns the maximum depth of node: its own override if set,
+// the tree default for its address family otherwise.
+func (t *ArmTree) maxBitsFor(node *ArmNode) int {
+	if node.MaxBits > 0 {
+		return node.MaxBits
+	}
+	if node.Prefix.Addr().Is4() {
+		return t.maxBitsV4
+	}
+	return t.maxBitsV6
+}
+
+// setSubtree applies set to the node for prefix and all its descendants.
+func (t *ArmTree) setSubtree(prefix netip.Prefix, set func(n *ArmNode)) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	node, ok := t.nodeMap[prefix.Masked()]
+	if !ok {
+		return false
+	}
+	var walk func(n *ArmNode)
+	walk = func(n *ArmNode) {
+		set(n)
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	walk(node)
+	return true
+}
+
 // AllNodes returns all nodes in the tree.
 func (t *ArmTree) AllNodes() []*ArmNode {
 	t.mu.RLock()
@@ -163,18 +330,69 @@ func (t *ArmTree) LeafNodes() []*ArmNode {
 	return leaves
 }
 
+// ActiveLeafNodes returns leaf nodes that may be sampled: not frozen and
+// without an open circuit breaker.
+func (t *ArmTree) ActiveLeafNodes() []*ArmNode {
+	leaves := t.LeafNodes()
+
+	now := time.Now()
+	active := leaves[:0]
+	for _, node := range leaves {
+		if node.IsFrozen() {
+			continue
+		}
+		if t.breakerThreshold > 0 && node.Suspended(now) {
+			continue
+		}
+		active = append(active, node)
+	}
+	return active
+}
+
+// Sampleable returns true unless prefix is frozen or suspended.
+// Unknown prefixes are considered sampleable.
+func (t *ArmTree) Sampleable(prefix netip.Prefix) bool {
+	node := t.GetNode(prefix)
+	if node == nil {
+		return true
+	}
+	return !node.IsFrozen() && !node.Suspended(time.Now())
+}
+
+// RecordOutcome feeds a probe outcome to the prefix's circuit breaker.
+// Returns true if this outcome suspended the prefix.
+func (t *ArmTree) RecordOutcome(prefix netip.Prefix, hardFail bool) bool {
+	if t.breakerThreshold <= 0 {
+		return false
+	}
+	node := t.GetNode(prefix)
+	if node == nil {
+		return false
+	}
+	return node.RecordOutcome(hardFail, t.breakerThreshold, t.breakerCooldown, time.Now())
+}
+
 // SplitNode splits a node into child prefixes.
 // Returns the created children, or nil if split is not possible.
 func (t *ArmTree) SplitNode(node *ArmNode) []*ArmNode {
-	if !node.CanSplit(t.minSamples, t.maxBitsV4, t.maxBitsV6) {
+	if !t.canSplit(node) {
 		return nil
 	}
 
 	prefix := node.Prefix
-	step := t.splitStepV6
+	step, maxBits := t.splitStepV6, t.splitDepth(node)
 	if prefix.Addr().Is4() {
 		step = t.splitStepV4
 	}
+	// Each uninformative split doubles the step of the next one.
+	for i := 0; i < node.MergeCount() && prefix.Bits()+step < maxBits; i++ {
+		step *= 2
+	}
+	step = t.phaseStep(node, step)
+	// Never split past the maximum depth, even if the step doesn't align.
+	if prefix.Bits()+step > maxBits {
+		step = maxBits - prefix.Bits()
+	}
 
 	children, err := cidr.SplitPrefix(prefix, step)
 	if err != nil || len(children) == 0 {
@@ -206,11 +424,13 @@ func (t *ArmTree) SplitNode(node *ArmNode) []*ArmNode {
 	return createdChildren
 }
 
-// GetSplitCandidates returns nodes that are candidates for splitting,
-// sorted by a combination of performance (good nodes first) and uncertainty.
-// This ensures we drill down into promising regions while also exploring uncertain ones.
+// GetSplitCandidates returns nodes that are candidates for splitting, in the
+// order of the tree's split policy (see SplitHybrid and friends). The
+// default favours fast, reliable prefixes and, strongly, those whose
+// latencies are spread out or bimodal, while also exploring uncertain ones.
 func (t *ArmTree) GetSplitCandidates(limit int) []*ArmNode {
 	leaves := t.LeafNodes()
+	t.updateDeepBest(leaves)
 
 	type candidate struct {
 		node     *ArmNode
@@ -219,55 +439,35 @@ func (t *ArmTree) GetSplitCandidates(limit int) []*ArmNode {
 
 	candidates := make([]candidate, 0, len(leaves))
 	for _, node := range leaves {
-		if node.CanSplit(t.minSamples, t.maxBitsV4, t.maxBitsV6) {
-			stats := node.Stats()
-
-			// Priority formula:
-			// - Low latency = high priority (we want to drill into fast regions)
-			// - High success rate = high priority
-			// - High uncertainty = moderate boost (explore unknowns)
-
-			// Base priority is mean latency (lower = better)
-			latencyScore := stats.MeanLatency
-			if stats.Successes == 0 {
-				latencyScore = 10000 // Penalty for no successes
-			}
-
-			// Bonus for high success rate (up to 500ms reduction)
-			successBonus := stats.SuccessRate * 500
-
-			// Bonus for uncertainty (encourage exploring uncertain nodes)
-			uncertaintyBonus := node.InformationGain() * 50
-
-			priority := latencyScore - successBonus - uncertaintyBonus
-
+		if t.canSplit(node) {
 			candidates = append(candidates, candidate{
 				node:     node,
-				priority: priority,
+				priority: t.splitPriority(node),
 			})
 		}
 	}
 
-	// Sort by priority (lowest first = best candidates)
-	sort.Slice(candidates, func(i, j int) bool {
-		return candidates[i].priority < candidates[j].priority
-	})
-
-	if limit > len(candidates) {
-		limit = len(candidates)
-	}
+	// Keep the limit best (lowest priority first)
+	best := smallestK(candidates, limit, func(c candidate) float64 { return c.priority })
 
-	result := make([]*ArmNode, limit)
-	for i := 0; i < limit; i++ {
-		result[i] = candidates[i].node
+	result := make([]*ArmNode, len(best))
+	for i, c := range best {
+		result[i] = c.node
 	}
 	return result
 }
 
 // Update updates the statistics for a prefix.
-func (t *ArmTree) Update(prefix netip.Prefix, success bool, latencyMS, timeoutMS float64) {
+func (t *ArmTree) Update(prefix netip.Prefix, success bool, latencyMS, timeoutMS, penalty float64) {
+	node := t.GetOrCreateNode(prefix)
+	node.Update(success, latencyMS, timeoutMS, penalty)
+}
+
+// UpdateCensored records a timed-out probe of a prefix (see
+// ArmNode.UpdateCensored).
+func (t *ArmTree) UpdateCensored(prefix netip.Prefix, timeoutMS, weight float64) {
 	node := t.GetOrCreateNode(prefix)
-	node.Update(success, latencyMS, timeoutMS)
+	node.UpdateCensored(timeoutMS, weight)
 }
 
 // Roots returns the root nodes.
@@ -4,10 +4,13 @@ package cache
 
 import (
 	"encoding/json"
+	"errors"
 	"net/netip"
 	"os"
 	"sort"
 	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/store"
 )
 
 // CachedIP represents a cached IP with its performance metrics.
@@ -17,8 +20,15 @@ type CachedIP struct {
 	DownloadMbps float64    `json:"download_mbps"`
 	DownloadOK   bool       `json:"download_ok"`
 	Colo         string     `json:"colo,omitempty"`
+	Label        string     `json:"label,omitempty"`
 	LastTested   time.Time  `json:"last_tested"`
 	TestCount    int        `json:"test_count"`
+
+	// Stability history: OK is the outcome of the last check, GoodSince when
+	// the current run of good checks began, Flaps how often it went bad.
+	OK        bool      `json:"ok"`
+	GoodSince time.Time `json:"good_since,omitempty"`
+	Flaps     int       `json:"flaps,omitempty"`
 }
 
 // Cache holds the cached IP results.
@@ -33,10 +43,42 @@ const (
 	CurrentVersion = 1
 	// DefaultCacheFile is the default cache file path.
 	DefaultCacheFile = ".mcis_cache.json"
+
+	// DefaultRefresh is the base refresh interval when none is given.
+	DefaultRefresh = 10 * time.Minute
+	// MaxRefresh caps the suggested refresh interval of very stable IPs.
+	MaxRefresh = 24 * time.Hour
 )
 
+// RefreshAfter suggests how long the IP can go without being re-checked:
+// half as long as it has stayed good so far, shortened by every past flap,
+// and never less than base (DefaultRefresh if base <= 0) or more than
+// MaxRefresh. IPs that are currently bad should be re-checked after base.
+func (ip CachedIP) RefreshAfter(base time.Duration) time.Duration {
+	if base <= 0 {
+		base = DefaultRefresh
+	}
+	if !ip.OK || ip.GoodSince.IsZero() {
+		return base
+	}
+	d := ip.LastTested.Sub(ip.GoodSince) / 2 / time.Duration(1+ip.Flaps)
+	return min(max(d, base), max(base, MaxRefresh))
+}
+
+// Due reports whether the IP should be re-checked at now.
+func (ip CachedIP) Due(now time.Time, base time.Duration) bool {
+	return now.Sub(ip.LastTested) >= ip.RefreshAfter(base)
+}
+
 // Load loads the cache from a file. Returns an empty cache if file doesn't exist.
 func Load(path string) (*Cache, error) {
+	return LoadWithKey(path, nil)
+}
+
+// LoadWithKey is like Load but decrypts the file with key if it is encrypted.
+// Plaintext files are still read, so an existing cache can be migrated by
+// saving it with a key.
+func LoadWithKey(path string, key *[KeySize]byte) (*Cache, error) {
 	if path == "" {
 		path = DefaultCacheFile
 	}
@@ -44,23 +86,44 @@ func Load(path string) (*Cache, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return &Cache{
-				Version:   CurrentVersion,
-				UpdatedAt: time.Now(),
-				IPs:       []CachedIP{},
-			}, nil
+			return empty(), nil
+		}
+		return nil, err
+	}
+	return decode(data, key)
+}
+
+// LoadFrom is like LoadWithKey but reads the cache stored under name in b.
+func LoadFrom(b store.Backend, name string, key *[KeySize]byte) (*Cache, error) {
+	data, err := b.Get(name)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return empty(), nil
 		}
 		return nil, err
 	}
+	return decode(data, key)
+}
+
+func empty() *Cache {
+	return &Cache{
+		Version:   CurrentVersion,
+		UpdatedAt: time.Now(),
+		IPs:       []CachedIP{},
+	}
+}
+
+// decode parses a stored cache, decrypting it with key if it is encrypted.
+func decode(data []byte, key *[KeySize]byte) (*Cache, error) {
+	data, err := decrypt(data, key)
+	if err != nil {
+		return nil, err
+	}
 
 	var cache Cache
 	if err := json.Unmarshal(data, &cache); err != nil {
 		// Return empty cache if file is corrupted
-		return &Cache{
-			Version:   CurrentVersion,
-			UpdatedAt: time.Now(),
-			IPs:       []CachedIP{},
-		}, nil
+		return empty(), nil
 	}
 
 	return &cache, nil
@@ -68,19 +131,50 @@ func Load(path string) (*Cache, error) {
 
 // Save saves the cache to a file.
 func (c *Cache) Save(path string) error {
+	return c.SaveWithKey(path, nil)
+}
+
+// SaveWithKey saves the cache to a file, encrypted with key (NaCl secretbox)
+// unless key is nil.
+func (c *Cache) SaveWithKey(path string, key *[KeySize]byte) error {
 	if path == "" {
 		path = DefaultCacheFile
 	}
 
+	data, err := c.encode(key)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		return os.WriteFile(path, data, 0600)
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+// SaveTo is like SaveWithKey but stores the cache under name in b.
+func (c *Cache) SaveTo(b store.Backend, name string, key *[KeySize]byte) error {
+	data, err := c.encode(key)
+	if err != nil {
+		return err
+	}
+	return b.Put(name, data)
+}
+
+// encode stamps and serializes the cache, encrypted with key unless key is
+// nil.
+func (c *Cache) encode(key *[KeySize]byte) ([]byte, error) {
 	c.UpdatedAt = time.Now()
 	c.Version = CurrentVersion
 
 	data, err := json.MarshalIndent(c, "", "  ")
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	return os.WriteFile(path, data, 0644)
+	if key != nil {
+		return encrypt(data, key)
+	}
+	return data, nil
 }
 
 // GetIPs returns the list of cached IPs.
@@ -124,13 +218,26 @@ func (c *Cache) Update(newIPs []CachedIP, maxCount int) {
 				existing.ScoreMS = newIP.ScoreMS
 			}
 			existing.LastTested = newIP.LastTested
+			if newIP.Colo != "" && existing.Colo != "" && newIP.Colo != existing.Colo && existing.OK {
+				// Routed to another colo: latency is no longer what we learned,
+				// so treat it like a flap and restart the stable period.
+				existing.Flaps++
+				existing.GoodSince = time.Time{}
+			}
 			if newIP.Colo != "" {
 				existing.Colo = newIP.Colo
 			}
+			if newIP.Label != "" {
+				existing.Label = newIP.Label
+			}
+			existing.record(newIP.OK, newIP.LastTested)
 		} else {
 			// Add new IP
 			newEntry := newIP
 			newEntry.TestCount = 1
+			if newEntry.OK {
+				newEntry.GoodSince = newEntry.LastTested
+			}
 			ipMap[newIP.IP] = &newEntry
 		}
 	}
@@ -167,6 +274,40 @@ func (c *Cache) Update(newIPs []CachedIP, maxCount int) {
 	c.IPs = result
 }
 
+// MarkFailed records a failed re-check of a cached IP.
+func (c *Cache) MarkFailed(ip netip.Addr, when time.Time) {
+	for i := range c.IPs {
+		if c.IPs[i].IP == ip {
+			c.IPs[i].LastTested = when
+			c.IPs[i].TestCount++
+			c.IPs[i].record(false, when)
+			return
+		}
+	}
+}
+
+// Lookup returns the cached entry for ip.
+func (c *Cache) Lookup(ip netip.Addr) (CachedIP, bool) {
+	for _, e := range c.IPs {
+		if e.IP == ip {
+			return e, true
+		}
+	}
+	return CachedIP{}, false
+}
+
+// record updates the stability history with a check outcome.
+func (ip *CachedIP) record(ok bool, when time.Time) {
+	switch {
+	case ok && (!ip.OK || ip.GoodSince.IsZero()):
+		ip.GoodSince = when
+	case !ok && ip.OK:
+		ip.Flaps++
+		ip.GoodSince = time.Time{}
+	}
+	ip.OK = ok
+}
+
 // Clear clears the cache.
 func (c *Cache) Clear() {
 	c.IPs = []CachedIP{}
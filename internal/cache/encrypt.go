@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// KeySize is the size of a cache encryption key in bytes.
+const KeySize = 32
+
+// encMagic prefixes encrypted cache files, followed by the 24-byte nonce and
+// the NaCl secretbox ciphertext.
+var encMagic = []byte("MCISENC1")
+
+var (
+	// ErrEncrypted is returned when loading an encrypted cache without a key.
+	ErrEncrypted = errors.New("cache file is encrypted (set --cache-encrypt-key)")
+	// ErrDecrypt is returned when a cache file cannot be decrypted with the
+	// given key (wrong key or corrupted file).
+	ErrDecrypt = errors.New("cache file decryption failed (wrong key?)")
+)
+
+// ReadKeyFile reads a 32-byte encryption key stored raw, hex encoded or base64
+// encoded (e.g. `head -c 32 /dev/urandom > key` or `openssl rand -hex 32`).
+func ReadKeyFile(path string) (*[KeySize]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := data
+	if len(raw) != KeySize {
+		text := bytes.TrimSpace(data)
+		if b, err := hex.DecodeString(string(text)); err == nil {
+			raw = b
+		} else if b, err := base64.StdEncoding.DecodeString(string(text)); err == nil {
+			raw = b
+		}
+	}
+	if len(raw) != KeySize {
+		return nil, fmt.Errorf("%s: key must be %d bytes (raw, hex or base64)", path, KeySize)
+	}
+
+	var key [KeySize]byte
+	copy(key[:], raw)
+	return &key, nil
+}
+
+// Encrypt encrypts data with key in the format of encrypted cache files,
+// for other state kept alongside the cache. A nil key leaves data as is.
+func Encrypt(data []byte, key *[KeySize]byte) ([]byte, error) {
+	if key == nil {
+		return data, nil
+	}
+	return encrypt(data, key)
+}
+
+// Decrypt reverses Encrypt; data that is not encrypted is returned as is.
+func Decrypt(data []byte, key *[KeySize]byte) ([]byte, error) {
+	return decrypt(data, key)
+}
+
+func encrypt(plain []byte, key *[KeySize]byte) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	out := append([]byte{}, encMagic...)
+	out = append(out, nonce[:]...)
+	return secretbox.Seal(out, plain, &nonce, key), nil
+}
+
+// decrypt returns data unchanged if it is not encrypted.
+func decrypt(data []byte, key *[KeySize]byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, encMagic) {
+		return data, nil
+	}
+	if key == nil {
+		return nil, ErrEncrypted
+	}
+	data = data[len(encMagic):]
+	if len(data) < 24 {
+		return nil, ErrDecrypt
+	}
+	var nonce [24]byte
+	copy(nonce[:], data[:24])
+	plain, ok := secretbox.Open(nil, data[24:], &nonce, key)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
@@ -0,0 +1,55 @@
+package cidr
+
+import "net/netip"
+
+// BogonsV4 lists IPv4 ranges that are never routable on the public internet
+// (RFC 6890 special-purpose, private, multicast and reserved space).
+var BogonsV4 = mustPrefixes(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.88.99.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+)
+
+// GlobalIPv4 returns every /8 that is not entirely bogon space. Bogons smaller
+// than a /8 are not removed here; callers should exclude BogonsV4 when sampling.
+func GlobalIPv4() []netip.Prefix {
+	out := make([]netip.Prefix, 0, 256)
+	for i := 0; i < 256; i++ {
+		p := netip.PrefixFrom(netip.AddrFrom4([4]byte{byte(i), 0, 0, 0}), 8)
+		if coveredBy(p, BogonsV4) {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// coveredBy reports whether p is entirely inside one of the given prefixes.
+func coveredBy(p netip.Prefix, set []netip.Prefix) bool {
+	for _, s := range set {
+		if s.Bits() <= p.Bits() && s.Contains(p.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustPrefixes(strs ...string) []netip.Prefix {
+	out := make([]netip.Prefix, len(strs))
+	for i, s := range strs {
+		out[i] = netip.MustParsePrefix(s)
+	}
+	return out
+}
@@ -1,65 +1,67 @@
 package cidr
 
 import (
-	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
 	mrand "math/rand"
 	"net/netip"
-	"os"
-	"strings"
 )
 
+// ReadCIDRsFromFile reads the prefixes of a CIDR list file (see ParseLine
+// for the accepted line formats), coalesced and without attributes.
 func ReadCIDRsFromFile(path string) ([]netip.Prefix, error) {
-	f, err := os.Open(path)
+	entries, err := ReadEntriesFromFile(path)
 	if err != nil {
 		return nil, err
 	}
-	defer func() { _ = f.Close() }()
-	return ReadCIDRs(f)
+	return Prefixes(entries), nil
 }
 
+// ReadCIDRs reads the prefixes of a CIDR list, ignoring attributes.
 func ReadCIDRs(r io.Reader) ([]netip.Prefix, error) {
 	var out []netip.Prefix
-	sc := bufio.NewScanner(r)
-	for sc.Scan() {
-		line := strings.TrimSpace(sc.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-		// allow inline comments after space-#
-		if idx := strings.Index(line, "#"); idx >= 0 {
-			line = strings.TrimSpace(line[:idx])
-		}
-		p, err := netip.ParsePrefix(line)
-		if err != nil {
-			return nil, fmt.Errorf("parse cidr %q: %w", line, err)
-		}
-		out = append(out, p.Masked())
-	}
-	if err := sc.Err(); err != nil {
+	err := ScanEntries(r, func(e Entry) error {
+		out = append(out, e.Prefix)
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-func ParseCIDRs(strs []string) ([]netip.Prefix, error) {
-	out := make([]netip.Prefix, 0, len(strs))
+// ParseEntries parses CIDR list lines (e.g. --cidr values).
+func ParseEntries(strs []string) ([]Entry, error) {
+	var out []Entry
 	for _, s := range strs {
-		s = strings.TrimSpace(s)
-		if s == "" {
-			continue
-		}
-		p, err := netip.ParsePrefix(s)
+		entries, err := ParseLine(s)
 		if err != nil {
-			return nil, fmt.Errorf("parse cidr %q: %w", s, err)
+			return nil, err
 		}
-		out = append(out, p.Masked())
+		out = append(out, entries...)
 	}
 	return out, nil
 }
 
+// ParseCIDRs parses CIDR list lines into prefixes, ignoring attributes.
+func ParseCIDRs(strs []string) ([]netip.Prefix, error) {
+	entries, err := ParseEntries(strs)
+	if err != nil {
+		return nil, err
+	}
+	return Prefixes(entries), nil
+}
+
+// Prefixes returns the prefixes of entries.
+func Prefixes(entries []Entry) []netip.Prefix {
+	out := make([]netip.Prefix, len(entries))
+	for i, e := range entries {
+		out[i] = e.Prefix
+	}
+	return out
+}
+
 // SplitPrefix splits a prefix into sub-prefixes by increasing the prefix length by step.
 // For example, IPv4 /16 with step=2 yields 4 sub-prefixes of /18.
 func SplitPrefix(p netip.Prefix, step int) ([]netip.Prefix, error) {
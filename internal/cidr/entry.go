@@ -0,0 +1,281 @@
+package cidr
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Entry is one search root parsed from a CIDR list, with optional
+// attributes given inline as key=value after the address:
+//
+//	1.1.0.0/16 weight=2 label=apnic
+//	2606:4700::/32 maxbits=64   # drill this root down to /64s
+//	1.0.1.0-1.0.3.255           # range, expanded to covering prefixes
+//	104.16.1.1                  # bare IP, treated as /32 (or /128)
+type Entry struct {
+	Prefix netip.Prefix
+
+	// Weight biases how often the root is sampled relative to others
+	// (1 = neutral, 0 = unset).
+	Weight float64
+
+	// Label is carried through to results (e.g. the source list).
+	Label string
+
+	// MaxBits overrides the maximum drill-down depth for this root
+	// (0 = unset, use the global MaxBitsV4/MaxBitsV6).
+	MaxBits int
+}
+
+// ParseLine parses one line of a CIDR list. A line holds one or more
+// address specs (CIDR, bare IP or "a-b" range), optionally followed by
+// weight=N, label=NAME and maxbits=N attributes that apply to all of them.
+// Blank lines and "#" comments yield no entries.
+func ParseLine(line string) ([]Entry, error) {
+	if idx := strings.Index(line, "#"); idx >= 0 {
+		line = line[:idx]
+	}
+	// Allow "a - b" ranges and comma separated lists.
+	line = strings.ReplaceAll(line, " - ", "-")
+	line = strings.ReplaceAll(line, ",", " ")
+
+	var specs []string
+	var weight float64
+	var label string
+	var maxBits int
+	for _, tok := range strings.Fields(line) {
+		key, val, ok := strings.Cut(tok, "=")
+		if !ok {
+			specs = append(specs, tok)
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "weight", "w":
+			w, err := strconv.ParseFloat(val, 64)
+			if err != nil || w <= 0 {
+				return nil, fmt.Errorf("invalid weight %q", val)
+			}
+			weight = w
+		case "label":
+			label = val
+		case "maxbits":
+			b, err := strconv.Atoi(val)
+			if err != nil || b <= 0 || b > 128 {
+				return nil, fmt.Errorf("invalid maxbits %q", val)
+			}
+			maxBits = b
+		default:
+			return nil, fmt.Errorf("unknown attribute %q", key)
+		}
+	}
+	if len(specs) == 0 && (weight != 0 || label != "" || maxBits != 0) {
+		return nil, fmt.Errorf("attributes without an address")
+	}
+
+	var out []Entry
+	for _, s := range specs {
+		ps, err := ParseSpec(s)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range ps {
+			if maxBits > p.Addr().BitLen() {
+				return nil, fmt.Errorf("maxbits %d exceeds the address length of %s", maxBits, p)
+			}
+			out = append(out, Entry{Prefix: p, Weight: weight, Label: label, MaxBits: maxBits})
+		}
+	}
+	return out, nil
+}
+
+// ParseSpec parses a CIDR, a bare IP or an "a-b" range into prefixes.
+func ParseSpec(s string) ([]netip.Prefix, error) {
+	if from, to, ok := strings.Cut(s, "-"); ok {
+		a, err := netip.ParseAddr(strings.TrimSpace(from))
+		if err != nil {
+			return nil, fmt.Errorf("parse range %q: %w", s, err)
+		}
+		b, err := netip.ParseAddr(strings.TrimSpace(to))
+		if err != nil {
+			return nil, fmt.Errorf("parse range %q: %w", s, err)
+		}
+		ps, err := RangeToPrefixes(a, b)
+		if err != nil {
+			return nil, fmt.Errorf("parse range %q: %w", s, err)
+		}
+		return ps, nil
+	}
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("parse cidr %q: %w", s, err)
+		}
+		return []netip.Prefix{p.Masked()}, nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return nil, fmt.Errorf("parse ip %q: %w", s, err)
+	}
+	a = a.Unmap()
+	return []netip.Prefix{netip.PrefixFrom(a, a.BitLen())}, nil
+}
+
+// RangeToPrefixes returns the minimal list of prefixes exactly covering the
+// inclusive range [from, to].
+func RangeToPrefixes(from, to netip.Addr) ([]netip.Prefix, error) {
+	from, to = from.Unmap(), to.Unmap()
+	if from.Is4() != to.Is4() {
+		return nil, fmt.Errorf("mixed address families")
+	}
+	if to.Less(from) {
+		return nil, fmt.Errorf("end before start")
+	}
+
+	bitLen := from.BitLen()
+	var out []netip.Prefix
+	for cur := from; ; {
+		// Largest aligned block starting at cur that doesn't pass to.
+		bits := bitLen
+		for bits > 0 {
+			p := netip.PrefixFrom(cur, bits-1).Masked()
+			if p.Addr() != cur || lastAddr(p).Compare(to) > 0 {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(cur, bits)
+		out = append(out, p)
+
+		last := lastAddr(p)
+		if last.Compare(to) >= 0 {
+			return out, nil
+		}
+		cur = last.Next()
+	}
+}
+
+// lastAddr returns the last address in p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	host := len(b)*8 - p.Bits()
+	for i := len(b) - 1; i >= 0 && host > 0; i-- {
+		n := min(host, 8)
+		b[i] |= byte(1<<n - 1)
+		host -= n
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
+
+// ScanEntries streams the entries of a CIDR list to fn, one line at a time,
+// so large files never have to be held in memory as text.
+func ScanEntries(r io.Reader, fn func(Entry) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		entries, err := ParseLine(sc.Text())
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		for _, e := range entries {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+	return sc.Err()
+}
+
+// ReadEntriesFromFile reads a CIDR list file, coalescing adjacent entries
+// with the same attributes (see Coalesce).
+func ReadEntriesFromFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var out []Entry
+	if err := ScanEntries(f, func(e Entry) error {
+		out = append(out, e)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return Coalesce(out), nil
+}
+
+// Coalesce merges entries without changing the covered address set: entries
+// covered by another entry with the same attributes are dropped, and sibling
+// prefixes with the same attributes are merged into their parent. This keeps
+// the root count small for long IP lists. Order follows the first
+// appearance of each attribute group, then address order.
+func Coalesce(entries []Entry) []Entry {
+	type attrs struct {
+		weight  float64
+		label   string
+		maxBits int
+	}
+	var order []attrs
+	groups := make(map[attrs][]netip.Prefix)
+	for _, e := range entries {
+		k := attrs{e.Weight, e.Label, e.MaxBits}
+		if _, ok := groups[k]; !ok {
+			order = append(order, k)
+		}
+		groups[k] = append(groups[k], e.Prefix.Masked())
+	}
+
+	var out []Entry
+	for _, k := range order {
+		for _, p := range coalescePrefixes(groups[k]) {
+			out = append(out, Entry{Prefix: p, Weight: k.weight, Label: k.label, MaxBits: k.maxBits})
+		}
+	}
+	return out
+}
+
+// coalescePrefixes returns the minimal prefix list covering the same
+// addresses as ps.
+func coalescePrefixes(ps []netip.Prefix) []netip.Prefix {
+	slices.SortFunc(ps, func(a, b netip.Prefix) int {
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Bits(), b.Bits())
+	})
+
+	// Drop prefixes covered by an earlier (shorter or equal) one.
+	var kept []netip.Prefix
+	for _, p := range ps {
+		if n := len(kept); n > 0 && kept[n-1].Contains(p.Addr()) && kept[n-1].Bits() <= p.Bits() {
+			continue
+		}
+		kept = append(kept, p)
+	}
+
+	// Merge siblings bottom-up with a stack.
+	var stack []netip.Prefix
+	for _, p := range kept {
+		stack = append(stack, p)
+		for len(stack) >= 2 {
+			a, b := stack[len(stack)-2], stack[len(stack)-1]
+			if a.Bits() != b.Bits() || a.Bits() == 0 {
+				break
+			}
+			parent := netip.PrefixFrom(a.Addr(), a.Bits()-1).Masked()
+			if parent.Addr() != a.Addr() || !parent.Contains(b.Addr()) {
+				break
+			}
+			stack = append(stack[:len(stack)-2], parent)
+		}
+	}
+	return stack
+}
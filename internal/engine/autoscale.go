@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"math"
+	"net/netip"
+)
+
+const (
+	autoBudgetMin = 500
+	autoBudgetMax = 50000
+
+	// autoBudgetBase is the budget for a single IPv4 /16 (256 /24s), which
+	// matches the historical default of 2000.
+	autoBudgetBase = 2000
+
+	// v6 prefixes are measured in /48s, capped so a /32 doesn't dwarf
+	// everything else (the address space is sparse anyway).
+	autoV6UnitBits = 48
+	autoV6MaxUnits = 1 << 16
+
+	// Roots are grouped into clusters of nearby address space (one per
+	// IPv4 /8 or IPv6 /16) and each cluster gets a head, within bounds.
+	// The minimum is the historical default.
+	autoHeadsMin      = 4
+	autoHeadsMax      = 16
+	autoClusterBitsV4 = 8
+	autoClusterBitsV6 = 16
+)
+
+// Scale holds search parameters derived from the size of the search space.
+type Scale struct {
+	// Units is the size of the search space in /24 (IPv4) plus /48 (IPv6)
+	// equivalents.
+	Units float64
+
+	// Budget is the recommended probe budget.
+	Budget int
+
+	// MaxBitsV4 and MaxBitsV6 are the recommended drill-down depths.
+	MaxBitsV4 int
+	MaxBitsV6 int
+
+	// Heads is the recommended number of search heads.
+	Heads int
+}
+
+// AutoScale derives a probe budget and maximum drill-down depth from the
+// prefixes to search. The budget grows with the square root of the space:
+// the tree only needs to drill into the promising parts, not cover it all.
+func AutoScale(prefixes []netip.Prefix, defaults Config) Scale {
+	s := Scale{
+		MaxBitsV4: defaults.MaxBitsV4,
+		MaxBitsV6: defaults.MaxBitsV6,
+	}
+
+	addresses := 0.0
+	shallowestV4, shallowestV6 := 32, 128
+	clusters := make(map[netip.Prefix]bool)
+	for _, p := range prefixes {
+		clusters[clusterOf(p)] = true
+		bits := p.Bits()
+		if p.Addr().Is4() {
+			addresses += math.Pow(2, float64(32-bits))
+			s.Units += scaleUnits(p)
+			shallowestV4 = min(shallowestV4, bits)
+		} else {
+			addresses += math.Pow(2, math.Min(float64(128-bits), 62))
+			s.Units += scaleUnits(p)
+			shallowestV6 = min(shallowestV6, bits)
+		}
+	}
+
+	budget := autoBudgetBase * math.Sqrt(s.Units/256)
+	budget = math.Min(math.Max(budget, autoBudgetMin), autoBudgetMax)
+	// No point probing more IPs than the space holds.
+	s.Budget = int(math.Round(math.Max(1, math.Min(budget, addresses))))
+
+	// If every root is already at the default depth (e.g. a single /24),
+	// nothing could be split at all; allow a couple of levels below it.
+	if shallowestV4 >= s.MaxBitsV4 && shallowestV4 < 32 {
+		s.MaxBitsV4 = min(32, shallowestV4+2*defaults.SplitStepV4)
+	}
+	if shallowestV6 >= s.MaxBitsV6 && shallowestV6 < 128 {
+		s.MaxBitsV6 = min(128, shallowestV6+2*defaults.SplitStepV6)
+	}
+
+	// Spread roots deserve a head each so the diversity penalty can keep
+	// them apart; a few heads still help within a single range.
+	s.Heads = min(max(len(clusters), autoHeadsMin), autoHeadsMax)
+	return s
+}
+
+// clusterOf returns the block of address space p is grouped under when
+// choosing the number of heads.
+func clusterOf(p netip.Prefix) netip.Prefix {
+	bits := autoClusterBitsV4
+	if p.Addr().Is6() {
+		bits = autoClusterBitsV6
+	}
+	c, _ := p.Addr().Prefix(min(bits, p.Bits()))
+	return c
+}
+
+// scaleUnits is the size of p in the units of Scale.Units.
+func scaleUnits(p netip.Prefix) float64 {
+	if p.Addr().Is4() {
+		return math.Pow(2, math.Max(0, float64(24-p.Bits())))
+	}
+	return math.Min(math.Pow(2, math.Max(0, float64(autoV6UnitBits-p.Bits()))), autoV6MaxUnits)
+}
+
+// BudgetTooSmall reports whether budget is clearly too small to meaningfully
+// explore a space for which recommended probes are suggested.
+func BudgetTooSmall(budget, recommended int) bool {
+	return budget*4 < recommended
+}
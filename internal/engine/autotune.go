@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// autotuneMinWindow is the fewest probes a concurrency decision is
+	// based on.
+	autotuneMinWindow = 32
+	// autotuneTimeoutSpike is how far the timeout rate of a window may rise
+	// above the baseline (absolute) before concurrency is halved.
+	autotuneTimeoutSpike = 0.15
+	// autotuneLatencyDrift is the mean latency / baseline ratio above which
+	// concurrency stops growing.
+	autotuneLatencyDrift = 1.3
+	// autotuneEWMA is the smoothing factor of the baselines.
+	autotuneEWMA = 0.2
+)
+
+// concurrencyTuner adapts the number of in-flight probes (AIMD) to what the
+// local network handles, from the outcomes of the probes themselves: it
+// starts low and grows while the timeout rate and latency stay level, and
+// halves as soon as timeouts spike, the sign of a router or NAT table that
+// can't keep up. Unlike the backpressure controller it needs no reference
+// IP.
+//
+// Some candidates never answer whatever the concurrency, so the timeout
+// rate is judged against a baseline learned while the limit was growing
+// without trouble rather than against zero.
+type concurrencyTuner struct {
+	mu sync.Mutex
+
+	limit    int
+	minLimit int
+	maxLimit int
+
+	// The current window.
+	probes   int
+	timeouts int
+	okCount  int
+	latency  float64 // sum over the successes
+
+	baseTimeouts float64 // smoothed timeout rate of healthy windows, <0 before the first
+	baseLatency  float64 // smoothed mean latency of healthy windows, 0 before the first
+}
+
+func newConcurrencyTuner(minLimit, maxLimit int) *concurrencyTuner {
+	if minLimit <= 0 {
+		minLimit = 1
+	}
+	if maxLimit < minLimit {
+		maxLimit = minLimit
+	}
+	return &concurrencyTuner{limit: minLimit, minLimit: minLimit, maxLimit: maxLimit, baseTimeouts: -1}
+}
+
+// Limit returns the current in-flight probe limit.
+func (t *concurrencyTuner) Limit() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limit
+}
+
+// Observe records a finished probe and, once a window of probes is
+// complete, adjusts the limit. It returns the new limit and whether it
+// changed.
+func (t *concurrencyTuner) Observe(timedOut, ok bool, latencyMS float64, inflight int) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.probes++
+	if timedOut {
+		t.timeouts++
+	}
+	if ok {
+		t.okCount++
+		t.latency += latencyMS
+	}
+	if t.probes < max(autotuneMinWindow, t.limit) {
+		return t.limit, false
+	}
+
+	timeoutRate := float64(t.timeouts) / float64(t.probes)
+	meanLatency := 0.0
+	if t.okCount > 0 {
+		meanLatency = t.latency / float64(t.okCount)
+	}
+	t.probes, t.timeouts, t.okCount, t.latency = 0, 0, 0, 0
+
+	old := t.limit
+	switch {
+	case t.baseTimeouts >= 0 && timeoutRate > t.baseTimeouts+autotuneTimeoutSpike:
+		// Multiplicative decrease from what was actually in flight, so a
+		// limit that was never reached doesn't mask the collapse.
+		cur := t.limit
+		if inflight > 0 && inflight < cur {
+			cur = inflight
+		}
+		t.limit = cur / 2
+	case t.baseLatency > 0 && meanLatency > t.baseLatency*autotuneLatencyDrift:
+		// Queueing somewhere: hold until it clears.
+	default:
+		t.limit += max(1, t.maxLimit/20)
+		if t.baseTimeouts < 0 {
+			t.baseTimeouts = timeoutRate
+		} else {
+			t.baseTimeouts = autotuneEWMA*timeoutRate + (1-autotuneEWMA)*t.baseTimeouts
+		}
+		if meanLatency > 0 {
+			if t.baseLatency == 0 {
+				t.baseLatency = meanLatency
+			} else {
+				t.baseLatency = autotuneEWMA*meanLatency + (1-autotuneEWMA)*t.baseLatency
+			}
+		}
+	}
+
+	t.limit = min(max(t.limit, t.minLimit), t.maxLimit)
+	return t.limit, t.limit != old
+}
+
+// observeAutotune feeds a finished probe to the concurrency tuner.
+func (e *Engine) observeAutotune(timedOut, ok bool, latencyMS float64) {
+	if e.tuner == nil {
+		return
+	}
+	inflight := int(atomic.LoadInt64(&e.submitted) - atomic.LoadInt64(&e.completed))
+	limit, changed := e.tuner.Observe(timedOut, ok, latencyMS, inflight)
+	if changed && e.cfg.Verbose {
+		fmt.Fprintf(os.Stderr, "autotune: concurrency limit=%d (inflight=%d)\n", limit, inflight)
+	}
+}
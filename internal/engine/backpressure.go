@@ -0,0 +1,212 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/probe"
+)
+
+const (
+	// backpressureHighDrift is the reference RTT / baseline ratio above which
+	// we assume local congestion and cut concurrency.
+	backpressureHighDrift = 1.5
+	// backpressureLowDrift is the ratio below which concurrency may grow again.
+	backpressureLowDrift = 1.15
+	// backpressureEWMA is the smoothing factor for reference RTT samples.
+	backpressureEWMA = 0.3
+	// backpressureDialShare is the share of in-flight probes still
+	// connecting above which the dial queue counts as backed up: a moderate
+	// reference drift (above backpressureLowDrift) then already cuts
+	// concurrency, and concurrency does not grow.
+	backpressureDialShare = 0.5
+	// backpressureRefFailures is how many reference probes in a row may fail
+	// before another reference is picked.
+	backpressureRefFailures = 3
+)
+
+// backpressureController adapts the number of in-flight probes (AIMD) based on
+// local congestion indicators. When high concurrency saturates the local link
+// every IP looks slow and the arm statistics get corrupted, so we back off
+// before that happens.
+//
+// Congestion is detected by probing a known-good reference IP at a fixed interval
+// and comparing its TCP handshake RTT against the lowest RTT seen so far, and by
+// watching the dial queue: the share of in-flight probes still connecting.
+type backpressureController struct {
+	mu sync.Mutex
+
+	limit    int
+	minLimit int
+	maxLimit int
+
+	reference netip.Addr
+	baseline  float64 // lowest reference RTT (ms) seen for the current reference
+	ewma      float64 // smoothed reference RTT (ms)
+	dialShare float64 // smoothed share of in-flight probes still dialing
+
+	// pinned is the reference picked from the results when none is
+	// configured; it is kept until it stops answering, so the baseline
+	// doesn't restart every time the best IP changes.
+	pinned   netip.Addr
+	failures int
+}
+
+func newBackpressureController(minLimit, maxLimit int) *backpressureController {
+	if minLimit <= 0 {
+		minLimit = 1
+	}
+	if maxLimit < minLimit {
+		maxLimit = minLimit
+	}
+	return &backpressureController{
+		limit:    maxLimit,
+		minLimit: minLimit,
+		maxLimit: maxLimit,
+	}
+}
+
+// Limit returns the current in-flight probe limit.
+func (b *backpressureController) Limit() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit
+}
+
+// Observe feeds a reference RTT sample taken while inflight probes were
+// running, dialing of them still connecting. It returns the new limit and
+// whether it changed.
+func (b *backpressureController) Observe(ref netip.Addr, rttMS float64, inflight, dialing int) (int, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	share := 0.0
+	if inflight > 0 {
+		share = min(float64(dialing)/float64(inflight), 1)
+	}
+
+	// A new reference has a different path, so its baseline starts over.
+	if ref != b.reference {
+		b.reference = ref
+		b.baseline = rttMS
+		b.ewma = rttMS
+		b.dialShare = share
+		return b.limit, false
+	}
+
+	if rttMS < b.baseline {
+		b.baseline = rttMS
+	}
+	b.ewma = backpressureEWMA*rttMS + (1-backpressureEWMA)*b.ewma
+	b.dialShare = backpressureEWMA*share + (1-backpressureEWMA)*b.dialShare
+
+	if b.baseline <= 0 {
+		return b.limit, false
+	}
+	drift := b.ewma / b.baseline
+	queued := b.dialShare > backpressureDialShare
+
+	old := b.limit
+	switch {
+	case drift > backpressureHighDrift, queued && drift > backpressureLowDrift:
+		// Multiplicative decrease from what was actually in flight, so a
+		// limit that was never reached doesn't mask the congestion.
+		cur := b.limit
+		if inflight > 0 && inflight < cur {
+			cur = inflight
+		}
+		b.limit = cur * 3 / 4
+	case drift < backpressureLowDrift && !queued:
+		step := b.maxLimit / 20
+		if step < 1 {
+			step = 1
+		}
+		b.limit += step
+	}
+
+	if b.limit < b.minLimit {
+		b.limit = b.minLimit
+	}
+	if b.limit > b.maxLimit {
+		b.limit = b.maxLimit
+	}
+	return b.limit, b.limit != old
+}
+
+// Failed records a reference probe that got no answer. After
+// backpressureRefFailures in a row the pinned reference is dropped.
+func (b *backpressureController) Failed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= backpressureRefFailures {
+		b.pinned = netip.Addr{}
+		b.failures = 0
+	}
+}
+
+// Drift returns the current smoothed reference RTT relative to its baseline.
+func (b *backpressureController) Drift() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.baseline <= 0 {
+		return 1
+	}
+	return b.ewma / b.baseline
+}
+
+// runBackpressure periodically probes the reference IP and adjusts concurrency.
+func (e *Engine) runBackpressure(ctx context.Context, timeout time.Duration) {
+	ticker := time.NewTicker(e.cfg.BackpressureInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ref := e.backpressureReference()
+		if !ref.IsValid() {
+			continue
+		}
+
+		inflight := int(atomic.LoadInt64(&e.submitted) - atomic.LoadInt64(&e.completed))
+		dialing := int(e.dials.Pending())
+		rtt, err := probe.DialRTT(ctx, ref, 443, timeout)
+		if err != nil {
+			e.bp.Failed()
+			continue
+		}
+
+		limit, changed := e.bp.Observe(ref, float64(rtt.Microseconds())/1000, inflight, dialing)
+		if changed && e.cfg.Verbose {
+			fmt.Fprintf(os.Stderr, "backpressure: ref=%s rtt=%.1fms drift=%.2f dialing=%d/%d limit=%d\n",
+				ref.String(), float64(rtt.Microseconds())/1000, e.bp.Drift(), dialing, inflight, limit)
+		}
+	}
+}
+
+// backpressureReference returns the IP used to measure local congestion:
+// the configured reference IP, or else the best successfully probed IP at
+// the time the reference was last picked.
+func (e *Engine) backpressureReference() netip.Addr {
+	if e.cfg.ReferenceIP.IsValid() {
+		return e.cfg.ReferenceIP
+	}
+	e.bp.mu.Lock()
+	defer e.bp.mu.Unlock()
+	if !e.bp.pinned.IsValid() {
+		if best := e.topN.Best(); best.OK {
+			e.bp.pinned = best.IP
+		}
+	}
+	return e.bp.pinned
+}
@@ -0,0 +1,60 @@
+package engine
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// Baseline is the latency of the target over the system's default path
+// (the address its regular DNS answer gives, connected to directly),
+// measured before the search as the point the results are compared with.
+type Baseline struct {
+	Host    string     `json:"host"`
+	IP      netip.Addr `json:"ip,omitzero"`
+	OK      bool       `json:"ok"`
+	ScoreMS float64    `json:"score_ms,omitempty"` // median of the successful probes
+	Probes  int        `json:"probes"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// SetBaseline records b in m and, when both b and the recommendation have
+// a latency, how much faster the recommendation is than b in percent
+// (negative when slower).
+func (m *Meta) SetBaseline(b Baseline) {
+	m.Baseline = &b
+	m.ImprovementPct = 0
+	if b.OK && b.ScoreMS > 0 && m.Recommended.IsValid() {
+		m.ImprovementPct = 100 * (b.ScoreMS - m.ScoreMS) / b.ScoreMS
+	}
+}
+
+// ImprovedOver returns the working results of top at least minPct percent
+// faster than b, in order. If b failed nothing can be shown to beat it, so
+// there are none: a DNS failure or a blocked default route must not let
+// every result through.
+func ImprovedOver(top []TopResult, b Baseline, minPct float64) []TopResult {
+	if !b.OK {
+		return nil
+	}
+	limit := b.ScoreMS * (1 - minPct/100)
+	var out []TopResult
+	for _, r := range top {
+		if r.OK && r.ScoreMS <= limit {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// NoImprovement is the Meta of a search none of whose results beat b by
+// minPct percent, or whose baseline b failed, advising to stay on the
+// default path.
+func NoImprovement(b Baseline, minPct float64) Meta {
+	m := Meta{Baseline: &b, MinImprovementPct: minPct}
+	if b.OK {
+		m.Verdict = fmt.Sprintf("No IP is at least %g%% faster than the default route (%.0fms); keep using it.", minPct, b.ScoreMS)
+	} else {
+		m.Verdict = fmt.Sprintf("The default route could not be measured (%s), so no IP can be shown to be %g%% faster; keep the current setup.", b.Error, minPct)
+	}
+	return m
+}
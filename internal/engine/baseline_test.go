@@ -0,0 +1,29 @@
+package engine
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestImprovedOver(t *testing.T) {
+	top := []TopResult{
+		{IP: netip.MustParseAddr("198.18.0.1"), OK: true, ScoreMS: 40},
+		{IP: netip.MustParseAddr("198.18.0.2"), OK: true, ScoreMS: 85},
+		{IP: netip.MustParseAddr("198.18.0.3"), OK: false},
+	}
+	for _, tc := range []struct {
+		name string
+		base Baseline
+		want int
+	}{
+		{"faster", Baseline{OK: true, ScoreMS: 100}, 2},
+		{"margin", Baseline{OK: true, ScoreMS: 50}, 1},
+		{"none", Baseline{OK: true, ScoreMS: 30}, 0},
+		// A default route that could not be measured gates everything out.
+		{"failed", Baseline{Error: "lookup: no such host"}, 0},
+	} {
+		if got := ImprovedOver(top, tc.base, 10); len(got) != tc.want {
+			t.Errorf("%s: %d results pass, want %d", tc.name, len(got), tc.want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Budget units (see Config.BudgetUnit).
+const (
+	// BudgetProbes counts every completed probe against the budget.
+	BudgetProbes = "probes"
+	// BudgetSuccesses counts only successful probes, so a search keeps
+	// going until it has Budget usable measurements.
+	BudgetSuccesses = "successes"
+)
+
+// successBudgetProbes caps a search budgeted in successes at this many
+// probes per unit of budget, so ranges that hardly ever answer cannot keep
+// it running forever.
+const successBudgetProbes = 10
+
+// spent returns the budget used so far, in Config.BudgetUnit.
+func (e *Engine) spent() int64 {
+	if e.cfg.BudgetUnit == BudgetSuccesses {
+		return atomic.LoadInt64(&e.succeeded)
+	}
+	return atomic.LoadInt64(&e.completed)
+}
+
+// probeLimit returns the most probes the search may submit.
+func (e *Engine) probeLimit() int64 {
+	if e.cfg.BudgetUnit == BudgetSuccesses {
+		return int64(e.cfg.Budget) * successBudgetProbes
+	}
+	return int64(e.cfg.Budget)
+}
+
+// budgetMet reports whether the search has used up its budget or its time.
+func (e *Engine) budgetMet() bool {
+	return e.spent() >= int64(e.cfg.Budget) || atomic.LoadInt64(&e.completed) >= e.probeLimit() || e.pastDeadline()
+}
+
+// pastDeadline reports whether Config.Deadline has passed.
+func (e *Engine) pastDeadline() bool {
+	return !e.cfg.Deadline.IsZero() && !time.Now().Before(e.cfg.Deadline)
+}
+
+// inflightNeeded reports whether more probes are needed to meet a budget
+// in successes: the probes in flight, at the success rate so far, are not
+// expected to bring in the successes still missing. Budgets in probes are
+// met exactly and always need more until probeLimit.
+func (e *Engine) inflightNeeded(submitted int64) bool {
+	if e.cfg.BudgetUnit != BudgetSuccesses {
+		return true
+	}
+	completed := atomic.LoadInt64(&e.completed)
+	succeeded := atomic.LoadInt64(&e.succeeded)
+	if completed == 0 || succeeded == 0 {
+		return true
+	}
+	rate := float64(succeeded) / float64(completed)
+	expected := float64(submitted-completed) * rate
+	return float64(succeeded)+expected < float64(e.cfg.Budget)
+}
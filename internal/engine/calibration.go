@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/probe"
+)
+
+const (
+	// calibrationEWMA is the smoothing factor for reference latency samples.
+	calibrationEWMA = 0.3
+	// Bounds for the drift factor, so a single broken reference probe can't
+	// rescale every score by an absurd amount.
+	calibrationMinFactor = 0.5
+	calibrationMaxFactor = 3.0
+	// calibrationWarmup is how many reference samples are averaged into the
+	// initial baseline, so one unlucky first probe doesn't skew every score.
+	calibrationWarmup = 3
+	// calibrationRebaseline is how far the baseline moves toward the smoothed
+	// latency with each later sample. Short-term drift is still corrected,
+	// but a lasting change of the reference path (a reroute, a new uplink)
+	// stops counting as drift after a few dozen samples.
+	calibrationRebaseline = 0.02
+)
+
+// referenceCalibrator tracks the latency drift of a fixed reference IP over the
+// course of a run. Scores are divided by the drift factor so results measured
+// at minute 1 and minute 20 of a long run stay comparable despite local
+// network fluctuations.
+type referenceCalibrator struct {
+	mu       sync.RWMutex
+	baseline float64 // reference latency (ms) scores are normalized to
+	current  float64 // smoothed reference latency (ms)
+	samples  int
+}
+
+// Observe records a successful reference probe latency.
+func (c *referenceCalibrator) Observe(latencyMS float64) {
+	if latencyMS <= 0 {
+		latencyMS = 1
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.samples++
+	if c.samples <= calibrationWarmup {
+		// Running mean of the warm-up samples.
+		c.baseline += (latencyMS - c.baseline) / float64(c.samples)
+		c.current = c.baseline
+		return
+	}
+	c.current = calibrationEWMA*latencyMS + (1-calibrationEWMA)*c.current
+	c.baseline += calibrationRebaseline * (c.current - c.baseline)
+}
+
+// Factor returns current/baseline latency of the reference (1 = no drift).
+func (c *referenceCalibrator) Factor() float64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.samples == 0 || c.baseline <= 0 {
+		return 1
+	}
+	f := c.current / c.baseline
+	if f < calibrationMinFactor {
+		f = calibrationMinFactor
+	}
+	if f > calibrationMaxFactor {
+		f = calibrationMaxFactor
+	}
+	return f
+}
+
+// Adjust normalizes a latency measured now to the baseline conditions.
+func (c *referenceCalibrator) Adjust(latencyMS float64) float64 {
+	return latencyMS / c.Factor()
+}
+
+// calibrateOnce probes the reference IP and records the result.
+func (e *Engine) calibrateOnce(ctx context.Context, prober *probe.Prober, timeout time.Duration) {
+	pctx, cancel := context.WithTimeout(ctx, timeout)
+	res := prober.ProbeHTTPTrace(pctx, e.cfg.ReferenceIP)
+	cancel()
+
+	if !res.OK {
+		if e.cfg.Verbose {
+			fmt.Fprintf(os.Stderr, "reference: ip=%s probe failed: %s\n", e.cfg.ReferenceIP.String(), res.Error)
+		}
+		return
+	}
+
+	e.calib.Observe(float64(res.TotalMS))
+	if e.cfg.Verbose {
+		fmt.Fprintf(os.Stderr, "reference: ip=%s latency=%dms drift=%.2f\n",
+			e.cfg.ReferenceIP.String(), res.TotalMS, e.calib.Factor())
+	}
+}
+
+// runCalibration periodically probes the reference IP until ctx is done.
+func (e *Engine) runCalibration(ctx context.Context, prober *probe.Prober, timeout time.Duration) {
+	ticker := time.NewTicker(e.cfg.ReferenceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.calibrateOnce(ctx, prober, timeout)
+		}
+	}
+}
@@ -4,26 +4,75 @@ package engine
 
 import (
 	"fmt"
+	"net/netip"
 	"time"
 
 	"github.com/zhaiiker/montecarlo-ip-searcher/internal/bandit"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/priors"
 	"github.com/zhaiiker/montecarlo-ip-searcher/internal/probe"
 )
 
+// RewardFunc maps a raw probe result to the value the engine optimizes.
+// reward is a cost in milliseconds (lower is better, like ScoreMS) that
+// replaces the measured latency in both arm statistics and ranking; ok
+// decides whether the probe counts as a success. Failed probes are still
+// scored with the timeout penalty regardless of the returned reward.
+//
+// It is called from the scheduling goroutine only, so it need not be
+// safe for concurrent use. The result's Body is only available to it: the
+// engine drops the body once the function has run.
+type RewardFunc func(probe.Result) (reward float64, ok bool)
+
 // Config holds all configuration for the search engine.
 type Config struct {
-	// Budget is the total number of probes to perform.
+	// Budget is the total number of probes to perform, or of successful
+	// probes to collect with BudgetUnit BudgetSuccesses.
 	Budget int
 
+	// BudgetUnit is what Budget counts: BudgetProbes (default) or
+	// BudgetSuccesses. A budget in successes stops after at most
+	// successBudgetProbes probes per unit.
+	BudgetUnit string
+
 	// TopN is the number of top results to keep.
 	TopN int
 
 	// Concurrency is the number of parallel probe workers.
 	Concurrency int
 
+	// MaxInflight caps submitted but not yet completed probes, which also
+	// sizes the task queue (0 = 2x Concurrency). Values above Concurrency
+	// keep probes queued for idle workers; lower values throttle slow links.
+	MaxInflight int
+
+	// Throttle, if set, paces probes under a probe rate and bandwidth
+	// ceiling. It may be shared with download tests run outside the engine
+	// so they count against the same bandwidth.
+	Throttle *probe.Throttle
+
+	// Shared, if set, is the probe pool and negative cache this search
+	// shares with others running in the same process (see Shared).
+	Shared *Shared
+
+	// Priors, if set, seeds the posterior of every new arm with what
+	// earlier searches learned about its prefix (see priors.Pack.Lookup).
+	Priors *priors.Pack
+
+	// SlowStart ramps the in-flight limit up from a small window, growing
+	// it by one per completed probe (doubling per round trip), instead of
+	// submitting the full limit at once.
+	SlowStart bool
+
 	// Heads is the number of search heads for diversity.
 	Heads int
 
+	// HeadsV4 and HeadsV6 dedicate that many heads to IPv4 and IPv6
+	// prefixes, so with mixed roots neither family is starved by quicker
+	// wins in the other. Heads is raised to their sum if needed; the
+	// remaining heads roam over both families. 0 dedicates none.
+	HeadsV4 int
+	HeadsV6 int
+
 	// Beam is the width of the beam search per head.
 	Beam int
 
@@ -33,6 +82,11 @@ type Config struct {
 	// SplitStepV6 is the prefix bits to add when splitting IPv6.
 	SplitStepV6 int
 
+	// SplitPolicy orders the prefixes considered for splitting:
+	// bandit.SplitBest, SplitUncertain, SplitVariance or SplitHybrid
+	// (default).
+	SplitPolicy string
+
 	// MinSamplesSplit is the minimum samples before a prefix can be split.
 	MinSamplesSplit int
 
@@ -42,17 +96,190 @@ type Config struct {
 	// MaxBitsV6 is the maximum prefix length for IPv6 drill-down.
 	MaxBitsV6 int
 
+	// DeepDrillV4 lets IPv4 prefixes that are consistently excellent but
+	// dispersed keep splitting past MaxBitsV4, down to this length, to
+	// single out standout addresses (0 = off; see bandit.TreeConfig).
+	DeepDrillV4 int
+
+	// SplitOnThroughput also splits prefixes whose measured throughput
+	// varies widely, so congested and uncongested subnets are told apart
+	// (see Engine.ObserveThroughput).
+	SplitOnThroughput bool
+
+	// ThroughputFunc, if set, runs the integrated bandwidth phase: during
+	// the search one in ThroughputEvery successful probes is followed by
+	// a throughput measurement of the same IP, which goes into the
+	// throughput posterior of its prefix. See ThroughputFunc.
+	ThroughputFunc ThroughputFunc
+
+	// ThroughputEvery is how many successful probes there are per
+	// throughput measurement (0 = defaultThroughputEvery).
+	ThroughputEvery int
+
 	// Seed is the random seed (0 = time-based).
 	Seed int64
 
 	// Verbose enables progress output to stderr.
 	Verbose bool
 
+	// QuietProgress suppresses the once-a-second verbose progress line,
+	// for callers that render progress themselves (see OnEpoch).
+	QuietProgress bool
+
 	// SplitInterval is how often to check for split opportunities (by samples).
 	SplitInterval int
 
 	// DiversityWeight controls how much diversity affects arm selection (0-1).
 	DiversityWeight float64
+
+	// Backpressure enables adaptive concurrency that backs off when local
+	// congestion starts inflating measured latency.
+	Backpressure bool
+
+	// BackpressureInterval is how often the reference RTT is sampled.
+	BackpressureInterval time.Duration
+
+	// MinConcurrency is the lower bound for adaptive concurrency.
+	MinConcurrency int
+
+	// AutoConcurrency tunes the in-flight probe limit from the probes'
+	// outcomes (see concurrencyTuner), between MinConcurrency and
+	// Concurrency, starting at the former.
+	AutoConcurrency bool
+
+	// ReferenceIP is a known-good IP probed at regular intervals. Its latency
+	// drift is used to normalize scores over the course of a run.
+	ReferenceIP netip.Addr
+
+	// ReferenceInterval is how often the reference IP is probed.
+	ReferenceInterval time.Duration
+
+	// BreakerThreshold is the number of consecutive hard failures (connection
+	// refused/reset) after which a prefix is suspended (0 = disabled).
+	BreakerThreshold int
+
+	// BreakerCooldown is how long a suspended prefix is skipped before it is
+	// retried.
+	BreakerCooldown time.Duration
+
+	// FailFastThreshold aborts the search with a *FailFastError when the
+	// first FailFastThreshold probes all fail, since that points at a
+	// misconfiguration rather than bad IPs (0 = disabled).
+	FailFastThreshold int
+
+	// MaxWaste ends the search early once probes of already-probed
+	// addresses reach this share of the budget: the search space has been
+	// sampled out and the rest of the budget would only repeat it (see
+	// Waste; 0 = never).
+	MaxWaste float64
+
+	// FailureModel selects how failed probes bear on latency estimates:
+	// FailureBetaOnly (default), FailurePseudoLatency or FailureHazard.
+	FailureModel string
+
+	// TimeoutPenalty and RefusalPenalty are the weights of the pessimistic
+	// latency a failed probe adds to its prefix's latency estimate under
+	// FailurePseudoLatency (twice the timeout) and, for timeouts,
+	// FailureHazard. A timeout suggests a slow or lossy path and is
+	// penalised on both; a connection refused or reset right away says
+	// nothing about latency, so it mostly counts as a failure (0 = failures
+	// leave the latency estimate alone).
+	TimeoutPenalty float64
+	RefusalPenalty float64
+
+	// RewardFunc overrides the default latency-based scoring (nil = TotalMS
+	// for successful probes). See RewardFunc.
+	RewardFunc RewardFunc
+
+	// Objective selects what the search optimizes: ObjectiveIP (default) or
+	// ObjectivePrefixRanking.
+	Objective string
+
+	// RankBitsV4 is the IPv4 prefix length ranked in prefix-ranking mode.
+	RankBitsV4 int
+
+	// RankBitsV6 is the IPv6 prefix length ranked in prefix-ranking mode.
+	RankBitsV6 int
+
+	// Colos, if set, restricts results to these Cloudflare data centers
+	// (trace colo, case-insensitive). Probes served elsewhere count as
+	// failures, so the search steers away from ranges routed to them.
+	Colos []string
+
+	// PreferCache, if set to probe.CacheHit or probe.CacheMiss, scores
+	// only responses with that cache status: a fast answer from the edge
+	// cache says little about the latency of dynamic requests, and the
+	// other way round. Responses whose status is unknown are scored
+	// either way; the others are left out of the statistics and results.
+	PreferCache string
+
+	// GroupBy, if set to one of the Group* trace fields, keeps at most
+	// PerGroup results per value of that field in the response, so the top
+	// list spans e.g. several data centers instead of the best one only.
+	GroupBy  string
+	PerGroup int
+
+	// PhaseBitsV6 splits an IPv6 search into two phases: first find the
+	// responsive prefixes of this length, then drill below them (see
+	// bandit.ArmTree.StartDrill). 0 searches in a single phase.
+	PhaseBitsV6 int
+
+	// DrillAfter is the share of the budget the first IPv6 phase gets.
+	DrillAfter float64
+
+	// MinCoverage is how many distinct /24s (/48s for IPv6) of each root
+	// must have been sampled, or all of a smaller root's, before sampling
+	// starts exploiting the best prefixes found; until then it only
+	// explores. Exploitation starts at half the budget regardless
+	// (0 = exploit from the start).
+	MinCoverage int
+
+	// SubnetsPerPrefixV6 caps the distinct /64s sampled in an IPv6 prefix
+	// of PhaseBitsV6 (/48 in a single phase) or longer; further samples
+	// revisit those /64s (0 = unlimited).
+	SubnetsPerPrefixV6 int
+
+	// SuffixesV6 are interface IDs (the low 64 bits, e.g. 1 for ::1) tried
+	// in order in every IPv6 /64 before random host bits: CDNs and
+	// gateways tend to answer on low, hand-assigned addresses while most
+	// of a /64 is empty (nil = random host bits only).
+	SuffixesV6 []uint64
+
+	// Ports, if set, are the ports tried on every address, each an arm of
+	// its own chosen by Thompson Sampling next to the prefix (see
+	// bandit.PortArms); empty probes the probe type's default port.
+	Ports []uint16
+
+	// MaxMemory caps the heap of the process in bytes: nearing it, the
+	// search drops its deduplication set and prunes the worst ranges of
+	// its tree, then throttles probes until the heap shrinks (see
+	// checkMemory; 0 = no cap). Pair it with debug.SetMemoryLimit so the
+	// garbage collector works to the same cap.
+	MaxMemory int64
+
+	// AutoBudget derives Budget from the size of the search space (see
+	// AutoScale) instead of using the configured value.
+	AutoBudget bool
+
+	// Deadline, if set, ends the search at that time as if its budget were
+	// met: no new probes are submitted and those in flight are finished.
+	Deadline time.Time
+
+	// AutoMaxBits derives MaxBitsV4/MaxBitsV6 from the search space.
+	AutoMaxBits bool
+
+	// AutoHeads derives Heads from the number and spread of the roots.
+	AutoHeads bool
+
+	// OnProbe, if set, is called with every completed probe (rate-limited
+	// probes excluded) as soon as it has been scored. It is called from the
+	// scheduling goroutine and should return quickly.
+	OnProbe func(ProbeResult)
+
+	// OnEpoch, if set, is called about once a second during a search and
+	// once at its end with a summary of progress (see Epoch). It is called
+	// from the scheduling goroutine and should return quickly.
+	OnEpoch func(Epoch)
 }
 
 // Request holds the input for a search run.
@@ -63,6 +290,13 @@ type Request struct {
 	// CIDRFile is a path to a file containing CIDRs.
 	CIDRFile string
 
+	// Prefixes are additional, already parsed prefixes to search.
+	Prefixes []netip.Prefix
+
+	// Exclude lists ranges that are never probed even if they fall inside
+	// a searched prefix (e.g. bogons in global mode).
+	Exclude []netip.Prefix
+
 	// Probe is the probe configuration.
 	Probe probe.Config
 }
@@ -71,12 +305,14 @@ type Request struct {
 func DefaultConfig() Config {
 	return Config{
 		Budget:          2000,
+		BudgetUnit:      BudgetProbes,
 		TopN:            20,
 		Concurrency:     200,
 		Heads:           4,
 		Beam:            32,
 		SplitStepV4:     2,
 		SplitStepV6:     4,
+		SplitPolicy:     bandit.SplitHybrid,
 		MinSamplesSplit: 5, // Lower threshold for faster drill-down
 		MaxBitsV4:       24,
 		MaxBitsV6:       56,
@@ -84,6 +320,30 @@ func DefaultConfig() Config {
 		Verbose:         false,
 		SplitInterval:   20, // Check more frequently
 		DiversityWeight: 0.3,
+
+		BackpressureInterval: 2 * time.Second,
+		MinConcurrency:       8,
+
+		ReferenceInterval: 30 * time.Second,
+
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+
+		FailFastThreshold: 50,
+		MaxWaste:          0.2,
+
+		FailureModel:   FailureBetaOnly,
+		TimeoutPenalty: 0.5,
+		RefusalPenalty: 0.05,
+
+		PhaseBitsV6:        48,
+		DrillAfter:         0.3,
+		SubnetsPerPrefixV6: 16,
+		MinCoverage:        8,
+
+		Objective:  ObjectiveIP,
+		RankBitsV4: 24,
+		RankBitsV6: 48,
 	}
 }
 
@@ -92,6 +352,9 @@ func (c *Config) Validate() error {
 	if c.Budget <= 0 {
 		return fmt.Errorf("budget must be > 0, got %d", c.Budget)
 	}
+	if c.BudgetUnit != BudgetProbes && c.BudgetUnit != BudgetSuccesses {
+		return fmt.Errorf("budgetUnit must be %q or %q, got %q", BudgetProbes, BudgetSuccesses, c.BudgetUnit)
+	}
 	if c.TopN <= 0 {
 		return fmt.Errorf("topN must be > 0, got %d", c.TopN)
 	}
@@ -101,6 +364,9 @@ func (c *Config) Validate() error {
 	if c.Heads <= 0 {
 		return fmt.Errorf("heads must be > 0, got %d", c.Heads)
 	}
+	if c.HeadsV4 < 0 || c.HeadsV6 < 0 {
+		return fmt.Errorf("headsV4 and headsV6 must be >= 0, got %d and %d", c.HeadsV4, c.HeadsV6)
+	}
 	if c.Beam <= 0 {
 		return fmt.Errorf("beam must be > 0, got %d", c.Beam)
 	}
@@ -110,6 +376,9 @@ func (c *Config) Validate() error {
 	if c.SplitStepV6 <= 0 || c.SplitStepV6 > 16 {
 		return fmt.Errorf("splitStepV6 must be in [1,16], got %d", c.SplitStepV6)
 	}
+	if c.ThroughputEvery <= 0 {
+		c.ThroughputEvery = defaultThroughputEvery
+	}
 	if c.MinSamplesSplit <= 0 {
 		return fmt.Errorf("minSamplesSplit must be > 0, got %d", c.MinSamplesSplit)
 	}
@@ -119,9 +388,79 @@ func (c *Config) Validate() error {
 	if c.MaxBitsV6 <= 0 || c.MaxBitsV6 > 128 {
 		return fmt.Errorf("maxBitsV6 must be in [1,128], got %d", c.MaxBitsV6)
 	}
+	if c.DeepDrillV4 < 0 || c.DeepDrillV4 > 32 {
+		return fmt.Errorf("deepDrillV4 must be in [0,32], got %d", c.DeepDrillV4)
+	}
 	if c.DiversityWeight < 0 || c.DiversityWeight > 1 {
 		return fmt.Errorf("diversityWeight must be in [0,1], got %f", c.DiversityWeight)
 	}
+	if !bandit.ValidSplitPolicy(c.SplitPolicy) {
+		return fmt.Errorf("splitPolicy must be %q, %q, %q or %q, got %q",
+			bandit.SplitBest, bandit.SplitUncertain, bandit.SplitVariance, bandit.SplitHybrid, c.SplitPolicy)
+	}
+	switch c.Objective {
+	case ObjectiveIP, ObjectivePrefixRanking:
+	default:
+		return fmt.Errorf("objective must be %q or %q, got %q", ObjectiveIP, ObjectivePrefixRanking, c.Objective)
+	}
+	switch c.PreferCache {
+	case "", probe.CacheHit, probe.CacheMiss:
+	default:
+		return fmt.Errorf("preferCache must be %q or %q, got %q", probe.CacheHit, probe.CacheMiss, c.PreferCache)
+	}
+	if c.PhaseBitsV6 < 0 || c.PhaseBitsV6 > 128 {
+		return fmt.Errorf("phaseBitsV6 must be in [0,128], got %d", c.PhaseBitsV6)
+	}
+	if c.DrillAfter < 0 || c.DrillAfter > 1 {
+		return fmt.Errorf("drillAfter must be in [0,1], got %f", c.DrillAfter)
+	}
+	if c.MinCoverage < 0 {
+		return fmt.Errorf("minCoverage must be >= 0, got %d", c.MinCoverage)
+	}
+	if c.SubnetsPerPrefixV6 < 0 {
+		return fmt.Errorf("subnetsPerPrefixV6 must be >= 0, got %d", c.SubnetsPerPrefixV6)
+	}
+	if !ValidGroupBy(c.GroupBy) {
+		return fmt.Errorf("groupBy must be %q, %q, %q or %q, got %q", GroupColo, GroupLoc, GroupHTTP, GroupWarp, c.GroupBy)
+	}
+	if c.PerGroup < 0 {
+		return fmt.Errorf("perGroup must be >= 0, got %d", c.PerGroup)
+	}
+	if c.RankBitsV4 <= 0 || c.RankBitsV4 > 32 {
+		return fmt.Errorf("rankBitsV4 must be in [1,32], got %d", c.RankBitsV4)
+	}
+	if c.RankBitsV6 <= 0 || c.RankBitsV6 > 128 {
+		return fmt.Errorf("rankBitsV6 must be in [1,128], got %d", c.RankBitsV6)
+	}
+	if c.BreakerThreshold < 0 {
+		return fmt.Errorf("breakerThreshold must be >= 0, got %d", c.BreakerThreshold)
+	}
+	if c.FailFastThreshold < 0 {
+		return fmt.Errorf("failFastThreshold must be >= 0, got %d", c.FailFastThreshold)
+	}
+	if c.MaxWaste < 0 || c.MaxWaste > 1 {
+		return fmt.Errorf("maxWaste must be in [0,1], got %f", c.MaxWaste)
+	}
+	switch c.FailureModel {
+	case FailureBetaOnly, FailurePseudoLatency, FailureHazard:
+	default:
+		return fmt.Errorf("failureModel must be %q, %q or %q, got %q", FailureBetaOnly, FailurePseudoLatency, FailureHazard, c.FailureModel)
+	}
+	if c.TimeoutPenalty < 0 || c.TimeoutPenalty > 1 {
+		return fmt.Errorf("timeoutPenalty must be in [0,1], got %f", c.TimeoutPenalty)
+	}
+	if c.RefusalPenalty < 0 || c.RefusalPenalty > 1 {
+		return fmt.Errorf("refusalPenalty must be in [0,1], got %f", c.RefusalPenalty)
+	}
+	if c.MaxMemory < 0 {
+		return fmt.Errorf("maxMemory must be >= 0, got %d", c.MaxMemory)
+	}
+	if c.MaxInflight < 0 {
+		return fmt.Errorf("maxInflight must be >= 0, got %d", c.MaxInflight)
+	}
+	if c.MinConcurrency <= 0 || c.MinConcurrency > c.Concurrency {
+		return fmt.Errorf("minConcurrency must be in [1,%d], got %d", c.Concurrency, c.MinConcurrency)
+	}
 	return nil
 }
 
@@ -132,12 +471,18 @@ func (c *Config) ApplyDefaults() {
 	if c.Budget <= 0 {
 		c.Budget = defaults.Budget
 	}
+	if c.BudgetUnit == "" {
+		c.BudgetUnit = defaults.BudgetUnit
+	}
 	if c.TopN <= 0 {
 		c.TopN = defaults.TopN
 	}
 	if c.Concurrency <= 0 {
 		c.Concurrency = defaults.Concurrency
 	}
+	if c.MaxInflight <= 0 {
+		c.MaxInflight = c.Concurrency * 2
+	}
 	if c.Heads <= 0 {
 		c.Heads = defaults.Heads
 	}
@@ -165,16 +510,68 @@ func (c *Config) ApplyDefaults() {
 	if c.DiversityWeight <= 0 {
 		c.DiversityWeight = defaults.DiversityWeight
 	}
+	if c.BackpressureInterval <= 0 {
+		c.BackpressureInterval = defaults.BackpressureInterval
+	}
+	if c.MinConcurrency <= 0 {
+		c.MinConcurrency = defaults.MinConcurrency
+	}
+	if c.MinConcurrency > c.Concurrency {
+		c.MinConcurrency = c.Concurrency
+	}
+	if c.ReferenceInterval <= 0 {
+		c.ReferenceInterval = defaults.ReferenceInterval
+	}
+	// BreakerThreshold, FailFastThreshold, MaxWaste, TimeoutPenalty,
+	// RefusalPenalty, PhaseBitsV6, SubnetsPerPrefixV6, MinCoverage and
+	// DeepDrillV4 are left alone: 0 disables them. So is DrillAfter,
+	// where 0 drills into responsive prefixes right away.
+	if c.BreakerCooldown <= 0 {
+		c.BreakerCooldown = defaults.BreakerCooldown
+	}
+	if c.SplitPolicy == "" {
+		c.SplitPolicy = defaults.SplitPolicy
+	}
+	if c.Objective == "" {
+		c.Objective = defaults.Objective
+	}
+	if c.FailureModel == "" {
+		c.FailureModel = defaults.FailureModel
+	}
+	if c.GroupBy != "" && c.PerGroup <= 0 {
+		c.PerGroup = 1
+	}
+	if c.RankBitsV4 <= 0 {
+		c.RankBitsV4 = defaults.RankBitsV4
+	}
+	if c.RankBitsV6 <= 0 {
+		c.RankBitsV6 = defaults.RankBitsV6
+	}
 }
 
 // ToTreeConfig converts to bandit.TreeConfig.
+// In prefix-ranking mode the tree drills down exactly to the ranking depth,
+// never deeper.
 func (c *Config) ToTreeConfig() bandit.TreeConfig {
+	maxBitsV4, maxBitsV6, deepBitsV4 := c.MaxBitsV4, c.MaxBitsV6, c.DeepDrillV4
+	if c.Objective == ObjectivePrefixRanking {
+		maxBitsV4, maxBitsV6, deepBitsV4 = c.RankBitsV4, c.RankBitsV6, 0
+	}
 	return bandit.TreeConfig{
 		SplitStepV4: c.SplitStepV4,
 		SplitStepV6: c.SplitStepV6,
-		MaxBitsV4:   c.MaxBitsV4,
-		MaxBitsV6:   c.MaxBitsV6,
+		MaxBitsV4:   maxBitsV4,
+		MaxBitsV6:   maxBitsV6,
 		MinSamples:  c.MinSamplesSplit,
+		SplitPolicy: c.SplitPolicy,
+
+		BreakerThreshold: c.BreakerThreshold,
+		BreakerCooldown:  c.BreakerCooldown,
+
+		PhaseBitsV6: c.PhaseBitsV6,
+		DeepBitsV4:  deepBitsV4,
+
+		SplitOnThroughput: c.SplitOnThroughput,
 	}
 }
 
@@ -187,6 +584,8 @@ func (c *Config) ToHeadManagerConfig(timeoutMS float64) bandit.HeadManagerConfig
 		HistorySize:     c.Beam,
 		DiversityWeight: c.DiversityWeight,
 		RepulsionDecay:  0.5,
+		HeadsV4:         c.HeadsV4,
+		HeadsV6:         c.HeadsV6,
 	}
 }
 
@@ -0,0 +1,240 @@
+package engine
+
+import (
+	"errors"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/bandit"
+)
+
+// ErrNotRunning is returned by the mid-run control methods when no search is
+// in progress.
+var ErrNotRunning = errors.New("engine is not running")
+
+// ErrRootOverlap is returned by AddRoots for a prefix that overlaps a root
+// of the search without being one.
+var ErrRootOverlap = bandit.ErrOverlap
+
+// AddRoots adds new root prefixes to a search in progress. Prefixes that
+// already are roots are ignored; if one overlaps a root (or another of
+// prefixes), nothing is added and the error wraps ErrRootOverlap. Returns
+// the number of roots added.
+func (e *Engine) AddRoots(prefixes []netip.Prefix) (int, error) {
+	if !e.live.Load() {
+		return 0, ErrNotRunning
+	}
+
+	nodes, err := e.tree.AddRoots(prefixes)
+	if err != nil || len(nodes) == 0 {
+		return 0, err
+	}
+	added := make([]netip.Prefix, len(nodes))
+	for i, n := range nodes {
+		added[i] = n.Prefix
+	}
+
+	// Adding a range lifts earlier removals within it.
+	e.removedMu.Lock()
+	kept := e.removed[:0]
+	for _, r := range e.removed {
+		readded := false
+		for _, p := range added {
+			if p.Bits() <= r.Bits() && p.Contains(r.Addr()) {
+				readded = true
+				break
+			}
+		}
+		if !readded {
+			kept = append(kept, r)
+		}
+	}
+	e.removed = kept
+	e.removedMu.Unlock()
+
+	for _, p := range added {
+		e.subnets.forget(p)
+	}
+	e.coverage.add(added, e.cfg.MinCoverage)
+	e.seedPriors(nodes)
+	return len(nodes), nil
+}
+
+// RemovePrefix drops a prefix (and everything below it) from a search in
+// progress: no new probes are sampled from it, results for in-flight probes
+// are discarded, and matching entries are removed from the top results.
+// Returns the number of tree nodes removed.
+func (e *Engine) RemovePrefix(prefix netip.Prefix) (int, error) {
+	if !e.live.Load() {
+		return 0, ErrNotRunning
+	}
+	prefix = prefix.Masked()
+
+	e.removedMu.Lock()
+	e.removed = append(e.removed, prefix)
+	e.removedMu.Unlock()
+
+	n := e.tree.RemovePrefix(prefix)
+	e.topN.RemoveWithin(prefix)
+	e.subnets.forget(prefix)
+	e.coverage.drop(prefix)
+	return n, nil
+}
+
+// ObserveThroughput feeds a throughput measurement of ip, in Mbps, to the
+// arm that owns it during a search, for throughput-aware splitting (see
+// Config.SplitOnThroughput). It reports whether an arm took it.
+func (e *Engine) ObserveThroughput(ip netip.Addr, mbps float64) (bool, error) {
+	if !e.live.Load() {
+		return false, ErrNotRunning
+	}
+	if mbps < 0 {
+		return false, nil
+	}
+	return e.tree.UpdateThroughput(ip, mbps), nil
+}
+
+// Progress returns the budget spent so far and the total budget, in
+// Config.BudgetUnit: completed probes, or successful ones.
+func (e *Engine) Progress() (spent, budget int64) {
+	return e.spent(), int64(e.cfg.Budget)
+}
+
+// Top returns the best results of the current (or last) search so far,
+// best first.
+func (e *Engine) Top() []TopResult {
+	if !e.started.Load() {
+		return nil
+	}
+	return e.topN.Snapshot()
+}
+
+// Running reports whether a search is in progress.
+func (e *Engine) Running() bool {
+	return e.live.Load()
+}
+
+// LastProbe returns when the last probe completed (zero if none yet).
+func (e *Engine) LastProbe() time.Time {
+	return unixNanoTime(e.lastProbe.Load())
+}
+
+// LastOK returns when the last successful probe completed (zero if none yet).
+func (e *Engine) LastOK() time.Time {
+	return unixNanoTime(e.lastOK.Load())
+}
+
+// TreeDump is a snapshot of the search tree (see Engine.TreeSnapshot).
+type TreeDump struct {
+	Time      time.Time `json:"time"`
+	Running   bool      `json:"running"`
+	Completed int64     `json:"completed"`
+	Budget    int64     `json:"budget"`
+	Nodes     int       `json:"nodes"`
+
+	// HistogramBoundsMS are the upper bounds of the latency histogram
+	// buckets of each node; the last bucket has none.
+	HistogramBoundsMS []float64 `json:"histogram_bounds_ms"`
+
+	// Stats are those of the last finished search, nil during the first.
+	Stats *RunStats `json:"stats,omitempty"`
+
+	Roots []bandit.NodeSnapshot `json:"roots"`
+}
+
+// TreeSnapshot returns the full arm tree with posterior parameters, sample
+// counts and split lineage. It can be called during or after a run; before
+// the first run the tree is empty.
+func (e *Engine) TreeSnapshot() TreeDump {
+	d := TreeDump{
+		Time:      time.Now(),
+		Running:   e.live.Load(),
+		Completed: atomic.LoadInt64(&e.completed),
+		Budget:    int64(e.cfg.Budget),
+
+		HistogramBoundsMS: bandit.LatencyBucketBounds[:],
+	}
+	if !e.started.Load() {
+		return d
+	}
+	d.Stats = e.lastStats()
+	d.Nodes = e.tree.Size()
+	d.Roots = e.tree.Snapshot()
+	return d
+}
+
+// Status is a point-in-time summary of a search (see Engine.Status).
+type Status struct {
+	Running   bool  `json:"running"`
+	Completed int64 `json:"completed"`
+	Succeeded int64 `json:"succeeded"`
+	Budget    int64 `json:"budget"`
+	Nodes     int   `json:"nodes"`
+
+	// BudgetUnit is what Budget counts: completed probes or successes.
+	BudgetUnit string `json:"budget_unit"`
+
+	// CompletedV4 and CompletedV6 split Completed by address family.
+	CompletedV4 int64 `json:"completed_v4"`
+	CompletedV6 int64 `json:"completed_v6"`
+
+	// Waste counts sampling attempts that bought no useful probe.
+	Waste Waste `json:"waste"`
+
+	// Best is the best result so far, nil before the first result.
+	Best *TopResult `json:"best,omitempty"`
+
+	// Heads is the prefix each search head is currently focused on.
+	Heads []netip.Prefix `json:"heads,omitempty"`
+
+	// Memory is the heap and goroutine count of the process.
+	Memory MemoryUsage `json:"memory"`
+}
+
+// Status returns the progress, best result and per-head focus of the
+// current (or last) search.
+func (e *Engine) Status() Status {
+	st := Status{
+		Running:   e.live.Load(),
+		Completed: atomic.LoadInt64(&e.completed),
+		Succeeded: atomic.LoadInt64(&e.succeeded),
+		Budget:    int64(e.cfg.Budget),
+
+		BudgetUnit: e.cfg.BudgetUnit,
+
+		CompletedV4: atomic.LoadInt64(&e.completedV4),
+		CompletedV6: atomic.LoadInt64(&e.completedV6),
+		Waste:       e.waste.snapshot(),
+		Memory:      ReadMemoryUsage(),
+	}
+	if !e.started.Load() {
+		return st
+	}
+	st.Nodes = e.tree.Size()
+	if e.topN.Len() > 0 {
+		best := e.topN.Best()
+		st.Best = &best
+	}
+	st.Heads = e.headFocuses()
+	return st
+}
+
+func unixNanoTime(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// isRemoved reports whether ip falls inside a prefix removed during the run.
+func (e *Engine) isRemoved(ip netip.Addr) bool {
+	e.removedMu.RLock()
+	defer e.removedMu.RUnlock()
+	for _, p := range e.removed {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package engine
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// Coverage blocks: the unit a root counts as explored in (see
+// Config.MinCoverage).
+const (
+	coverageBitsV4 = 24
+	coverageBitsV6 = 48
+)
+
+// coverageGate holds back exploitation of known-good prefixes until every
+// root has been sampled in enough distinct /24s (/48s for IPv6), so on
+// large inputs the first lucky prefixes don't soak up the budget before the
+// rest of the space has been looked at.
+type coverageGate struct {
+	mu      sync.Mutex
+	need    map[netip.Prefix]int                       // blocks each root still needs
+	blocks  map[netip.Prefix]map[netip.Prefix]struct{} // blocks sampled per root
+	pending int                                        // roots still short of their need
+	open    atomic.Bool
+}
+
+// reset sets the gate up for a run over roots, requiring perRoot blocks
+// per root (or all of a root's blocks, if it has fewer); 0 opens it.
+func (g *coverageGate) reset(roots []netip.Prefix, perRoot int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.need = make(map[netip.Prefix]int, len(roots))
+	g.blocks = make(map[netip.Prefix]map[netip.Prefix]struct{}, len(roots))
+	g.pending = 0
+	if perRoot > 0 {
+		for _, r := range roots {
+			r = r.Masked()
+			if _, dup := g.need[r]; dup {
+				continue
+			}
+			g.need[r] = min(perRoot, coverageBlocks(r))
+			g.pending++
+		}
+	}
+	g.open.Store(g.pending == 0)
+}
+
+// add extends the gate to roots added mid-run (see Engine.AddRoots),
+// closing it again until they are covered as well.
+func (g *coverageGate) add(roots []netip.Prefix, perRoot int) {
+	if perRoot <= 0 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, r := range roots {
+		r = r.Masked()
+		if g.need[r] > 0 {
+			continue
+		}
+		g.need[r] = min(perRoot, coverageBlocks(r))
+		delete(g.blocks, r)
+		g.pending++
+	}
+	g.open.Store(g.pending == 0)
+}
+
+// drop stops waiting for the roots within prefix, which was removed from
+// the search (see Engine.RemovePrefix).
+func (g *coverageGate) drop(prefix netip.Prefix) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for r, n := range g.need {
+		if n == 0 || r.Bits() < prefix.Bits() || !prefix.Contains(r.Addr()) {
+			continue
+		}
+		g.need[r] = 0
+		delete(g.blocks, r)
+		if g.pending--; g.pending == 0 {
+			g.open.Store(true)
+		}
+	}
+}
+
+// coverageBlocks returns how many coverage blocks root spans, capped well
+// above any sensible requirement.
+func coverageBlocks(root netip.Prefix) int {
+	bits := coverageBitsV6
+	if root.Addr().Is4() {
+		bits = coverageBitsV4
+	}
+	if root.Bits() >= bits {
+		return 1
+	}
+	return 1 << min(bits-root.Bits(), 20)
+}
+
+// record notes that ip was sampled.
+func (g *coverageGate) record(ip netip.Addr) {
+	if g.open.Load() {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var root netip.Prefix
+	for bits := 0; bits <= ip.BitLen(); bits++ {
+		p, _ := ip.Prefix(bits)
+		if g.need[p] > 0 {
+			root = p
+			break
+		}
+	}
+	if !root.IsValid() {
+		return
+	}
+	bits := coverageBitsV6
+	if ip.Is4() {
+		bits = coverageBitsV4
+	}
+	block, _ := ip.Prefix(bits)
+	seen := g.blocks[root]
+	if seen == nil {
+		seen = make(map[netip.Prefix]struct{})
+		g.blocks[root] = seen
+	}
+	if _, ok := seen[block]; ok {
+		return
+	}
+	seen[block] = struct{}{}
+	if len(seen) >= g.need[root] {
+		g.need[root] = 0
+		delete(g.blocks, root)
+		if g.pending--; g.pending == 0 {
+			g.open.Store(true)
+		}
+	}
+}
+
+// exploiting reports whether exploitation of known-good prefixes may start:
+// once the coverage gate has opened, or half the budget is spent, since
+// with more roots than the budget can cover the gate would never open.
+func (e *Engine) exploiting(spent, budget int64) bool {
+	return e.coverage.open.Load() || 2*spent >= budget
+}
@@ -15,35 +15,79 @@ import (
 	"github.com/zhaiiker/montecarlo-ip-searcher/internal/probe"
 )
 
+// slowStartWindow is the initial in-flight limit with Config.SlowStart.
+const slowStartWindow = 8
+
 // Engine is the core search engine using hierarchical Thompson Sampling.
 type Engine struct {
 	cfg      Config
 	probeCfg probe.Config
 
 	tree        *bandit.ArmTree
+	ports       *bandit.PortArms // nil without Config.Ports
 	headManager *bandit.HeadManager
 	topN        *TopNCollector
+	bp          *backpressureController
+	dials       *probe.DialGauge
+	tuner       *concurrencyTuner
+	calib       *referenceCalibrator
+	backoff     probe.Backoff
+	throughput  chan netip.Addr // IPs to measure throughput of; nil without Config.ThroughputFunc
+	tputProbes  int             // successful probes counted for throughput sampling
 
 	// Worker coordination
-	tasks chan probeTask
-	done  chan probeDone
+	tasks  chan probeTask
+	done   chan probeDone
+	window int64 // slow-start in-flight window; scheduler goroutine only
 
 	// Statistics
-	submitted int64
-	completed int64
+	submitted   int64
+	completed   int64
+	succeeded   int64
+	rateLimited int64
+	completedV4 int64 // budget spent per address family
+	completedV6 int64
+	lastProbe   atomic.Int64 // unix nanos of the last completed probe
+	lastOK      atomic.Int64 // unix nanos of the last successful probe
+
+	// Epoch accounting (see timeline.go); scheduler goroutine only
+	runStart  time.Time
+	epochDone int64
+	epochOK   int64
+
+	// First failures by kind, for fail-fast (see failfast.go)
+	failKinds   map[string]int
+	failSamples map[string]string
+
+	// Per-worker health (see workers.go)
+	workers []*workerHealth
+	fleet   fleetHealth
 
 	// Deduplication using atomic map
-	seenIPs sync.Map
+	seenIPs  sync.Map
+	waste    wasteCounters // see waste.go
+	subnets  subnetCap     // see ipv6.go
+	coverage coverageGate  // see coverage.go
+	tally    runTally      // see stats.go
+	mem      memoryGuard   // see memory.go
+
+	// Mid-run control (see control.go)
+	live      atomic.Bool
+	started   atomic.Bool // set once the tree exists; never cleared
+	removedMu sync.RWMutex
+	removed   []netip.Prefix
 }
 
 type probeTask struct {
 	headID int
 	prefix netip.Prefix
 	ip     netip.Addr
+	port   uint16
 }
 
 type probeDone struct {
 	task   probeTask
+	worker int
 	result probe.Result
 }
 
@@ -58,18 +102,11 @@ func New(cfg Config, probeCfg probe.Config) *Engine {
 
 // Run executes the search with the given CIDRs.
 func (e *Engine) Run(ctx context.Context, req Request) (Response, error) {
-	if err := e.cfg.Validate(); err != nil {
-		return Response{}, err
-	}
-
-	// Load prefixes
-	prefixes, err := loadPrefixes(req)
+	entries, _, err := e.prepare(req)
 	if err != nil {
 		return Response{}, err
 	}
-	if len(prefixes) == 0 {
-		return Response{}, errors.New("no CIDR provided (use --cidr or --cidr-file)")
-	}
+	prefixes := cidr.Prefixes(entries)
 
 	// Initialize seed
 	seed := e.cfg.Seed
@@ -80,22 +117,89 @@ func (e *Engine) Run(ctx context.Context, req Request) (Response, error) {
 	// Initialize components
 	timeoutMS := req.TimeoutMS()
 	e.tree = bandit.NewArmTree(prefixes, e.cfg.ToTreeConfig())
+	for _, en := range entries {
+		if en.Weight > 0 {
+			e.tree.SetWeight(en.Prefix, en.Weight)
+		}
+		if en.Label != "" {
+			e.tree.SetLabel(en.Prefix, en.Label)
+		}
+		// Prefix ranking drills every root to the ranking depth.
+		if en.MaxBits > 0 && e.cfg.Objective != ObjectivePrefixRanking {
+			e.tree.SetMaxBits(en.Prefix, en.MaxBits)
+		}
+	}
+	e.seedPriors(e.tree.Roots())
+	if len(e.cfg.Ports) > 0 {
+		e.ports = bandit.NewPortArms(e.cfg.Ports)
+	}
+	e.coverage.reset(prefixes, e.cfg.MinCoverage)
 	e.headManager = bandit.NewHeadManager(e.cfg.ToHeadManagerConfig(timeoutMS))
 	e.topN = NewTopNCollector(e.cfg.TopN)
+	for _, p := range req.Exclude {
+		e.removed = append(e.removed, p.Masked())
+	}
+	e.started.Store(true)
+	e.live.Store(true)
+	defer e.live.Store(false)
 
 	// Initialize channels
-	e.tasks = make(chan probeTask, e.cfg.Concurrency*2)
-	e.done = make(chan probeDone, e.cfg.Concurrency*2)
+	e.tasks = make(chan probeTask, e.cfg.MaxInflight)
+	e.done = make(chan probeDone, e.cfg.MaxInflight)
+	e.window = slowStartWindow
+	e.runStart = time.Now()
+
+	// The backpressure controller watches the dial queue of the workers.
+	if e.cfg.Backpressure {
+		e.dials = &probe.DialGauge{}
+		req.Probe.Dials = e.dials
+	}
 
 	// Start workers
 	var wg sync.WaitGroup
-	for i := 0; i < e.cfg.Concurrency; i++ {
+	e.workers = make([]*workerHealth, e.cfg.Concurrency)
+	for i := range e.workers {
+		e.workers[i] = &workerHealth{}
 		wg.Add(1)
-		go e.worker(ctx, &wg, req.Probe)
+		go e.worker(ctx, &wg, req.Probe, i)
+	}
+
+	// Calibrate against the reference IP before the search starts, then
+	// keep sampling it in the background.
+	if e.cfg.ReferenceIP.IsValid() {
+		calCtx, calCancel := context.WithCancel(ctx)
+		defer calCancel()
+		e.calib = &referenceCalibrator{}
+		refProber := probe.NewProber(req.Probe)
+		defer refProber.Close()
+		e.calibrateOnce(ctx, refProber, req.Probe.Timeout)
+		go e.runCalibration(calCtx, refProber, req.Probe.Timeout)
+	}
+
+	// Start the backpressure controller
+	if e.cfg.Backpressure {
+		bpCtx, bpCancel := context.WithCancel(ctx)
+		defer bpCancel()
+		e.bp = newBackpressureController(e.cfg.MinConcurrency, e.cfg.MaxInflight)
+		go e.runBackpressure(bpCtx, req.Probe.Timeout)
+	}
+
+	if e.cfg.AutoConcurrency {
+		e.tuner = newConcurrencyTuner(e.cfg.MinConcurrency, e.cfg.Concurrency)
+	}
+
+	// Start the integrated bandwidth phase
+	e.throughput, e.tputProbes = nil, 0
+	if e.cfg.ThroughputFunc != nil {
+		tpCtx, tpCancel := context.WithCancel(ctx)
+		defer tpCancel()
+		e.throughput = make(chan netip.Addr, throughputQueue)
+		go e.runThroughput(tpCtx, e.throughput)
 	}
 
 	// Run main event-driven scheduling loop
 	err = e.schedule(ctx, timeoutMS)
+	e.emitEpoch()
 
 	// Cleanup
 	close(e.tasks)
@@ -110,8 +214,72 @@ func (e *Engine) Run(ctx context.Context, req Request) (Response, error) {
 	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
 		return Response{}, err
 	}
+	if e.cfg.Verbose {
+		e.logFamilySpend()
+		if w := e.waste.snapshot(); w != (Waste{}) {
+			fmt.Fprintf(os.Stderr, "waste: %s\n", w)
+		}
+	}
 
-	return Response{Top: e.topN.Snapshot()}, nil
+	resp := Response{Top: groupTop(e.topN.Snapshot(), e.cfg.GroupBy, e.cfg.PerGroup), Stats: e.finishStats()}
+	resp.Footprint = e.footprint(resp.Top)
+	if e.ports != nil {
+		resp.PortArms = e.ports.Stats()
+	}
+	if e.cfg.Objective == ObjectivePrefixRanking {
+		ranks := e.rankPrefixes(timeoutMS)
+		if len(ranks) > e.cfg.TopN {
+			ranks = ranks[:e.cfg.TopN]
+		}
+		resp.Prefixes = ranks
+	}
+	meta := Recommend(resp.Top)
+	resp.Meta = &meta
+	return resp, nil
+}
+
+// prepare validates the configuration, loads the roots of req and scales
+// the budget and drill-down depth to them.
+func (e *Engine) prepare(req Request) ([]cidr.Entry, Scale, error) {
+	if err := e.cfg.Validate(); err != nil {
+		return nil, Scale{}, err
+	}
+
+	// Load prefixes
+	entries, err := loadPrefixes(req)
+	if err != nil {
+		return nil, Scale{}, err
+	}
+	prefixes := cidr.Prefixes(entries)
+	if len(prefixes) == 0 {
+		return nil, Scale{}, errors.New("no CIDR provided (use --cidr or --cidr-file)")
+	}
+
+	// Scale budget and depth to the search space
+	scale := AutoScale(prefixes, e.cfg)
+	if e.cfg.AutoBudget {
+		e.cfg.Budget = scale.Budget
+	}
+	if e.cfg.AutoMaxBits {
+		e.cfg.MaxBitsV4 = scale.MaxBitsV4
+		e.cfg.MaxBitsV6 = scale.MaxBitsV6
+	}
+	if e.cfg.AutoHeads {
+		e.cfg.Heads = scale.Heads
+	}
+	if n := e.cfg.HeadsV4 + e.cfg.HeadsV6; e.cfg.Heads < n {
+		e.cfg.Heads = n
+	}
+	warnMissingFamily(prefixes, e.cfg.HeadsV4, e.cfg.HeadsV6)
+	if e.cfg.Verbose && (e.cfg.AutoBudget || e.cfg.AutoMaxBits || e.cfg.AutoHeads) {
+		fmt.Fprintf(os.Stderr, "autoscale: space=%.0f units budget=%d max-bits-v4=%d max-bits-v6=%d heads=%d\n",
+			scale.Units, e.cfg.Budget, e.cfg.MaxBitsV4, e.cfg.MaxBitsV6, e.cfg.Heads)
+	}
+	if BudgetTooSmall(e.cfg.Budget, scale.Budget) {
+		fmt.Fprintf(os.Stderr, "warning: budget %d is too small to meaningfully explore this address space (recommended >= %d)\n",
+			e.cfg.Budget, scale.Budget)
+	}
+	return entries, scale, nil
 }
 
 // schedule is the main event-driven scheduling loop.
@@ -120,61 +288,162 @@ func (e *Engine) schedule(ctx context.Context, timeoutMS float64) error {
 	lastLog := time.Now()
 	lastSplit := int64(0)
 
-	// Initial fill - submit initial batch of tasks
-	initialBatch := e.cfg.Concurrency * 2
-	if initialBatch > e.cfg.Budget {
-		initialBatch = e.cfg.Budget
+	var epochs <-chan time.Time
+	if e.cfg.OnEpoch != nil {
+		ticker := time.NewTicker(epochInterval)
+		defer ticker.Stop()
+		epochs = ticker.C
+	}
+	var memChecks <-chan time.Time
+	if e.cfg.MaxMemory > 0 || e.cfg.Verbose {
+		ticker := time.NewTicker(memCheckInterval)
+		defer ticker.Stop()
+		memChecks = ticker.C
+	}
+	var deadline <-chan time.Time
+	if !e.cfg.Deadline.IsZero() {
+		timer := time.NewTimer(time.Until(e.cfg.Deadline))
+		defer timer.Stop()
+		deadline = timer.C
 	}
 
-	for i := 0; i < initialBatch; i++ {
-		headID := i % e.cfg.Heads
-		if err := e.submitOneTask(ctx, headID); err != nil {
-			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-				return err
-			}
+	// Initial fill - submit initial batch of tasks
+	if err := e.fillTasks(ctx); err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return err
 		}
 	}
 
-	// Main event loop - process results and submit new tasks
-	for atomic.LoadInt64(&e.completed) < int64(e.cfg.Budget) {
+	// Main event loop - process results and submit new tasks. A search
+	// whose space is sampled out ends once its last probes are in.
+	for !e.budgetMet() {
+		if e.exhausted() && atomic.LoadInt64(&e.completed) == atomic.LoadInt64(&e.submitted) {
+			if e.cfg.Verbose {
+				fmt.Fprintf(os.Stderr, "search: stopping early after %d probes, the address space is sampled out (see --max-waste)\n",
+					atomic.LoadInt64(&e.completed))
+			}
+			break
+		}
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 
+		case <-epochs:
+			e.emitEpoch()
+
+		case <-memChecks:
+			e.checkMemory(timeoutMS)
+
+		case <-deadline:
+			// budgetMet now holds; the loop ends on its next check.
+
 		case d := <-e.done:
 			// Process the completed probe
 			e.processOneResult(d, timeoutMS)
 			completed := atomic.AddInt64(&e.completed, 1)
+			if d.task.ip.Is4() {
+				atomic.AddInt64(&e.completedV4, 1)
+			} else {
+				atomic.AddInt64(&e.completedV6, 1)
+			}
+			e.growWindow()
+			if err := e.checkFailFast(d.result, completed); err != nil {
+				return err
+			}
+			e.checkWaste(completed)
 
 			// Check if we need to split - more aggressive splitting
 			if completed-lastSplit >= int64(e.cfg.SplitInterval) {
 				e.trySplit()
+				if e.cfg.Objective == ObjectivePrefixRanking {
+					e.rankPrefixes(timeoutMS)
+				}
 				lastSplit = completed
 			}
 
-			// Submit replacement task if we haven't reached budget
-			submitted := atomic.LoadInt64(&e.submitted)
-			if submitted < int64(e.cfg.Budget) {
-				headID := int(submitted) % e.cfg.Heads
-				if err := e.submitOneTask(ctx, headID); err != nil {
-					// Non-fatal, continue
-				}
+			// Submit replacement tasks if we haven't reached budget
+			if err := e.fillTasks(ctx); err != nil {
+				// Non-fatal, continue
 			}
 
 			// Verbose logging
-			if e.cfg.Verbose && time.Since(lastLog) > time.Second {
+			if e.cfg.Verbose && !e.cfg.QuietProgress && time.Since(lastLog) > time.Second {
 				best := e.topN.Best()
 				elapsed := time.Since(start).Truncate(100 * time.Millisecond)
-				fmt.Fprintf(os.Stderr, "progress: %d/%d done, best=%.1fms ip=%s prefix=%s elapsed=%s nodes=%d\n",
-					completed, e.cfg.Budget, best.ScoreMS, best.IP.String(), best.Prefix.String(), elapsed, e.tree.Size())
+				done := fmt.Sprintf("%d/%d done", completed, e.cfg.Budget)
+				if e.cfg.BudgetUnit == BudgetSuccesses {
+					done = fmt.Sprintf("%d/%d successes in %d probes", e.spent(), e.cfg.Budget, completed)
+				}
+				fmt.Fprintf(os.Stderr, "progress: %s, best=%.1fms ip=%s prefix=%s elapsed=%s nodes=%d rate_limited=%d\n",
+					done, best.ScoreMS, best.IP.String(), best.Prefix.String(), elapsed, e.tree.Size(),
+					atomic.LoadInt64(&e.rateLimited))
 				lastLog = time.Now()
 			}
 		}
 	}
 
+	if e.pastDeadline() && e.spent() < int64(e.cfg.Budget) && e.cfg.Verbose {
+		fmt.Fprintf(os.Stderr, "search: time is up after %d probes (%d/%d budget spent)\n",
+			atomic.LoadInt64(&e.completed), e.spent(), e.cfg.Budget)
+	}
+	if e.spent() < int64(e.cfg.Budget) && atomic.LoadInt64(&e.completed) >= e.probeLimit() {
+		fmt.Fprintf(os.Stderr, "warning: stopped after %d probes with only %d/%d successes (at most %d probes per success budgeted)\n",
+			atomic.LoadInt64(&e.completed), e.spent(), e.cfg.Budget, successBudgetProbes)
+	}
 	return nil
 }
 
+// inflightLimit returns the maximum number of submitted but not yet completed probes.
+func (e *Engine) inflightLimit() int64 {
+	limit := int64(e.cfg.MaxInflight)
+	if e.bp != nil {
+		limit = min(limit, int64(e.bp.Limit()))
+	}
+	if e.tuner != nil {
+		limit = min(limit, int64(e.tuner.Limit()))
+	}
+	if e.mem.throttled.Load() {
+		limit = min(limit, int64(e.cfg.MinConcurrency))
+	}
+	if e.cfg.SlowStart && e.window < limit {
+		return e.window
+	}
+	return limit
+}
+
+// growWindow widens the slow-start window by one completed probe.
+func (e *Engine) growWindow() {
+	if !e.cfg.SlowStart || e.window >= int64(e.cfg.MaxInflight) {
+		return
+	}
+	e.window++
+	if e.cfg.Verbose && e.window == int64(e.cfg.MaxInflight) {
+		fmt.Fprintf(os.Stderr, "slow-start: reached max in-flight %d\n", e.cfg.MaxInflight)
+	}
+}
+
+// fillTasks submits tasks until the in-flight limit or the budget is reached.
+func (e *Engine) fillTasks(ctx context.Context) error {
+	for {
+		submitted := atomic.LoadInt64(&e.submitted)
+		if submitted >= e.probeLimit() || !e.inflightNeeded(submitted) || e.pastDeadline() {
+			return nil
+		}
+		if submitted-atomic.LoadInt64(&e.completed) >= e.inflightLimit() {
+			return nil
+		}
+
+		headID := int(submitted) % e.cfg.Heads
+		if err := e.submitOneTask(ctx, headID); err != nil {
+			return err
+		}
+		if atomic.LoadInt64(&e.submitted) == submitted {
+			// Nothing to sample from; avoid spinning.
+			return nil
+		}
+	}
+}
+
 // submitOneTask submits a single probe task for a head.
 func (e *Engine) submitOneTask(ctx context.Context, headID int) error {
 	head := e.headManager.GetHead(headID % e.cfg.Heads)
@@ -186,18 +455,17 @@ func (e *Engine) submitOneTask(ctx context.Context, headID int) error {
 
 	// Exploitation mode: directly sample from known-good prefixes
 	// This ensures we find multiple IPs from the best regions
-	completed := atomic.LoadInt64(&e.completed)
-	budget := int64(e.cfg.Budget)
+	spent, budget := e.spent(), int64(e.cfg.Budget)
 
 	// Gradually increase exploitation rate as we progress
 	// Early: 20% exploit, Late: 50% exploit
-	exploitRate := 0.2 + 0.3*float64(completed)/float64(budget)
+	exploitRate := 0.2 + 0.3*float64(spent)/float64(budget)
 	if exploitRate > 0.5 {
 		exploitRate = 0.5
 	}
 
-	if completed > 30 { // Only after initial exploration
-		exploitPrefixes := e.getExploitationPrefixes()
+	if e.exploiting(spent, budget) {
+		exploitPrefixes := e.getExploitationPrefixes(head)
 		if len(exploitPrefixes) > 0 && head.Sampler != nil {
 			if r := head.Sampler.SampleUniform(); r < exploitRate {
 				// Pick a random prefix from exploit list, weighted toward better ones
@@ -215,22 +483,50 @@ func (e *Engine) submitOneTask(ctx context.Context, headID int) error {
 		prefix = e.headManager.SelectNextPrefix(head, e.tree, e.cfg.Beam)
 	}
 
+	fallback := false
 	if !prefix.IsValid() {
-		// Fallback to any leaf
+		// Fallback to any leaf of the head's family, even a suspended
+		// one, then to any leaf at all
 		leaves := e.tree.LeafNodes()
+		own := make([]*bandit.ArmNode, 0, len(leaves))
+		for _, node := range leaves {
+			if head.Accepts(node.Prefix) {
+				own = append(own, node)
+			}
+		}
+		if len(own) > 0 {
+			leaves = own
+		}
 		if len(leaves) > 0 {
 			prefix = leaves[headID%len(leaves)].Prefix
+			fallback = true
 		}
 	}
 
 	if !prefix.IsValid() {
+		e.waste.invalid.Add(1)
+		return nil
+	}
+
+	if e.exhausted() {
+		return nil
+	}
+	ip, fresh := e.sampleIPWithDedup(prefix, head)
+	if !ip.IsValid() {
 		return nil
 	}
+	e.coverage.record(ip)
+	if fallback && fresh {
+		e.waste.fallbacks.Add(1)
+	}
 
-	ip := e.sampleIPWithDedup(prefix, head)
+	task := probeTask{headID: headID, prefix: prefix, ip: ip}
+	if e.ports != nil && head.Sampler != nil {
+		task.port = e.ports.Select(head.Sampler)
+	}
 
 	select {
-	case e.tasks <- probeTask{headID: headID, prefix: prefix, ip: ip}:
+	case e.tasks <- task:
 		atomic.AddInt64(&e.submitted, 1)
 		return nil
 	case <-ctx.Done():
@@ -240,54 +536,212 @@ func (e *Engine) submitOneTask(ctx context.Context, headID int) error {
 
 // processOneResult processes a single probe result.
 func (e *Engine) processOneResult(d probeDone, timeoutMS float64) {
+	e.lastProbe.Store(time.Now().UnixNano())
+
+	// Rate-limit responses say nothing about the IP: back off globally and
+	// keep them out of the arm statistics.
+	if d.result.RateLimited {
+		atomic.AddInt64(&e.rateLimited, 1)
+		e.tallyRateLimited()
+		pause := e.backoff.Trigger(d.result.RetryAfter)
+		if e.cfg.Verbose {
+			fmt.Fprintf(os.Stderr, "ratelimit: ip=%s status=%d, backing off %s\n",
+				d.task.ip.String(), d.result.Status, pause)
+		}
+		return
+	}
+	e.backoff.Reset()
+
+	// Drop results for ranges removed while the probe was in flight
+	if e.isRemoved(d.task.ip) {
+		e.tally.probes++
+		return
+	}
+	// Drop responses from the other side of the edge cache than the one
+	// being scored
+	if e.cfg.PreferCache != "" && d.result.CacheStatus != "" && d.result.CacheStatus != e.cfg.PreferCache {
+		e.tally.probes++
+		e.tally.cacheSkipped++
+		return
+	}
+	// Credit results for children merged back while the probe was in
+	// flight to their parent
+	d.task.prefix = e.tree.Owner(d.task.prefix)
+
+	// Compute the score (latency by default, or a user-defined cost); the
+	// body is only needed for that and would otherwise stay in the top-N
+	ok, latency := e.score(d.result)
+	d.result.Body = ""
+	e.observeAutotune(failureKind(d.result) == FailTimeout, ok, latency)
+	// A worker that got an answer is healthy even if the data center that
+	// answered is excluded
+	e.recordWorker(d.worker, ok, latency)
+	if ok && !e.coloAllowed(d.result.Colo) {
+		ok = false
+		d.result.Error = ErrColoExcluded
+	}
+	if ok {
+		e.lastOK.Store(time.Now().UnixNano())
+		atomic.AddInt64(&e.succeeded, 1)
+	}
+
+	// Normalize latency against reference drift
+	drift := 0.0
+	if e.calib != nil {
+		drift = e.calib.Factor()
+		latency = e.calib.Adjust(latency)
+	}
+
 	// Update arm tree with result
-	e.tree.Update(d.task.prefix, d.result.OK, float64(d.result.TotalMS), timeoutMS)
+	e.updateArm(d.task.prefix, ok, latency, timeoutMS, d.result.HardFail)
+	if e.ports != nil {
+		e.ports.Update(d.task.port, ok, latency, timeoutMS)
+	}
+	if ok {
+		e.sampleThroughput(d.task.ip)
+	}
+	if e.tree.RecordOutcome(d.task.prefix, d.result.HardFail) && e.cfg.Verbose {
+		fmt.Fprintf(os.Stderr, "breaker: prefix=%s suspended for %s after %d hard failures\n",
+			d.task.prefix.String(), e.cfg.BreakerCooldown, e.cfg.BreakerThreshold)
+	}
 
 	// Get arm stats
 	node := e.tree.GetNode(d.task.prefix)
 	var stats bandit.ArmStats
+	var label string
 	if node != nil {
 		stats = node.Stats()
+		label = node.Label
+	}
+
+	// A resumed handshake is reported separately from a full one.
+	tlsMS, resumeMS := d.result.TLSMS, int64(0)
+	if d.result.TLSResumed {
+		tlsMS, resumeMS = 0, d.result.TLSMS
 	}
 
 	// Calculate score - use actual latency for success, penalty for failure
-	score := float64(d.result.TotalMS)
-	if !d.result.OK {
+	score := latency
+	if !ok {
 		score = timeoutMS * 2
 	}
+	e.tallyResult(d, ok, score)
+
+	if e.cfg.OnProbe != nil {
+		e.cfg.OnProbe(ProbeResult{
+			IP:            d.task.ip,
+			Prefix:        d.task.prefix,
+			Label:         label,
+			Port:          d.task.port,
+			HeadID:        d.task.headID,
+			Worker:        d.worker,
+			OK:            ok,
+			Status:        d.result.Status,
+			Error:         d.result.Error,
+			ConnectMS:     d.result.ConnectMS,
+			TLSMS:         tlsMS,
+			TLSResumeMS:   resumeMS,
+			TLSUnverified: d.result.TLSUnverified,
+			TTFBMS:        d.result.TTFBMS,
+			TotalMS:       d.result.TotalMS,
+			ScoreMS:       score,
+			Trace:         d.result.Trace,
+			TraceInfo:     d.result.TraceInfo,
+			When:          d.result.When,
+			Path:          d.result.Path,
+			WarmTTFBMS:    d.result.WarmTTFBMS,
+			WarmTotalMS:   d.result.WarmTotalMS,
+			Targets:       d.result.Targets,
+			PrefixSamples: stats.Samples,
+			PrefixOK:      stats.Successes,
+			PrefixFail:    stats.Failures,
+
+			BandwidthHintMbps: d.result.BandwidthHintMbps,
+			RemoteAddr:        d.result.RemoteAddr,
+			Location:          d.result.Location,
+			Redirects:         d.result.Redirects,
+			Headers:           d.result.Headers,
+			CacheStatus:       d.result.CacheStatus,
+		})
+	}
 
 	// Add to top N
 	e.topN.Consider(TopResult{
 		IP:            d.task.ip,
 		Prefix:        d.task.prefix,
-		OK:            d.result.OK,
+		Label:         label,
+		Port:          d.task.port,
+		OK:            ok,
 		Status:        d.result.Status,
 		Error:         d.result.Error,
 		ConnectMS:     d.result.ConnectMS,
-		TLSMS:         d.result.TLSMS,
+		TLSMS:         tlsMS,
+		TLSResumeMS:   resumeMS,
+		TLSUnverified: d.result.TLSUnverified,
 		TTFBMS:        d.result.TTFBMS,
 		TotalMS:       d.result.TotalMS,
 		ScoreMS:       score,
+		DriftFactor:   drift,
 		Trace:         d.result.Trace,
+		TraceInfo:     d.result.TraceInfo,
+		Path:          d.result.Path,
+		WarmTTFBMS:    d.result.WarmTTFBMS,
+		WarmTotalMS:   d.result.WarmTotalMS,
+		Targets:       d.result.Targets,
 		PrefixSamples: stats.Samples,
 		PrefixOK:      stats.Successes,
 		PrefixFail:    stats.Failures,
+
+		BandwidthHintMbps: d.result.BandwidthHintMbps,
+		RemoteAddr:        d.result.RemoteAddr,
+		Location:          d.result.Location,
+		Redirects:         d.result.Redirects,
+		Headers:           d.result.Headers,
+		CacheStatus:       d.result.CacheStatus,
 	})
 }
 
-// worker runs probe tasks.
-func (e *Engine) worker(ctx context.Context, wg *sync.WaitGroup, probeCfg probe.Config) {
+// score returns whether a probe counts as a success and its cost in ms.
+func (e *Engine) score(r probe.Result) (bool, float64) {
+	if e.cfg.RewardFunc == nil {
+		return r.OK, float64(r.TotalMS)
+	}
+	reward, ok := e.cfg.RewardFunc(r)
+	return ok, reward
+}
+
+// worker runs probe tasks. It replaces its prober, and with it its
+// connection pool, when the scheduler finds it sick (see workers.go).
+func (e *Engine) worker(ctx context.Context, wg *sync.WaitGroup, probeCfg probe.Config, id int) {
 	defer wg.Done()
 
 	prober := probe.NewProber(probeCfg)
+	defer func() { prober.Close() }()
+	health := e.workers[id]
 
 	for task := range e.tasks {
+		if health.recycle.Swap(false) {
+			prober.Close()
+			prober = probe.NewProber(probeCfg)
+		}
+		if err := e.backoff.Wait(ctx); err != nil {
+			return
+		}
+		if err := e.cfg.Throttle.WaitProbe(ctx); err != nil {
+			return
+		}
+
+		if err := e.cfg.Shared.acquire(ctx); err != nil {
+			return
+		}
 		pctx, cancel := context.WithTimeout(ctx, probeCfg.Timeout)
-		result := prober.ProbeHTTPTrace(pctx, task.ip)
+		result := prober.ProbeAt(pctx, task.ip, task.port)
 		cancel()
+		e.cfg.Shared.release()
+		e.cfg.Shared.record(task.ip, result)
 
 		select {
-		case e.done <- probeDone{task: task, result: result}:
+		case e.done <- probeDone{task: task, worker: id, result: result}:
 		case <-ctx.Done():
 			return
 		}
@@ -297,6 +751,22 @@ func (e *Engine) worker(ctx context.Context, wg *sync.WaitGroup, probeCfg probe.
 // trySplit attempts to split promising prefixes.
 // It prioritizes nodes with good performance (low latency, high success rate).
 func (e *Engine) trySplit() {
+	// Undo splits whose children turned out indistinguishable, so they
+	// stop costing selection time and can be re-split with a larger step
+	for _, node := range e.tree.MergeUniform() {
+		if e.cfg.Verbose {
+			fmt.Fprintf(os.Stderr, "split: merged prefix=%s back (children indistinguishable), merges=%d\n",
+				node.Prefix.String(), node.MergeCount())
+		}
+	}
+
+	e.maybeStartDrill()
+	if e.mem.throttled.Load() {
+		// Splits would only grow the tree again (see checkMemory)
+		e.headManager.RebalanceHeads(e.tree)
+		return
+	}
+
 	// Get more candidates - be more aggressive about splitting
 	candidates := e.tree.GetSplitCandidates(e.cfg.Heads * 4)
 
@@ -307,7 +777,8 @@ func (e *Engine) trySplit() {
 		if splitCount >= maxSplits {
 			break
 		}
-		if e.tree.SplitNode(node) != nil {
+		if children := e.tree.SplitNode(node); children != nil {
+			e.seedPriors(children)
 			splitCount++
 		}
 	}
@@ -319,8 +790,9 @@ func (e *Engine) trySplit() {
 // getExploitationPrefixes returns prefixes that deserve intensive exploitation.
 // These are prefixes containing top-performing IPs that we should sample more from.
 // Returns prefixes sorted by best score (best first), with repeats for weighting.
-func (e *Engine) getExploitationPrefixes() []netip.Prefix {
-	topResults := e.topN.Snapshot()
+// Only prefixes the head may explore are returned.
+func (e *Engine) getExploitationPrefixes(head *bandit.SearchHead) []netip.Prefix {
+	topResults := e.topN.Within(1.5) // Within 50% of best
 	if len(topResults) == 0 {
 		return nil
 	}
@@ -328,14 +800,10 @@ func (e *Engine) getExploitationPrefixes() []netip.Prefix {
 	// Calculate thresholds
 	bestScore := topResults[0].ScoreMS
 	tier1Threshold := bestScore * 1.2 // Within 20% of best
-	tier2Threshold := bestScore * 1.5 // Within 50% of best
 
 	// Track best score per prefix
 	prefixBestScore := make(map[netip.Prefix]float64)
 	for _, r := range topResults {
-		if r.ScoreMS > tier2Threshold {
-			break
-		}
 		if _, exists := prefixBestScore[r.Prefix]; !exists {
 			prefixBestScore[r.Prefix] = r.ScoreMS
 		}
@@ -344,6 +812,9 @@ func (e *Engine) getExploitationPrefixes() []netip.Prefix {
 	// Build weighted list: tier1 prefixes appear 3x, tier2 appear 1x
 	var exploitPrefixes []netip.Prefix
 	for prefix, score := range prefixBestScore {
+		if !e.tree.Sampleable(prefix) || !head.Accepts(prefix) {
+			continue
+		}
 		if score <= tier1Threshold {
 			// Best prefixes get 3x weight
 			exploitPrefixes = append(exploitPrefixes, prefix, prefix, prefix)
@@ -356,74 +827,77 @@ func (e *Engine) getExploitationPrefixes() []netip.Prefix {
 	return exploitPrefixes
 }
 
-// sampleIPWithDedup samples an IP with deduplication.
-func (e *Engine) sampleIPWithDedup(prefix netip.Prefix, head *bandit.SearchHead) netip.Addr {
-	prefix = prefix.Masked()
-
-	// Check if prefix has any host bits
-	hostBits := 32 - prefix.Bits()
-	if prefix.Addr().Is6() {
-		hostBits = 128 - prefix.Bits()
-	}
-
-	if hostBits <= 0 {
-		return prefix.Addr()
-	}
-
-	const maxTries = 32
-	var last netip.Addr
-
-	for i := 0; i < maxTries; i++ {
-		ip := head.Sampler.SampleIP(prefix)
-		last = ip
-
-		// Use uint128 representation for efficient dedup
-		key := ipToKey(ip)
-		if _, loaded := e.seenIPs.LoadOrStore(key, struct{}{}); !loaded {
-			return ip
-		}
-	}
-
-	// Too many duplicates, return last sampled
-	return last
-}
-
 // ipToKey converts an IP to a comparable key.
 // Using the IP directly as netip.Addr is comparable and efficient.
 func ipToKey(ip netip.Addr) netip.Addr {
 	return ip
 }
 
-// loadPrefixes loads and deduplicates CIDR prefixes from the request.
-func loadPrefixes(req Request) ([]netip.Prefix, error) {
-	var pfxs []netip.Prefix
+// loadPrefixes loads and deduplicates CIDR prefixes from the request, with
+// their inline attributes. The first occurrence of a prefix wins.
+func loadPrefixes(req Request) ([]cidr.Entry, error) {
+	var entries []cidr.Entry
+	for _, p := range req.Prefixes {
+		entries = append(entries, cidr.Entry{Prefix: p})
+	}
 
 	if len(req.CIDRs) > 0 {
-		ps, err := cidr.ParseCIDRs(req.CIDRs)
+		es, err := cidr.ParseEntries(req.CIDRs)
 		if err != nil {
 			return nil, err
 		}
-		pfxs = append(pfxs, ps...)
+		entries = append(entries, es...)
 	}
 
 	if req.CIDRFile != "" {
-		ps, err := cidr.ReadCIDRsFromFile(req.CIDRFile)
+		es, err := cidr.ReadEntriesFromFile(req.CIDRFile)
 		if err != nil {
 			return nil, err
 		}
-		pfxs = append(pfxs, ps...)
+		entries = append(entries, es...)
 	}
 
 	// Deduplicate
-	seen := make(map[netip.Prefix]struct{}, len(pfxs))
-	unique := make([]netip.Prefix, 0, len(pfxs))
-	for _, p := range pfxs {
-		p = p.Masked()
-		if _, exists := seen[p]; !exists {
-			seen[p] = struct{}{}
-			unique = append(unique, p)
+	seen := make(map[netip.Prefix]struct{}, len(entries))
+	unique := make([]cidr.Entry, 0, len(entries))
+	for _, en := range entries {
+		en.Prefix = en.Prefix.Masked()
+		if _, exists := seen[en.Prefix]; !exists {
+			seen[en.Prefix] = struct{}{}
+			unique = append(unique, en)
 		}
 	}
 
 	return unique, nil
 }
+
+// warnMissingFamily warns when heads are dedicated to an address family
+// that none of the roots belong to; those heads then roam over the other.
+func warnMissingFamily(prefixes []netip.Prefix, headsV4, headsV6 int) {
+	has4, has6 := false, false
+	for _, p := range prefixes {
+		if p.Addr().Is4() {
+			has4 = true
+		} else {
+			has6 = true
+		}
+	}
+	if headsV4 > 0 && !has4 {
+		fmt.Fprintf(os.Stderr, "warning: --heads-v4 %d has no IPv4 roots to explore\n", headsV4)
+	}
+	if headsV6 > 0 && !has6 {
+		fmt.Fprintf(os.Stderr, "warning: --heads-v6 %d has no IPv6 roots to explore\n", headsV6)
+	}
+}
+
+// logFamilySpend prints how the budget was split between the address
+// families, when both were probed.
+func (e *Engine) logFamilySpend() {
+	v4, v6 := atomic.LoadInt64(&e.completedV4), atomic.LoadInt64(&e.completedV6)
+	if v4 == 0 || v6 == 0 {
+		return
+	}
+	total := float64(v4 + v6)
+	fmt.Fprintf(os.Stderr, "family: ipv4=%d (%.0f%%) ipv6=%d (%.0f%%)\n",
+		v4, float64(v4)/total*100, v6, float64(v6)/total*100)
+}
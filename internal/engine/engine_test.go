@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"math/rand"
+	"net/netip"
+	"strconv"
+	"testing"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/bandit"
+)
+
+// benchEngine returns an engine in the state of a long search: leaves
+// sampled /24 leaves and a result collector holding top results.
+func benchEngine(leaves, top int) *Engine {
+	cfg := DefaultConfig()
+	cfg.TopN = top
+	cfg.ApplyDefaults()
+	e := &Engine{cfg: cfg}
+
+	rng := rand.New(rand.NewSource(1))
+	prefixes := make([]netip.Prefix, leaves)
+	for i := range prefixes {
+		prefixes[i] = netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0}), 24)
+	}
+	e.tree = bandit.NewArmTree(prefixes, cfg.ToTreeConfig())
+	for _, p := range prefixes {
+		mean := 50 + 200*rng.Float64()
+		for range 8 {
+			e.tree.Update(p, rng.Float64() > 0.1, mean+20*rng.NormFloat64(), 3000, 0)
+		}
+	}
+	e.headManager = bandit.NewHeadManager(cfg.ToHeadManagerConfig(3000))
+
+	e.topN = NewTopNCollector(top)
+	for i := range top {
+		p := prefixes[rng.Intn(len(prefixes))]
+		ip := p.Addr().As4()
+		ip[3] = byte(i)
+		e.topN.Consider(TopResult{IP: netip.AddrFrom4(ip), Prefix: p, OK: true, ScoreMS: 50 + 200*rng.Float64()})
+	}
+	return e
+}
+
+// BenchmarkSelectPrefix measures picking the prefix of one probe the way
+// submitOneTask does late in a search: the exploitation list from the top
+// results, then a Thompson sampling pass over the leaves.
+func BenchmarkSelectPrefix(b *testing.B) {
+	for _, leaves := range []int{256, 4096, 16384} {
+		b.Run("leaves="+strconv.Itoa(leaves), func(b *testing.B) {
+			e := benchEngine(leaves, 1000)
+			head := e.headManager.GetHead(0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = e.getExploitationPrefixes(head)
+				if !e.headManager.SelectNextPrefix(head, e.tree, e.cfg.Beam).IsValid() {
+					b.Fatal("no prefix selected")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/probe"
+)
+
+// Failure kinds reported by FailFastError.
+const (
+	FailTimeout     = "timeout"
+	FailRefused     = "connection refused"
+	FailReset       = "connection reset"
+	FailUnreachable = "network unreachable"
+	FailCertificate = "certificate error"
+	FailTLS         = "TLS handshake error"
+	FailForbidden   = "HTTP 403"
+	FailNotFound    = "HTTP 404"
+	FailRedirect    = "HTTP redirect"
+	FailHTTPStatus  = "HTTP error status"
+	FailRateLimited = "rate limited"
+	FailRejected    = "response rejected"
+	FailOther       = "other"
+)
+
+// failHints suggests fixes for each failure kind.
+var failHints = map[string]string{
+	FailTimeout:     "the IPs did not answer within --timeout: check that the ranges are reachable from this network (not firewalled), or raise --timeout",
+	FailRefused:     "nothing listens on port 443: check that --cidr/--cidr-file list the CDN's ranges",
+	FailReset:       "connections were reset, often by a middlebox filtering on the SNI: try another --host or a --tls-fingerprint",
+	FailUnreachable: "no route to the addresses: IPv6 ranges need working IPv6 connectivity",
+	FailCertificate: "the certificate does not match the SNI: --host must be a domain served by this CDN",
+	FailTLS:         "the TLS handshake failed: check that --host is a domain served by this CDN, or try a --tls-fingerprint",
+	FailForbidden:   "the edge refused the request: check that --host is a domain served by this CDN",
+	FailNotFound:    "the path does not exist on this host: check --path (default /cdn-cgi/trace)",
+	FailRedirect:    "the edge redirects the request (see the location of the probes in --stream): fix --host/--path, or allow it with --follow-redirects",
+	FailHTTPStatus:  "the edge answered with an error status: check --host and --path",
+	FailRateLimited: "the provider is rate limiting the probes: lower --concurrency or set --max-probes-per-second",
+	FailRejected:    "requests succeeded but the responses were rejected: check the --validate regexp",
+	FailOther:       "see the sample error below",
+}
+
+// FailFastError is returned by Run when the first probes of a search all
+// failed (see Config.FailFastThreshold). It names the most common kind of
+// failure and suggests how to fix it.
+type FailFastError struct {
+	Probes int
+
+	// Kinds counts the failures by kind; Kind is the most common one and
+	// Sample an error message of that kind.
+	Kinds  map[string]int
+	Kind   string
+	Sample string
+}
+
+func (e *FailFastError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "the first %d probes all failed, aborting (see --fail-fast-threshold)\n", e.Probes)
+	fmt.Fprintf(&b, "  most common: %s (%d/%d)\n", e.Kind, e.Kinds[e.Kind], e.Probes)
+	if len(e.Kinds) > 1 {
+		fmt.Fprintf(&b, "  all:         %s\n", formatKinds(e.Kinds))
+	}
+	if e.Sample != "" {
+		fmt.Fprintf(&b, "  sample:      %s\n", e.Sample)
+	}
+	fmt.Fprintf(&b, "  hint:        %s", failHints[e.Kind])
+	return b.String()
+}
+
+// formatKinds lists failure kinds by count, most common first.
+func formatKinds(counts map[string]int) string {
+	kinds := sortedKinds(counts)
+	parts := make([]string, len(kinds))
+	for i, k := range kinds {
+		parts[i] = fmt.Sprintf("%s %d", k, counts[k])
+	}
+	return strings.Join(parts, ", ")
+}
+
+func sortedKinds(counts map[string]int) []string {
+	kinds := make([]string, 0, len(counts))
+	for k := range counts {
+		kinds = append(kinds, k)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if counts[kinds[i]] != counts[kinds[j]] {
+			return counts[kinds[i]] > counts[kinds[j]]
+		}
+		return kinds[i] < kinds[j]
+	})
+	return kinds
+}
+
+// failureKind classifies why a probe failed.
+func failureKind(r probe.Result) string {
+	msg := strings.ToLower(r.Error)
+	switch {
+	case r.RateLimited:
+		return FailRateLimited
+	case r.OK:
+		return FailRejected // by the score function
+	case strings.Contains(msg, "timeout"), strings.Contains(msg, "deadline exceeded"):
+		return FailTimeout
+	case strings.Contains(msg, "connection refused"):
+		return FailRefused
+	case strings.Contains(msg, "connection reset"), strings.Contains(msg, "broken pipe"), strings.Contains(msg, "eof"):
+		return FailReset
+	case strings.Contains(msg, "unreachable"), strings.Contains(msg, "no route"):
+		return FailUnreachable
+	case strings.Contains(msg, "x509"), strings.Contains(msg, "certificate"):
+		return FailCertificate
+	case strings.Contains(msg, "tls"):
+		return FailTLS
+	case r.Status == 403:
+		return FailForbidden
+	case r.Status == 404:
+		return FailNotFound
+	case r.Status >= 300 && r.Status < 400:
+		return FailRedirect
+	case r.Status != 0:
+		return FailHTTPStatus
+	default:
+		return FailOther
+	}
+}
+
+// checkFailFast records a completed probe and returns a *FailFastError once
+// the first Config.FailFastThreshold probes have all failed. Scheduler
+// goroutine only.
+func (e *Engine) checkFailFast(r probe.Result, completed int64) error {
+	threshold := int64(e.cfg.FailFastThreshold)
+	if threshold == 0 || completed > threshold || atomic.LoadInt64(&e.succeeded) > 0 {
+		return nil
+	}
+	if e.failKinds == nil {
+		e.failKinds = make(map[string]int)
+		e.failSamples = make(map[string]string)
+	}
+	kind := failureKind(r)
+	e.failKinds[kind]++
+	if _, ok := e.failSamples[kind]; !ok && r.Error != "" {
+		e.failSamples[kind] = r.Error
+	}
+	if completed < threshold {
+		return nil
+	}
+
+	top := sortedKinds(e.failKinds)[0]
+	return &FailFastError{
+		Probes: int(threshold),
+		Kinds:  e.failKinds,
+		Kind:   top,
+		Sample: e.failSamples[top],
+	}
+}
@@ -0,0 +1,43 @@
+package engine
+
+import "net/netip"
+
+// Failure models: how a failed probe bears on its prefix's latency
+// estimate. Every failure counts against the success rate.
+const (
+	// FailureBetaOnly leaves the latency estimate to successful probes
+	// (default). A prefix that fails for a while and then recovers is
+	// judged on the latency it actually shows.
+	FailureBetaOnly = "beta-only"
+	// FailurePseudoLatency also counts each failure as a latency of twice
+	// the timeout, weighted by TimeoutPenalty or RefusalPenalty. The
+	// pseudo-observations stay in the estimate after the prefix recovers.
+	FailurePseudoLatency = "pseudo-latency"
+	// FailureHazard treats a timeout as a censored latency, one known only
+	// to exceed the timeout, and pulls the estimate towards the latency
+	// expected beyond it, weighted by TimeoutPenalty. Refusals leave the
+	// latency estimate alone.
+	FailureHazard = "hazard-model"
+)
+
+// updateArm records a probe result in the arm of prefix under the
+// configured failure model.
+func (e *Engine) updateArm(prefix netip.Prefix, ok bool, latency, timeoutMS float64, hardFail bool) {
+	switch {
+	case ok || e.cfg.FailureModel == FailureBetaOnly:
+		e.tree.Update(prefix, ok, latency, timeoutMS, 0)
+	case e.cfg.FailureModel == FailureHazard:
+		if hardFail {
+			e.tree.Update(prefix, false, latency, timeoutMS, 0)
+		} else {
+			e.tree.UpdateCensored(prefix, timeoutMS, e.cfg.TimeoutPenalty)
+		}
+	default:
+		// A refusal costs less latency than a timeout
+		penalty := e.cfg.TimeoutPenalty
+		if hardFail {
+			penalty = e.cfg.RefusalPenalty
+		}
+		e.tree.Update(prefix, false, latency, timeoutMS, penalty)
+	}
+}
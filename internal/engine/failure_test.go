@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"math"
+	"math/rand"
+	"net/netip"
+	"testing"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/bandit"
+)
+
+// TestCensoredEstimate compares the failure models on the same latency
+// distribution cut off by the timeout: a shifted exponential (50ms plus a
+// 100ms mean tail, 150ms on average) probed with a 200ms timeout, so about
+// 22% of the probes time out. Each timeout counts as one observation
+// (TimeoutPenalty 1). Treating the timeouts as censored latencies must
+// recover the true mean; the successes alone underestimate it, and the
+// fixed pseudo-latency of twice the timeout overestimates it.
+func TestCensoredEstimate(t *testing.T) {
+	const (
+		shiftMS   = 50.0
+		tailMS    = 100.0
+		timeoutMS = 200.0
+		trueMean  = shiftMS + tailMS
+		probes    = 20000
+		tolerance = 0.05
+	)
+	prefix := netip.MustParsePrefix("198.18.0.0/24")
+
+	for _, tc := range []struct {
+		model    string
+		unbiased bool
+	}{
+		{FailureBetaOnly, false},
+		{FailurePseudoLatency, false},
+		{FailureHazard, true},
+	} {
+		cfg := DefaultConfig()
+		cfg.FailureModel = tc.model
+		cfg.TimeoutPenalty = 1
+		e := &Engine{cfg: cfg, tree: bandit.NewArmTree([]netip.Prefix{prefix}, cfg.ToTreeConfig())}
+
+		rng := rand.New(rand.NewSource(1))
+		for range probes {
+			latency := shiftMS + rng.ExpFloat64()*tailMS
+			if latency > timeoutMS {
+				e.updateArm(prefix, false, 0, timeoutMS, false)
+			} else {
+				e.updateArm(prefix, true, latency, timeoutMS, false)
+			}
+		}
+
+		got := e.tree.GetNode(prefix).Stats().MeanLatency
+		within := math.Abs(got-trueMean) <= tolerance*trueMean
+		switch {
+		case tc.unbiased && !within:
+			t.Errorf("%s: estimate %.1fms, want within %.0f%% of the true mean %.0fms", tc.model, got, 100*tolerance, trueMean)
+		case !tc.unbiased && within:
+			t.Errorf("%s: estimate %.1fms is within %.0f%% of the true mean %.0fms; the scenario must show its bias", tc.model, got, 100*tolerance, trueMean)
+		}
+	}
+}
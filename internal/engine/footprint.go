@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"math"
+	"net/netip"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/bandit"
+)
+
+// Footprint is the estimated density of responsive addresses in a prefix
+// the search found good: the chance that an address picked from it without
+// scanning answers a probe, from the hit rate of the probes sent into it.
+// The estimate assumes those probes were spread over the whole prefix.
+type Footprint struct {
+	Prefix  netip.Prefix `json:"prefix"`
+	Label   string       `json:"label,omitempty"`
+	Samples int          `json:"samples"`
+	OK      int          `json:"ok"`
+
+	// Density is OK/Samples; Lower and Upper bound it (Wilson interval,
+	// ~95%), so thinly sampled prefixes show how little is known.
+	Density float64 `json:"density"`
+	Lower   float64 `json:"lower"`
+	Upper   float64 `json:"upper"`
+
+	// Addresses is the size of the prefix and Responsive the estimated
+	// number of responsive addresses in it (Density × Addresses).
+	Addresses  float64 `json:"addresses"`
+	Responsive float64 `json:"responsive"`
+
+	// MeanMS is the mean latency of the successful probes and Results the
+	// number of top results in the prefix.
+	MeanMS  float64 `json:"mean_ms,omitempty"`
+	Results int     `json:"results"`
+}
+
+// footprint estimates the responsive density of the prefixes holding the
+// successful results of top, in the order of their best result. A prefix
+// split since counts the probes of its whole subtree.
+func (e *Engine) footprint(top []TopResult) []Footprint {
+	var out []Footprint
+	index := make(map[netip.Prefix]int)
+	for _, r := range top {
+		if !r.OK || !r.Prefix.IsValid() {
+			continue
+		}
+		if i, ok := index[r.Prefix]; ok {
+			out[i].Results++
+			continue
+		}
+		node := e.tree.GetNode(r.Prefix)
+		if node == nil {
+			continue
+		}
+		var samples, ok int
+		var latency float64
+		countSubtree(node.Snapshot(), &samples, &ok, &latency)
+		if samples == 0 {
+			continue
+		}
+		f := Footprint{
+			Prefix:    r.Prefix,
+			Label:     r.Label,
+			Samples:   samples,
+			OK:        ok,
+			Density:   float64(ok) / float64(samples),
+			Addresses: math.Exp2(float64(r.Prefix.Addr().BitLen() - r.Prefix.Bits())),
+			Results:   1,
+		}
+		f.Lower, f.Upper = wilson(ok, samples, rankZ)
+		f.Responsive = f.Density * f.Addresses
+		if ok > 0 {
+			f.MeanMS = latency / float64(ok)
+		}
+		index[r.Prefix] = len(out)
+		out = append(out, f)
+	}
+	return out
+}
+
+// countSubtree adds the probes, successes and summed success latency of s
+// and its descendants.
+func countSubtree(s bandit.NodeSnapshot, samples, ok *int, latency *float64) {
+	*samples += s.Samples
+	*ok += s.Successes
+	*latency += s.MeanLatency * float64(s.Successes)
+	for _, c := range s.Children {
+		countSubtree(c, samples, ok, latency)
+	}
+}
+
+// wilson returns the Wilson score interval of k successes in n trials.
+func wilson(k, n int, z float64) (lower, upper float64) {
+	p, fn := float64(k)/float64(n), float64(n)
+	denom := 1 + z*z/fn
+	center := (p + z*z/(2*fn)) / denom
+	radius := z * math.Sqrt(p*(1-p)/fn+z*z/(4*fn*fn)) / denom
+	return max(0, center-radius), min(1, center+radius)
+}
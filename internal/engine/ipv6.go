@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/bandit"
+)
+
+const (
+	// subnetBits is the IPv6 subnet size Config.SubnetsPerPrefixV6 counts.
+	subnetBits = 64
+
+	// capBitsV6 is the shortest prefix whose /64s are capped when the
+	// search runs in a single phase (Config.PhaseBitsV6 = 0).
+	capBitsV6 = 48
+)
+
+// subnetCap bounds the distinct /64s sampled per IPv6 prefix (see
+// Config.SubnetsPerPrefixV6), so a drilled-down prefix is probed ever more
+// densely instead of in ever new subnets.
+type subnetCap struct {
+	mu   sync.Mutex
+	seen map[netip.Prefix][]netip.Prefix
+}
+
+// capSubnet returns ip, sampled from prefix, or, if prefix has used up its
+// /64s and ip lies in a new one, an address from one of the /64s already
+// visited. Prefixes shorter than Config.PhaseBitsV6 (or capBitsV6) are
+// exempt: the first phase needs them to spread out.
+func (e *Engine) capSubnet(prefix netip.Prefix, ip netip.Addr, head *bandit.SearchHead) netip.Addr {
+	per := e.cfg.SubnetsPerPrefixV6
+	minBits := e.cfg.PhaseBitsV6
+	if minBits == 0 {
+		minBits = capBitsV6
+	}
+	if per <= 0 || !ip.Is6() || prefix.Bits() < minBits || prefix.Bits() >= subnetBits {
+		return ip
+	}
+	subnet, _ := ip.Prefix(subnetBits)
+
+	c := &e.subnets
+	c.mu.Lock()
+	if c.seen == nil {
+		c.seen = make(map[netip.Prefix][]netip.Prefix)
+	}
+	visited := c.seen[prefix]
+	for _, s := range visited {
+		if s == subnet {
+			c.mu.Unlock()
+			return ip
+		}
+	}
+	if len(visited) < per {
+		c.seen[prefix] = append(visited, subnet)
+		c.mu.Unlock()
+		return ip
+	}
+	c.mu.Unlock()
+
+	i := int(head.Sampler.SampleUniform() * float64(len(visited)))
+	return head.Sampler.SampleIP(visited[min(i, len(visited)-1)])
+}
+
+// forget drops the /64s recorded for the prefixes within prefix, which
+// was added to or removed from the search mid-run and starts over.
+func (c *subnetCap) forget(prefix netip.Prefix) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for p := range c.seen {
+		if prefix.Overlaps(p) {
+			delete(c.seen, p)
+		}
+	}
+}
+
+// wellKnownSuffix returns the first address of Config.SuffixesV6 in ip's
+// /64 that lies in prefix and has not been probed yet, marking it probed;
+// false once all of them have been, so the /64 falls back to random host
+// bits.
+func (e *Engine) wellKnownSuffix(prefix netip.Prefix, ip netip.Addr) (netip.Addr, bool) {
+	if len(e.cfg.SuffixesV6) == 0 || !ip.Is6() {
+		return netip.Addr{}, false
+	}
+	b := ip.As16()
+	for _, id := range e.cfg.SuffixesV6 {
+		binary.BigEndian.PutUint64(b[8:], id)
+		cand := netip.AddrFrom16(b)
+		if !prefix.Contains(cand) || e.isRemoved(cand) {
+			continue
+		}
+		if _, loaded := e.seenIPs.LoadOrStore(ipToKey(cand), struct{}{}); !loaded && !e.cfg.Shared.Dead(cand) {
+			return cand, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// maybeStartDrill starts the second phase of the IPv6 search once
+// Config.DrillAfter of the budget has been spent finding responsive
+// prefixes.
+func (e *Engine) maybeStartDrill() {
+	if e.tree.Drilling() || float64(e.spent()) < e.cfg.DrillAfter*float64(e.cfg.Budget) {
+		return
+	}
+	e.tree.StartDrill()
+	if e.cfg.Verbose {
+		fmt.Fprintf(os.Stderr, "ipv6: drilling below /%d after %d probes, %d responsive prefixes\n",
+			e.cfg.PhaseBitsV6, e.spent(), e.tree.ResponsiveLeaves())
+	}
+}
@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// memCheckInterval is how often the scheduler reads the heap size.
+	memCheckInterval = 2 * time.Second
+
+	// memReportInterval is how often verbose runs log the heap size.
+	memReportInterval = 30 * time.Second
+
+	// memPruneRatio is the share of Config.MaxMemory at which the search
+	// drops its deduplication set and folds part of its tree; above
+	// memThrottleRatio it also stops splitting and throttles probes to
+	// Config.MinConcurrency until the heap shrinks.
+	memPruneRatio    = 0.8
+	memThrottleRatio = 0.95
+
+	// memPruneShare is the share of the tree's nodes a prune removes, at
+	// most.
+	memPruneShare = 0.25
+)
+
+// MemoryUsage is the heap and goroutine count of the process.
+type MemoryUsage struct {
+	HeapBytes  uint64 `json:"heap_bytes"`
+	Goroutines int    `json:"goroutines"`
+}
+
+func (u MemoryUsage) String() string {
+	return fmt.Sprintf("heap=%.1fMiB goroutines=%d", float64(u.HeapBytes)/(1<<20), u.Goroutines)
+}
+
+// ReadMemoryUsage returns the current MemoryUsage, without stopping the
+// world as runtime.ReadMemStats does.
+func ReadMemoryUsage() MemoryUsage {
+	s := []metrics.Sample{
+		{Name: "/memory/classes/heap/objects:bytes"},
+		{Name: "/sched/goroutines:goroutines"},
+	}
+	metrics.Read(s)
+	var u MemoryUsage
+	if s[0].Value.Kind() == metrics.KindUint64 {
+		u.HeapBytes = s[0].Value.Uint64()
+	}
+	if s[1].Value.Kind() == metrics.KindUint64 {
+		u.Goroutines = int(s[1].Value.Uint64())
+	}
+	return u
+}
+
+// memoryGuard keeps a search under Config.MaxMemory. Scheduler goroutine
+// only, except for throttled.
+type memoryGuard struct {
+	throttled  atomic.Bool
+	prunes     int64
+	peak       uint64
+	lastReport time.Time
+}
+
+// checkMemory logs the heap size now and then in verbose runs and, with
+// Config.MaxMemory, sheds what the search can rebuild as the heap nears
+// the cap: the deduplication set first (at worst some addresses are
+// probed twice) and the worst ranges of the tree, then probe concurrency.
+func (e *Engine) checkMemory(timeoutMS float64) {
+	g := &e.mem
+	u := ReadMemoryUsage()
+	g.peak = max(g.peak, u.HeapBytes)
+	if e.cfg.Verbose && time.Since(g.lastReport) >= memReportInterval {
+		fmt.Fprintf(os.Stderr, "memory: %s nodes=%d\n", u, e.tree.Size())
+		g.lastReport = time.Now()
+	}
+	if e.cfg.MaxMemory <= 0 {
+		return
+	}
+
+	limit := float64(e.cfg.MaxMemory)
+	if float64(u.HeapBytes) >= memPruneRatio*limit {
+		e.seenIPs.Clear()
+		removed := e.tree.Prune(int(memPruneShare*float64(e.tree.Size())), timeoutMS)
+		runtime.GC()
+		g.prunes++
+		after := ReadMemoryUsage()
+		if e.cfg.Verbose {
+			fmt.Fprintf(os.Stderr, "memory: heap %.1fMiB near the %.0fMiB cap, cleared the dedup set and pruned %d nodes (now %.1fMiB)\n",
+				float64(u.HeapBytes)/(1<<20), limit/(1<<20), removed, float64(after.HeapBytes)/(1<<20))
+		}
+		u = after
+	}
+
+	throttle := float64(u.HeapBytes) >= memThrottleRatio*limit
+	if was := g.throttled.Swap(throttle); was != throttle && e.cfg.Verbose {
+		if throttle {
+			fmt.Fprintf(os.Stderr, "memory: still near the cap, throttling to %d in-flight probes and pausing splits\n", e.cfg.MinConcurrency)
+		} else {
+			fmt.Fprintln(os.Stderr, "memory: back under the cap, resuming")
+		}
+	}
+}
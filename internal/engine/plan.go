@@ -0,0 +1,88 @@
+package engine
+
+import (
+	"math"
+	mrand "math/rand"
+	"net/netip"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/cidr"
+)
+
+// Plan describes what a search would do, computed without sending any
+// packets (see Engine.Plan).
+type Plan struct {
+	Roots []cidr.Entry
+
+	// AddressesV4 and AddressesV6 are the sizes of the search space.
+	AddressesV4 float64
+	AddressesV6 float64
+
+	// Scale is the automatic scaling derived from the roots.
+	Scale Scale
+
+	// Config is the effective configuration after defaults and scaling.
+	Config Config
+
+	// Samples are addresses drawn from the roots the way the first probes
+	// of a search are: roots by weight, uniformly within a root.
+	Samples []netip.Addr
+}
+
+// Plan loads and normalizes the roots of req and returns the root set, the
+// size of the search space, the effective configuration and n sample
+// addresses, without probing anything.
+func (e *Engine) Plan(req Request, n int) (Plan, error) {
+	entries, scale, err := e.prepare(req)
+	if err != nil {
+		return Plan{}, err
+	}
+	p := Plan{Roots: entries, Scale: scale, Config: e.cfg}
+
+	weights := make([]float64, len(entries))
+	total := 0.0
+	for i, en := range entries {
+		hostBits := float64(en.Prefix.Addr().BitLen() - en.Prefix.Bits())
+		if en.Prefix.Addr().Is4() {
+			p.AddressesV4 += math.Pow(2, hostBits)
+		} else {
+			p.AddressesV6 += math.Pow(2, hostBits)
+		}
+		// Roots start with equal priors, so heads pick them alike
+		// regardless of size, scaled by their weight.
+		weights[i] = 1
+		if en.Weight > 0 {
+			weights[i] = en.Weight
+		}
+		total += weights[i]
+	}
+
+	seed := e.cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rng := mrand.New(mrand.NewSource(seed))
+	for tries := 0; len(p.Samples) < n && tries < n*10; tries++ {
+		x := rng.Float64() * total
+		i := 0
+		for i < len(weights)-1 && x >= weights[i] {
+			x -= weights[i]
+			i++
+		}
+		addr := cidr.RandomAddr(entries[i].Prefix, rng)
+		if excluded(addr, req.Exclude) {
+			continue
+		}
+		p.Samples = append(p.Samples, addr)
+	}
+	return p, nil
+}
+
+func excluded(addr netip.Addr, exclude []netip.Prefix) bool {
+	for _, p := range exclude {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,17 @@
+package engine
+
+import "github.com/zhaiiker/montecarlo-ip-searcher/internal/bandit"
+
+// seedPriors gives each of nodes the prior Config.Priors holds for its
+// prefix, so a search sharing a pack starts out favouring the prefixes that
+// did well elsewhere and avoiding the ones that failed.
+func (e *Engine) seedPriors(nodes []*bandit.ArmNode) {
+	if e.cfg.Priors == nil {
+		return
+	}
+	for _, n := range nodes {
+		if pr, ok := e.cfg.Priors.Lookup(n.Prefix); ok {
+			n.SetPrior(pr.Successes, pr.Failures, pr.MeanMS, pr.VarMS)
+		}
+	}
+}
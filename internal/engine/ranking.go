@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"math"
+	"net/netip"
+	"sort"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/bandit"
+)
+
+// Search objectives.
+const (
+	// ObjectiveIP finds the best individual IPs (default).
+	ObjectiveIP = "ip"
+	// ObjectivePrefixRanking finds the best K prefixes at RankBitsV4/RankBitsV6
+	// with statistical confidence.
+	ObjectivePrefixRanking = "prefix-ranking"
+)
+
+// rankZ is the confidence multiplier for ranking intervals (~95%).
+const rankZ = 2.0
+
+// PrefixRank is a ranked prefix in prefix-ranking mode.
+type PrefixRank struct {
+	Rank        int          `json:"rank"`
+	Prefix      netip.Prefix `json:"prefix"`
+	Label       string       `json:"label,omitempty"`
+	Samples     int          `json:"samples"`
+	OK          int          `json:"ok"`
+	Fail        int          `json:"fail"`
+	SuccessRate float64      `json:"success_rate"`
+	MeanMS      float64      `json:"mean_ms"`
+	ScoreMS     float64      `json:"score_ms"`
+	LowerMS     float64      `json:"lower_ms"`
+	UpperMS     float64      `json:"upper_ms"`
+
+	// Decided is true once the prefix's membership in the top K is known
+	// with confidence; decided prefixes are no longer sampled.
+	Decided bool `json:"decided"`
+}
+
+// rankPrefixes computes a confidence-interval ranking of all leaves at the
+// ranking depth and freezes the ones whose top-K membership is decided
+// (LUCB-style racing). Returns the full ranking, best first.
+func (e *Engine) rankPrefixes(timeoutMS float64) []PrefixRank {
+	var ranks []PrefixRank
+	nodes := make(map[netip.Prefix]*bandit.ArmNode)
+
+	for _, node := range e.tree.LeafNodes() {
+		if node.Prefix.Bits() != e.rankBits(node.Prefix) {
+			continue
+		}
+		stats := node.Stats()
+		if stats.Samples < e.cfg.MinSamplesSplit {
+			continue
+		}
+
+		score := stats.Score(timeoutMS)
+		// Per-sample variance: latency spread plus the Bernoulli variance of
+		// the failure penalty.
+		v := stats.VarLatency + timeoutMS*timeoutMS*stats.SuccessRate*(1-stats.SuccessRate)
+		radius := rankZ * math.Sqrt(v/float64(stats.Samples))
+
+		ranks = append(ranks, PrefixRank{
+			Prefix:      node.Prefix,
+			Label:       node.Label,
+			Samples:     stats.Samples,
+			OK:          stats.Successes,
+			Fail:        stats.Failures,
+			SuccessRate: stats.SuccessRate,
+			MeanMS:      stats.MeanLatency,
+			ScoreMS:     score,
+			LowerMS:     score - radius,
+			UpperMS:     score + radius,
+			Decided:     node.IsFrozen(),
+		})
+		nodes[node.Prefix] = node
+	}
+
+	sort.Slice(ranks, func(i, j int) bool { return ranks[i].ScoreMS < ranks[j].ScoreMS })
+	for i := range ranks {
+		ranks[i].Rank = i + 1
+	}
+
+	k := e.cfg.TopN
+	if k >= len(ranks) {
+		// Nothing to race against yet.
+		return ranks
+	}
+
+	// Lowest lower bound outside the top K, highest upper bound inside it.
+	minRestLower := math.Inf(1)
+	for _, r := range ranks[k:] {
+		minRestLower = math.Min(minRestLower, r.LowerMS)
+	}
+	maxTopUpper := math.Inf(-1)
+	for _, r := range ranks[:k] {
+		maxTopUpper = math.Max(maxTopUpper, r.UpperMS)
+	}
+
+	for i := range ranks {
+		r := &ranks[i]
+		if r.Decided {
+			continue
+		}
+		in := i < k && r.UpperMS < minRestLower
+		out := i >= k && r.LowerMS > maxTopUpper
+		if in || out {
+			r.Decided = true
+			nodes[r.Prefix].Freeze()
+		}
+	}
+
+	return ranks
+}
+
+// rankBits returns the ranking depth for the prefix's address family.
+func (e *Engine) rankBits(p netip.Prefix) int {
+	if p.Addr().Is4() {
+		return e.cfg.RankBitsV4
+	}
+	return e.cfg.RankBitsV6
+}
@@ -3,38 +3,86 @@ package engine
 import (
 	"container/heap"
 	"net/netip"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/bandit"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/probe"
 )
 
 // ProbeResult holds the result of a single probe.
 type ProbeResult struct {
-	IP     netip.Addr
-	Prefix netip.Prefix
-	HeadID int
-
-	OK        bool
-	Status    int
-	Error     string
-	ConnectMS int64
-	TLSMS     int64
-	TTFBMS    int64
-	TotalMS   int64
-	ScoreMS   float64
-	Trace     map[string]string
+	IP     netip.Addr   `json:"ip"`
+	Prefix netip.Prefix `json:"prefix"`
+	Label  string       `json:"label,omitempty"`
+	Port   uint16       `json:"port,omitempty"`
+	HeadID int          `json:"head"`
+	Worker int          `json:"worker"`
+
+	OK        bool              `json:"ok"`
+	Status    int               `json:"status"`
+	Error     string            `json:"error,omitempty"`
+	ConnectMS int64             `json:"connect_ms"`
+	TLSMS     int64             `json:"tls_ms"`
+	TTFBMS    int64             `json:"ttfb_ms"`
+	TotalMS   int64             `json:"total_ms"`
+	ScoreMS   float64           `json:"score_ms"`
+	Trace     map[string]string `json:"trace,omitempty"`
+	When      time.Time         `json:"when"`
+	Path      string            `json:"path,omitempty"`
+
+	// Typed copies of the trace fields results are filtered and grouped by.
+	probe.TraceInfo
+
+	// Warm-connection timings (second request on the same connection).
+	WarmTTFBMS  int64 `json:"warm_ttfb_ms,omitempty"`
+	WarmTotalMS int64 `json:"warm_total_ms,omitempty"`
+
+	// TLSResumeMS is the handshake time when it resumed an earlier TLS
+	// session; TLSMS is then 0.
+	TLSResumeMS int64 `json:"tls_resume_ms,omitempty"`
+
+	// TLSUnverified is set when the server certificate was not verified.
+	TLSUnverified bool `json:"tls_unverified,omitempty"`
+
+	// Targets are the per-target outcomes when probing several targets.
+	Targets []probe.TargetResult `json:"targets,omitempty"`
+
+	// BandwidthHintMbps is the probe's rough throughput estimate.
+	BandwidthHintMbps float64 `json:"bw_hint_mbps,omitempty"`
+
+	// RemoteAddr is where the probe's connection actually went.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	// Location is the target of an unfollowed redirect, and Redirects the
+	// followed ones.
+	Location  string              `json:"location,omitempty"`
+	Redirects []probe.RedirectHop `json:"redirects,omitempty"`
+
+	// Headers are the captured response headers (--capture-headers).
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// CacheStatus is probe.CacheHit or probe.CacheMiss when the response
+	// headers tell.
+	CacheStatus string `json:"cache_status,omitempty"`
 
 	// Statistics from the prefix at the time of probe
-	PrefixSamples int
-	PrefixOK      int
-	PrefixFail    int
+	PrefixSamples int `json:"prefix_samples"`
+	PrefixOK      int `json:"prefix_ok"`
+	PrefixFail    int `json:"prefix_fail"`
 }
 
 // TopResult is the public result type for output.
 type TopResult struct {
 	IP     netip.Addr   `json:"ip"`
 	Prefix netip.Prefix `json:"prefix"`
-	OK     bool         `json:"ok"`
-	Status int          `json:"status"`
-	Error  string       `json:"error,omitempty"`
+	Label  string       `json:"label,omitempty"`
+	// Port is the port the result was found on with Config.Ports.
+	Port   uint16 `json:"port,omitempty"`
+	OK     bool   `json:"ok"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
 
 	ConnectMS int64             `json:"connect_ms"`
 	TLSMS     int64             `json:"tls_ms"`
@@ -42,35 +90,155 @@ type TopResult struct {
 	TotalMS   int64             `json:"total_ms"`
 	ScoreMS   float64           `json:"score_ms"`
 	Trace     map[string]string `json:"trace,omitempty"`
+	Path      string            `json:"path,omitempty"`
+
+	// Typed copies of the trace fields results are filtered and grouped by.
+	probe.TraceInfo
+
+	// Warm-connection timings: a second request reusing the connection of
+	// the (cold) probe above, as long-lived proxy connections experience.
+	WarmTTFBMS  int64 `json:"warm_ttfb_ms,omitempty"`
+	WarmTotalMS int64 `json:"warm_total_ms,omitempty"`
+
+	// TLSResumeMS is the time of a resumed TLS handshake (session ticket
+	// from an earlier probe of this IP), next to the full handshake TLSMS.
+	// Either may be 0 when only the other kind was measured.
+	TLSResumeMS int64 `json:"tls_resume_ms,omitempty"`
+
+	// TLSUnverified is set when the server certificate was not verified
+	// (--insecure), so the results are not evidence the edge is genuine.
+	TLSUnverified bool `json:"tls_unverified,omitempty"`
+
+	// Targets are the per-target outcomes when probing several targets;
+	// the timings above are their worst or average.
+	Targets []probe.TargetResult `json:"targets,omitempty"`
+
+	// BandwidthHintMbps is a rough throughput estimate from the pacing of
+	// the probe's TLS handshake, for ordering results without download
+	// tests. It is an estimate, not a measurement (0 = none).
+	BandwidthHintMbps float64 `json:"bw_hint_mbps,omitempty"`
+
+	// RemoteAddr is the address (ip:port) the probe connection actually
+	// went to, as an audit that the candidate itself was measured.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	// Location is the target of a redirect the probe did not follow, and
+	// Redirects the redirects it followed on the candidate (see
+	// probe.Config.MaxRedirects), with the time of each hop.
+	Location  string              `json:"location,omitempty"`
+	Redirects []probe.RedirectHop `json:"redirects,omitempty"`
+
+	// Headers are the response headers captured by the probe (see
+	// probe.Config.CaptureHeaders).
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// CacheStatus is whether the probe's response came from the edge
+	// cache (see probe.Result.CacheStatus).
+	CacheStatus string `json:"cache_status,omitempty"`
+
+	// DriftFactor is the reference latency drift the score was normalized by
+	// (0 when no reference IP is configured).
+	DriftFactor float64 `json:"drift_factor,omitempty"`
 
 	DownloadOK    bool    `json:"download_ok"`
 	DownloadBytes int64   `json:"download_bytes"`
 	DownloadMS    int64   `json:"download_ms"`
 	DownloadMbps  float64 `json:"download_mbps"`
 	DownloadError string  `json:"download_error,omitempty"`
+	// DownloadAttempts is the number of download tests the figures above are
+	// the best of; failed or slow downloads are retried to confirm them.
+	DownloadAttempts int `json:"download_attempts,omitempty"`
+
+	// RankScore is the combined latency and download speed score results
+	// are ranked by after the download tests (higher is better).
+	RankScore float64 `json:"rank_score,omitempty"`
+
+	// Domain fronting check: whether the edge served a request whose SNI and
+	// Host header name different domains.
+	FrontingTested bool   `json:"fronting_tested,omitempty"`
+	FrontingOK     bool   `json:"fronting_ok,omitempty"`
+	FrontingError  string `json:"fronting_error,omitempty"`
+
+	// Encrypted ClientHello check: whether the edge accepted an ECH handshake.
+	ECHTested    bool   `json:"ech_tested,omitempty"`
+	ECHSupported bool   `json:"ech_supported,omitempty"`
+	ECHError     string `json:"ech_error,omitempty"`
+
+	// Certificate check: whether the served chain verifies against the
+	// system roots, the leaf's expiry and the stapled OCSP status.
+	CertTested bool      `json:"cert_tested,omitempty"`
+	CertOK     bool      `json:"cert_ok,omitempty"`
+	CertError  string    `json:"cert_error,omitempty"`
+	CertExpiry time.Time `json:"cert_expiry,omitzero"`
+	CertOCSP   string    `json:"cert_ocsp,omitempty"`
+
+	// Stability annotations from the IP cache (monitor mode): how long the IP
+	// has stayed good, how long it can go before being re-checked, and
+	// whether this row reuses an earlier check because it wasn't due yet.
+	StableForS    int64 `json:"stable_for_s,omitempty"`
+	RefreshAfterS int64 `json:"refresh_after_s,omitempty"`
+	Reused        bool  `json:"reused,omitempty"`
+
+	// Ports is the TCP reachability of each port tested by the port check.
+	Ports []PortResult `json:"ports,omitempty"`
 
 	PrefixSamples int `json:"prefix_samples"`
 	PrefixOK      int `json:"prefix_ok"`
 	PrefixFail    int `json:"prefix_fail"`
 }
 
+// PortResult is the TCP reachability of one port on a result IP.
+type PortResult struct {
+	Port      int   `json:"port"`
+	OK        bool  `json:"ok"`
+	ConnectMS int64 `json:"connect_ms,omitempty"`
+}
+
 // Response holds the complete search response.
 type Response struct {
 	Top []TopResult `json:"top"`
+
+	// Prefixes is the top-K prefix ranking (prefix-ranking objective only).
+	Prefixes []PrefixRank `json:"prefixes,omitempty"`
+
+	// PortArms are the statistics of each searched port (Config.Ports).
+	PortArms []bandit.PortStats `json:"port_arms,omitempty"`
+
+	// Footprint is the responsive density of the prefixes holding the top
+	// results (see Footprint).
+	Footprint []Footprint `json:"footprint,omitempty"`
+
+	// Stats are the run-level statistics of the search.
+	Stats RunStats `json:"stats"`
+
+	// SearchOrder is the ranking of Top by probe score alone, before the
+	// download tests re-ranked it.
+	SearchOrder []netip.Addr `json:"search_order,omitempty"`
+
+	// Meta is the recommendation drawn from Top (see Recommend).
+	Meta *Meta `json:"meta,omitempty"`
 }
 
 // topNHeap is a max-heap of TopResult ordered by ScoreMS.
 // We use a max-heap so we can efficiently remove the worst result when full.
+// index tracks the position of each IP as the heap moves items around.
 type topNHeap struct {
 	items []TopResult
+	index map[netip.Addr]int
 }
 
 func (h topNHeap) Len() int           { return len(h.items) }
 func (h topNHeap) Less(i, j int) bool { return h.items[i].ScoreMS > h.items[j].ScoreMS } // max-heap
-func (h topNHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h topNHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.index[h.items[i].IP] = i
+	h.index[h.items[j].IP] = j
+}
 
 func (h *topNHeap) Push(x interface{}) {
-	h.items = append(h.items, x.(TopResult))
+	r := x.(TopResult)
+	h.index[r.IP] = len(h.items)
+	h.items = append(h.items, r)
 }
 
 func (h *topNHeap) Pop() interface{} {
@@ -78,25 +246,42 @@ func (h *topNHeap) Pop() interface{} {
 	n := len(old)
 	x := old[n-1]
 	h.items = old[0 : n-1]
+	delete(h.index, x.IP)
 	return x
 }
 
-// TopNCollector collects and maintains the top N results efficiently using a heap.
+// reindex rebuilds the IP index after the items were changed wholesale.
+func (h *topNHeap) reindex() {
+	h.index = make(map[netip.Addr]int, len(h.items))
+	for i, item := range h.items {
+		h.index[item.IP] = i
+	}
+}
+
+// TopNCollector collects and maintains the top N results efficiently using
+// a heap: Consider is O(log N) and Snapshot O(N log N), so N can be large
+// enough to "collect everything".
 type TopNCollector struct {
-	n      int
-	heap   *topNHeap
-	ipSeen map[netip.Addr]int // IP -> index in heap for dedup
-	mu     sync.Mutex
+	n    int
+	heap *topNHeap
+	mu   sync.Mutex
 }
 
+// topNPrealloc caps the capacity reserved up front, so a huge N (say
+// --top 100000) only costs memory as results actually arrive.
+const topNPrealloc = 1024
+
 // NewTopNCollector creates a new TopN collector with heap-based storage.
 func NewTopNCollector(n int) *TopNCollector {
-	h := &topNHeap{items: make([]TopResult, 0, n+1)}
+	size := min(n, topNPrealloc)
+	h := &topNHeap{
+		items: make([]TopResult, 0, size+1),
+		index: make(map[netip.Addr]int, size),
+	}
 	heap.Init(h)
 	return &TopNCollector{
-		n:      n,
-		heap:   h,
-		ipSeen: make(map[netip.Addr]int, n),
+		n:    n,
+		heap: h,
 	}
 }
 
@@ -110,12 +295,11 @@ func (c *TopNCollector) Consider(r TopResult) {
 	}
 
 	// Check for duplicate IP
-	if idx, exists := c.ipSeen[r.IP]; exists {
+	if idx, exists := c.heap.index[r.IP]; exists {
 		// Only update if new score is better
 		if r.ScoreMS < c.heap.items[idx].ScoreMS {
 			c.heap.items[idx] = r
 			heap.Fix(c.heap, idx)
-			c.rebuildIPMap()
 		}
 		return
 	}
@@ -123,27 +307,16 @@ func (c *TopNCollector) Consider(r TopResult) {
 	// If heap is not full, just add
 	if c.heap.Len() < c.n {
 		heap.Push(c.heap, r)
-		c.rebuildIPMap()
 		return
 	}
 
 	// Heap is full, check if new result is better than worst
 	if r.ScoreMS < c.heap.items[0].ScoreMS {
-		// Remove the worst
-		worst := heap.Pop(c.heap).(TopResult)
-		delete(c.ipSeen, worst.IP)
-
-		// Add the new one
-		heap.Push(c.heap, r)
-		c.rebuildIPMap()
-	}
-}
-
-// rebuildIPMap rebuilds the IP -> index map after heap modifications.
-func (c *TopNCollector) rebuildIPMap() {
-	c.ipSeen = make(map[netip.Addr]int, len(c.heap.items))
-	for i, item := range c.heap.items {
-		c.ipSeen[item.IP] = i
+		// Replace the worst
+		delete(c.heap.index, c.heap.items[0].IP)
+		c.heap.items[0] = r
+		c.heap.index[r.IP] = 0
+		heap.Fix(c.heap, 0)
 	}
 }
 
@@ -173,21 +346,61 @@ func (c *TopNCollector) Snapshot() []TopResult {
 
 	result := make([]TopResult, len(c.heap.items))
 	copy(result, c.heap.items)
+	sortByScore(result)
+	return result
+}
+
+// Within returns the results scoring at most ratio times the best score,
+// sorted best first. It only sorts those, so it stays cheap for a huge N.
+func (c *TopNCollector) Within(ratio float64) []TopResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	// Sort by ScoreMS (ascending = best first)
-	for i := 0; i < len(result); i++ {
-		minIdx := i
-		for j := i + 1; j < len(result); j++ {
-			if result[j].ScoreMS < result[minIdx].ScoreMS {
-				minIdx = j
-			}
+	if len(c.heap.items) == 0 {
+		return nil
+	}
+	best := c.heap.items[0].ScoreMS
+	for _, item := range c.heap.items[1:] {
+		best = min(best, item.ScoreMS)
+	}
+	var result []TopResult
+	for _, item := range c.heap.items {
+		if item.ScoreMS <= best*ratio {
+			result = append(result, item)
 		}
-		result[i], result[minIdx] = result[minIdx], result[i]
 	}
-
+	sortByScore(result)
 	return result
 }
 
+// sortByScore sorts results by ScoreMS, best first; ties keep their order.
+func sortByScore(rows []TopResult) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].ScoreMS < rows[j].ScoreMS
+	})
+}
+
+// RemoveWithin drops all results whose IP is inside prefix.
+// Returns the number of results removed.
+func (c *TopNCollector) RemoveWithin(prefix netip.Prefix) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	kept := c.heap.items[:0]
+	for _, item := range c.heap.items {
+		if !prefix.Contains(item.IP) {
+			kept = append(kept, item)
+		}
+	}
+	removed := len(c.heap.items) - len(kept)
+	if removed > 0 {
+		c.heap.items = kept
+		c.heap.reindex()
+		heap.Init(c.heap)
+	}
+	return removed
+}
+
 // Len returns the current number of results.
 func (c *TopNCollector) Len() int {
 	c.mu.Lock()
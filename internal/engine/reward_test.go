@@ -0,0 +1,75 @@
+package engine
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/probe"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/testserver"
+)
+
+// TestRewardFunc checks that a custom RewardFunc decides both which probes
+// succeed and the cost the arms and the results are scored with.
+func TestRewardFunc(t *testing.T) {
+	root := netip.MustParsePrefix("198.18.0.0/24")
+	srv, err := testserver.New(1, testserver.Rule{Prefix: root, Profile: testserver.Profile{Latency: 5 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = srv.Close() }()
+
+	// Only even addresses count, all of them at a fixed cost.
+	const reward = 7.0
+	even := func(ip netip.Addr) bool { return ip.As4()[3]%2 == 0 }
+	var calls, rewarded int
+	cfg := DefaultConfig()
+	cfg.Budget = 60
+	cfg.Concurrency = 8
+	cfg.Seed = 1
+	cfg.RewardFunc = func(r probe.Result) (float64, bool) {
+		calls++
+		if !r.OK || !even(r.IP) {
+			return 0, false
+		}
+		rewarded++
+		return reward, true
+	}
+	pc := probe.Config{
+		Timeout:    time.Second,
+		SNI:        selftestHost,
+		HostHeader: selftestHost,
+		RootCAs:    srv.RootCAs(),
+		Dial:       srv.Dial,
+	}
+	e := New(cfg, pc)
+	resp, err := e.Run(context.Background(), Request{Prefixes: []netip.Prefix{root}, Probe: pc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls == 0 || rewarded == 0 {
+		t.Fatalf("RewardFunc called %d times, %d rewarded; want both > 0", calls, rewarded)
+	}
+
+	for _, r := range resp.Top {
+		if r.OK && (!even(r.IP) || r.ScoreMS != reward) {
+			t.Errorf("result %s ok with score %.1f, want only even IPs scored %.0f", r.IP, r.ScoreMS, reward)
+		}
+	}
+	var successes int
+	var latency float64
+	for _, n := range e.tree.AllNodes() {
+		st := n.Stats()
+		successes += st.Successes
+		if st.Successes > 0 {
+			latency = max(latency, st.MeanLatency)
+		}
+	}
+	if successes != rewarded {
+		t.Errorf("arms counted %d successes, want the %d the RewardFunc accepted", successes, rewarded)
+	}
+	if latency > reward+1 {
+		t.Errorf("arm latency estimate up to %.1fms, want about the %.0fms reward, not the measured latency", latency, reward)
+	}
+}
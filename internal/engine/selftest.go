@@ -0,0 +1,176 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/probe"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/testserver"
+)
+
+// selftestHost is the name the fake edge is probed under.
+const selftestHost = "selftest.mcis.invalid"
+
+// The fake address space of the self-test: a slow, lossy IPv4 /16 and IPv6
+// /40 each hiding one fast range, plus a refused IPv4 block. A working
+// search ends up in the fast ranges.
+var (
+	selftestRootV4 = netip.MustParsePrefix("198.18.0.0/16")
+	selftestFastV4 = netip.MustParsePrefix("198.18.64.0/20")
+	selftestDeadV4 = netip.MustParsePrefix("198.18.200.0/22")
+	selftestRootV6 = netip.MustParsePrefix("2001:db8::/40")
+	selftestFastV6 = netip.MustParsePrefix("2001:db8:40::/44")
+)
+
+func selftestRules() []testserver.Rule {
+	slow := testserver.Profile{Latency: 120 * time.Millisecond, Jitter: 60 * time.Millisecond, Loss: 0.2}
+	fast := testserver.Profile{Latency: 10 * time.Millisecond, Jitter: 4 * time.Millisecond, Loss: 0.02}
+	return []testserver.Rule{
+		{Prefix: selftestRootV4, Profile: slow},
+		{Prefix: selftestFastV4, Profile: fast},
+		{Prefix: selftestDeadV4, Profile: testserver.Profile{Refuse: true}},
+		{Prefix: selftestRootV6, Profile: slow},
+		{Prefix: selftestFastV6, Profile: fast},
+	}
+}
+
+// SelftestConfig configures a self-test search.
+type SelftestConfig struct {
+	Budget      int
+	Concurrency int
+	Timeout     time.Duration
+	Seed        int64 // of the search and of the fake edge's losses and jitter
+	Verbose     bool
+	Faults      []testserver.Fault // injected into the fake edge mid-run
+}
+
+// DefaultSelftestConfig returns the settings of `mcis selftest`.
+func DefaultSelftestConfig() SelftestConfig {
+	return SelftestConfig{Budget: 2000, Concurrency: 64, Timeout: 800 * time.Millisecond, Seed: 1}
+}
+
+// SelftestCheck is the outcome of one self-test check.
+type SelftestCheck struct {
+	OK   bool
+	Desc string
+}
+
+// SelftestResult is the outcome of a self-test search.
+type SelftestResult struct {
+	Response Response
+	Elapsed  time.Duration
+	Events   []testserver.Event // the faults that hit a probe
+	Checks   []SelftestCheck
+}
+
+// Failed returns the number of failed checks.
+func (r *SelftestResult) Failed() int {
+	n := 0
+	for _, c := range r.Checks {
+		if !c.OK {
+			n++
+		}
+	}
+	return n
+}
+
+// Selftest runs a search against a fake edge on localhost (see
+// internal/testserver) and checks that it finds the fast ranges hidden in
+// the slow ones, that they get a fair share of the probes and that
+// injected rate-limit answers are kept out of the statistics.
+func Selftest(ctx context.Context, sc SelftestConfig) (*SelftestResult, error) {
+	srv, err := testserver.New(sc.Seed, selftestRules()...)
+	if err != nil {
+		return nil, fmt.Errorf("fake edge: %w", err)
+	}
+	defer func() { _ = srv.Close() }()
+
+	cfg := DefaultConfig()
+	cfg.Budget = sc.Budget
+	cfg.HeadsV4, cfg.HeadsV6 = 2, 2
+	cfg.Concurrency = sc.Concurrency
+	cfg.Seed = sc.Seed
+	cfg.Verbose = sc.Verbose
+	req := Request{
+		Prefixes: []netip.Prefix{selftestRootV4, selftestRootV6},
+		Probe: probe.Config{
+			Timeout:    sc.Timeout,
+			SNI:        selftestHost,
+			HostHeader: selftestHost,
+			RootCAs:    srv.RootCAs(),
+			Dial:       srv.Dial,
+		},
+	}
+
+	start := time.Now()
+	srv.Inject(sc.Faults...)
+	resp, err := New(cfg, req.Probe).Run(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+	res := &SelftestResult{Response: resp, Elapsed: time.Since(start), Events: srv.Events()}
+	check := func(ok bool, format string, a ...any) {
+		res.Checks = append(res.Checks, SelftestCheck{OK: ok, Desc: fmt.Sprintf(format, a...)})
+	}
+
+	for _, fam := range []struct {
+		name       string
+		root, fast netip.Prefix
+	}{
+		{"IPv4", selftestRootV4, selftestFastV4},
+		{"IPv6", selftestRootV6, selftestFastV6},
+	} {
+		var best *RootStats
+		for i, rs := range resp.Stats.PerRoot {
+			if rs.Prefix == fam.root && rs.BestIP.IsValid() {
+				best = &resp.Stats.PerRoot[i]
+			}
+		}
+		if best == nil {
+			check(false, "%s: no working IP found", fam.name)
+			continue
+		}
+		check(fam.fast.Contains(best.BestIP), "%s: best IP %s (%.1fms) lies in the fast range %s", fam.name, best.BestIP, best.BestScoreMS, fam.fast)
+
+		var inFast, inRoot int
+		for ip, n := range srv.Dials() {
+			if fam.root.Contains(ip) {
+				inRoot += n
+				if fam.fast.Contains(ip) {
+					inFast += n
+				}
+			}
+		}
+		share := float64(inFast) / float64(max(inRoot, 1))
+		space := 1 / float64(uint64(1)<<(fam.fast.Bits()-fam.root.Bits()))
+		check(share >= 2*space, "%s: fast range got %.1f%% of the probes (%.2f%% of the addresses)", fam.name, 100*share, 100*space)
+	}
+
+	// Rate-limit answers say nothing about the IPs: the search must back
+	// off and keep them out of the arm statistics.
+	if n := res.Injected(testserver.FaultRateLimit); n > 0 {
+		check(resp.Stats.RateLimited > 0 && resp.Stats.RateLimited <= int64(n),
+			"%d of %d injected rate-limit responses were recognized and kept out of the statistics", resp.Stats.RateLimited, n)
+	}
+
+	if resp.Meta != nil && resp.Meta.Recommended.IsValid() {
+		ip := resp.Meta.Recommended
+		check(selftestFastV4.Contains(ip) || selftestFastV6.Contains(ip), "recommended IP %s lies in a fast range", ip)
+	} else {
+		check(false, "no IP recommended")
+	}
+	return res, nil
+}
+
+// Injected returns how many probes were hit by a fault of the given kind.
+func (r *SelftestResult) Injected(kind string) int {
+	n := 0
+	for _, ev := range r.Events {
+		if ev.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
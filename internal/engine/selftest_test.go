@@ -0,0 +1,41 @@
+package engine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/testserver"
+)
+
+// TestSelftest runs the `mcis selftest` scenario: the search must find the
+// fast ranges of the fake edge, give them a fair share of the probes and,
+// with rate-limit answers injected mid-run, keep those out of the arm
+// statistics.
+func TestSelftest(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		faults []testserver.Fault
+	}{
+		{"clean", nil},
+		{"ratelimit", []testserver.Fault{{Kind: testserver.FaultRateLimit, Start: time.Second, Duration: time.Second}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			sc := DefaultSelftestConfig()
+			sc.Faults = tc.faults
+			res, err := Selftest(context.Background(), sc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.faults != nil && res.Injected(testserver.FaultRateLimit) == 0 {
+				t.Fatal("no probe hit the injected rate limit")
+			}
+			for _, c := range res.Checks {
+				if !c.OK {
+					t.Error(c.Desc)
+				}
+			}
+		})
+	}
+}
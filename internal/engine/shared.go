@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/probe"
+)
+
+// Shared is state that searches running at once in one process share, so
+// several jobs (e.g. one per SNI) cost about as much as one: a pool of
+// probe slots bounding their combined concurrency, and a negative cache of
+// addresses that failed at the network level. Whether an address answers
+// on port 443 at all doesn't depend on the SNI, so once one search finds
+// it refused or unreachable, the others skip it like an address they have
+// already probed.
+//
+// A nil Shared shares nothing.
+type Shared struct {
+	slots chan struct{}
+
+	mu   sync.Mutex
+	dead map[netip.Addr]time.Time
+}
+
+// deadTTL is how long an address stays in the negative cache.
+const deadTTL = 10 * time.Minute
+
+// NewShared creates shared state whose pool runs at most workers probes at
+// once across all searches using it.
+func NewShared(workers int) *Shared {
+	return &Shared{
+		slots: make(chan struct{}, max(1, workers)),
+		dead:  make(map[netip.Addr]time.Time),
+	}
+}
+
+// acquire takes a probe slot, waiting until one is free.
+func (s *Shared) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release returns a slot taken by acquire.
+func (s *Shared) release() {
+	if s != nil {
+		<-s.slots
+	}
+}
+
+// record adds ip to the negative cache if r failed for a reason no other
+// SNI or path could fix.
+func (s *Shared) record(ip netip.Addr, r probe.Result) {
+	if s == nil || r.OK {
+		return
+	}
+	switch failureKind(r) {
+	case FailRefused, FailUnreachable:
+	default:
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dead[ip] = time.Now()
+	// Expired entries are pruned as the cache grows.
+	if len(s.dead)%1024 == 0 {
+		for a, t := range s.dead {
+			if time.Since(t) > deadTTL {
+				delete(s.dead, a)
+			}
+		}
+	}
+}
+
+// Dead reports whether ip is in the negative cache.
+func (s *Shared) Dead(ip netip.Addr) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.dead[ip]
+	return ok && time.Since(t) <= deadTTL
+}
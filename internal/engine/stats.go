@@ -0,0 +1,175 @@
+package engine
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// RunStats summarizes a finished search (see Response.Stats), so consumers
+// don't have to recompute run-level figures from the probe stream.
+type RunStats struct {
+	// TotalProbes counts every probe that completed, including
+	// rate-limited ones and those of ranges removed mid-run; Successes,
+	// Failures and RateLimited split them by outcome.
+	TotalProbes int64 `json:"total_probes"`
+	Successes   int64 `json:"successes"`
+	Failures    int64 `json:"failures"`
+	RateLimited int64 `json:"rate_limited"`
+
+	// CacheSkipped counts the responses left unscored for not having the
+	// cache status of Config.PreferCache.
+	CacheSkipped int64 `json:"cache_skipped,omitempty"`
+
+	DurationS float64 `json:"duration_s"`
+	TreeSize  int     `json:"tree_size"`
+
+	// PerRoot splits the probes by the root prefix they were sampled from,
+	// in root order.
+	PerRoot []RootStats `json:"per_root"`
+
+	// ErrorBreakdown counts failed and rate-limited probes by kind (the
+	// Fail* constants).
+	ErrorBreakdown map[string]int `json:"error_breakdown"`
+
+	Waste Waste `json:"waste"`
+
+	// PeakHeapBytes is the largest heap seen during the search (sampled
+	// every few seconds) and MemoryPrunes how often Config.MaxMemory
+	// forced the search to shed state.
+	PeakHeapBytes uint64 `json:"peak_heap_bytes,omitempty"`
+	MemoryPrunes  int64  `json:"memory_prunes,omitempty"`
+}
+
+// RootStats is the share of a search spent on one root prefix.
+type RootStats struct {
+	Prefix    netip.Prefix `json:"prefix"`
+	Label     string       `json:"label,omitempty"`
+	Probes    int64        `json:"probes"`
+	Successes int64        `json:"successes"`
+	Failures  int64        `json:"failures"`
+
+	// BestScoreMS and BestIP are the best success within the root.
+	BestScoreMS float64    `json:"best_score_ms,omitempty"`
+	BestIP      netip.Addr `json:"best_ip,omitzero"`
+}
+
+// runTally accumulates RunStats during a search. It is only touched by the
+// goroutine running the search, except for last, which is read by
+// TreeSnapshot.
+type runTally struct {
+	probes, successes, failures, rateLimited int64
+	cacheSkipped                             int64
+
+	errors map[string]int
+	roots  map[netip.Prefix]*RootStats
+
+	mu   sync.Mutex
+	last *RunStats // stats of the last finished search
+}
+
+// tallyRateLimited records a rate-limited probe.
+func (e *Engine) tallyRateLimited() {
+	e.tally.probes++
+	e.tally.rateLimited++
+	e.tallyError(FailRateLimited)
+}
+
+// tallyResult records a scored probe against its root prefix.
+func (e *Engine) tallyResult(d probeDone, ok bool, score float64) {
+	t := &e.tally
+	t.probes++
+	if ok {
+		t.successes++
+	} else {
+		t.failures++
+		e.tallyError(failureKind(d.result))
+	}
+
+	root := e.tree.GetNode(d.task.prefix)
+	if root == nil {
+		return
+	}
+	for root.Parent != nil {
+		root = root.Parent
+	}
+	if t.roots == nil {
+		t.roots = make(map[netip.Prefix]*RootStats)
+	}
+	rs := t.roots[root.Prefix]
+	if rs == nil {
+		rs = &RootStats{Prefix: root.Prefix, Label: root.Label}
+		t.roots[root.Prefix] = rs
+	}
+	rs.Probes++
+	if !ok {
+		rs.Failures++
+		return
+	}
+	rs.Successes++
+	if !rs.BestIP.IsValid() || score < rs.BestScoreMS {
+		rs.BestScoreMS, rs.BestIP = score, d.task.ip
+	}
+}
+
+func (e *Engine) tallyError(kind string) {
+	if e.tally.errors == nil {
+		e.tally.errors = make(map[string]int)
+	}
+	e.tally.errors[kind]++
+}
+
+// finishStats builds the RunStats of the search that just ended and keeps
+// them for TreeSnapshot.
+func (e *Engine) finishStats() RunStats {
+	t := &e.tally
+	st := RunStats{
+		TotalProbes:    t.probes,
+		Successes:      t.successes,
+		Failures:       t.failures,
+		RateLimited:    t.rateLimited,
+		CacheSkipped:   t.cacheSkipped,
+		DurationS:      time.Since(e.runStart).Seconds(),
+		TreeSize:       e.tree.Size(),
+		ErrorBreakdown: make(map[string]int, len(t.errors)),
+		Waste:          e.waste.snapshot(),
+		PeakHeapBytes:  e.mem.peak,
+		MemoryPrunes:   e.mem.prunes,
+	}
+	for k, n := range t.errors {
+		st.ErrorBreakdown[k] = n
+	}
+	for _, root := range e.tree.Roots() {
+		if rs := t.roots[root.Prefix]; rs != nil {
+			st.PerRoot = append(st.PerRoot, *rs)
+		}
+	}
+	if e.cfg.Verbose {
+		breakdown := ""
+		if len(st.ErrorBreakdown) > 0 {
+			breakdown = " errors=" + formatKinds(st.ErrorBreakdown)
+		}
+		if st.CacheSkipped > 0 {
+			breakdown += fmt.Sprintf(" cache_skipped=%d", st.CacheSkipped)
+		}
+		if st.MemoryPrunes > 0 {
+			breakdown += fmt.Sprintf(" memory_prunes=%d", st.MemoryPrunes)
+		}
+		fmt.Fprintf(os.Stderr, "stats: probes=%d successes=%d failures=%d rate_limited=%d duration=%.1fs nodes=%d%s\n",
+			st.TotalProbes, st.Successes, st.Failures, st.RateLimited, st.DurationS, st.TreeSize, breakdown)
+	}
+
+	t.mu.Lock()
+	t.last = &st
+	t.mu.Unlock()
+	return st
+}
+
+// lastStats returns the stats of the last finished search, nil if none.
+func (e *Engine) lastStats() *RunStats {
+	e.tally.mu.Lock()
+	defer e.tally.mu.Unlock()
+	return e.tally.last
+}
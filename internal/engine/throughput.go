@@ -0,0 +1,60 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+)
+
+const (
+	// defaultThroughputEvery is how many successful probes there are per
+	// throughput measurement by default.
+	defaultThroughputEvery = 20
+	// throughputQueue is how many sampled IPs may wait for a measurement;
+	// further samples are dropped rather than holding up the search.
+	throughputQueue = 4
+)
+
+// ThroughputFunc measures the throughput of ip in Mbps, typically with a
+// short download. ok is false if the measurement failed. It is called from
+// one goroutine at a time, concurrently with the search.
+type ThroughputFunc func(ctx context.Context, ip netip.Addr) (mbps float64, ok bool)
+
+// sampleThroughput queues ip, the address of a successful probe, for a
+// throughput measurement if it is the ThroughputEvery-th one. It is called
+// from the scheduling goroutine only.
+func (e *Engine) sampleThroughput(ip netip.Addr) {
+	if e.throughput == nil {
+		return
+	}
+	e.tputProbes++
+	if e.tputProbes%e.cfg.ThroughputEvery != 0 {
+		return
+	}
+	select {
+	case e.throughput <- ip:
+	default:
+	}
+}
+
+// runThroughput measures the throughput of the queued IPs and feeds it to
+// their prefixes until ctx is done.
+func (e *Engine) runThroughput(ctx context.Context, queue <-chan netip.Addr) {
+	for {
+		var ip netip.Addr
+		select {
+		case <-ctx.Done():
+			return
+		case ip = <-queue:
+		}
+
+		mbps, ok := e.cfg.ThroughputFunc(ctx, ip)
+		if !ok || ctx.Err() != nil {
+			continue
+		}
+		if took, _ := e.ObserveThroughput(ip, mbps); took && e.cfg.Verbose {
+			fmt.Fprintf(os.Stderr, "throughput: ip=%s %.1fMbps\n", ip.String(), mbps)
+		}
+	}
+}
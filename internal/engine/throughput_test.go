@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/bandit"
+)
+
+// TestThroughputPhase checks that every ThroughputEvery-th successful
+// probe is measured and the result lands in its prefix's posterior.
+func TestThroughputPhase(t *testing.T) {
+	prefix := netip.MustParsePrefix("198.18.0.0/24")
+	cfg := DefaultConfig()
+	cfg.ThroughputEvery = 2
+	measured := make(chan netip.Addr, 8)
+	cfg.ThroughputFunc = func(_ context.Context, ip netip.Addr) (float64, bool) {
+		measured <- ip
+		return 42, true
+	}
+	e := &Engine{cfg: cfg, tree: bandit.NewArmTree([]netip.Prefix{prefix}, cfg.ToTreeConfig())}
+	e.live.Store(true)
+	e.throughput = make(chan netip.Addr, throughputQueue)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.runThroughput(ctx, e.throughput)
+
+	ip := netip.MustParseAddr("198.18.0.7")
+	for range 4 {
+		e.sampleThroughput(ip)
+	}
+	for range 2 {
+		select {
+		case got := <-measured:
+			if got != ip {
+				t.Fatalf("measured %s, want %s", got, ip)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("throughput not measured")
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for e.tree.GetNode(prefix).Stats().MbpsSamples < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("measurements did not reach the arm")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-measured:
+		t.Fatal("more than one in ThroughputEvery probes measured")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
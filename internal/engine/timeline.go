@@ -0,0 +1,70 @@
+package engine
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// epochInterval is how often the scheduler summarizes a search in progress.
+const epochInterval = time.Second
+
+// Epoch summarizes one epoch (about a second) of a search, for plotting how
+// fast a run converges (see Config.OnEpoch).
+type Epoch struct {
+	// ElapsedS is the time since the search started, in seconds.
+	ElapsedS  float64 `json:"elapsed_s"`
+	Completed int64   `json:"completed"`
+	Succeeded int64   `json:"succeeded"`
+	Budget    int64   `json:"budget"`
+
+	// Probes and SuccessRate cover the probes completed in this epoch only.
+	Probes      int64   `json:"probes"`
+	SuccessRate float64 `json:"success_rate"`
+
+	// BestScoreMS and BestIP are the best result so far (zero before the
+	// first result).
+	BestScoreMS float64    `json:"best_score_ms"`
+	BestIP      netip.Addr `json:"best_ip,omitzero"`
+	Nodes       int        `json:"nodes"`
+
+	// Heads is the prefix each search head is focused on.
+	Heads []netip.Prefix `json:"heads"`
+}
+
+// emitEpoch reports the epoch that ended now to Config.OnEpoch and starts
+// the next one.
+func (e *Engine) emitEpoch() {
+	if e.cfg.OnEpoch == nil {
+		return
+	}
+	completed := atomic.LoadInt64(&e.completed)
+	succeeded := atomic.LoadInt64(&e.succeeded)
+	ep := Epoch{
+		ElapsedS:  time.Since(e.runStart).Seconds(),
+		Completed: completed,
+		Succeeded: succeeded,
+		Budget:    int64(e.cfg.Budget),
+		Probes:    completed - e.epochDone,
+		Nodes:     e.tree.Size(),
+		Heads:     e.headFocuses(),
+	}
+	if ep.Probes > 0 {
+		ep.SuccessRate = float64(succeeded-e.epochOK) / float64(ep.Probes)
+	}
+	if e.topN.Len() > 0 {
+		best := e.topN.Best()
+		ep.BestScoreMS, ep.BestIP = best.ScoreMS, best.IP
+	}
+	e.epochDone, e.epochOK = completed, succeeded
+	e.cfg.OnEpoch(ep)
+}
+
+// headFocuses returns the prefix each head is currently focused on.
+func (e *Engine) headFocuses() []netip.Prefix {
+	heads := make([]netip.Prefix, 0, e.headManager.NumHeads())
+	for i := 0; i < e.headManager.NumHeads(); i++ {
+		heads = append(heads, e.headManager.GetHead(i).GetFocus())
+	}
+	return heads
+}
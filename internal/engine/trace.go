@@ -0,0 +1,57 @@
+package engine
+
+import "strings"
+
+// Trace fields results can be grouped by (see Config.GroupBy).
+const (
+	GroupColo = "colo"
+	GroupLoc  = "loc"
+	GroupHTTP = "http"
+	GroupWarp = "warp"
+)
+
+// ErrColoExcluded is the error of a probe that succeeded but was served by
+// a data center outside Config.Colos.
+const ErrColoExcluded = "colo_excluded"
+
+// ValidGroupBy reports whether by is a known group-by field ("" = none).
+func ValidGroupBy(by string) bool {
+	switch by {
+	case "", GroupColo, GroupLoc, GroupHTTP, GroupWarp:
+		return true
+	}
+	return false
+}
+
+// coloAllowed reports whether a probe served by colo counts under
+// Config.Colos. Probes without a colo (non-Cloudflare targets) always do.
+func (e *Engine) coloAllowed(colo string) bool {
+	if len(e.cfg.Colos) == 0 || colo == "" {
+		return true
+	}
+	for _, c := range e.cfg.Colos {
+		if strings.EqualFold(c, colo) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupTop keeps, in order, at most per results for each value of the
+// trace field by. Results without a value form a group of their own.
+func groupTop(top []TopResult, by string, per int) []TopResult {
+	if by == "" || per <= 0 {
+		return top
+	}
+	seen := make(map[string]int)
+	kept := top[:0]
+	for _, r := range top {
+		v := r.Field(by)
+		if seen[v] >= per {
+			continue
+		}
+		seen[v]++
+		kept = append(kept, r)
+	}
+	return kept
+}
@@ -0,0 +1,193 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Verdict thresholds.
+const (
+	// verdictFallbacks is how many fallback IPs are recommended.
+	verdictFallbacks = 3
+	// verdictMinSamples is the prefix sample count below which a
+	// recommendation is flagged as resting on little evidence.
+	verdictMinSamples = 10
+	// verdictMinSuccessRate is the prefix success rate below which the
+	// recommended IP's range is flagged as unreliable.
+	verdictMinSuccessRate = 0.8
+	// verdictMaxSpread is the coefficient of variation of the results'
+	// scores above which the ranking is flagged as unsettled.
+	verdictMaxSpread = 0.5
+)
+
+// Caveat codes (see Caveat).
+const (
+	CaveatNoResults     = "no_results"
+	CaveatFewSamples    = "few_samples"
+	CaveatUnreliable    = "unreliable_prefix"
+	CaveatHighVariance  = "high_variance"
+	CaveatSingleColo    = "single_colo"
+	CaveatTLSUnverified = "tls_unverified"
+)
+
+// Meta is the plain-language conclusion of a search, for users who want an
+// answer rather than a table: the IP to use, what to fall back to, and
+// what to be wary of.
+type Meta struct {
+	Recommended netip.Addr   `json:"recommended,omitzero"`
+	ScoreMS     float64      `json:"score_ms,omitempty"` // of the recommended IP
+	Colo        string       `json:"colo,omitempty"`     // of the recommended IP
+	Fallbacks   []netip.Addr `json:"fallbacks,omitempty"`
+	Caveats     []Caveat     `json:"caveats,omitempty"`
+
+	// Verdict sums the above up in a sentence.
+	Verdict string `json:"verdict"`
+
+	// Baseline is the latency over the default path, if it was measured,
+	// and ImprovementPct how much faster the recommended IP is (see
+	// SetBaseline). MinImprovementPct is set when no result was fast enough
+	// to be recommended over it (see NoImprovement).
+	Baseline          *Baseline `json:"baseline,omitempty"`
+	ImprovementPct    float64   `json:"improvement_pct,omitempty"`
+	MinImprovementPct float64   `json:"min_improvement_pct,omitempty"`
+
+	// Version identifies the build that produced the results, if the
+	// caller sets it.
+	Version string `json:"version,omitempty"`
+}
+
+// Caveat is a reason to treat a recommendation with care. Code is one of
+// the Caveat* constants and Arg its detail (a count, percentage or colo),
+// for callers that word caveats themselves; Message is the English text.
+type Caveat struct {
+	Code    string `json:"code"`
+	Arg     string `json:"arg,omitempty"`
+	Message string `json:"message"`
+}
+
+// Recommend draws the conclusion from results in rank order (best first):
+// the first working IP is recommended, and the next working ones, from
+// other prefixes where possible so they don't fail together, are the
+// fallbacks.
+func Recommend(top []TopResult) Meta {
+	var ok []TopResult
+	for _, r := range top {
+		if r.OK {
+			ok = append(ok, r)
+		}
+	}
+	if len(ok) == 0 {
+		return Meta{
+			Caveats: []Caveat{{Code: CaveatNoResults, Message: "no IP answered successfully"}},
+			Verdict: "No usable IP was found; check --sni/--host and the CIDRs, or raise --timeout.",
+		}
+	}
+
+	best := ok[0]
+	m := Meta{Recommended: best.IP, ScoreMS: best.ScoreMS, Colo: best.Colo, Fallbacks: fallbacks(best, ok[1:])}
+	m.Caveats = caveats(best, ok)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Use %s (%.0fms", best.IP, best.ScoreMS)
+	if best.Colo != "" {
+		fmt.Fprintf(&b, ", colo %s", best.Colo)
+	}
+	b.WriteString(")")
+	if len(m.Fallbacks) > 0 {
+		b.WriteString("; if it stops working, fall back to ")
+		for i, ip := range m.Fallbacks {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(ip.String())
+		}
+	}
+	b.WriteString(".")
+	m.Verdict = b.String()
+	return m
+}
+
+// fallbacks picks up to verdictFallbacks of rest, preferring IPs outside
+// the prefixes already picked.
+func fallbacks(best TopResult, rest []TopResult) []netip.Addr {
+	used := map[netip.Prefix]bool{best.Prefix: true}
+	var out []netip.Addr
+	taken := make([]bool, len(rest))
+	for pass := 0; pass < 2 && len(out) < verdictFallbacks; pass++ {
+		for i, r := range rest {
+			if len(out) == verdictFallbacks {
+				break
+			}
+			if taken[i] || (pass == 0 && used[r.Prefix]) {
+				continue
+			}
+			taken[i] = true
+			used[r.Prefix] = true
+			out = append(out, r.IP)
+		}
+	}
+	return out
+}
+
+// caveats lists what weakens the recommendation of best among ok.
+func caveats(best TopResult, ok []TopResult) []Caveat {
+	var out []Caveat
+	if best.PrefixSamples < verdictMinSamples {
+		out = append(out, Caveat{
+			Code:    CaveatFewSamples,
+			Arg:     strconv.Itoa(best.PrefixSamples),
+			Message: fmt.Sprintf("the recommendation rests on only %d probes of its prefix; a larger --budget would confirm it", best.PrefixSamples),
+		})
+	}
+	if best.PrefixSamples > 0 {
+		if rate := float64(best.PrefixOK) / float64(best.PrefixSamples); rate < verdictMinSuccessRate {
+			pct := strconv.Itoa(int(math.Round(rate * 100)))
+			out = append(out, Caveat{
+				Code:    CaveatUnreliable,
+				Arg:     pct,
+				Message: fmt.Sprintf("only %s%% of probes of its prefix succeeded, so it may be unreliable", pct),
+			})
+		}
+	}
+	if len(ok) >= 3 {
+		var sum, sumSq float64
+		for _, r := range ok {
+			sum += r.ScoreMS
+			sumSq += r.ScoreMS * r.ScoreMS
+		}
+		n := float64(len(ok))
+		mean := sum / n
+		if sd := math.Sqrt(max(0, sumSq/n-mean*mean)); mean > 0 && sd/mean > verdictMaxSpread {
+			out = append(out, Caveat{
+				Code:    CaveatHighVariance,
+				Message: "latencies vary widely between the results, so the ranking may change from run to run",
+			})
+		}
+	}
+	if len(ok) >= 2 && ok[0].Colo != "" {
+		single := true
+		for _, r := range ok[1:] {
+			if r.Colo != ok[0].Colo {
+				single = false
+				break
+			}
+		}
+		if single {
+			out = append(out, Caveat{
+				Code:    CaveatSingleColo,
+				Arg:     ok[0].Colo,
+				Message: fmt.Sprintf("every result is served from the %s data center; if it has trouble, the fallbacks will too", ok[0].Colo),
+			})
+		}
+	}
+	if best.TLSUnverified {
+		out = append(out, Caveat{
+			Code:    CaveatTLSUnverified,
+			Message: "its certificate was not verified (--insecure), so it is not proven to be a genuine edge",
+		})
+	}
+	return out
+}
@@ -0,0 +1,161 @@
+package engine
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"sync/atomic"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/bandit"
+)
+
+const (
+	// dedupTries is how many addresses are drawn from a prefix looking for
+	// one not probed yet, before sampling widens to its parent.
+	dedupTries = 32
+
+	// wasteWarnRatio is the share of wasted probes that triggers a
+	// warning, once wasteWarnMin probes have completed.
+	wasteWarnRatio = 0.1
+	wasteWarnMin   = 100
+)
+
+// Waste counts the sampling attempts of a search that did not buy a useful
+// probe (see Engine.Status).
+type Waste struct {
+	// Duplicates are probes of an address that had been probed already,
+	// because the prefix and all its ancestors looked exhausted.
+	Duplicates int64 `json:"duplicates"`
+
+	// Widened counts samples drawn from an ancestor of the selected
+	// prefix because every address tried in the prefix itself had been
+	// probed. They are not wasted, but show a search drilling too fine.
+	Widened int64 `json:"widened"`
+
+	// Fallbacks are probes of a leaf picked without selection, because
+	// every leaf the head may explore was frozen or suspended (duplicates
+	// excluded, so the two add up).
+	Fallbacks int64 `json:"fallbacks"`
+
+	// Invalid counts attempts that sampled nothing: no prefix to sample
+	// from, or only addresses removed from the search.
+	Invalid int64 `json:"invalid"`
+}
+
+// Wasted returns the number of probes spent without gaining information.
+func (w Waste) Wasted() int64 {
+	return w.Duplicates + w.Fallbacks
+}
+
+// wasteCounters are the live counters behind Waste; written by the
+// scheduler goroutine, read by Status.
+type wasteCounters struct {
+	duplicates atomic.Int64
+	widened    atomic.Int64
+	fallbacks  atomic.Int64
+	invalid    atomic.Int64
+
+	warned bool // scheduler goroutine only
+}
+
+func (c *wasteCounters) snapshot() Waste {
+	return Waste{
+		Duplicates: c.duplicates.Load(),
+		Widened:    c.widened.Load(),
+		Fallbacks:  c.fallbacks.Load(),
+		Invalid:    c.invalid.Load(),
+	}
+}
+
+// sampleIPWithDedup samples an address from prefix that has not been
+// probed yet. If dedupTries draws turn up only known addresses it widens to
+// the prefix's ancestors in turn; only when the whole root looks exhausted
+// does it return a known address, counted as a duplicate. It returns an
+// invalid address if every draw fell into a removed range. fresh reports
+// whether the address had not been probed before.
+func (e *Engine) sampleIPWithDedup(prefix netip.Prefix, head *bandit.SearchHead) (ip netip.Addr, fresh bool) {
+	prefix = prefix.Masked()
+	if prefix.Bits() == prefix.Addr().BitLen() {
+		_, loaded := e.seenIPs.LoadOrStore(ipToKey(prefix.Addr()), struct{}{})
+		return prefix.Addr(), !loaded && !e.cfg.Shared.Dead(prefix.Addr())
+	}
+
+	var last netip.Addr
+	var node *bandit.ArmNode
+	for widened := false; ; widened = true {
+		for i := 0; i < dedupTries; i++ {
+			ip := e.capSubnet(prefix, head.Sampler.SampleIP(prefix), head)
+			// A /64's well-known suffixes come before its random addresses.
+			if s, ok := e.wellKnownSuffix(prefix, ip); ok {
+				if widened {
+					e.waste.widened.Add(1)
+				}
+				return s, true
+			}
+			if e.isRemoved(ip) {
+				continue
+			}
+			last = ip
+			// Addresses another search found dead count as seen.
+			if _, loaded := e.seenIPs.LoadOrStore(ipToKey(ip), struct{}{}); !loaded && !e.cfg.Shared.Dead(ip) {
+				if widened {
+					e.waste.widened.Add(1)
+				}
+				return ip, true
+			}
+		}
+
+		// Widen to the parent prefix
+		if node == nil {
+			node = e.tree.GetNode(e.tree.Owner(prefix))
+		} else {
+			node = node.Parent
+		}
+		for node != nil && node.Prefix.Bits() >= prefix.Bits() {
+			node = node.Parent
+		}
+		if node == nil {
+			break
+		}
+		prefix = node.Prefix
+	}
+
+	if !last.IsValid() {
+		e.waste.invalid.Add(1)
+		return last, false
+	}
+	e.waste.duplicates.Add(1)
+	return last, false
+}
+
+// exhausted reports whether duplicate probes have reached the
+// Config.MaxWaste share of the budget, meaning the search space has been
+// sampled out and further probes would only repeat known addresses.
+func (e *Engine) exhausted() bool {
+	if e.cfg.MaxWaste <= 0 {
+		return false
+	}
+	return float64(e.waste.duplicates.Load()) >= e.cfg.MaxWaste*float64(e.cfg.Budget)
+}
+
+// checkWaste warns once when a large share of the completed probes was
+// wasted. Scheduler goroutine only.
+func (e *Engine) checkWaste(completed int64) {
+	if e.waste.warned || completed < wasteWarnMin {
+		return
+	}
+	w := e.waste.snapshot()
+	if float64(w.Wasted()) < wasteWarnRatio*float64(completed) {
+		return
+	}
+	e.waste.warned = true
+	hint := "the search space may be too small for the budget; lower --budget or add ranges"
+	if w.Fallbacks > w.Duplicates {
+		hint = "most prefixes are suspended by the circuit breaker; check --breaker-threshold or the ranges"
+	}
+	fmt.Fprintf(os.Stderr, "warning: %d of %d probes wasted (%s): %s\n", w.Wasted(), completed, w, hint)
+}
+
+func (w Waste) String() string {
+	return fmt.Sprintf("duplicates=%d fallbacks=%d widened=%d invalid=%d", w.Duplicates, w.Fallbacks, w.Widened, w.Invalid)
+}
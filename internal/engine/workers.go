@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+const (
+	// workerWindow is how many probes of a worker are judged together.
+	workerWindow = 16
+
+	// workerSickMargin is how far a worker's failure rate has to exceed
+	// the fleet's for the worker to count as sick.
+	workerSickMargin = 0.5
+
+	// workerSlowFactor is how many times slower than the fleet a worker's
+	// successful probes have to be for it to count as sick.
+	workerSlowFactor = 3.0
+)
+
+// workerHealth tracks one worker's recent probes. Tasks come from a shared
+// queue, so every worker sees the same mix of IPs; a worker that fails or
+// lags far more than the others has a problem of its own (a broken
+// connection pool, leaked transport state) and biases the arms it serves.
+type workerHealth struct {
+	// Scheduler goroutine only.
+	probes     int
+	failures   int
+	latencySum float64
+	recycles   int
+
+	// recycle asks the worker to replace its prober before the next task.
+	recycle atomic.Bool
+}
+
+// fleetHealth is the probe record of all workers together (scheduler
+// goroutine only).
+type fleetHealth struct {
+	probes     int64
+	failures   int64
+	latencySum float64
+}
+
+// recordWorker attributes a scored probe to the worker that ran it and,
+// after every workerWindow probes, recycles the worker if it did much worse
+// than the fleet.
+func (e *Engine) recordWorker(id int, ok bool, latency float64) {
+	if id < 0 || id >= len(e.workers) {
+		return
+	}
+	w := e.workers[id]
+	w.probes++
+	e.fleet.probes++
+	if ok {
+		w.latencySum += latency
+		e.fleet.latencySum += latency
+	} else {
+		w.failures++
+		e.fleet.failures++
+	}
+	if w.probes < workerWindow {
+		return
+	}
+
+	// Compare against the rest of the fleet, which a sick worker would
+	// otherwise drag along.
+	restProbes := e.fleet.probes - int64(w.probes)
+	restFailures := e.fleet.failures - int64(w.failures)
+	restOK := restProbes - restFailures
+	reason := ""
+	if restProbes > 0 {
+		failRate := float64(w.failures) / float64(w.probes)
+		restFailRate := float64(restFailures) / float64(restProbes)
+		if failRate-restFailRate > workerSickMargin {
+			reason = fmt.Sprintf("failed %d/%d probes vs %.0f%% for the others", w.failures, w.probes, restFailRate*100)
+		} else if okProbes := w.probes - w.failures; okProbes > 0 && restOK > 0 {
+			mean := w.latencySum / float64(okProbes)
+			restMean := (e.fleet.latencySum - w.latencySum) / float64(restOK)
+			if mean > restMean*workerSlowFactor {
+				reason = fmt.Sprintf("mean latency %.0fms vs %.0fms for the others", mean, restMean)
+			}
+		}
+	}
+	if reason != "" {
+		w.recycle.Store(true)
+		w.recycles++
+		if e.cfg.Verbose {
+			fmt.Fprintf(os.Stderr, "worker: recycling worker %d (%s), recycled %d times\n", id, reason, w.recycles)
+		}
+	}
+	w.probes, w.failures, w.latencySum = 0, 0, 0
+}
@@ -0,0 +1,188 @@
+// Package kube publishes search results to Kubernetes, as a ConfigMap and
+// optionally an Endpoints object for a selector-less Service, and elects
+// one leader among replicas through a Lease so only one of them scans. It
+// talks to the API server over plain HTTPS with the pod's service account,
+// just enough of the API for these three kinds.
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/netguard"
+)
+
+// Files of the service account mounted into every pod.
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	tokenFile         = serviceAccountDir + "/token"
+	caFile            = serviceAccountDir + "/ca.crt"
+	namespaceFile     = serviceAccountDir + "/namespace"
+)
+
+const apiTimeout = 10 * time.Second
+
+// ErrNotFound and ErrConflict are returned for 404 and 409 answers.
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("conflict")
+)
+
+// Client is a Kubernetes API client.
+type Client struct {
+	server    string
+	tokenPath string
+	http      *http.Client
+}
+
+// InCluster returns a client for the API server of the cluster the process
+// runs in, authenticated as the pod's service account.
+func InCluster() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("kubernetes: not running in a cluster (KUBERNETES_SERVICE_HOST unset)")
+	}
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("kubernetes: no certificate in %s", caFile)
+	}
+	return &Client{
+		server:    "https://" + net.JoinHostPort(host, port),
+		tokenPath: tokenFile,
+		http: &http.Client{
+			Timeout: apiTimeout,
+			Transport: &http.Transport{
+				// The API server is reached directly, never through a proxy,
+				// and like every other connection it is subject to --offline.
+				Proxy:           nil,
+				DialContext:     netguard.DialContext,
+				TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+			},
+		},
+	}, nil
+}
+
+// Namespace returns the namespace of the pod, "" outside a cluster.
+func Namespace() string {
+	b, err := os.ReadFile(namespaceFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// ParseRef parses "namespace/name", or "name" in the pod's namespace.
+func ParseRef(s string) (namespace, name string, err error) {
+	namespace, name, ok := strings.Cut(s, "/")
+	if !ok {
+		namespace, name = Namespace(), s
+		if namespace == "" {
+			return "", "", fmt.Errorf("%q: want namespace/name", s)
+		}
+	}
+	if namespace == "" || name == "" || strings.Contains(name, "/") {
+		return "", "", fmt.Errorf("%q: want namespace/name", s)
+	}
+	return namespace, name, nil
+}
+
+// do sends a request with body (if not nil) encoded as JSON and decodes
+// the answer into out (if not nil).
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.server+path, rd)
+	if err != nil {
+		return err
+	}
+	// Projected tokens are rotated, so read it on every request.
+	token, err := os.ReadFile(c.tokenPath)
+	if err != nil {
+		return fmt.Errorf("kubernetes: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("kubernetes: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return fmt.Errorf("kubernetes: %w", err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("kubernetes: %s %s: %w", method, path, ErrNotFound)
+	case resp.StatusCode == http.StatusConflict:
+		return fmt.Errorf("kubernetes: %s %s: %w", method, path, ErrConflict)
+	case resp.StatusCode >= 300:
+		var st struct {
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(data, &st)
+		if st.Message == "" {
+			st.Message = http.StatusText(resp.StatusCode)
+		}
+		return fmt.Errorf("kubernetes: %s %s: %d %s", method, path, resp.StatusCode, st.Message)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("kubernetes: %s %s: %w", method, path, err)
+		}
+	}
+	return nil
+}
+
+// ObjectMeta is the metadata of an object, as far as mcis uses it.
+type ObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+// managedLabels mark the objects mcis writes.
+var managedLabels = map[string]string{"app.kubernetes.io/managed-by": "mcis"}
+
+// upsert creates obj at collection/name or, if it exists, replaces it,
+// setting meta (obj's metadata) to the version it replaces.
+func (c *Client) upsert(ctx context.Context, collection, name string, obj any, meta *ObjectMeta) error {
+	var cur struct {
+		Metadata ObjectMeta `json:"metadata"`
+	}
+	err := c.do(ctx, http.MethodGet, collection+"/"+name, nil, &cur)
+	if errors.Is(err, ErrNotFound) {
+		return c.do(ctx, http.MethodPost, collection, obj, nil)
+	}
+	if err != nil {
+		return err
+	}
+	meta.ResourceVersion = cur.Metadata.ResourceVersion
+	return c.do(ctx, http.MethodPut, collection+"/"+name, obj, nil)
+}
@@ -0,0 +1,164 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// LeaseDuration is how long a lease holds without being renewed.
+	LeaseDuration = 30 * time.Second
+	// renewPeriod is how often the lease is renewed or, by the other
+	// replicas, tried.
+	renewPeriod = LeaseDuration / 3
+)
+
+// microTime is the format of a Lease's timestamps.
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// lease is a coordination.k8s.io/v1 Lease.
+type lease struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   ObjectMeta `json:"metadata"`
+	Spec       leaseSpec  `json:"spec"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// expired reports whether the lease has lapsed at now.
+func (s leaseSpec) expired(now time.Time) bool {
+	renewed, err := time.Parse(time.RFC3339Nano, s.RenewTime)
+	if err != nil || s.HolderIdentity == "" {
+		return true
+	}
+	return now.After(renewed.Add(time.Duration(s.LeaseDurationSeconds) * time.Second))
+}
+
+// Elector elects one leader among the replicas sharing a Lease: the one
+// holding it renews it, the others take it over once it lapses.
+type Elector struct {
+	client    *Client
+	namespace string
+	name      string
+	identity  string
+
+	leading atomic.Bool
+	once    sync.Once
+	ready   chan struct{} // closed after the first attempt
+}
+
+// NewElector returns an elector over the Lease namespace/name, identifying
+// this replica by the POD_NAME environment variable or the host name.
+func NewElector(c *Client, namespace, name string) *Elector {
+	id := os.Getenv("POD_NAME")
+	if id == "" {
+		id, _ = os.Hostname()
+	}
+	return &Elector{client: c, namespace: namespace, name: name, identity: id, ready: make(chan struct{})}
+}
+
+// Identity returns the name this replica holds the lease under.
+func (e *Elector) Identity() string { return e.identity }
+
+// Run takes or renews the lease until ctx is done, calling onChange (if
+// not nil) when leadership is won or lost, or an attempt fails.
+func (e *Elector) Run(ctx context.Context, onChange func(leading bool, err error)) {
+	t := time.NewTicker(renewPeriod)
+	defer t.Stop()
+	for {
+		ok, err := e.tryAcquire(ctx)
+		if was := e.leading.Swap(ok); (was != ok || err != nil) && onChange != nil {
+			onChange(ok, err)
+		}
+		e.once.Do(func() { close(e.ready) })
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Leading reports whether this replica holds the lease, waiting for the
+// first attempt to take it.
+func (e *Elector) Leading(ctx context.Context) bool {
+	select {
+	case <-e.ready:
+	case <-ctx.Done():
+		return false
+	}
+	return e.leading.Load()
+}
+
+// tryAcquire creates the lease, renews it if held by this replica, or
+// takes it over if it has lapsed. It reports whether this replica holds
+// it afterwards.
+func (e *Elector) tryAcquire(ctx context.Context) (bool, error) {
+	path := "/apis/coordination.k8s.io/v1/namespaces/" + url.PathEscape(e.namespace) + "/leases"
+	now := time.Now().UTC()
+	stamp := now.Format(microTime)
+
+	var cur lease
+	err := e.client.do(ctx, http.MethodGet, path+"/"+e.name, nil, &cur)
+	if errors.Is(err, ErrNotFound) {
+		l := lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   ObjectMeta{Name: e.name, Namespace: e.namespace, Labels: managedLabels},
+			Spec: leaseSpec{
+				HolderIdentity:       e.identity,
+				LeaseDurationSeconds: int(LeaseDuration / time.Second),
+				AcquireTime:          stamp,
+				RenewTime:            stamp,
+			},
+		}
+		err = e.client.do(ctx, http.MethodPost, path, &l, nil)
+		return e.settle(err)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case cur.Spec.HolderIdentity == e.identity:
+	case cur.Spec.expired(now):
+		cur.Spec.HolderIdentity = e.identity
+		cur.Spec.AcquireTime = stamp
+		cur.Spec.LeaseTransitions++
+	default:
+		return false, nil
+	}
+	cur.Spec.RenewTime = stamp
+	cur.Spec.LeaseDurationSeconds = int(LeaseDuration / time.Second)
+	// The resource version makes the update fail if another replica got
+	// there first.
+	err = e.client.do(ctx, http.MethodPut, path+"/"+e.name, &cur, nil)
+	return e.settle(err)
+}
+
+// settle turns the outcome of a write to the lease into whether it is held:
+// a conflict means another replica won the race.
+func (e *Elector) settle(err error) (bool, error) {
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, ErrConflict):
+		return false, nil
+	default:
+		return false, fmt.Errorf("lease %s/%s: %w", e.namespace, e.name, err)
+	}
+}
@@ -0,0 +1,70 @@
+package kube
+
+import (
+	"context"
+	"net/netip"
+	"net/url"
+	"strconv"
+)
+
+// configMap is a v1 ConfigMap.
+type configMap struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Data       map[string]string `json:"data"`
+}
+
+// PublishConfigMap creates or replaces the ConfigMap namespace/name with
+// data.
+func (c *Client) PublishConfigMap(ctx context.Context, namespace, name string, data map[string]string) error {
+	cm := configMap{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Metadata:   ObjectMeta{Name: name, Namespace: namespace, Labels: managedLabels},
+		Data:       data,
+	}
+	return c.upsert(ctx, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/configmaps", name, &cm, &cm.Metadata)
+}
+
+// endpoints is a v1 Endpoints object.
+type endpoints struct {
+	APIVersion string           `json:"apiVersion"`
+	Kind       string           `json:"kind"`
+	Metadata   ObjectMeta       `json:"metadata"`
+	Subsets    []endpointSubset `json:"subsets"`
+}
+
+type endpointSubset struct {
+	Addresses []endpointAddress `json:"addresses"`
+	Ports     []endpointPort    `json:"ports"`
+}
+
+type endpointAddress struct {
+	IP string `json:"ip"`
+}
+
+type endpointPort struct {
+	Name     string `json:"name"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+// PublishEndpoints creates or replaces the Endpoints namespace/name with
+// ips on port, so a Service of the same name without a selector routes to
+// them.
+func (c *Client) PublishEndpoints(ctx context.Context, namespace, name string, ips []netip.Addr, port int) error {
+	sub := endpointSubset{Ports: []endpointPort{{Name: "port-" + strconv.Itoa(port), Port: port, Protocol: "TCP"}}}
+	for _, ip := range ips {
+		sub.Addresses = append(sub.Addresses, endpointAddress{IP: ip.String()})
+	}
+	ep := endpoints{
+		APIVersion: "v1",
+		Kind:       "Endpoints",
+		Metadata:   ObjectMeta{Name: name, Namespace: namespace, Labels: managedLabels},
+	}
+	if len(sub.Addresses) > 0 {
+		ep.Subsets = []endpointSubset{sub}
+	}
+	return c.upsert(ctx, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/endpoints", name, &ep, &ep.Metadata)
+}
@@ -0,0 +1,86 @@
+// Package netguard enforces an optional allow-list on outbound connections.
+//
+// Every dialer in the tool sets Control, so once Restrict has been called a
+// connection to an address outside the allow-list fails before any packet is
+// sent, no matter which code path opened it. Restrict also replaces the
+// default resolver and HTTP transport so code that does not build its own
+// dialer (DNS lookups, provider API clients) is covered too.
+package netguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+)
+
+// ErrBlocked is returned for connections outside the allow-list.
+var ErrBlocked = errors.New("connection blocked by offline mode")
+
+// allowed is nil while unrestricted.
+var allowed atomic.Pointer[[]netip.Prefix]
+
+// Restrict limits outbound connections to addresses within prefixes. It may
+// be called again to replace the allow-list.
+func Restrict(prefixes []netip.Prefix) {
+	ps := make([]netip.Prefix, len(prefixes))
+	for i, p := range prefixes {
+		ps[i] = p.Masked()
+	}
+	first := allowed.Swap(&ps) == nil
+	if !first {
+		return
+	}
+
+	d := &net.Dialer{Control: Control}
+	net.DefaultResolver = &net.Resolver{PreferGo: true, Dial: d.DialContext}
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		t = t.Clone()
+		t.DialContext = d.DialContext
+		http.DefaultTransport = t
+	}
+}
+
+// Restricted reports whether an allow-list is in effect.
+func Restricted() bool {
+	return allowed.Load() != nil
+}
+
+// Check returns ErrBlocked if addr is outside the allow-list.
+func Check(addr netip.Addr) error {
+	ps := allowed.Load()
+	if ps == nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	for _, p := range *ps {
+		if p.Contains(addr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrBlocked, addr)
+}
+
+// Control is a net.Dialer Control function that rejects connections outside
+// the allow-list. address is the resolved "ip:port" being dialed.
+func Control(network, address string, _ syscall.RawConn) error {
+	if !Restricted() {
+		return nil
+	}
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBlocked, address)
+	}
+	return Check(ap.Addr())
+}
+
+// DialContext dials with a guarded net.Dialer; for callers that would
+// otherwise use a zero net.Dialer.
+func DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d := net.Dialer{Control: Control}
+	return d.DialContext(ctx, network, address)
+}
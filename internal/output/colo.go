@@ -0,0 +1,83 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+)
+
+// ColoSummary is one data center in a colo summary.
+type ColoSummary struct {
+	Colo     string     `json:"colo"`
+	Count    int        `json:"count"`
+	BestIP   netip.Addr `json:"best_ip"`
+	BestMS   float64    `json:"best_ms"`
+	MedianMS float64    `json:"median_ms"`
+	BestMbps float64    `json:"best_mbps,omitempty"`
+}
+
+// SummarizeColos groups the successful results by data center. rows are
+// taken to be ranked, so each colo's best IP is its first row. Colos are
+// ordered by the rank of their best IP; results without a colo are grouped
+// under "-".
+func SummarizeColos(rows []engine.TopResult) []ColoSummary {
+	var out []ColoSummary
+	index := make(map[string]int)
+	scores := make(map[string][]float64)
+	for _, r := range rows {
+		if !r.OK {
+			continue
+		}
+		colo := r.Colo
+		if colo == "" {
+			colo = "-"
+		}
+		i, ok := index[colo]
+		if !ok {
+			i = len(out)
+			index[colo] = i
+			s := ColoSummary{Colo: colo, BestIP: r.IP, BestMS: r.ScoreMS}
+			if r.DownloadOK {
+				s.BestMbps = r.DownloadMbps
+			}
+			out = append(out, s)
+		}
+		out[i].Count++
+		scores[colo] = append(scores[colo], r.ScoreMS)
+	}
+	for i := range out {
+		out[i].MedianMS = median(scores[out[i].Colo])
+	}
+	return out
+}
+
+func median(xs []float64) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	sort.Float64s(xs)
+	n := len(xs)
+	if n%2 == 1 {
+		return xs[n/2]
+	}
+	return (xs[n/2-1] + xs[n/2]) / 2
+}
+
+// WriteColoSummary writes one line per data center: its best IP, the
+// median latency of its results and how many there are.
+func WriteColoSummary(w io.Writer, rows []engine.TopResult) error {
+	for _, s := range SummarizeColos(rows) {
+		line := fmt.Sprintf("%s\tbest=%s\tbest_ms=%.1f\tmedian_ms=%.1f\tcount=%d",
+			s.Colo, s.BestIP.String(), s.BestMS, s.MedianMS, s.Count)
+		if s.BestMbps > 0 {
+			line += fmt.Sprintf("\tbest_mbps=%.2f", s.BestMbps)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
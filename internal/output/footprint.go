@@ -0,0 +1,36 @@
+package output
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+)
+
+// WriteFootprint writes one line per good prefix: the estimated fraction of
+// its addresses that respond, with its interval, and what that amounts to
+// in addresses.
+func WriteFootprint(w io.Writer, rows []engine.Footprint) error {
+	for _, f := range rows {
+		prefix := f.Prefix.String()
+		if f.Label != "" {
+			prefix += "\tlabel=" + f.Label
+		}
+		_, err := fmt.Fprintf(w, "%s\tdensity=%.2f\t[%.2f, %.2f]\tresponsive~%s/%s\tsamples=%d\tmean_ms=%.1f\tresults=%d\n",
+			prefix, f.Density, f.Lower, f.Upper, formatAddresses(f.Responsive), formatAddresses(f.Addresses),
+			f.Samples, f.MeanMS, f.Results)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatAddresses formats an address count exactly when it is small and
+// in scientific notation otherwise (IPv6 prefixes).
+func formatAddresses(n float64) string {
+	if n < 1e9 {
+		return fmt.Sprintf("%.0f", n)
+	}
+	return fmt.Sprintf("%.2g", n)
+}
@@ -0,0 +1,178 @@
+package output
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+)
+
+// Languages of the text summary (see WriteVerdict). Only the plain-language
+// parts are translated; result rows and the JSONL/CSV formats stay the same
+// in every language so scripts can parse them.
+const (
+	LangEN = "en"
+	LangZH = "zh"
+	LangFA = "fa"
+	LangRU = "ru"
+)
+
+// ValidLang reports whether lang is a supported summary language.
+func ValidLang(lang string) bool {
+	return lang == LangEN || messages[lang] != nil
+}
+
+// catalog holds the summary texts of one language. Caveats are keyed by
+// engine.Caveat* code; their %s is the caveat's Arg.
+type catalog struct {
+	summary, recommended, fallbacks, caveat string
+
+	use       string // IP, latency in ms, colo part
+	colo      string // colo
+	fallback  string // fallback list
+	end       string
+	sep       string // between list items
+	noResults string
+	caveats   map[string]string
+
+	baseline       string // label
+	baselineVia    string // latency in ms, IP
+	baselineFailed string // error
+	faster, slower string // percentage
+	noImprovement  string // percentage, baseline latency in ms
+}
+
+// messages maps languages other than English to their catalogs; English
+// uses the texts of engine.Meta itself.
+var messages = map[string]*catalog{
+	LangZH: {
+		summary: "结论", recommended: "推荐", fallbacks: "备用", caveat: "注意",
+		use:       "推荐使用 %s（%.0fms%s）",
+		colo:      "，数据中心 %s",
+		fallback:  "；若其失效，可依次改用 %s",
+		end:       "。",
+		sep:       "、",
+		noResults: "未找到可用的 IP；请检查 --sni/--host 与 CIDR，或调大 --timeout。",
+		caveats: map[string]string{
+			engine.CaveatNoResults:     "没有任何 IP 探测成功",
+			engine.CaveatFewSamples:    "该推荐所在网段仅探测了 %s 次，加大 --budget 可进一步确认",
+			engine.CaveatUnreliable:    "其所在网段只有 %s%% 的探测成功，可能不稳定",
+			engine.CaveatHighVariance:  "各结果之间延迟差异很大，排名在不同运行之间可能变化",
+			engine.CaveatSingleColo:    "所有结果均来自 %s 数据中心；若该数据中心出现问题，备用 IP 也会一并受影响",
+			engine.CaveatTLSUnverified: "未验证其证书（--insecure），不能证明它是真正的边缘节点",
+		},
+
+		baseline:       "基准",
+		baselineVia:    "默认线路 %.0fms（%s）",
+		baselineFailed: "默认线路不可用：%s",
+		faster:         "；找到的最佳 IP 快 %.0f%%",
+		slower:         "；找到的最佳 IP 慢 %.0f%%",
+		noImprovement:  "没有比默认线路快 %g%% 以上的 IP（默认线路 %.0fms），继续使用默认线路即可。",
+	},
+	LangFA: {
+		summary: "خلاصه", recommended: "پیشنهاد", fallbacks: "جایگزین‌ها", caveat: "هشدار",
+		use:       "از %s استفاده کنید (%.0f میلی‌ثانیه%s)",
+		colo:      "، دیتاسنتر %s",
+		fallback:  "؛ اگر از کار افتاد، به ترتیب از %s استفاده کنید",
+		end:       ".",
+		sep:       "، ",
+		noResults: "هیچ IP قابل استفاده‌ای پیدا نشد؛ --sni/--host و محدوده‌های CIDR را بررسی کنید یا --timeout را افزایش دهید.",
+		caveats: map[string]string{
+			engine.CaveatNoResults:     "هیچ IP با موفقیت پاسخ نداد",
+			engine.CaveatFewSamples:    "این پیشنهاد تنها بر پایه %s آزمون از پیشوند آن است؛ با --budget بزرگ‌تر می‌توانید آن را تأیید کنید",
+			engine.CaveatUnreliable:    "تنها %s٪ از آزمون‌های پیشوند آن موفق بود، پس ممکن است ناپایدار باشد",
+			engine.CaveatHighVariance:  "تأخیر نتایج با یکدیگر تفاوت زیادی دارد، پس رتبه‌بندی ممکن است در هر اجرا تغییر کند",
+			engine.CaveatSingleColo:    "همه نتایج از دیتاسنتر %s ارائه می‌شوند؛ اگر این دیتاسنتر دچار مشکل شود، جایگزین‌ها هم آسیب می‌بینند",
+			engine.CaveatTLSUnverified: "گواهی آن بررسی نشد (--insecure)، پس ثابت نشده که یک edge واقعی است",
+		},
+
+		baseline:       "مبنا",
+		baselineVia:    "مسیر پیش‌فرض %.0f میلی‌ثانیه (%s)",
+		baselineFailed: "مسیر پیش‌فرض کار نکرد: %s",
+		faster:         "؛ بهترین IP یافته‌شده %.0f٪ سریع‌تر است",
+		slower:         "؛ بهترین IP یافته‌شده %.0f٪ کندتر است",
+		noImprovement:  "هیچ IP حداقل %g٪ سریع‌تر از مسیر پیش‌فرض (%.0f میلی‌ثانیه) نیست؛ همان را نگه دارید.",
+	},
+	LangRU: {
+		summary: "Итог", recommended: "Рекомендуется", fallbacks: "Запасные", caveat: "Внимание",
+		use:       "Используйте %s (%.0f мс%s)",
+		colo:      ", дата-центр %s",
+		fallback:  "; если он перестанет работать, переключитесь на %s",
+		end:       ".",
+		sep:       ", ",
+		noResults: "Рабочий IP не найден; проверьте --sni/--host и диапазоны CIDR или увеличьте --timeout.",
+		caveats: map[string]string{
+			engine.CaveatNoResults:     "ни один IP не ответил успешно",
+			engine.CaveatFewSamples:    "рекомендация основана всего на %s пробах его префикса; увеличьте --budget, чтобы подтвердить её",
+			engine.CaveatUnreliable:    "успешными были только %s%% проб его префикса, поэтому он может быть ненадёжен",
+			engine.CaveatHighVariance:  "задержки результатов сильно различаются, поэтому порядок может меняться от запуска к запуску",
+			engine.CaveatSingleColo:    "все результаты обслуживаются дата-центром %s; если у него возникнут проблемы, запасные адреса тоже пострадают",
+			engine.CaveatTLSUnverified: "его сертификат не проверялся (--insecure), поэтому нет подтверждения, что это настоящий edge-узел",
+		},
+
+		baseline:       "База",
+		baselineVia:    "маршрут по умолчанию %.0f мс (%s)",
+		baselineFailed: "маршрут по умолчанию не работает: %s",
+		faster:         "; лучший найденный IP быстрее на %.0f%%",
+		slower:         "; лучший найденный IP медленнее на %.0f%%",
+		noImprovement:  "Ни один IP не быстрее маршрута по умолчанию (%[2].0f мс) хотя бы на %[1]g%%; продолжайте использовать его.",
+	},
+}
+
+// verdict words meta's verdict in c's language.
+func (c *catalog) verdict(meta *engine.Meta) string {
+	if !meta.Recommended.IsValid() {
+		if meta.MinImprovementPct > 0 && meta.Baseline != nil {
+			return fmt.Sprintf(c.noImprovement, meta.MinImprovementPct, meta.Baseline.ScoreMS)
+		}
+		return c.noResults
+	}
+	colo := ""
+	if meta.Colo != "" {
+		colo = fmt.Sprintf(c.colo, meta.Colo)
+	}
+	s := fmt.Sprintf(c.use, meta.Recommended, meta.ScoreMS, colo)
+	if len(meta.Fallbacks) > 0 {
+		s += fmt.Sprintf(c.fallback, c.list(meta.Fallbacks))
+	}
+	return s + c.end
+}
+
+// baselineText words meta's baseline comparison in c's language.
+func (c *catalog) baselineText(meta *engine.Meta) string {
+	b := meta.Baseline
+	if !b.OK {
+		return fmt.Sprintf(c.baselineFailed, b.Error)
+	}
+	s := fmt.Sprintf(c.baselineVia, b.ScoreMS, b.IP)
+	switch {
+	case !meta.Recommended.IsValid():
+	case meta.ImprovementPct >= 0:
+		s += fmt.Sprintf(c.faster, meta.ImprovementPct)
+	default:
+		s += fmt.Sprintf(c.slower, -meta.ImprovementPct)
+	}
+	return s
+}
+
+func (c *catalog) list(ips []netip.Addr) string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return strings.Join(s, c.sep)
+}
+
+// caveatText words a caveat in c's language, falling back to its English
+// message for codes the catalog lacks.
+func (c *catalog) caveatText(cv engine.Caveat) string {
+	f, ok := c.caveats[cv.Code]
+	if !ok {
+		return cv.Message
+	}
+	if strings.Contains(f, "%s") {
+		return fmt.Sprintf(f, cv.Arg)
+	}
+	return f
+}
@@ -0,0 +1,157 @@
+package output
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"strconv"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/bandit"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+)
+
+// prefixMetrics are the metric families WritePrefixMetrics writes, in
+// order.
+var prefixMetrics = []struct {
+	name, typ, unit, help string
+}{
+	{"mcis_prefix_probes", "counter", "", "Probes scored against the prefix itself (its children's excluded)."},
+	{"mcis_prefix_successes", "counter", "", "Successful probes of the prefix."},
+	{"mcis_prefix_failures", "counter", "", "Failed probes of the prefix."},
+	{"mcis_prefix_success_ratio", "gauge", "ratio", "Share of the prefix's probes that succeeded."},
+	{"mcis_prefix_latency_mean_seconds", "gauge", "seconds", "Mean latency of the prefix's successful probes."},
+	{"mcis_prefix_latency_stddev_seconds", "gauge", "seconds", "Standard deviation of the latency of the prefix's successful probes."},
+	{"mcis_prefix_latency_seconds", "histogram", "seconds", "Latency of the prefix's successful probes."},
+	{"mcis_prefix_throughput_mbps", "gauge", "", "Mean measured throughput of the prefix in Mbps."},
+	{"mcis_prefix_split", "gauge", "", "1 if the prefix was split into children."},
+}
+
+// prefixSample is one node of the tree with the labels of its samples.
+type prefixSample struct {
+	node   bandit.NodeSnapshot
+	labels string
+}
+
+// WritePrefixMetrics writes the per-prefix statistics of a search tree as
+// OpenMetrics text, one sample per prefix and metric labelled with the
+// prefix, its address family and its root, all stamped with the time of
+// the snapshot. Every node of the tree is included; a probe counts only
+// against the prefix it was sampled from, so summing over all prefixes of
+// a root gives the root's totals. Histogram buckets follow
+// bandit.LatencyBucketBounds, whose bounds are exclusive.
+func WritePrefixMetrics(w io.Writer, dump engine.TreeDump) error {
+	var samples []prefixSample
+	var walk func(n bandit.NodeSnapshot, root netip.Prefix)
+	walk = func(n bandit.NodeSnapshot, root netip.Prefix) {
+		family := "ipv6"
+		if n.Prefix.Addr().Is4() {
+			family = "ipv4"
+		}
+		labels := fmt.Sprintf(`prefix="%s",family="%s",root="%s"`, n.Prefix, family, root)
+		if n.Label != "" {
+			labels += `,label="` + escapeLabel(n.Label) + `"`
+		}
+		samples = append(samples, prefixSample{node: n, labels: labels})
+		for _, c := range n.Children {
+			walk(c, root)
+		}
+	}
+	for _, r := range dump.Roots {
+		walk(r, r.Prefix)
+	}
+
+	ts := " " + strconv.FormatFloat(float64(dump.Time.UnixMilli())/1000, 'f', 3, 64)
+	bw := bufio.NewWriter(w)
+	for _, m := range prefixMetrics {
+		fmt.Fprintf(bw, "# TYPE %s %s\n", m.name, m.typ)
+		if m.unit != "" {
+			fmt.Fprintf(bw, "# UNIT %s %s\n", m.name, m.unit)
+		}
+		fmt.Fprintf(bw, "# HELP %s %s\n", m.name, m.help)
+		for _, s := range samples {
+			writePrefixSample(bw, m.name, s, ts)
+		}
+	}
+	fmt.Fprintln(bw, "# EOF")
+	return bw.Flush()
+}
+
+func writePrefixSample(w io.Writer, name string, s prefixSample, ts string) {
+	n := s.node
+	sample := func(suffix, extra string, v float64) {
+		labels := s.labels
+		if extra != "" {
+			labels += "," + extra
+		}
+		fmt.Fprintf(w, "%s%s{%s} %s%s\n", name, suffix, labels, formatFloat(v), ts)
+	}
+	switch name {
+	case "mcis_prefix_probes":
+		sample("_total", "", float64(n.Samples))
+	case "mcis_prefix_successes":
+		sample("_total", "", float64(n.Successes))
+	case "mcis_prefix_failures":
+		sample("_total", "", float64(n.Failures))
+	case "mcis_prefix_success_ratio":
+		if n.Samples > 0 {
+			sample("", "", float64(n.Successes)/float64(n.Samples))
+		}
+	case "mcis_prefix_latency_mean_seconds":
+		if n.Successes > 0 {
+			sample("", "", n.MeanLatency/1000)
+		}
+	case "mcis_prefix_latency_stddev_seconds":
+		if n.Successes > 1 {
+			sample("", "", math.Sqrt(n.VarLatency)/1000)
+		}
+	case "mcis_prefix_latency_seconds":
+		if n.Histogram == nil {
+			return
+		}
+		cum := 0
+		for i, c := range n.Histogram {
+			cum += c
+			le := "+Inf"
+			if i < len(bandit.LatencyBucketBounds) {
+				le = formatFloat(bandit.LatencyBucketBounds[i] / 1000)
+			}
+			sample("_bucket", `le="`+le+`"`, float64(cum))
+		}
+		sample("_count", "", float64(n.Successes))
+		sample("_sum", "", n.MeanLatency*float64(n.Successes)/1000)
+	case "mcis_prefix_throughput_mbps":
+		if n.MbpsSamples > 0 {
+			sample("", "", n.MeanMbps)
+		}
+	case "mcis_prefix_split":
+		v := 0.0
+		if n.Split {
+			v = 1
+		}
+		sample("", "", v)
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escapeLabel escapes a label value for the text exposition format.
+func escapeLabel(s string) string {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			out = append(out, `\\`...)
+		case '"':
+			out = append(out, `\"`...)
+		case '\n':
+			out = append(out, `\n`...)
+		default:
+			out = append(out, c)
+		}
+	}
+	return string(out)
+}
@@ -7,70 +7,172 @@ import (
 	"io"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
 )
 
-// WriteJSONL writes results as JSON Lines format.
-func WriteJSONL(w io.Writer, rows []engine.TopResult) error {
-	enc := json.NewEncoder(w)
+// RowWriter writes results one at a time, in rank order, so a huge result
+// set goes out as it is produced instead of being formatted in memory first.
+type RowWriter interface {
+	Write(r engine.TopResult) error
+	Flush() error
+}
+
+// NewRowWriter returns the row writer for format ("jsonl" or "csv"). For
+// CSV it writes the header, with one reachability column per port in ports.
+func NewRowWriter(w io.Writer, format string, ports []int) (RowWriter, error) {
+	switch format {
+	case "jsonl":
+		return NewJSONLWriter(w), nil
+	case "csv":
+		return NewCSVWriter(w, ports)
+	default:
+		return nil, fmt.Errorf("no row writer for format %q", format)
+	}
+}
+
+// WriteRows writes rows through a row writer for format.
+func WriteRows(w io.Writer, format string, rows []engine.TopResult) error {
+	rw, err := NewRowWriter(w, format, portColumns(rows))
+	if err != nil {
+		return err
+	}
 	for _, r := range rows {
-		if err := enc.Encode(r); err != nil {
+		if err := rw.Write(r); err != nil {
 			return err
 		}
 	}
-	return nil
+	return rw.Flush()
+}
+
+// WriteJSONL writes results as JSON Lines format.
+func WriteJSONL(w io.Writer, rows []engine.TopResult) error {
+	return WriteRows(w, "jsonl", rows)
 }
 
 // WriteCSV writes results as CSV format.
 func WriteCSV(w io.Writer, rows []engine.TopResult) error {
+	return WriteRows(w, "csv", rows)
+}
+
+// JSONLWriter writes results as JSON Lines one row at a time.
+type JSONLWriter struct {
+	enc *json.Encoder
+}
+
+// NewJSONLWriter returns a JSON Lines writer for the rows.
+func NewJSONLWriter(w io.Writer) *JSONLWriter {
+	return &JSONLWriter{enc: json.NewEncoder(w)}
+}
+
+// Write writes one result as the next line.
+func (w *JSONLWriter) Write(r engine.TopResult) error {
+	return w.enc.Encode(r)
+}
+
+// Flush is a no-op: every Write already hands its line to the underlying
+// writer.
+func (w *JSONLWriter) Flush() error {
+	return nil
+}
+
+// CSVWriter writes results as CSV one row at a time, ranked in the order
+// they are written, so a huge result set can be written as it is produced
+// instead of being formatted in memory first.
+type CSVWriter struct {
+	cw    *csv.Writer
+	ports []int
+	rank  int
+}
+
+// NewCSVWriter writes the CSV header, with one reachability column per
+// port in ports, and returns a writer for the rows.
+func NewCSVWriter(w io.Writer, ports []int) (*CSVWriter, error) {
 	cw := csv.NewWriter(w)
-	defer cw.Flush()
 
 	header := []string{
-		"rank", "ip", "prefix",
+		"rank", "ip", "prefix", "label",
 		"ok", "status",
-		"connect_ms", "tls_ms", "ttfb_ms", "total_ms",
+		"connect_ms", "tls_ms", "tls_resume_ms", "ttfb_ms", "total_ms", "warm_ttfb_ms", "warm_total_ms",
 		"score_ms", "samples_prefix", "ok_prefix", "fail_prefix",
-		"download_ok", "download_mbps", "download_ms", "download_bytes", "download_error",
-		"colo",
+		"download_ok", "download_mbps", "download_ms", "download_bytes", "download_error", "download_attempts",
+		"colo", "loc", "http", "warp", "fronting_ok", "ech_supported", "cert_ok",
+		"stable_for_s", "refresh_after_s", "path", "tls_unverified", "bw_hint_mbps_est", "port",
+	}
+	for _, p := range ports {
+		header = append(header, "port_"+strconv.Itoa(p))
 	}
 	if err := cw.Write(header); err != nil {
-		return err
+		return nil, err
 	}
+	return &CSVWriter{cw: cw, ports: ports}, nil
+}
 
-	for i, r := range rows {
-		colo := ""
-		if r.Trace != nil {
-			colo = r.Trace["colo"]
-		}
-		rec := []string{
-			strconv.Itoa(i + 1),
-			r.IP.String(),
-			r.Prefix.String(),
-			strconv.FormatBool(r.OK),
-			strconv.Itoa(r.Status),
-			strconv.FormatInt(r.ConnectMS, 10),
-			strconv.FormatInt(r.TLSMS, 10),
-			strconv.FormatInt(r.TTFBMS, 10),
-			strconv.FormatInt(r.TotalMS, 10),
-			fmt.Sprintf("%.2f", r.ScoreMS),
-			strconv.Itoa(r.PrefixSamples),
-			strconv.Itoa(r.PrefixOK),
-			strconv.Itoa(r.PrefixFail),
-			strconv.FormatBool(r.DownloadOK),
-			fmt.Sprintf("%.2f", r.DownloadMbps),
-			strconv.FormatInt(r.DownloadMS, 10),
-			strconv.FormatInt(r.DownloadBytes, 10),
-			r.DownloadError,
-			colo,
-		}
-		if err := cw.Write(rec); err != nil {
-			return err
-		}
+// Write writes one result as the next ranked row.
+func (w *CSVWriter) Write(r engine.TopResult) error {
+	w.rank++
+	fronting := ""
+	if r.FrontingTested {
+		fronting = strconv.FormatBool(r.FrontingOK)
 	}
-	cw.Flush()
-	return cw.Error()
+	ech := ""
+	if r.ECHTested {
+		ech = strconv.FormatBool(r.ECHSupported)
+	}
+	cert := ""
+	if r.CertTested {
+		cert = strconv.FormatBool(r.CertOK)
+	}
+	rec := []string{
+		strconv.Itoa(w.rank),
+		r.IP.String(),
+		r.Prefix.String(),
+		r.Label,
+		strconv.FormatBool(r.OK),
+		strconv.Itoa(r.Status),
+		strconv.FormatInt(r.ConnectMS, 10),
+		strconv.FormatInt(r.TLSMS, 10),
+		strconv.FormatInt(r.TLSResumeMS, 10),
+		strconv.FormatInt(r.TTFBMS, 10),
+		strconv.FormatInt(r.TotalMS, 10),
+		strconv.FormatInt(r.WarmTTFBMS, 10),
+		strconv.FormatInt(r.WarmTotalMS, 10),
+		fmt.Sprintf("%.2f", r.ScoreMS),
+		strconv.Itoa(r.PrefixSamples),
+		strconv.Itoa(r.PrefixOK),
+		strconv.Itoa(r.PrefixFail),
+		strconv.FormatBool(r.DownloadOK),
+		fmt.Sprintf("%.2f", r.DownloadMbps),
+		strconv.FormatInt(r.DownloadMS, 10),
+		strconv.FormatInt(r.DownloadBytes, 10),
+		r.DownloadError,
+		strconv.Itoa(r.DownloadAttempts),
+		r.Colo,
+		r.Loc,
+		r.HTTP,
+		r.Warp,
+		fronting,
+		ech,
+		cert,
+		strconv.FormatInt(r.StableForS, 10),
+		strconv.FormatInt(r.RefreshAfterS, 10),
+		r.Path,
+		strconv.FormatBool(r.TLSUnverified),
+		hintCell(r.BandwidthHintMbps),
+		armPortCell(r.Port),
+	}
+	for _, p := range w.ports {
+		rec = append(rec, portCell(r.Ports, p))
+	}
+	return w.cw.Write(rec)
+}
+
+// Flush writes any buffered rows to the underlying writer.
+func (w *CSVWriter) Flush() error {
+	w.cw.Flush()
+	return w.cw.Error()
 }
 
 // WriteText writes results as human-readable text format.
@@ -78,22 +180,165 @@ func WriteText(w io.Writer, rows []engine.TopResult) error {
 	// Ensure stable output
 	sort.SliceStable(rows, func(i, j int) bool { return rows[i].ScoreMS < rows[j].ScoreMS })
 	for i, r := range rows {
-		colo := ""
-		if r.Trace != nil {
-			colo = r.Trace["colo"]
-		}
 		dl := ""
+		if r.WarmTotalMS > 0 {
+			dl = fmt.Sprintf("\tttfb=%dms\twarm_ttfb=%dms", r.TTFBMS, r.WarmTTFBMS)
+		}
+		if r.TLSResumeMS > 0 {
+			dl += fmt.Sprintf("\ttls=%dms\ttls_resume=%dms", r.TLSMS, r.TLSResumeMS)
+		}
+		if r.TLSUnverified {
+			dl += "\ttls_unverified=true"
+		}
+		if r.BandwidthHintMbps > 0 {
+			dl += fmt.Sprintf("\tbw_hint~%.0fMbps(est)", r.BandwidthHintMbps)
+		}
 		if r.DownloadOK || r.DownloadError != "" || r.DownloadMS != 0 || r.DownloadBytes != 0 {
-			dl = fmt.Sprintf("\tdl_ok=%v\tdl_mbps=%.2f\tdl_ms=%d", r.DownloadOK, r.DownloadMbps, r.DownloadMS)
+			dl += fmt.Sprintf("\tdl_ok=%v\tdl_mbps=%.2f\tdl_ms=%d", r.DownloadOK, r.DownloadMbps, r.DownloadMS)
 			if r.DownloadError != "" {
 				dl += "\tdl_err=" + r.DownloadError
 			}
+			if r.DownloadAttempts > 1 {
+				dl += fmt.Sprintf("\tdl_attempts=%d", r.DownloadAttempts)
+			}
+		}
+		for _, t := range r.Targets {
+			if t.OK {
+				dl += fmt.Sprintf("\t%s=%dms", t.Target, t.TotalMS)
+			} else {
+				dl += fmt.Sprintf("\t%s=fail", t.Target)
+			}
+		}
+		if r.FrontingTested {
+			dl += fmt.Sprintf("\tfronting=%v", r.FrontingOK)
+		}
+		if r.ECHTested {
+			dl += fmt.Sprintf("\tech=%v", r.ECHSupported)
+		}
+		if r.CertTested {
+			dl += fmt.Sprintf("\tcert=%v", r.CertOK)
+			if r.CertOCSP != "" {
+				dl += "\tocsp=" + r.CertOCSP
+			}
+		}
+		if r.RefreshAfterS > 0 {
+			dl += fmt.Sprintf("\tstable=%s\trefresh=%s",
+				time.Duration(r.StableForS)*time.Second, time.Duration(r.RefreshAfterS)*time.Second)
+		}
+		if len(r.Ports) > 0 {
+			var open []string
+			for _, pr := range r.Ports {
+				if pr.OK {
+					open = append(open, strconv.Itoa(pr.Port))
+				}
+			}
+			dl += "\tports=" + strings.Join(open, ",")
+		}
+		prefix := r.Prefix.String()
+		if r.Label != "" {
+			prefix += "\tlabel=" + r.Label
+		}
+		if r.Port != 0 {
+			prefix += "\tport=" + strconv.Itoa(int(r.Port))
+		}
+		if r.Loc != "" {
+			dl = "\tloc=" + r.Loc + dl
 		}
 		_, err := fmt.Fprintf(w, "%d\t%s\t%.1fms\tok=%v\tstatus=%d\tprefix=%s\tcolo=%s%s\n",
-			i+1, r.IP.String(), r.ScoreMS, r.OK, r.Status, r.Prefix.String(), colo, dl)
+			i+1, r.IP.String(), r.ScoreMS, r.OK, r.Status, prefix, r.Colo, dl)
 		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// WriteVerdict writes the recommendation of a search after its text
+// results, as a short plain-language summary in lang (see LangEN). A nil
+// meta writes nothing.
+func WriteVerdict(w io.Writer, meta *engine.Meta, lang string) error {
+	if meta == nil {
+		return nil
+	}
+	c := messages[lang]
+	if c == nil {
+		c = &catalog{
+			summary: "Summary", recommended: "Recommended", fallbacks: "Fallbacks", caveat: "Caveat", sep: ", ",
+			baseline:       "Baseline",
+			baselineVia:    "default route %.0fms (%s)",
+			baselineFailed: "default route failed: %s",
+			faster:         "; best found is %.0f%% faster",
+			slower:         "; best found is %.0f%% slower",
+		}
+	}
+
+	var b strings.Builder
+	verdict := meta.Verdict
+	if c.use != "" {
+		verdict = c.verdict(meta)
+	}
+	b.WriteString("\n" + c.summary + ": " + verdict + "\n")
+	if meta.Recommended.IsValid() {
+		b.WriteString(c.recommended + ": " + meta.Recommended.String() + "\n")
+	}
+	if len(meta.Fallbacks) > 0 {
+		b.WriteString(c.fallbacks + ": " + c.list(meta.Fallbacks) + "\n")
+	}
+	if meta.Baseline != nil {
+		b.WriteString(c.baseline + ": " + c.baselineText(meta) + "\n")
+	}
+	for _, cv := range meta.Caveats {
+		b.WriteString(c.caveat + ": " + c.caveatText(cv) + "\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// portColumns returns the sorted union of ports tested across rows, so the
+// CSV forms a reachability matrix with one column per port.
+func portColumns(rows []engine.TopResult) []int {
+	seen := make(map[int]bool)
+	var ports []int
+	for _, r := range rows {
+		for _, pr := range r.Ports {
+			if !seen[pr.Port] {
+				seen[pr.Port] = true
+				ports = append(ports, pr.Port)
+			}
+		}
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// hintCell formats a bandwidth hint, empty when there is none.
+func hintCell(mbps float64) string {
+	if mbps <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%.1f", mbps)
+}
+
+// armPortCell formats the port a result was found on, empty without
+// searched ports.
+func armPortCell(port uint16) string {
+	if port == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(port))
+}
+
+// portCell formats one port's reachability: the connect time in ms when
+// open, "x" when closed, empty when untested.
+func portCell(results []engine.PortResult, port int) string {
+	for _, pr := range results {
+		if pr.Port != port {
+			continue
+		}
+		if pr.OK {
+			return strconv.FormatInt(pr.ConnectMS, 10)
+		}
+		return "x"
+	}
+	return ""
+}
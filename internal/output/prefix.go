@@ -0,0 +1,76 @@
+package output
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+)
+
+// WritePrefixJSONL writes a prefix ranking as JSON Lines format.
+func WritePrefixJSONL(w io.Writer, rows []engine.PrefixRank) error {
+	enc := json.NewEncoder(w)
+	for _, r := range rows {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WritePrefixCSV writes a prefix ranking as CSV format.
+func WritePrefixCSV(w io.Writer, rows []engine.PrefixRank) error {
+	cw := csv.NewWriter(w)
+	defer cw.Flush()
+
+	header := []string{
+		"rank", "prefix", "label",
+		"samples", "ok", "fail", "success_rate",
+		"mean_ms", "score_ms", "lower_ms", "upper_ms",
+		"decided",
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		rec := []string{
+			strconv.Itoa(r.Rank),
+			r.Prefix.String(),
+			r.Label,
+			strconv.Itoa(r.Samples),
+			strconv.Itoa(r.OK),
+			strconv.Itoa(r.Fail),
+			fmt.Sprintf("%.3f", r.SuccessRate),
+			fmt.Sprintf("%.2f", r.MeanMS),
+			fmt.Sprintf("%.2f", r.ScoreMS),
+			fmt.Sprintf("%.2f", r.LowerMS),
+			fmt.Sprintf("%.2f", r.UpperMS),
+			strconv.FormatBool(r.Decided),
+		}
+		if err := cw.Write(rec); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WritePrefixText writes a prefix ranking as human-readable text format.
+func WritePrefixText(w io.Writer, rows []engine.PrefixRank) error {
+	for _, r := range rows {
+		prefix := r.Prefix.String()
+		if r.Label != "" {
+			prefix += "\tlabel=" + r.Label
+		}
+		_, err := fmt.Fprintf(w, "%d\t%s\t%.1fms\t[%.1f, %.1f]\tsamples=%d\tok_rate=%.2f\tdecided=%v\n",
+			r.Rank, prefix, r.ScoreMS, r.LowerMS, r.UpperMS, r.Samples, r.SuccessRate, r.Decided)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+)
+
+// ReadJSONL reads results written by WriteJSONL. A --stream capture is
+// accepted too: its summary event supplies the results and the probe and
+// epoch events are skipped. Without a summary (e.g. a capture cut off during
+// the download tests) the result events, with their updates, are used.
+func ReadJSONL(r io.Reader) ([]engine.TopResult, error) {
+	var rows []engine.TopResult
+	var summary []engine.TopResult
+	haveSummary := false
+	var early []engine.TopResult
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var head struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(line, &head); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		switch head.Type {
+		case "":
+			var row engine.TopResult
+			if err := json.Unmarshal(line, &row); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			rows = append(rows, row)
+		case EventResult, EventUpdate:
+			var ev resultEvent
+			if err := json.Unmarshal(line, &ev); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			switch {
+			case head.Type == EventResult:
+				early = append(early, ev.TopResult)
+			case ev.Rank >= 1 && ev.Rank <= len(early):
+				early[ev.Rank-1] = ev.TopResult
+			}
+		case EventSummary:
+			var ev summaryEvent
+			if err := json.Unmarshal(line, &ev); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			summary, haveSummary = ev.Top, true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if haveSummary {
+		return summary, nil
+	}
+	if len(rows) == 0 {
+		return early, nil
+	}
+	return rows, nil
+}
+
+// ReadJSONLFile reads a results file (see ReadJSONL).
+func ReadJSONLFile(path string) ([]engine.TopResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	rows, err := ReadJSONL(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rows, nil
+}
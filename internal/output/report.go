@@ -0,0 +1,253 @@
+package output
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+)
+
+// ReportRun is one run of a trend report: when it finished and its results.
+type ReportRun struct {
+	When time.Time
+	Top  []engine.TopResult
+}
+
+// trendSeries is the latency and speed of one IP or prefix across the
+// runs of a report; NaN where it has no result in a run.
+type trendSeries struct {
+	Name    string
+	Colo    string
+	Latency []float64
+	Mbps    []float64
+}
+
+// change is the relative change of the last value of xs against the first,
+// in percent; NaN with fewer than two values.
+func change(xs []float64) float64 {
+	first, last := math.NaN(), math.NaN()
+	for _, x := range xs {
+		if math.IsNaN(x) {
+			continue
+		}
+		if math.IsNaN(first) {
+			first = x
+		}
+		last = x
+	}
+	if math.IsNaN(first) || first == 0 {
+		return math.NaN()
+	}
+	return 100 * (last - first) / first
+}
+
+// WriteTrendReport writes an HTML page charting the latency and download
+// speed of IPs and prefixes across runs (oldest first). The series are
+// those of the last run's results, at most maxSeries of each kind, so the
+// page shows how the current picks got where they are and which are
+// degrading.
+func WriteTrendReport(w io.Writer, runs []ReportRun, maxSeries int) error {
+	if len(runs) == 0 {
+		return fmt.Errorf("no runs to report")
+	}
+	last := runs[len(runs)-1].Top
+	if maxSeries > 0 && len(last) > maxSeries {
+		last = last[:maxSeries]
+	}
+
+	var ips []*trendSeries
+	byIP := make(map[netip.Addr]*trendSeries)
+	var prefixes []*trendSeries
+	byPrefix := make(map[netip.Prefix]*trendSeries)
+	newSeries := func(name, colo string) *trendSeries {
+		s := &trendSeries{Name: name, Colo: colo, Latency: make([]float64, len(runs)), Mbps: make([]float64, len(runs))}
+		for i := range runs {
+			s.Latency[i], s.Mbps[i] = math.NaN(), math.NaN()
+		}
+		return s
+	}
+	for _, r := range last {
+		if _, ok := byIP[r.IP]; !ok {
+			byIP[r.IP] = newSeries(r.IP.String(), r.Colo)
+			ips = append(ips, byIP[r.IP])
+		}
+		if _, ok := byPrefix[r.Prefix]; !ok && r.Prefix.IsValid() {
+			byPrefix[r.Prefix] = newSeries(r.Prefix.String(), r.Colo)
+			prefixes = append(prefixes, byPrefix[r.Prefix])
+		}
+	}
+
+	// Prefixes take the mean over their results in each run.
+	for i, run := range runs {
+		latSum := make(map[netip.Prefix]float64)
+		latN := make(map[netip.Prefix]int)
+		mbpsSum := make(map[netip.Prefix]float64)
+		mbpsN := make(map[netip.Prefix]int)
+		for _, r := range run.Top {
+			if !r.OK {
+				continue
+			}
+			if s := byIP[r.IP]; s != nil && math.IsNaN(s.Latency[i]) {
+				s.Latency[i] = r.ScoreMS
+				if r.DownloadOK {
+					s.Mbps[i] = r.DownloadMbps
+				}
+			}
+			latSum[r.Prefix] += r.ScoreMS
+			latN[r.Prefix]++
+			if r.DownloadOK {
+				mbpsSum[r.Prefix] += r.DownloadMbps
+				mbpsN[r.Prefix]++
+			}
+		}
+		for p, s := range byPrefix {
+			if latN[p] > 0 {
+				s.Latency[i] = latSum[p] / float64(latN[p])
+			}
+			if mbpsN[p] > 0 {
+				s.Mbps[i] = mbpsSum[p] / float64(mbpsN[p])
+			}
+		}
+	}
+
+	type row struct {
+		Name, Colo                string
+		LatencyChart, MbpsChart   template.HTML
+		LatencyNow, MbpsNow       string
+		LatencyChange, MbpsChange string
+		LatencyWorse, MbpsWorse   bool
+	}
+	rows := func(series []*trendSeries) []row {
+		out := make([]row, 0, len(series))
+		for _, s := range series {
+			lc, mc := change(s.Latency), change(s.Mbps)
+			out = append(out, row{
+				Name:          s.Name,
+				Colo:          s.Colo,
+				LatencyChart:  sparkline(s.Latency),
+				MbpsChart:     sparkline(s.Mbps),
+				LatencyNow:    lastValue(s.Latency, "%.1f ms"),
+				MbpsNow:       lastValue(s.Mbps, "%.1f Mbps"),
+				LatencyChange: percent(lc),
+				MbpsChange:    percent(mc),
+				LatencyWorse:  lc > 10,
+				MbpsWorse:     mc < -10,
+			})
+		}
+		return out
+	}
+	return reportTemplate.Execute(w, map[string]any{
+		"From":     runs[0].When.Format(time.RFC3339),
+		"To":       runs[len(runs)-1].When.Format(time.RFC3339),
+		"Runs":     len(runs),
+		"IPs":      rows(ips),
+		"Prefixes": rows(prefixes),
+	})
+}
+
+func lastValue(xs []float64, format string) string {
+	for i := len(xs) - 1; i >= 0; i-- {
+		if !math.IsNaN(xs[i]) {
+			return fmt.Sprintf(format, xs[i])
+		}
+	}
+	return "-"
+}
+
+func percent(x float64) string {
+	if math.IsNaN(x) {
+		return "-"
+	}
+	return fmt.Sprintf("%+.0f%%", x)
+}
+
+// sparkline draws xs as an inline SVG line chart, one point per run, with
+// gaps where a value is missing.
+func sparkline(xs []float64) template.HTML {
+	const width, height = 240, 40
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, x := range xs {
+		if !math.IsNaN(x) {
+			lo, hi = min(lo, x), max(hi, x)
+		}
+	}
+	if math.IsInf(lo, 1) {
+		return ""
+	}
+	if hi == lo {
+		lo, hi = lo-1, hi+1
+	}
+	step := float64(width)
+	if len(xs) > 1 {
+		step = float64(width) / float64(len(xs)-1)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg width="%d" height="%d" viewBox="-2 -2 %d %d">`, width, height, width+4, height+4)
+	var seg []string
+	flush := func() {
+		switch len(seg) {
+		case 0:
+		case 1:
+			xy := strings.Split(seg[0], ",")
+			fmt.Fprintf(&b, `<circle cx="%s" cy="%s" r="2"/>`, xy[0], xy[1])
+		default:
+			fmt.Fprintf(&b, `<polyline points="%s"/>`, strings.Join(seg, " "))
+		}
+		seg = seg[:0]
+	}
+	for i, x := range xs {
+		if math.IsNaN(x) {
+			flush()
+			continue
+		}
+		y := height - (x-lo)/(hi-lo)*height
+		seg = append(seg, fmt.Sprintf("%.1f,%.1f", float64(i)*step, y))
+	}
+	flush()
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>mcis trend report</title>
+<style>
+  body { font: 14px/1.4 system-ui, sans-serif; margin: 20px; color: #1d2127; }
+  table { border-collapse: collapse; margin-bottom: 24px; font-variant-numeric: tabular-nums; }
+  th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #eceef1; vertical-align: middle; }
+  svg polyline { fill: none; stroke: #3c8dde; stroke-width: 1.5; }
+  svg circle { fill: #3c8dde; }
+  .worse { color: #c0392b; font-weight: 600; }
+  .muted { color: #6b7480; }
+</style>
+</head>
+<body>
+<h1>Trend report</h1>
+<p class="muted">{{.Runs}} runs from {{.From}} to {{.To}}. Change compares each series' last value with its first; latency up more than 10% or speed down more than 10% is highlighted.</p>
+{{define "table"}}
+<table>
+<thead><tr><th></th><th>Colo</th><th>Latency</th><th>Now</th><th>Change</th><th>Download</th><th>Now</th><th>Change</th></tr></thead>
+<tbody>
+{{range .}}<tr>
+<td>{{.Name}}</td><td>{{.Colo}}</td>
+<td>{{.LatencyChart}}</td><td>{{.LatencyNow}}</td><td{{if .LatencyWorse}} class="worse"{{end}}>{{.LatencyChange}}</td>
+<td>{{.MbpsChart}}</td><td>{{.MbpsNow}}</td><td{{if .MbpsWorse}} class="worse"{{end}}>{{.MbpsChange}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+{{end}}
+<h2>IPs</h2>
+{{template "table" .IPs}}
+<h2>Prefixes</h2>
+{{template "table" .Prefixes}}
+</body>
+</html>
+`))
@@ -0,0 +1,118 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+)
+
+// RotationEntry is one IP of a rotation list.
+type RotationEntry struct {
+	IP      netip.Addr `json:"ip"`
+	Colo    string     `json:"colo,omitempty"`
+	ScoreMS float64    `json:"score_ms"`
+	Mbps    float64    `json:"download_mbps,omitempty"`
+
+	// Weight is the suggested share of connections, 1-100 with the best IP
+	// at 100, proportional to its rank score after download tests and to
+	// inverse latency otherwise.
+	Weight int `json:"weight"`
+}
+
+// Rotation builds a rotation list of up to size IPs from the successful
+// rows, taken to be ranked: colos are visited round-robin in the order of
+// their best IP and each turn takes that colo's next IP, so the list starts
+// with the best IP and consecutive entries spread over data centers. size
+// <= 0 keeps every successful row.
+func Rotation(rows []engine.TopResult, size int) []RotationEntry {
+	var order []string
+	groups := make(map[string][]engine.TopResult)
+	total := 0
+	for _, r := range rows {
+		if !r.OK {
+			continue
+		}
+		if _, ok := groups[r.Colo]; !ok {
+			order = append(order, r.Colo)
+		}
+		groups[r.Colo] = append(groups[r.Colo], r)
+		total++
+	}
+	if size <= 0 || size > total {
+		size = total
+	}
+
+	picked := make([]engine.TopResult, 0, size)
+	for turn := 0; len(picked) < size; turn++ {
+		for _, colo := range order {
+			if g := groups[colo]; turn < len(g) && len(picked) < size {
+				picked = append(picked, g[turn])
+			}
+		}
+	}
+
+	out := make([]RotationEntry, len(picked))
+	for i, r := range picked {
+		out[i] = RotationEntry{IP: r.IP, Colo: r.Colo, ScoreMS: r.ScoreMS}
+		if r.DownloadOK {
+			out[i].Mbps = r.DownloadMbps
+		}
+	}
+	setWeights(out, picked)
+	return out
+}
+
+// setWeights scales the entries' weights so the best one gets 100. Rank
+// scores are used when every picked row has one, so download speed counts;
+// otherwise weights follow inverse latency.
+func setWeights(out []RotationEntry, rows []engine.TopResult) {
+	value := func(r engine.TopResult) float64 {
+		if r.ScoreMS <= 0 {
+			return 0
+		}
+		return 1 / r.ScoreMS
+	}
+	ranked := len(rows) > 0
+	for _, r := range rows {
+		if r.RankScore <= 0 {
+			ranked = false
+		}
+	}
+	if ranked {
+		value = func(r engine.TopResult) float64 { return r.RankScore }
+	}
+
+	var best float64
+	for _, r := range rows {
+		best = max(best, value(r))
+	}
+	for i, r := range rows {
+		w := 100
+		if best > 0 {
+			w = int(math.Round(100 * value(r) / best))
+		}
+		out[i].Weight = max(1, w)
+	}
+}
+
+// WriteRotation writes a rotation list of up to size IPs, one per line in
+// rotation order, with the suggested weight, colo and latency.
+func WriteRotation(w io.Writer, rows []engine.TopResult, size int) error {
+	for _, e := range Rotation(rows, size) {
+		colo := e.Colo
+		if colo == "" {
+			colo = "-"
+		}
+		line := fmt.Sprintf("%s\tweight=%d\tcolo=%s\tscore_ms=%.1f", e.IP.String(), e.Weight, colo, e.ScoreMS)
+		if e.Mbps > 0 {
+			line += fmt.Sprintf("\tdownload_mbps=%.2f", e.Mbps)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package output
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+)
+
+// sampleHeader is the header of the sample export, one column per field so
+// the file loads straight into a data frame.
+var sampleHeader = []string{
+	"when", "run", "ip", "family", "prefix", "prefix_bits", "label", "head", "worker",
+	"ok", "status", "error",
+	"connect_ms", "tls_ms", "tls_resume_ms", "ttfb_ms", "total_ms", "score_ms",
+	"warm_ttfb_ms", "warm_total_ms",
+	"colo", "loc", "http", "warp", "path", "tls_unverified",
+	"prefix_samples", "prefix_ok", "prefix_fail",
+}
+
+// SampleWriter exports every raw probe of a search as a CSV row, for
+// analysis outside the tool. Like StreamWriter, write errors are sticky and
+// reported by Err.
+type SampleWriter struct {
+	mu  sync.Mutex
+	cw  *csv.Writer
+	err error
+}
+
+// NewSampleWriter creates a SampleWriter writing to w, starting with the
+// header unless header is false (e.g. when appending to an existing file).
+func NewSampleWriter(w io.Writer, header bool) *SampleWriter {
+	s := &SampleWriter{cw: csv.NewWriter(w)}
+	if header {
+		s.err = s.cw.Write(sampleHeader)
+	}
+	return s
+}
+
+// Write writes one probe of run (the 1-based run index in monitor mode).
+func (s *SampleWriter) Write(run int, r engine.ProbeResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	family := "4"
+	if r.IP.Is6() {
+		family = "6"
+	}
+	s.err = s.cw.Write([]string{
+		r.When.UTC().Format(time.RFC3339Nano),
+		strconv.Itoa(run),
+		r.IP.String(),
+		family,
+		r.Prefix.String(),
+		strconv.Itoa(r.Prefix.Bits()),
+		r.Label,
+		strconv.Itoa(r.HeadID),
+		strconv.Itoa(r.Worker),
+		strconv.FormatBool(r.OK),
+		strconv.Itoa(r.Status),
+		r.Error,
+		strconv.FormatInt(r.ConnectMS, 10),
+		strconv.FormatInt(r.TLSMS, 10),
+		strconv.FormatInt(r.TLSResumeMS, 10),
+		strconv.FormatInt(r.TTFBMS, 10),
+		strconv.FormatInt(r.TotalMS, 10),
+		strconv.FormatFloat(r.ScoreMS, 'f', 2, 64),
+		strconv.FormatInt(r.WarmTTFBMS, 10),
+		strconv.FormatInt(r.WarmTotalMS, 10),
+		r.Colo,
+		r.Loc,
+		r.HTTP,
+		r.Warp,
+		r.Path,
+		strconv.FormatBool(r.TLSUnverified),
+		strconv.Itoa(r.PrefixSamples),
+		strconv.Itoa(r.PrefixOK),
+		strconv.Itoa(r.PrefixFail),
+	})
+}
+
+// Flush writes buffered rows to the underlying writer and returns the first
+// error, if any.
+func (s *SampleWriter) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cw.Flush()
+	if s.err == nil {
+		s.err = s.cw.Error()
+	}
+	return s.err
+}
@@ -0,0 +1,124 @@
+package output
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+)
+
+// Stream event types.
+const (
+	EventProbe   = "probe"
+	EventEpoch   = "epoch"
+	EventResult  = "result"
+	EventUpdate  = "update"
+	EventSummary = "summary"
+)
+
+// StreamWriter writes probe events as JSON Lines while a search runs,
+// interleaved with about one epoch event per second summarizing progress,
+// followed by a summary event with the final top results. Results are also
+// written as soon as the search ends, one result event per row in latency
+// order, and then one update event per finished download test, so slow
+// download tests don't hold back all output. Every line has a "type" field
+// so consumers can tell them apart.
+type StreamWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// NewStreamWriter creates a StreamWriter writing to w.
+func NewStreamWriter(w io.Writer) *StreamWriter {
+	return &StreamWriter{enc: json.NewEncoder(w)}
+}
+
+type probeEvent struct {
+	Type string `json:"type"`
+	engine.ProbeResult
+}
+
+type epochEvent struct {
+	Type string `json:"type"`
+	engine.Epoch
+}
+
+// resultEvent is a result or update event; Rank is the 1-based position in
+// the latency-ranked results.
+type resultEvent struct {
+	Type string `json:"type"`
+	Rank int    `json:"rank"`
+	engine.TopResult
+}
+
+type summaryEvent struct {
+	Type string             `json:"type"`
+	Top  []engine.TopResult `json:"top"`
+}
+
+// WriteProbe writes a single probe event. Write errors are sticky and
+// reported by Err, so this can be used directly as engine.Config.OnProbe.
+func (s *StreamWriter) WriteProbe(r engine.ProbeResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = s.enc.Encode(probeEvent{Type: EventProbe, ProbeResult: r})
+}
+
+// WriteEpoch writes an epoch event. Like WriteProbe it can be used as
+// engine.Config.OnEpoch.
+func (s *StreamWriter) WriteEpoch(ep engine.Epoch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = s.enc.Encode(epochEvent{Type: EventEpoch, Epoch: ep})
+}
+
+// WriteResults writes a result event for every row, ranked in order.
+func (s *StreamWriter) WriteResults(rows []engine.TopResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range rows {
+		if s.err != nil {
+			break
+		}
+		s.err = s.enc.Encode(resultEvent{Type: EventResult, Rank: i + 1, TopResult: r})
+	}
+	return s.err
+}
+
+// WriteUpdate writes an update event for the row at rank (as written by
+// WriteResults), e.g. once its download test has finished. Like WriteProbe
+// it may be called from any goroutine.
+func (s *StreamWriter) WriteUpdate(rank int, r engine.TopResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = s.enc.Encode(resultEvent{Type: EventUpdate, Rank: rank, TopResult: r})
+}
+
+// WriteSummary writes the final summary event.
+func (s *StreamWriter) WriteSummary(rows []engine.TopResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.err = s.enc.Encode(summaryEvent{Type: EventSummary, Top: rows})
+	return s.err
+}
+
+// Err returns the first write error, if any.
+func (s *StreamWriter) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
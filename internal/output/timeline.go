@@ -0,0 +1,44 @@
+package output
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+)
+
+// WriteTimelineCSV writes the per-epoch summaries of a search as CSV, one row
+// per epoch, for plotting convergence curves. The heads column lists each
+// head's focus prefix separated by spaces.
+func WriteTimelineCSV(w io.Writer, epochs []engine.Epoch) error {
+	cw := csv.NewWriter(w)
+	defer cw.Flush()
+
+	header := []string{"elapsed_s", "completed", "probes", "success_rate", "best_score_ms", "nodes", "heads"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, ep := range epochs {
+		heads := make([]string, len(ep.Heads))
+		for i, h := range ep.Heads {
+			heads[i] = h.String()
+		}
+		rec := []string{
+			fmt.Sprintf("%.1f", ep.ElapsedS),
+			strconv.FormatInt(ep.Completed, 10),
+			strconv.FormatInt(ep.Probes, 10),
+			fmt.Sprintf("%.3f", ep.SuccessRate),
+			fmt.Sprintf("%.2f", ep.BestScoreMS),
+			strconv.Itoa(ep.Nodes),
+			strings.Join(heads, " "),
+		}
+		if err := cw.Write(rec); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,204 @@
+// Package priors reads and writes prior packs: compact summaries of the
+// per-prefix statistics a search learned, which another machine can load so
+// its search starts from that knowledge instead of from scratch. Packs age:
+// the evidence they carry is discounted by their age before use.
+package priors
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/bandit"
+)
+
+// CurrentVersion is the current pack format version.
+const CurrentVersion = 1
+
+// DefaultHalfLife is how long it takes a pack to lose half its weight.
+const DefaultHalfLife = 7 * 24 * time.Hour
+
+// MaxWeight caps the pseudo-observations a pack gives one arm, so priors
+// steer the start of a search without outvoting what it measures.
+const MaxWeight = 20.0
+
+// Pack is a set of priors, as of Created.
+type Pack struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Priors  []Prior   `json:"priors"`
+}
+
+// Prior is the evidence about one prefix. Counts are fractional once a
+// pack has been decayed.
+type Prior struct {
+	Prefix    netip.Prefix `json:"prefix"`
+	Successes float64      `json:"successes"`
+	Failures  float64      `json:"failures"`
+	MeanMS    float64      `json:"mean_ms,omitempty"`
+	VarMS     float64      `json:"var_ms,omitempty"`
+}
+
+// FromTree builds a pack from a tree snapshot (see engine.TreeDump). Each
+// node contributes the probes credited to it directly, so the priors are
+// disjoint observations even though nodes nest. Nodes with fewer than
+// minSamples samples are left out.
+func FromTree(roots []bandit.NodeSnapshot, minSamples int, created time.Time) Pack {
+	p := Pack{Version: CurrentVersion, Created: created}
+	var walk func(n bandit.NodeSnapshot)
+	walk = func(n bandit.NodeSnapshot) {
+		if n.Samples > 0 && n.Samples >= minSamples {
+			p.Priors = append(p.Priors, Prior{
+				Prefix:    n.Prefix,
+				Successes: float64(n.Successes),
+				Failures:  float64(n.Failures),
+				MeanMS:    n.MeanLatency,
+				VarMS:     n.VarLatency,
+			})
+		}
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	for _, r := range roots {
+		walk(r)
+	}
+	p.sort()
+	return p
+}
+
+func (p *Pack) sort() {
+	sort.Slice(p.Priors, func(i, j int) bool {
+		a, b := p.Priors[i].Prefix, p.Priors[j].Prefix
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c < 0
+		}
+		return a.Bits() < b.Bits()
+	})
+}
+
+// Decayed returns the pack aged to now: every count is scaled by
+// 0.5^(age/halfLife) (DefaultHalfLife if halfLife <= 0) and Created is set
+// to now.
+func (p Pack) Decayed(now time.Time, halfLife time.Duration) Pack {
+	if halfLife <= 0 {
+		halfLife = DefaultHalfLife
+	}
+	factor := 1.0
+	if age := now.Sub(p.Created); age > 0 {
+		factor = math.Pow(0.5, age.Hours()/halfLife.Hours())
+	}
+	out := Pack{Version: CurrentVersion, Created: now, Priors: make([]Prior, len(p.Priors))}
+	for i, pr := range p.Priors {
+		pr.Successes *= factor
+		pr.Failures *= factor
+		out.Priors[i] = pr
+	}
+	return out
+}
+
+// Merge combines packs of the same age (see Decayed) into one, pooling the
+// priors of prefixes that appear in several.
+func Merge(created time.Time, packs ...Pack) Pack {
+	byPrefix := make(map[netip.Prefix]*pool)
+	for _, p := range packs {
+		for _, pr := range p.Priors {
+			pl := byPrefix[pr.Prefix]
+			if pl == nil {
+				pl = &pool{}
+				byPrefix[pr.Prefix] = pl
+			}
+			pl.add(pr)
+		}
+	}
+	out := Pack{Version: CurrentVersion, Created: created}
+	for prefix, pl := range byPrefix {
+		pr := pl.prior()
+		pr.Prefix = prefix
+		out.Priors = append(out.Priors, pr)
+	}
+	out.sort()
+	return out
+}
+
+// Lookup pools the priors of every prefix within p into one prior for p,
+// scaled down to at most MaxWeight observations. ok is false if the pack
+// knows nothing about p.
+func (pk *Pack) Lookup(p netip.Prefix) (pr Prior, ok bool) {
+	var pl pool
+	for _, x := range pk.Priors {
+		if x.Prefix.Bits() >= p.Bits() && p.Contains(x.Prefix.Addr()) {
+			pl.add(x)
+		}
+	}
+	if pl.successes+pl.failures <= 0 {
+		return Prior{}, false
+	}
+	pr = pl.prior()
+	pr.Prefix = p
+	if n := pr.Successes + pr.Failures; n > MaxWeight {
+		pr.Successes *= MaxWeight / n
+		pr.Failures *= MaxWeight / n
+	}
+	return pr, true
+}
+
+// pool accumulates priors, combining their latency means and variances.
+type pool struct {
+	successes, failures float64
+	sum, sumSq          float64 // success-weighted sums of mean and E[x^2]
+}
+
+func (pl *pool) add(pr Prior) {
+	pl.successes += pr.Successes
+	pl.failures += pr.Failures
+	pl.sum += pr.Successes * pr.MeanMS
+	pl.sumSq += pr.Successes * (pr.VarMS + pr.MeanMS*pr.MeanMS)
+}
+
+func (pl *pool) prior() Prior {
+	pr := Prior{Successes: pl.successes, Failures: pl.failures}
+	if pl.successes > 0 {
+		pr.MeanMS = pl.sum / pl.successes
+		pr.VarMS = max(0, pl.sumSq/pl.successes-pr.MeanMS*pr.MeanMS)
+	}
+	return pr
+}
+
+// Load reads a pack file.
+func Load(path string) (Pack, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Pack{}, err
+	}
+	p, err := Decode(data)
+	if err != nil {
+		return Pack{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+// Decode parses a pack in the format Save writes.
+func Decode(data []byte) (Pack, error) {
+	var p Pack
+	if err := json.Unmarshal(data, &p); err != nil {
+		return Pack{}, err
+	}
+	if p.Version != CurrentVersion {
+		return Pack{}, fmt.Errorf("unsupported prior pack version %d", p.Version)
+	}
+	return p, nil
+}
+
+// Save writes a pack file as compact JSON.
+func (p Pack) Save(path string) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,43 @@
+package probe
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Cache statuses of a response (see Result.CacheStatus).
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+// cacheStatus tells from the response headers whether the edge served it
+// from its cache: Cloudflare's cf-cache-status first, then the X-Cache
+// header other CDNs set, then a non-zero Age. Empty when none is present.
+func cacheStatus(h http.Header) string {
+	switch strings.ToUpper(strings.TrimSpace(h.Get("cf-cache-status"))) {
+	case "HIT", "STALE", "UPDATING", "REVALIDATED":
+		return CacheHit
+	case "MISS", "EXPIRED", "BYPASS", "DYNAMIC":
+		return CacheMiss
+	}
+	if x := strings.ToLower(h.Get("X-Cache")); x != "" {
+		// e.g. "Hit from cloudfront", or "MISS, HIT" behind a shield,
+		// where the last entry is the edge that answered.
+		if i := strings.LastIndexByte(x, ','); i >= 0 {
+			x = x[i+1:]
+		}
+		x = strings.TrimSpace(x)
+		switch {
+		case strings.HasPrefix(x, "hit"):
+			return CacheHit
+		case strings.HasPrefix(x, "miss"):
+			return CacheMiss
+		}
+	}
+	if age, err := strconv.Atoi(strings.TrimSpace(h.Get("Age"))); err == nil && age > 0 {
+		return CacheHit
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/netguard"
+)
+
+// OCSP staple states reported by CheckCert.
+const (
+	OCSPGood    = "good"
+	OCSPRevoked = "revoked"
+	OCSPUnknown = "unknown"
+	OCSPInvalid = "invalid"
+)
+
+// CertResult describes the certificate chain an IP serves for an SNI.
+type CertResult struct {
+	// OK is set when the chain verifies against the system roots for the
+	// SNI and no stapled OCSP response marks the leaf revoked.
+	OK    bool
+	Error string
+
+	// NotAfter is the leaf certificate's expiry.
+	NotAfter time.Time
+
+	// OCSP is the status of the stapled OCSP response (OCSPGood, ...),
+	// empty when the server staples none.
+	OCSP string
+}
+
+// CheckCert completes a TLS handshake with ip:443 for sni without failing on
+// certificate errors, then verifies the served chain against the system
+// roots and checks any stapled OCSP response, so a broken, self-signed or
+// revoked chain is reported instead of just failing the connection.
+func CheckCert(ctx context.Context, ip netip.Addr, sni string, timeout time.Duration) CertResult {
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	d := tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: timeout, Control: netguard.Control},
+		Config: &tls.Config{
+			ServerName: sni,
+			// Verified below, so the error can be reported rather than
+			// aborting the handshake.
+			InsecureSkipVerify: true,
+		},
+	}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), "443"))
+	if err != nil {
+		return CertResult{Error: err.Error()}
+	}
+	state := conn.(*tls.Conn).ConnectionState()
+	_ = conn.Close()
+
+	if len(state.PeerCertificates) == 0 {
+		return CertResult{Error: "no certificate"}
+	}
+	leaf := state.PeerCertificates[0]
+	res := CertResult{NotAfter: leaf.NotAfter}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range state.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       sni,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.OK = true
+
+	if len(state.OCSPResponse) > 0 {
+		res.OCSP = ocspStatus(state.OCSPResponse, leaf, chains)
+		if res.OCSP == OCSPRevoked {
+			res.OK = false
+			res.Error = "certificate revoked (stapled OCSP response)"
+		}
+	}
+	return res
+}
+
+// ocspStatus parses a stapled OCSP response for leaf, whose issuer is the
+// second certificate of the verified chain.
+func ocspStatus(raw []byte, leaf *x509.Certificate, chains [][]*x509.Certificate) string {
+	var issuer *x509.Certificate
+	if len(chains) > 0 && len(chains[0]) > 1 {
+		issuer = chains[0][1]
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		var rerr ocsp.ResponseError
+		if errors.As(err, &rerr) {
+			return OCSPUnknown
+		}
+		return OCSPInvalid
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return OCSPGood
+	case ocsp.Revoked:
+		return OCSPRevoked
+	default:
+		return OCSPUnknown
+	}
+}
@@ -2,14 +2,14 @@ package probe
 
 import (
 	"context"
-	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"net/netip"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -20,6 +20,16 @@ type DownloadConfig struct {
 	SNI      string
 	HostName string
 	Path     string
+
+	// TLSFingerprint selects a browser ClientHello (see Config.TLSFingerprint).
+	TLSFingerprint string
+
+	// RootCAs and InsecureSkipVerify control server verification, and
+	// UseEnvProxy proxy use and Dial the connections, as in Config.
+	RootCAs            *x509.CertPool
+	InsecureSkipVerify bool
+	UseEnvProxy        bool
+	Dial               DialFunc
 }
 
 type DownloadResult struct {
@@ -31,11 +41,27 @@ type DownloadResult struct {
 	TotalMS int64      `json:"total_ms"`
 	Mbps    float64    `json:"mbps"`
 	When    time.Time  `json:"when"`
+
+	RateLimited bool          `json:"rate_limited,omitempty"`
+	RetryAfter  time.Duration `json:"retry_after,omitempty"`
+
+	// TLSUnverified is set when the server certificate was not verified
+	// (DownloadConfig.InsecureSkipVerify).
+	TLSUnverified bool `json:"tls_unverified,omitempty"`
+
+	// Attempts is the number of tests the result is the best of, set by
+	// callers that retry (0 when not tracked).
+	Attempts int `json:"attempts,omitempty"`
 }
 
+// DownloadProber runs download tests. Each IP gets its own client, kept for
+// the life of the prober, so repeated tests of an IP reuse its warm
+// connections instead of paying for new TCP and TLS handshakes.
 type DownloadProber struct {
-	cfg    DownloadConfig
-	client *http.Client
+	cfg DownloadConfig
+
+	mu      sync.Mutex
+	clients map[netip.Addr]*http.Client
 }
 
 func NewDownloadProber(cfg DownloadConfig) *DownloadProber {
@@ -55,38 +81,72 @@ func NewDownloadProber(cfg DownloadConfig) *DownloadProber {
 		cfg.Path = "/__down"
 	}
 
-	transport := &http.Transport{
-		Proxy: nil, // critical: ignore HTTP(S)_PROXY and NO_PROXY env vars
-		DialContext: (&net.Dialer{
-			Timeout:   cfg.Timeout,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          64,
-		MaxIdleConnsPerHost:   8,
-		IdleConnTimeout:       30 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ResponseHeaderTimeout: 20 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		TLSClientConfig: &tls.Config{
-			ServerName: cfg.SNI,
-		},
+	return &DownloadProber{
+		cfg:     cfg,
+		clients: make(map[netip.Addr]*http.Client),
 	}
+}
 
-	return &DownloadProber{
-		cfg: cfg,
-		client: &http.Client{
-			Transport: transport,
-			Timeout:   cfg.Timeout,
-		},
+// client returns the client for ip, creating it on first use.
+func (p *DownloadProber) client(ip netip.Addr) *http.Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.clients[ip]; ok {
+		return c
+	}
+
+	transport := newTransport(transportConfig{
+		Timeout:        p.cfg.Timeout,
+		SNI:            p.cfg.SNI,
+		TLSFingerprint: p.cfg.TLSFingerprint,
+
+		RootCAs:            p.cfg.RootCAs,
+		InsecureSkipVerify: p.cfg.InsecureSkipVerify,
+
+		UseEnvProxy: p.cfg.UseEnvProxy,
+		Dial:        p.cfg.Dial,
+
+		MaxIdleConns:        8,
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     90 * time.Second,
+	})
+
+	c := &http.Client{
+		Transport:     transport,
+		Timeout:       p.cfg.Timeout,
+		CheckRedirect: redirectPolicy(maxRedirects),
+	}
+	p.clients[ip] = c
+	return c
+}
+
+// Close closes the idle connections of every client. The prober remains
+// usable; later tests simply dial again.
+func (p *DownloadProber) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for ip, c := range p.clients {
+		c.CloseIdleConnections()
+		delete(p.clients, ip)
 	}
 }
 
+// Timeout returns the per-test timeout.
+func (p *DownloadProber) Timeout() time.Duration {
+	return p.cfg.Timeout
+}
+
+// Bytes returns the number of bytes each download test requests.
+func (p *DownloadProber) Bytes() int64 {
+	return p.cfg.Bytes
+}
+
 func (p *DownloadProber) Download(ctx context.Context, ip netip.Addr) DownloadResult {
 	start := time.Now()
 	out := DownloadResult{
-		IP:   ip,
-		When: start,
+		IP:            ip,
+		When:          start,
+		TLSUnverified: p.cfg.InsecureSkipVerify,
 	}
 
 	host := ip.String()
@@ -97,7 +157,7 @@ func (p *DownloadProber) Download(ctx context.Context, ip netip.Addr) DownloadRe
 	// https://speed.cloudflare.com/__down?bytes=50000000
 	url := "https://" + host + p.cfg.Path + "?bytes=" + strconv.FormatInt(p.cfg.Bytes, 10)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(withPin(ctx, ip), http.MethodGet, url, nil)
 	if err != nil {
 		out.Error = err.Error()
 		out.TotalMS = time.Since(start).Milliseconds()
@@ -107,7 +167,7 @@ func (p *DownloadProber) Download(ctx context.Context, ip netip.Addr) DownloadRe
 	req.Header.Set("User-Agent", "mcis/0.1")
 	req.Header.Set("Accept", "application/octet-stream")
 
-	resp, err := p.client.Do(req)
+	resp, err := p.client(ip).Do(req)
 	if err != nil {
 		if errors.Is(err, context.DeadlineExceeded) {
 			out.Error = "timeout"
@@ -121,6 +181,14 @@ func (p *DownloadProber) Download(ctx context.Context, ip netip.Addr) DownloadRe
 
 	out.Status = resp.StatusCode
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4*1024))
+		if limited, retryAfter := detectRateLimit(resp, body); limited {
+			out.RateLimited = true
+			out.RetryAfter = retryAfter
+			out.Error = ErrRateLimited
+			out.TotalMS = time.Since(start).Milliseconds()
+			return out
+		}
 		out.Error = fmt.Sprintf("http_status_%d", resp.StatusCode)
 		out.TotalMS = time.Since(start).Milliseconds()
 		return out
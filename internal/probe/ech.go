@@ -0,0 +1,103 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/netguard"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/resolver"
+)
+
+// svcParamECH is the SvcParamKey for the ECHConfigList (RFC 9460 / 9848).
+const svcParamECH = 5
+
+// typeHTTPS is the DNS HTTPS resource record type.
+const typeHTTPS dnsmessage.Type = 65
+
+// ErrNoECHConfig is returned when the host publishes no ECH configuration.
+var ErrNoECHConfig = errors.New("no ECH config in HTTPS record")
+
+// LookupECHConfig fetches the ECHConfigList published in host's HTTPS record
+// through r.
+func LookupECHConfig(ctx context.Context, host string, r *resolver.Resolver) ([]byte, error) {
+	msg, err := r.Query(ctx, host, typeHTTPS)
+	if err != nil {
+		return nil, err
+	}
+	for _, ans := range msg.Answers {
+		rr, ok := ans.Body.(*dnsmessage.UnknownResource)
+		if !ok || rr.Type != typeHTTPS {
+			continue
+		}
+		if ech := svcbParam(rr.Data, svcParamECH); ech != nil {
+			return ech, nil
+		}
+	}
+	return nil, ErrNoECHConfig
+}
+
+// svcbParam returns the value of SvcParam key in SVCB/HTTPS RDATA, or nil.
+func svcbParam(rdata []byte, key uint16) []byte {
+	// SvcPriority (2 bytes), then an uncompressed TargetName.
+	if len(rdata) < 3 {
+		return nil
+	}
+	i := 2
+	for i < len(rdata) {
+		l := int(rdata[i])
+		i++
+		if l == 0 {
+			break
+		}
+		i += l
+	}
+
+	for i+4 <= len(rdata) {
+		k := binary.BigEndian.Uint16(rdata[i:])
+		l := int(binary.BigEndian.Uint16(rdata[i+2:]))
+		i += 4
+		if i+l > len(rdata) {
+			return nil
+		}
+		if k == key {
+			return rdata[i : i+l]
+		}
+		i += l
+	}
+	return nil
+}
+
+// CheckECH attempts a TLS handshake with ip:443 using Encrypted ClientHello
+// for sni and reports whether the server accepted it.
+func CheckECH(ctx context.Context, ip netip.Addr, sni string, echConfig []byte, timeout time.Duration) (bool, error) {
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	d := tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: timeout, Control: netguard.Control},
+		Config: &tls.Config{
+			ServerName:                     sni,
+			EncryptedClientHelloConfigList: echConfig,
+			MinVersion:                     tls.VersionTLS13,
+		},
+	}
+
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), "443"))
+	if err != nil {
+		var rej *tls.ECHRejectionError
+		if errors.As(err, &rej) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	return conn.(*tls.Conn).ConnectionState().ECHAccepted, nil
+}
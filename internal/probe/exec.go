@@ -0,0 +1,210 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Placeholders expanded in the arguments of Config.Exec.
+const (
+	ExecIP      = "{ip}"
+	ExecTimeout = "{timeout_ms}"
+	ExecHost    = "{host}"
+)
+
+// maxExecOutput bounds how much of a plugin's stdout is read.
+const maxExecOutput = 64 * 1024
+
+// ExecResult is what an exec plugin prints on the last line of its stdout:
+//
+//	{"ok":true,"latency_ms":42.5}
+//	{"ok":false,"error":"no reply","hard_fail":true}
+//
+// LatencyMS is required when OK is set; it becomes the probe's total time
+// and is what the search optimizes. The other timings are informational.
+// Trace fields (e.g. "colo") feed the same filters as /cdn-cgi/trace.
+type ExecResult struct {
+	OK           bool              `json:"ok"`
+	LatencyMS    *float64          `json:"latency_ms"`
+	ConnectMS    float64           `json:"connect_ms,omitempty"`
+	TTFBMS       float64           `json:"ttfb_ms,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	HardFail     bool              `json:"hard_fail,omitempty"`
+	RateLimited  bool              `json:"rate_limited,omitempty"`
+	RetryAfterMS int64             `json:"retry_after_ms,omitempty"`
+	Trace        map[string]string `json:"trace,omitempty"`
+}
+
+// ParseExec splits a plugin command line into its arguments. Arguments are
+// separated by spaces; single quotes keep their content literally and
+// double quotes allow \" and \\ escapes. No shell is involved.
+func ParseExec(cmdline string) ([]string, error) {
+	var (
+		args  []string
+		cur   strings.Builder
+		inArg bool
+		quote rune
+	)
+	rs := []rune(cmdline)
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case quote == '"':
+			switch {
+			case r == '"':
+				quote = 0
+			case r == '\\' && i+1 < len(rs) && (rs[i+1] == '"' || rs[i+1] == '\\'):
+				i++
+				cur.WriteRune(rs[i])
+			default:
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, cmdline)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
+
+// probeExec runs the plugin in Config.Exec for ip and converts its JSON
+// answer into a Result. The plugin is killed after Config.Timeout.
+func (p *Prober) probeExec(ctx context.Context, ip netip.Addr) Result {
+	start := time.Now()
+	res := Result{IP: ip, When: start}
+
+	host := p.cfg.HostHeader
+	if host == "" {
+		host = p.cfg.SNI
+	}
+	timeoutMS := strconv.FormatInt(p.cfg.Timeout.Milliseconds(), 10)
+	expand := strings.NewReplacer(ExecIP, ip.String(), ExecTimeout, timeoutMS, ExecHost, host)
+	args := make([]string, len(p.cfg.Exec))
+	for i, a := range p.cfg.Exec {
+		args[i] = expand.Replace(a)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "MCIS_IP="+ip.String(), "MCIS_TIMEOUT_MS="+timeoutMS, "MCIS_HOST="+host)
+	cmd.WaitDelay = time.Second
+	var stdout, stderr limitedBuffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	runErr := cmd.Run()
+	res.TotalMS = time.Since(start).Milliseconds()
+
+	if ctx.Err() != nil {
+		res.Error = "timeout"
+		return res
+	}
+	out, parseErr := parseExecOutput(stdout.Bytes())
+	if parseErr != nil {
+		switch {
+		case runErr != nil:
+			res.Error = "exec: " + runErr.Error()
+			if msg := firstLine(stderr.Bytes()); msg != "" {
+				res.Error += ": " + msg
+			}
+		default:
+			res.Error = "exec: " + parseErr.Error()
+		}
+		return res
+	}
+
+	res.Body = stdout.String()
+	res.Error = out.Error
+	res.HardFail = out.HardFail
+	res.ConnectMS = int64(out.ConnectMS)
+	res.TTFBMS = int64(out.TTFBMS)
+	if out.Trace != nil {
+		res.Trace = out.Trace
+		res.TraceInfo = NewTraceInfo(out.Trace)
+	}
+	switch {
+	case out.RateLimited:
+		res.RateLimited = true
+		res.RetryAfter = time.Duration(out.RetryAfterMS) * time.Millisecond
+		res.Error = ErrRateLimited
+	case !out.OK:
+		if res.Error == "" {
+			res.Error = "exec: not ok"
+		}
+	case runErr != nil:
+		res.Error = "exec: " + runErr.Error()
+	case out.LatencyMS == nil || *out.LatencyMS < 0:
+		res.Error = "exec: ok result without latency_ms"
+	default:
+		res.OK = true
+		res.TotalMS = int64(*out.LatencyMS)
+	}
+	return res
+}
+
+// parseExecOutput decodes the last non-empty line of a plugin's stdout, so
+// plugins may log progress on the lines before it.
+func parseExecOutput(b []byte) (ExecResult, error) {
+	b = bytes.TrimSpace(b)
+	if i := bytes.LastIndexByte(b, '\n'); i >= 0 {
+		b = bytes.TrimSpace(b[i+1:])
+	}
+	var out ExecResult
+	if len(b) == 0 {
+		return out, errors.New("no output")
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return out, fmt.Errorf("invalid result %q: %w", firstLine(b), err)
+	}
+	return out, nil
+}
+
+func firstLine(b []byte) string {
+	line, _, _ := bytes.Cut(bytes.TrimSpace(b), []byte("\n"))
+	if len(line) > 200 {
+		line = line[:200]
+	}
+	return string(line)
+}
+
+// limitedBuffer keeps the first maxExecOutput bytes written to it and
+// discards the rest, so a chatty plugin cannot exhaust memory.
+type limitedBuffer struct{ bytes.Buffer }
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := maxExecOutput - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
@@ -0,0 +1,118 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// The bandwidth hint is a rough downstream throughput estimate taken from
+// an ordinary probe, for runs that skip the download tests. The server's
+// handshake flight (certificate chain and all) is sent back to back, and
+// the bottleneck link spreads its segments out in time: the bytes read
+// after the first read of that burst, divided by the time until its last
+// read, approximate the link rate (packet dispersion). Reads the kernel
+// coalesced shorten the burst, so hints are only given for bursts of at
+// least minHintBytes over minHintSpan, and remain estimates.
+const (
+	minHintBytes = 1500
+	minHintSpan  = 500 * time.Microsecond
+)
+
+type pacingKey struct{}
+
+// pacing records the read bursts of a connection until stop is called.
+// Reads more than gap apart (half the connect RTT) start a new burst, so
+// the round trips of the handshake do not count as transfer time.
+type pacing struct {
+	mu   sync.Mutex
+	gap  time.Duration
+	done bool
+
+	start, last time.Time
+	bytes       int
+
+	bestBytes int
+	bestSpan  time.Duration
+}
+
+// withPacing returns a context whose new probe connections are recorded
+// by the returned pacing.
+func withPacing(ctx context.Context) (context.Context, *pacing) {
+	p := &pacing{}
+	return context.WithValue(ctx, pacingKey{}, p), p
+}
+
+// paced wraps conn to record its reads when ctx carries a pacing.
+func paced(ctx context.Context, conn net.Conn) net.Conn {
+	p, ok := ctx.Value(pacingKey{}).(*pacing)
+	if !ok {
+		return conn
+	}
+	return &pacedConn{Conn: conn, p: p}
+}
+
+type pacedConn struct {
+	net.Conn
+	p *pacing
+}
+
+func (c *pacedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.p.read(n, time.Now())
+	}
+	return n, err
+}
+
+// setRTT sets the burst gap from the connect time.
+func (p *pacing) setRTT(rtt time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gap = rtt / 2
+}
+
+func (p *pacing) read(n int, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return
+	}
+	if p.start.IsZero() || (p.gap > 0 && now.Sub(p.last) > p.gap) {
+		p.endBurst()
+		// The first read only marks the start; its bytes arrived before it.
+		p.start, p.bytes = now, 0
+	} else {
+		p.bytes += n
+	}
+	p.last = now
+}
+
+func (p *pacing) endBurst() {
+	if p.bytes > p.bestBytes {
+		p.bestBytes, p.bestSpan = p.bytes, p.last.Sub(p.start)
+	}
+}
+
+// stop ends the recording (at the end of the TLS handshake).
+func (p *pacing) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.done {
+		p.endBurst()
+		p.done = true
+	}
+}
+
+// mbps returns the bandwidth hint of the largest burst, or 0 when it was
+// too small or too short to say anything.
+func (p *pacing) mbps() float64 {
+	p.stop()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bestBytes < minHintBytes || p.bestSpan < minHintSpan {
+		return 0
+	}
+	return float64(p.bestBytes) * 8 / p.bestSpan.Seconds() / 1e6
+}
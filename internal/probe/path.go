@@ -0,0 +1,37 @@
+package probe
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// RandToken is replaced in a probe path by a fresh random token on every
+// probe, e.g. "/cdn-cgi/trace?r={rand}", so no two probes hit the same URL.
+const RandToken = "{rand}"
+
+// normalizePath ensures p starts with a slash.
+func normalizePath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return "/" + p
+	}
+	return p
+}
+
+// nextPath returns the path for the next probe: the configured paths are
+// rotated round-robin and RandToken is expanded.
+func (p *Prober) nextPath() string {
+	path := p.cfg.Path
+	if n := len(p.cfg.Paths); n > 0 {
+		path = p.cfg.Paths[(p.pathSeq.Add(1)-1)%uint64(n)]
+	}
+	return expandPath(path)
+}
+
+// expandPath replaces every RandToken in path with a random hex token.
+func expandPath(path string) string {
+	for strings.Contains(path, RandToken) {
+		path = strings.Replace(path, RandToken, strconv.FormatUint(rand.Uint64(), 16), 1)
+	}
+	return path
+}
@@ -0,0 +1,91 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// ErrNotCandidate is returned for a connection to anything but the IP
+// being probed.
+var ErrNotCandidate = errors.New("refused to dial: not the candidate IP")
+
+// maxRedirects is the most redirects a download test follows (net/http's
+// own limit).
+const maxRedirects = 10
+
+type pinKey struct{}
+
+// withPin returns a context whose connections may only go to ip.
+func withPin(ctx context.Context, ip netip.Addr) context.Context {
+	return context.WithValue(ctx, pinKey{}, ip.Unmap())
+}
+
+// pinned wraps dial so it only ever connects to an IP literal, and only to
+// the IP pinned in the context when there is one. Probes and download
+// tests therefore never resolve a name, and nothing a server sends back
+// (a redirect, an Alt-Svc header) can make them measure another host.
+// net/http does not act on Alt-Svc or upgrade to HTTP/3 itself; this
+// keeps it that way for any future transport too.
+func pinned(dial DialFunc) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ap, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrNotCandidate, addr)
+		}
+		if ip, ok := ctx.Value(pinKey{}).(netip.Addr); ok && ap.Addr().Unmap() != ip {
+			return nil, fmt.Errorf("%w: %s", ErrNotCandidate, addr)
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// RedirectHop is one redirect followed by a probe.
+type RedirectHop struct {
+	Status   int    `json:"status"`
+	Location string `json:"location"`
+	// MS is the time from the request of the hop to its redirect response.
+	MS int64 `json:"ms"`
+}
+
+type redirectsKey struct{}
+
+// redirectLog records the redirects a request follows.
+type redirectLog struct {
+	last time.Time
+	hops []RedirectHop
+}
+
+// withRedirectLog returns a context whose requests, started at start,
+// record their redirects in the returned log.
+func withRedirectLog(ctx context.Context, start time.Time) (context.Context, *redirectLog) {
+	l := &redirectLog{last: start}
+	return context.WithValue(ctx, redirectsKey{}, l), l
+}
+
+// redirectPolicy returns the CheckRedirect of a prober client, following
+// up to maxHops redirects (none for 0). Redirects are only ever followed
+// on the candidate itself: one to another host, or past maxHops, ends the
+// request with the redirect response, which then fails the probe as a
+// non-2xx status.
+func redirectPolicy(maxHops int) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > maxHops || req.URL.Host != via[0].URL.Host {
+			return http.ErrUseLastResponse
+		}
+		if l, ok := req.Context().Value(redirectsKey{}).(*redirectLog); ok {
+			now := time.Now()
+			hop := RedirectHop{Location: req.URL.String(), MS: now.Sub(l.last).Milliseconds()}
+			if req.Response != nil {
+				hop.Status = req.Response.StatusCode
+			}
+			l.hops = append(l.hops, hop)
+			l.last = now
+		}
+		return nil
+	}
+}
@@ -0,0 +1,138 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is the normalized error string for rate-limited responses.
+const ErrRateLimited = "rate_limited"
+
+// detectRateLimit reports whether resp is a provider rate-limit response and,
+// if so, how long the provider asked us to wait (0 if it didn't say).
+//
+// 429 is always a rate limit. 403 only counts when it carries rate-limit
+// headers or a Cloudflare 1015 ("You are being rate limited") body, since a
+// plain 403 is a legitimate per-IP failure.
+func detectRateLimit(resp *http.Response, body []byte) (bool, time.Duration) {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+	case http.StatusForbidden:
+		if !hasRateLimitHeaders(resp.Header) && !isCloudflare1015(body) {
+			return false, 0
+		}
+	default:
+		return false, 0
+	}
+	return true, parseRetryAfter(resp.Header.Get("Retry-After"))
+}
+
+func hasRateLimitHeaders(h http.Header) bool {
+	if h.Get("Retry-After") != "" {
+		return true
+	}
+	for _, k := range []string{"X-RateLimit-Remaining", "RateLimit-Remaining"} {
+		if v := strings.TrimSpace(h.Get(k)); v == "0" {
+			return true
+		}
+	}
+	return false
+}
+
+func isCloudflare1015(body []byte) bool {
+	return bytes.Contains(body, []byte("error code: 1015")) ||
+		bytes.Contains(body, []byte("Error 1015"))
+}
+
+// parseRetryAfter parses a Retry-After header (delta-seconds or HTTP-date).
+func parseRetryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// Backoff is a global pause shared by all probers once a provider starts
+// rate limiting. Consecutive hits double the pause up to a cap; any
+// non-rate-limited response resets it.
+type Backoff struct {
+	mu    sync.Mutex
+	until time.Time
+	delay time.Duration
+}
+
+const (
+	backoffInitial = time.Second
+	backoffMax     = 60 * time.Second
+)
+
+// Trigger starts (or extends) the pause and returns its length. A provider
+// supplied Retry-After takes precedence over the exponential delay. Rate
+// limits that arrive during a pause come from probes sent before it and
+// do not double the delay again.
+func (b *Backoff) Trigger(retryAfter time.Duration) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.delay == 0:
+		b.delay = backoffInitial
+	case time.Now().After(b.until):
+		b.delay *= 2
+	}
+	if b.delay > backoffMax {
+		b.delay = backoffMax
+	}
+
+	d := b.delay
+	if retryAfter > d {
+		d = retryAfter
+	}
+	if until := time.Now().Add(d); until.After(b.until) {
+		b.until = until
+	}
+	return d
+}
+
+// Reset clears the exponential delay after a non-rate-limited response.
+func (b *Backoff) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.delay = 0
+}
+
+// Wait blocks until the current pause (if any) is over or ctx is done.
+func (b *Backoff) Wait(ctx context.Context) error {
+	b.mu.Lock()
+	d := time.Until(b.until)
+	b.mu.Unlock()
+
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,32 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/netguard"
+)
+
+// DialRTT measures the TCP handshake time (SYN -> SYN/ACK) to ip:port.
+// The connection is closed immediately after it is established.
+func DialRTT(ctx context.Context, ip netip.Addr, port int, timeout time.Duration) (time.Duration, error) {
+	if port <= 0 {
+		port = 443
+	}
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+
+	d := net.Dialer{Timeout: timeout, Control: netguard.Control}
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	_ = conn.Close()
+	return rtt, nil
+}
@@ -0,0 +1,84 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http/httptrace"
+)
+
+// SessionCache keeps TLS session tickets per destination IP, so re-probing
+// an IP resumes its earlier session instead of doing a full handshake.
+// crypto/tls keys sessions by server name only, which would hand one IP's
+// ticket to every other IP behind the same SNI.
+type SessionCache struct {
+	cache tls.ClientSessionCache
+}
+
+// NewSessionCache creates a session cache holding up to capacity sessions
+// (0 = crypto/tls default).
+func NewSessionCache(capacity int) *SessionCache {
+	return &SessionCache{cache: tls.NewLRUClientSessionCache(capacity)}
+}
+
+// forIP returns a view of the cache scoped to ip.
+func (c *SessionCache) forIP(ip string) tls.ClientSessionCache {
+	return ipSessionCache{shared: c.cache, ip: ip}
+}
+
+type ipSessionCache struct {
+	shared tls.ClientSessionCache
+	ip     string
+}
+
+func (c ipSessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	return c.shared.Get(c.ip + "|" + key)
+}
+
+func (c ipSessionCache) Put(key string, cs *tls.ClientSessionState) {
+	c.shared.Put(c.ip+"|"+key, cs)
+}
+
+// sessionDialer returns a TLS dialer for http.Transport that resumes
+// sessions from sessions per destination IP, over connections from dial.
+// Like the uTLS dialer it reports connect and handshake trace events itself.
+func sessionDialer(base *tls.Config, sessions *SessionCache, dial DialFunc) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		trace := httptrace.ContextClientTrace(ctx)
+
+		if trace != nil && trace.ConnectStart != nil {
+			trace.ConnectStart(network, addr)
+		}
+		conn, err := dial(ctx, network, addr)
+		if trace != nil && trace.ConnectDone != nil {
+			trace.ConnectDone(network, addr, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		conn = paced(ctx, conn)
+
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		cfg := base.Clone()
+		cfg.ClientSessionCache = sessions.forIP(host)
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+
+		if trace != nil && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+		tconn := tls.Client(conn, cfg)
+		err = tconn.HandshakeContext(ctx)
+		if trace != nil && trace.TLSHandshakeDone != nil {
+			trace.TLSHandshakeDone(tconn.ConnectionState(), err)
+		}
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return tconn, nil
+	}
+}
@@ -0,0 +1,139 @@
+package probe
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// Ways of combining per-target timings into one result (Config.TargetScore).
+const (
+	TargetScoreWorst = "worst"
+	TargetScoreAvg   = "avg"
+)
+
+// Target is one service an IP has to serve: the TLS SNI, HTTP Host header
+// and path of its probe request.
+type Target struct {
+	SNI        string
+	HostHeader string
+	Path       string
+}
+
+// ParseTarget parses a target given as "[sni@]host[/path]", e.g.
+// "www.example.com", "api.example.com/health" or
+// "front.example.com@back.example.com/cdn-cgi/trace". Without "sni@" the
+// host is used as SNI too; the path defaults to /cdn-cgi/trace.
+func ParseTarget(s string) (Target, error) {
+	s = strings.TrimSpace(s)
+	hostPart, path, hasPath := strings.Cut(s, "/")
+	sni, host, hasSNI := strings.Cut(hostPart, "@")
+	if !hasSNI {
+		host = sni
+	}
+	if host == "" || sni == "" {
+		return Target{}, fmt.Errorf("invalid target %q: want [sni@]host[/path]", s)
+	}
+	t := Target{SNI: sni, HostHeader: host, Path: "/cdn-cgi/trace"}
+	if hasPath {
+		t.Path = "/" + path
+	}
+	return t, nil
+}
+
+// String formats t the way ParseTarget reads it.
+func (t Target) String() string {
+	s := t.HostHeader + t.Path
+	if t.SNI != t.HostHeader {
+		s = t.SNI + "@" + s
+	}
+	return s
+}
+
+// TargetResult is the outcome of probing one target (see Config.Targets).
+type TargetResult struct {
+	Target  string `json:"target"`
+	OK      bool   `json:"ok"`
+	Status  int    `json:"status"`
+	Error   string `json:"error,omitempty"`
+	TotalMS int64  `json:"total_ms"`
+}
+
+// newTargetProbers creates one prober per target, sharing everything but
+// the request identity with cfg.
+func newTargetProbers(cfg Config) []*Prober {
+	probers := make([]*Prober, len(cfg.Targets))
+	for i, t := range cfg.Targets {
+		c := cfg
+		c.Targets = nil
+		c.SNI, c.HostHeader, c.Path, c.Paths = t.SNI, t.HostHeader, t.Path, nil
+		probers[i] = NewProber(c)
+	}
+	return probers
+}
+
+// probeTargets probes ip against every target in parallel and folds the
+// results into one: the IP is OK only if every target is, and its timings
+// are the worst or the average over the targets (Config.TargetScore).
+func (p *Prober) probeTargets(ctx context.Context, ip netip.Addr, port uint16) Result {
+	results := make([]Result, len(p.targets))
+	var wg sync.WaitGroup
+	for i, tp := range p.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = tp.ProbeAt(ctx, ip, port)
+		}()
+	}
+	wg.Wait()
+
+	// The first target carries the trace, body and TLS details.
+	res := results[0]
+	res.Targets = make([]TargetResult, len(results))
+	if !res.OK {
+		res.Error = p.cfg.Targets[0].String() + ": " + res.Error
+	}
+	for i, r := range results {
+		name := p.cfg.Targets[i].String()
+		res.Targets[i] = TargetResult{Target: name, OK: r.OK, Status: r.Status, Error: r.Error, TotalMS: r.TotalMS}
+		if i == 0 || r.OK {
+			continue
+		}
+		if res.OK || r.RateLimited {
+			// Report the first failing target, preferring a rate limit
+			// since it says nothing about the IP.
+			res.OK = false
+			res.Status = r.Status
+			res.Error = name + ": " + r.Error
+			res.HardFail = r.HardFail
+			res.RateLimited = r.RateLimited
+			res.RetryAfter = r.RetryAfter
+		}
+	}
+
+	combine := func(get func(Result) int64) int64 {
+		var worst, sum int64
+		for _, r := range results {
+			v := get(r)
+			worst = max(worst, v)
+			sum += v
+		}
+		if p.cfg.TargetScore == TargetScoreAvg {
+			return sum / int64(len(results))
+		}
+		return worst
+	}
+	for _, r := range results {
+		res.TLSResumed = res.TLSResumed && r.TLSResumed
+		res.WarmOK = res.WarmOK && r.WarmOK
+	}
+	res.ConnectMS = combine(func(r Result) int64 { return r.ConnectMS })
+	res.TLSMS = combine(func(r Result) int64 { return r.TLSMS })
+	res.TTFBMS = combine(func(r Result) int64 { return r.TTFBMS })
+	res.TotalMS = combine(func(r Result) int64 { return r.TotalMS })
+	res.WarmTTFBMS = combine(func(r Result) int64 { return r.WarmTTFBMS })
+	res.WarmTotalMS = combine(func(r Result) int64 { return r.WarmTotalMS })
+	return res
+}
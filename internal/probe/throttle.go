@@ -0,0 +1,87 @@
+package probe
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ProbeBytes is a rough estimate of the traffic of one trace probe (TCP and
+// TLS handshakes including the certificate chain, request and response). It
+// is what a probe is charged against a bandwidth ceiling.
+const ProbeBytes = 8 << 10
+
+// Throttle enforces average ceilings on the probe rate and on bandwidth, so
+// the tool can run on metered links. Work is paced rather than slowed down:
+// each caller waits for its turn before it starts, and nothing is throttled
+// mid-transfer, so measured latencies and download speeds are unaffected.
+// A nil Throttle, or one without limits, never waits.
+type Throttle struct {
+	mu           sync.Mutex
+	probesPerSec float64
+	bytesPerSec  float64
+	nextProbe    time.Time
+	nextBytes    time.Time
+}
+
+// SetLimits sets the probe rate and bandwidth ceilings (0 = unlimited).
+func (t *Throttle) SetLimits(probesPerSec, bytesPerSec float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.probesPerSec = probesPerSec
+	t.bytesPerSec = bytesPerSec
+}
+
+// WaitProbe waits until a probe may start, charging it ProbeBytes.
+func (t *Throttle) WaitProbe(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return sleepCtx(ctx, t.reserve(1, ProbeBytes))
+}
+
+// WaitBytes waits until a transfer of n bytes may start. Later work is held
+// back until the transfer has been paid for at the bandwidth ceiling.
+func (t *Throttle) WaitBytes(ctx context.Context, n int64) error {
+	if t == nil {
+		return nil
+	}
+	return sleepCtx(ctx, t.reserve(0, float64(n)))
+}
+
+// reserve books the next slot for the given work and returns how long the
+// caller has to wait for it.
+func (t *Throttle) reserve(probes, bytes float64) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	start := now
+	if probes > 0 && t.probesPerSec > 0 && t.nextProbe.After(start) {
+		start = t.nextProbe
+	}
+	if bytes > 0 && t.bytesPerSec > 0 && t.nextBytes.After(start) {
+		start = t.nextBytes
+	}
+	if probes > 0 && t.probesPerSec > 0 {
+		t.nextProbe = start.Add(time.Duration(probes / t.probesPerSec * float64(time.Second)))
+	}
+	if bytes > 0 && t.bytesPerSec > 0 {
+		t.nextBytes = start.Add(time.Duration(bytes / t.bytesPerSec * float64(time.Second)))
+	}
+	return start.Sub(now)
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -3,14 +3,18 @@ package probe
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"net/http/httptrace"
 	"net/netip"
+	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -19,6 +23,100 @@ type Config struct {
 	SNI        string
 	HostHeader string
 	Path       string
+
+	// Sessions, when set, caches TLS sessions per IP so later probes of
+	// the same IP resume instead of doing a full handshake. It is ignored
+	// with TLSFingerprint.
+	Sessions *SessionCache
+
+	// Warm sends a second request over the same connection after each
+	// successful probe and records its timings alongside the cold ones.
+	Warm bool
+
+	// Paths, when set, are rotated round-robin per probe instead of Path,
+	// so latency isn't measured against one cached hot URL. Paths may
+	// contain RandToken.
+	Paths []string
+
+	// Targets, when set, replace SNI, HostHeader and Path(s): every probe
+	// checks the IP against each target and only succeeds if all do.
+	// TargetScore (TargetScoreWorst, the default, or TargetScoreAvg)
+	// selects how the per-target timings are combined.
+	Targets     []Target
+	TargetScore string
+
+	// TLSFingerprint selects a browser ClientHello (see TLSFingerprints);
+	// empty uses Go's default TLS stack.
+	TLSFingerprint string
+
+	// ClientCert, if set, is presented to servers that request a client
+	// certificate (mutual TLS). See LoadClientCert.
+	ClientCert *tls.Certificate
+
+	// RootCAs, if set, replaces the system roots for verifying servers
+	// (see LoadCAFile). InsecureSkipVerify disables verification entirely;
+	// results then carry TLSUnverified.
+	RootCAs            *x509.CertPool
+	InsecureSkipVerify bool
+
+	// Exec, when set, replaces the HTTPS probe with an external plugin:
+	// the command (program and arguments, see ParseExec) is run once per
+	// probe with ExecIP etc. expanded, and answers with an ExecResult on
+	// stdout.
+	Exec []string
+
+	// UseEnvProxy routes probes through the proxy named by HTTP(S)_PROXY
+	// and NO_PROXY. Off by default: a proxy hides the edge being measured.
+	UseEnvProxy bool
+
+	// Dial, when set, opens the probe connections instead of a direct
+	// dialer, e.g. the fake edge of mcis selftest.
+	Dial DialFunc
+
+	// Dials, when set, counts the probe connections being dialed.
+	Dials *DialGauge
+
+	// WireGuard, when set, replaces the HTTPS probe with a WireGuard
+	// handshake (see WireGuardConfig).
+	WireGuard *WireGuardConfig
+
+	// MaxRedirects is how many redirects a probe follows, only ever on the
+	// candidate itself; 0 follows none, so a 30x response fails the probe
+	// with its Location recorded.
+	MaxRedirects int
+
+	// CaptureHeaders names the response headers kept in Result.Headers
+	// (case-insensitive), e.g. cf-ray, server or age.
+	CaptureHeaders []string
+}
+
+// LoadClientCert loads a PEM client certificate and its private key.
+func LoadClientCert(certFile, keyFile string) (*tls.Certificate, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("client certificate and key must be given together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load client certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// LoadCAFile returns the system roots plus the PEM certificates in path, for
+// endpoints signed by a private CA.
+func LoadCAFile(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return pool, nil
 }
 
 type Result struct {
@@ -32,11 +130,81 @@ type Result struct {
 	TotalMS   int64             `json:"total_ms"`
 	Trace     map[string]string `json:"trace,omitempty"`
 	When      time.Time         `json:"when"`
+
+	// TraceInfo holds the commonly used trace fields, parsed out of Trace.
+	TraceInfo
+
+	// TLSResumed is set when the handshake resumed an earlier session
+	// (see Config.Sessions), so TLSMS is a resumption time.
+	TLSResumed bool `json:"tls_resumed,omitempty"`
+
+	// TLSUnverified is set when the server certificate was not verified
+	// (Config.InsecureSkipVerify).
+	TLSUnverified bool `json:"tls_unverified,omitempty"`
+
+	// Path is the request path used for this probe.
+	Path string `json:"path,omitempty"`
+
+	// Port is the port probed when it was chosen per probe (see ProbeAt);
+	// 0 for the probe type's default.
+	Port uint16 `json:"port,omitempty"`
+
+	// RemoteAddr is the address the probe's connection actually went to
+	// (ip:port), for auditing that it measured the candidate: the proxy's
+	// with Config.UseEnvProxy, empty when no connection was made.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	// Location is the target of a redirect response that was not
+	// followed (see Config.MaxRedirects), and Redirects the redirects
+	// that were, with their timings.
+	Location  string        `json:"location,omitempty"`
+	Redirects []RedirectHop `json:"redirects,omitempty"`
+
+	// Headers are the final response's values of Config.CaptureHeaders,
+	// by lower-case name; headers it did not send are left out.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// CacheStatus is whether the response came from the edge cache:
+	// CacheHit, CacheMiss or empty when the headers don't tell.
+	CacheStatus string `json:"cache_status,omitempty"`
+
+	// Warm-connection timings of a second request reusing the connection
+	// (only with Config.Warm).
+	WarmOK      bool   `json:"warm_ok,omitempty"`
+	WarmTTFBMS  int64  `json:"warm_ttfb_ms,omitempty"`
+	WarmTotalMS int64  `json:"warm_total_ms,omitempty"`
+	WarmError   string `json:"warm_error,omitempty"`
+
+	// Targets holds the per-target outcomes with Config.Targets; the
+	// fields above then combine them.
+	Targets []TargetResult `json:"targets,omitempty"`
+
+	// HardFail is set when the connection was actively refused or reset,
+	// as opposed to timing out or returning a bad status.
+	HardFail bool `json:"hard_fail,omitempty"`
+
+	// RateLimited is set when the provider answered with a rate-limit
+	// response. Such results say nothing about the IP itself.
+	RateLimited bool          `json:"rate_limited,omitempty"`
+	RetryAfter  time.Duration `json:"retry_after,omitempty"`
+
+	// BandwidthHintMbps is a rough estimate of the downstream throughput
+	// from the pacing of the TLS handshake (see pacing.go); 0 when the
+	// connection gave no usable estimate. It is not a measurement: use the
+	// download test for that.
+	BandwidthHintMbps float64 `json:"bw_hint_mbps,omitempty"`
+
+	// Body is the (size-limited) response body, kept for custom score
+	// functions (engine.RewardFunc) that check content rather than just the
+	// status.
+	Body string `json:"-"`
 }
 
 type Prober struct {
-	cfg    Config
-	client *http.Client
+	cfg     Config
+	client  *http.Client
+	pathSeq atomic.Uint64
+	targets []*Prober
 }
 
 // NewProber creates a reusable, direct-connection (no proxy) prober.
@@ -44,44 +212,89 @@ func NewProber(cfg Config) *Prober {
 	if cfg.Path == "" {
 		cfg.Path = "/cdn-cgi/trace"
 	}
-	if !strings.HasPrefix(cfg.Path, "/") {
-		cfg.Path = "/" + cfg.Path
+	cfg.Path = normalizePath(cfg.Path)
+	paths := make([]string, len(cfg.Paths))
+	for i, p := range cfg.Paths {
+		paths[i] = normalizePath(p)
 	}
+	cfg.Paths = paths
 	if cfg.Timeout <= 0 {
 		cfg.Timeout = 3 * time.Second
 	}
-
-	transport := &http.Transport{
-		Proxy: nil, // critical: ignore HTTP(S)_PROXY and NO_PROXY env vars
-		DialContext: (&net.Dialer{
-			Timeout:   cfg.Timeout,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          1024,
-		MaxIdleConnsPerHost:   256,
-		IdleConnTimeout:       30 * time.Second,
-		TLSHandshakeTimeout:   cfg.Timeout,
-		ResponseHeaderTimeout: cfg.Timeout,
-		ExpectContinueTimeout: 1 * time.Second,
-		TLSClientConfig: &tls.Config{
-			ServerName: cfg.SNI,
-		},
+	if len(cfg.Targets) > 0 {
+		return &Prober{cfg: cfg, targets: newTargetProbers(cfg)}
+	}
+	if len(cfg.Exec) > 0 || cfg.WireGuard != nil {
+		return &Prober{cfg: cfg}
 	}
+
+	transport := newTransport(transportConfig{
+		Timeout:        cfg.Timeout,
+		SNI:            cfg.SNI,
+		TLSFingerprint: cfg.TLSFingerprint,
+		Sessions:       cfg.Sessions,
+
+		ClientCert:         cfg.ClientCert,
+		RootCAs:            cfg.RootCAs,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+
+		UseEnvProxy: cfg.UseEnvProxy,
+		Dial:        cfg.Dial,
+		Dials:       cfg.Dials,
+
+		MaxIdleConns:        1024,
+		MaxIdleConnsPerHost: 256,
+		IdleConnTimeout:     30 * time.Second,
+	})
 	client := &http.Client{
-		Transport: transport,
-		Timeout:   cfg.Timeout,
+		Transport:     transport,
+		Timeout:       cfg.Timeout,
+		CheckRedirect: redirectPolicy(cfg.MaxRedirects),
 	}
 
 	return &Prober{cfg: cfg, client: client}
 }
 
-// ProbeHTTPTrace probes https://<ip>/<path> with SNI/HostHeader.
+// Close closes the prober's idle connections.
+func (p *Prober) Close() {
+	for _, tp := range p.targets {
+		tp.Close()
+	}
+	if p.client != nil {
+		p.client.CloseIdleConnections()
+	}
+}
+
+// ProbeHTTPTrace probes https://<ip>/<path> with SNI/HostHeader (or runs
+// the Config.Exec plugin, or a Config.WireGuard handshake) on the default
+// port.
 func (p *Prober) ProbeHTTPTrace(ctx context.Context, ip netip.Addr) Result {
+	return p.ProbeAt(ctx, ip, 0)
+}
+
+// ProbeAt is ProbeHTTPTrace on the given port; 0 is the probe type's
+// default (443, or DefaultWireGuardPort). Exec plugins ignore the port.
+func (p *Prober) ProbeAt(ctx context.Context, ip netip.Addr, port uint16) Result {
+	if len(p.targets) > 0 {
+		res := p.probeTargets(ctx, ip, port)
+		res.TLSUnverified = p.cfg.InsecureSkipVerify
+		return res
+	}
+	if len(p.cfg.Exec) > 0 {
+		return p.probeExec(ctx, ip)
+	}
+	if p.cfg.WireGuard != nil {
+		if port == 0 {
+			port = DefaultWireGuardPort
+		}
+		return p.probeWireGuard(ctx, ip, port)
+	}
 	start := time.Now()
 	res := Result{
-		IP:   ip,
-		When: start,
+		IP:            ip,
+		When:          start,
+		TLSUnverified: p.cfg.InsecureSkipVerify,
+		Port:          port,
 	}
 
 	targetHost := ip.String()
@@ -89,8 +302,12 @@ func (p *Prober) ProbeHTTPTrace(ctx context.Context, ip netip.Addr) Result {
 	if ip.Is6() {
 		targetHost = "[" + targetHost + "]"
 	}
+	if port != 0 && port != 443 {
+		targetHost += ":" + strconv.Itoa(int(port))
+	}
 
-	url := "https://" + targetHost + p.cfg.Path
+	res.Path = p.nextPath()
+	url := "https://" + targetHost + res.Path
 
 	var (
 		connectStart time.Time
@@ -100,13 +317,19 @@ func (p *Prober) ProbeHTTPTrace(ctx context.Context, ip netip.Addr) Result {
 		tlsDur       time.Duration
 	)
 
+	ctx, pace := withPacing(withPin(ctx, ip))
+	ctx, redirects := withRedirectLog(ctx, start)
 	trace := &httptrace.ClientTrace{
 		ConnectStart: func(network, addr string) {
 			connectStart = time.Now()
 		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			res.RemoteAddr = info.Conn.RemoteAddr().String()
+		},
 		ConnectDone: func(network, addr string, err error) {
 			if !connectStart.IsZero() {
 				connectDur = time.Since(connectStart)
+				pace.setRTT(connectDur)
 			}
 		},
 		TLSHandshakeStart: func() {
@@ -116,6 +339,8 @@ func (p *Prober) ProbeHTTPTrace(ctx context.Context, ip netip.Addr) Result {
 			if !tlsStart.IsZero() {
 				tlsDur = time.Since(tlsStart)
 			}
+			res.TLSResumed = err == nil && state.DidResume
+			pace.stop()
 		},
 		GotFirstResponseByte: func() {
 			gotFirstByte = time.Now()
@@ -142,6 +367,7 @@ func (p *Prober) ProbeHTTPTrace(ctx context.Context, ip netip.Addr) Result {
 		} else {
 			res.Error = err.Error()
 		}
+		res.HardFail = IsHardFailure(err)
 		res.TotalMS = time.Since(start).Milliseconds()
 		res.ConnectMS = connectDur.Milliseconds()
 		res.TLSMS = tlsDur.Milliseconds()
@@ -154,6 +380,13 @@ func (p *Prober) ProbeHTTPTrace(ctx context.Context, ip netip.Addr) Result {
 
 	body, _ := io.ReadAll(io.LimitReader(httpRes.Body, 64*1024))
 	res.Status = httpRes.StatusCode
+	res.Redirects = redirects.hops
+	if httpRes.StatusCode >= 300 && httpRes.StatusCode < 400 {
+		res.Location = httpRes.Header.Get("Location")
+	}
+	res.Headers = p.captureHeaders(httpRes.Header)
+	res.CacheStatus = cacheStatus(httpRes.Header)
+	res.Body = string(body)
 	res.ConnectMS = connectDur.Milliseconds()
 	res.TLSMS = tlsDur.Milliseconds()
 	if !gotFirstByte.IsZero() {
@@ -163,7 +396,18 @@ func (p *Prober) ProbeHTTPTrace(ctx context.Context, ip netip.Addr) Result {
 
 	if httpRes.StatusCode >= 200 && httpRes.StatusCode < 300 {
 		res.OK = true
+		res.BandwidthHintMbps = pace.mbps()
 		res.Trace = parseTrace(string(body))
+		res.TraceInfo = NewTraceInfo(res.Trace)
+		if p.cfg.Warm {
+			// Return the connection to the pool before reusing it.
+			_ = httpRes.Body.Close()
+			p.probeWarm(ctx, targetHost, &res)
+		}
+	} else if limited, retryAfter := detectRateLimit(httpRes, body); limited {
+		res.RateLimited = true
+		res.RetryAfter = retryAfter
+		res.Error = ErrRateLimited
 	} else {
 		res.OK = false
 		res.Error = fmt.Sprintf("http_status_%d", httpRes.StatusCode)
@@ -171,6 +415,75 @@ func (p *Prober) ProbeHTTPTrace(ctx context.Context, ip netip.Addr) Result {
 	return res
 }
 
+// captureHeaders returns the values of Config.CaptureHeaders in h, nil if
+// there are none.
+func (p *Prober) captureHeaders(h http.Header) map[string]string {
+	var out map[string]string
+	for _, name := range p.cfg.CaptureHeaders {
+		vs := h.Values(name)
+		if len(vs) == 0 {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]string, len(p.cfg.CaptureHeaders))
+		}
+		out[strings.ToLower(name)] = strings.Join(vs, ", ")
+	}
+	return out
+}
+
+// IsHardFailure reports whether err means the remote end actively refused or
+// reset the connection.
+func IsHardFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	// Not every platform maps socket errors to these errnos.
+	msg := err.Error()
+	return strings.Contains(msg, "connection refused") || strings.Contains(msg, "connection reset")
+}
+
+// TraceInfo is the part of a /cdn-cgi/trace response that callers act on.
+type TraceInfo struct {
+	// Colo is the IATA code of the serving data center (e.g. "SJC").
+	Colo string `json:"colo,omitempty"`
+	// Loc is the country the edge placed the client in.
+	Loc string `json:"loc,omitempty"`
+	// HTTP is the protocol the edge saw ("http/1.1", "http/2", "http/3").
+	HTTP string `json:"http,omitempty"`
+	// Warp is the WARP status ("off", "on" or "plus").
+	Warp string `json:"warp,omitempty"`
+}
+
+// NewTraceInfo extracts the TraceInfo fields from a parsed trace.
+func NewTraceInfo(trace map[string]string) TraceInfo {
+	return TraceInfo{
+		Colo: trace["colo"],
+		Loc:  trace["loc"],
+		HTTP: trace["http"],
+		Warp: trace["warp"],
+	}
+}
+
+// Field returns the named TraceInfo field ("colo", "loc", "http" or "warp"),
+// or "" for any other name.
+func (t TraceInfo) Field(name string) string {
+	switch name {
+	case "colo":
+		return t.Colo
+	case "loc":
+		return t.Loc
+	case "http":
+		return t.HTTP
+	case "warp":
+		return t.Warp
+	}
+	return ""
+}
+
 func parseTrace(s string) map[string]string {
 	m := make(map[string]string)
 	lines := strings.Split(s, "\n")
@@ -0,0 +1,138 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/netguard"
+)
+
+// maxSetupTimeout caps the time to connect, handshake and receive response
+// headers, so a long download timeout doesn't let a dead edge stall a test
+// before the first byte.
+const maxSetupTimeout = 20 * time.Second
+
+// transportConfig is everything newTransport needs from a prober's config.
+type transportConfig struct {
+	Timeout        time.Duration
+	SNI            string
+	TLSFingerprint string
+	Sessions       *SessionCache
+
+	ClientCert         *tls.Certificate
+	RootCAs            *x509.CertPool
+	InsecureSkipVerify bool
+
+	UseEnvProxy bool
+	Dial        DialFunc
+	Dials       *DialGauge
+
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+}
+
+// DialFunc dials a TCP connection to addr (an IP and port).
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DialGauge counts the connections being dialed through the probers that
+// share it. Connects piling up faster than they complete are a sign of a
+// saturated local link or NAT table.
+type DialGauge struct {
+	n atomic.Int64
+}
+
+// Pending returns the number of dials in progress.
+func (g *DialGauge) Pending() int64 {
+	return g.n.Load()
+}
+
+func (g *DialGauge) wrap(dial DialFunc) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		g.n.Add(1)
+		defer g.n.Add(-1)
+		return dial(ctx, network, addr)
+	}
+}
+
+// newTransport builds the HTTP transport of a prober. Every prober goes
+// through it, so all probe types behave the same:
+//
+//   - Dial: connections use Dial when set (e.g. a test server), and a direct,
+//     netguard-checked TCP dialer otherwise. Either way they only go to IP
+//     literals, and to the probed IP only (see pinned), unless through a
+//     proxy. Dials, when set, counts the dials in progress.
+//   - Proxy: connections are direct and HTTP(S)_PROXY/NO_PROXY are ignored,
+//     unless UseEnvProxy opts into them. Through a proxy net/http does its
+//     own TLS, so TLSFingerprint and Sessions have no effect there.
+//   - TLS: the handshake uses SNI, ClientCert, RootCAs and
+//     InsecureSkipVerify, with a uTLS ClientHello for TLSFingerprint or
+//     session resumption for Sessions.
+//   - ALPN: h2 and http/1.1, except http/1.1 only with TLSFingerprint.
+//   - Timeouts: connecting, the TLS handshake and the response headers are
+//     each bounded by Timeout, capped at maxSetupTimeout.
+//   - Pacing: connections dialed for a probe record their reads for the
+//     bandwidth hint (see pacing.go).
+func newTransport(c transportConfig) *http.Transport {
+	setup := min(c.Timeout, maxSetupTimeout)
+	dial := c.Dial
+	if dial == nil {
+		dial = (&net.Dialer{
+			Timeout:   setup,
+			KeepAlive: 30 * time.Second,
+			Control:   netguard.Control,
+		}).DialContext
+	}
+	if !c.UseEnvProxy {
+		// A proxy is dialed by its own address, often a name.
+		dial = pinned(dial)
+	}
+	if c.Dials != nil {
+		dial = c.Dials.wrap(dial)
+	}
+
+	transport := &http.Transport{
+		Proxy: nil, // critical: ignore HTTP(S)_PROXY and NO_PROXY env vars
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return paced(ctx, conn), nil
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		TLSHandshakeTimeout:   setup,
+		ResponseHeaderTimeout: setup,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig: &tls.Config{
+			ServerName:         c.SNI,
+			RootCAs:            c.RootCAs,
+			InsecureSkipVerify: c.InsecureSkipVerify,
+		},
+	}
+	if c.UseEnvProxy {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+	if c.ClientCert != nil {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*c.ClientCert}
+	}
+
+	if c.TLSFingerprint != "" {
+		// Invalid names are rejected up front by ValidateTLSFingerprint;
+		// fall back to the default stack rather than failing every probe.
+		if dial, err := utlsDialer(c.TLSFingerprint, transport.TLSClientConfig, dial); err == nil {
+			transport.DialTLSContext = dial
+		}
+	} else if c.Sessions != nil {
+		transport.DialTLSContext = sessionDialer(transport.TLSClientConfig, c.Sessions, dial)
+	}
+	return transport
+}
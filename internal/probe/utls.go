@@ -0,0 +1,118 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// tlsFingerprints maps --tls-fingerprint names to uTLS ClientHello presets.
+var tlsFingerprints = map[string]utls.ClientHelloID{
+	"chrome":  utls.HelloChrome_Auto,
+	"firefox": utls.HelloFirefox_Auto,
+	"ios":     utls.HelloIOS_Auto,
+	"safari":  utls.HelloSafari_Auto,
+	"edge":    utls.HelloEdge_Auto,
+}
+
+// TLSFingerprints returns the supported fingerprint names.
+func TLSFingerprints() []string {
+	return []string{"chrome", "firefox", "ios", "safari", "edge"}
+}
+
+// ValidateTLSFingerprint returns an error if name is not a supported
+// fingerprint. The empty string (Go's default ClientHello) is valid.
+func ValidateTLSFingerprint(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := tlsFingerprints[name]; !ok {
+		return fmt.Errorf("unknown TLS fingerprint %q (supported: %s)", name, strings.Join(TLSFingerprints(), ", "))
+	}
+	return nil
+}
+
+// utlsDialer returns a DialTLSContext function that performs the handshake
+// with the named browser ClientHello instead of Go's own over connections
+// from dial. The server name, client certificates and verification
+// settings are taken from base.
+//
+// ALPN is restricted to http/1.1 because http.Transport can only speak HTTP/2
+// over a *tls.Conn; everything else in the ClientHello matches the preset.
+func utlsDialer(fingerprint string, base *tls.Config, dial DialFunc) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	id, ok := tlsFingerprints[fingerprint]
+	if !ok {
+		return nil, ValidateTLSFingerprint(fingerprint)
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// http.Transport doesn't fire connect/TLS trace events for custom
+		// TLS dialers, so report them here to keep timings comparable.
+		trace := httptrace.ContextClientTrace(ctx)
+
+		if trace != nil && trace.ConnectStart != nil {
+			trace.ConnectStart(network, addr)
+		}
+		conn, err := dial(ctx, network, addr)
+		if trace != nil && trace.ConnectDone != nil {
+			trace.ConnectDone(network, addr, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		conn = paced(ctx, conn)
+
+		// Specs hold per-handshake state, so every connection gets a fresh one.
+		spec, err := utls.UTLSIdToSpec(id)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		for _, ext := range spec.Extensions {
+			if alpn, ok := ext.(*utls.ALPNExtension); ok {
+				alpn.AlpnProtocols = []string{"http/1.1"}
+			}
+		}
+		uconn := utls.UClient(conn, toUTLSConfig(base), utls.HelloCustom)
+		if err := uconn.ApplyPreset(&spec); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+
+		if trace != nil && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+		err = uconn.HandshakeContext(ctx)
+		if trace != nil && trace.TLSHandshakeDone != nil {
+			trace.TLSHandshakeDone(tls.ConnectionState{}, err)
+		}
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return uconn, nil
+	}, nil
+}
+
+// toUTLSConfig carries the settings of base that matter to a probe over to
+// a uTLS config.
+func toUTLSConfig(base *tls.Config) *utls.Config {
+	c := &utls.Config{
+		ServerName:         base.ServerName,
+		RootCAs:            base.RootCAs,
+		InsecureSkipVerify: base.InsecureSkipVerify,
+	}
+	for _, cert := range base.Certificates {
+		c.Certificates = append(c.Certificates, utls.Certificate{
+			Certificate: cert.Certificate,
+			PrivateKey:  cert.PrivateKey,
+			Leaf:        cert.Leaf,
+		})
+	}
+	return c
+}
@@ -0,0 +1,62 @@
+package probe
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+// probeWarm sends a second request to targetHost right after a successful
+// cold probe, reusing the pooled connection, and records its timings in res.
+// Long-lived clients (proxies) mostly see this warm latency, since only the
+// first request pays for the TCP and TLS handshakes.
+func (p *Prober) probeWarm(ctx context.Context, targetHost string, res *Result) {
+	var reused bool
+	var gotFirstByte time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			reused = info.Reused
+		},
+		GotFirstResponseByte: func() {
+			gotFirstByte = time.Now()
+		},
+	}
+
+	start := time.Now()
+	url := "https://" + targetHost + p.nextPath()
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, url, nil)
+	if err != nil {
+		res.WarmError = err.Error()
+		return
+	}
+	if p.cfg.HostHeader != "" {
+		req.Host = p.cfg.HostHeader
+	}
+	req.Header.Set("User-Agent", "mcis/0.1")
+	req.Header.Set("Accept", "text/plain")
+
+	httpRes, err := p.client.Do(req)
+	if err != nil {
+		res.WarmError = err.Error()
+		return
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(httpRes.Body, 64*1024))
+	_ = httpRes.Body.Close()
+
+	switch {
+	case !reused:
+		// The cold connection wasn't kept alive, so this would just be
+		// another cold measurement.
+		res.WarmError = "connection not reused"
+	case httpRes.StatusCode < 200 || httpRes.StatusCode >= 300:
+		res.WarmError = http.StatusText(httpRes.StatusCode)
+	default:
+		res.WarmOK = true
+		if !gotFirstByte.IsZero() {
+			res.WarmTTFBMS = gotFirstByte.Sub(start).Milliseconds()
+		}
+		res.WarmTotalMS = time.Since(start).Milliseconds()
+	}
+}
@@ -0,0 +1,229 @@
+package probe
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/netguard"
+)
+
+// DefaultWireGuardPort is the port WireGuard probes use when the search
+// does not pick one (Cloudflare WARP's).
+const DefaultWireGuardPort = 2408
+
+// WireGuardConfig makes probes WireGuard handshakes instead of HTTPS
+// requests: a handshake initiation is sent to the candidate over UDP and
+// the probe succeeds when the matching handshake response arrives, its
+// latency being the handshake round trip. The server only answers peers
+// it knows, so the keys must be those of a configured peer (e.g. a WARP
+// account).
+type WireGuardConfig struct {
+	PrivateKey    [32]byte
+	PeerPublicKey [32]byte
+
+	// Reserved is copied into the reserved bytes of the initiation; WARP
+	// uses them for its client ID. Zero for standard WireGuard.
+	Reserved [3]byte
+}
+
+// WireGuard message types and sizes.
+const (
+	wgInitiation     = 1
+	wgResponse       = 2
+	wgCookieReply    = 3
+	wgInitiationSize = 148
+	wgResponseSize   = 92
+	wgCookieSize     = 64
+)
+
+var (
+	wgConstruction = []byte("Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s")
+	wgIdentifier   = []byte("WireGuard v1 zx2c4 Jason@zx2c4.com")
+	wgLabelMAC1    = []byte("mac1----")
+)
+
+// probeWireGuard performs one WireGuard handshake with ip:port.
+func (p *Prober) probeWireGuard(ctx context.Context, ip netip.Addr, port uint16) Result {
+	start := time.Now()
+	res := Result{IP: ip, When: start, Port: port}
+	fail := func(err error) Result {
+		if errors.Is(err, context.DeadlineExceeded) || isTimeout(err) {
+			res.Error = "timeout"
+		} else {
+			res.Error = err.Error()
+		}
+		res.HardFail = IsHardFailure(err)
+		res.TotalMS = time.Since(start).Milliseconds()
+		return res
+	}
+
+	msg, sender, err := wgInitiationMessage(p.cfg.WireGuard)
+	if err != nil {
+		return fail(err)
+	}
+
+	d := net.Dialer{Control: netguard.Control}
+	conn, err := d.DialContext(ctx, "udp", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	if err != nil {
+		return fail(err)
+	}
+	defer func() { _ = conn.Close() }()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	sent := time.Now()
+	if _, err := conn.Write(msg); err != nil {
+		return fail(err)
+	}
+	buf := make([]byte, 256)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return fail(err)
+		}
+		// Anything not addressed to this initiation is stray traffic.
+		switch {
+		case n == wgResponseSize && buf[0] == wgResponse && binary.LittleEndian.Uint32(buf[8:12]) == sender:
+			res.OK = true
+			res.TotalMS = time.Since(sent).Milliseconds()
+			res.TTFBMS = res.TotalMS
+			return res
+		case n == wgCookieSize && buf[0] == wgCookieReply && binary.LittleEndian.Uint32(buf[4:8]) == sender:
+			// The endpoint is alive but under load: it wants a retry
+			// with a cookie before it will do the handshake.
+			res.Error = "wg_under_load"
+			res.TotalMS = time.Since(start).Milliseconds()
+			return res
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// wgInitiationMessage builds a handshake initiation (the first message of
+// the Noise IKpsk2 handshake) from cfg, returning it and its sender index.
+func wgInitiationMessage(cfg *WireGuardConfig) ([]byte, uint32, error) {
+	static, err := ecdh.X25519().NewPrivateKey(cfg.PrivateKey[:])
+	if err != nil {
+		return nil, 0, err
+	}
+	peer, err := ecdh.X25519().NewPublicKey(cfg.PeerPublicKey[:])
+	if err != nil {
+		return nil, 0, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	var idx [4]byte
+	if _, err := rand.Read(idx[:]); err != nil {
+		return nil, 0, err
+	}
+	sender := binary.LittleEndian.Uint32(idx[:])
+
+	msg := make([]byte, wgInitiationSize)
+	msg[0] = wgInitiation
+	copy(msg[1:4], cfg.Reserved[:])
+	copy(msg[4:8], idx[:])
+
+	ck := wgHash(wgConstruction)
+	h := wgHash(ck, wgIdentifier)
+	h = wgHash(h, cfg.PeerPublicKey[:])
+
+	epub := ephemeral.PublicKey().Bytes()
+	copy(msg[8:40], epub)
+	ck = wgKDF(ck, epub, 1)[0]
+	h = wgHash(h, epub)
+
+	dh, err := ephemeral.ECDH(peer)
+	if err != nil {
+		return nil, 0, err
+	}
+	keys := wgKDF(ck, dh, 2)
+	ck = keys[0]
+	encStatic := wgSeal(keys[1], static.PublicKey().Bytes(), h)
+	copy(msg[40:88], encStatic)
+	h = wgHash(h, encStatic)
+
+	dh, err = static.ECDH(peer)
+	if err != nil {
+		return nil, 0, err
+	}
+	keys = wgKDF(ck, dh, 2)
+	encTime := wgSeal(keys[1], tai64n(time.Now()), h)
+	copy(msg[88:116], encTime)
+
+	mac, _ := blake2s.New128(wgHash(wgLabelMAC1, cfg.PeerPublicKey[:]))
+	mac.Write(msg[:116])
+	copy(msg[116:132], mac.Sum(nil))
+	// mac2 stays zero: there is no cookie.
+	return msg, sender, nil
+}
+
+// wgHash is BLAKE2s-256 over the concatenation of parts.
+func wgHash(parts ...[]byte) []byte {
+	h, _ := blake2s.New256(nil)
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func wgHMAC(key []byte, parts ...[]byte) []byte {
+	m := hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+	for _, p := range parts {
+		m.Write(p)
+	}
+	return m.Sum(nil)
+}
+
+// wgKDF derives n keys from the chaining key ck and input.
+func wgKDF(ck, input []byte, n int) [][]byte {
+	prk := wgHMAC(ck, input)
+	out := make([][]byte, 0, n)
+	prev := []byte{}
+	for i := 1; i <= n; i++ {
+		prev = wgHMAC(prk, prev, []byte{byte(i)})
+		out = append(out, prev)
+	}
+	return out
+}
+
+// wgSeal encrypts plaintext with key and a zero counter, authenticating ad.
+func wgSeal(key, plaintext, ad []byte) []byte {
+	aead, _ := chacha20poly1305.New(key)
+	var nonce [chacha20poly1305.NonceSize]byte
+	return aead.Seal(nil, nonce[:], plaintext, ad)
+}
+
+// tai64n encodes t as a TAI64N timestamp.
+func tai64n(t time.Time) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b, uint64(1<<62+t.Unix()))
+	binary.BigEndian.PutUint32(b[8:], uint32(t.Nanosecond()))
+	return b
+}
@@ -0,0 +1,363 @@
+// Package resolver performs DNS lookups through a configurable upstream:
+// plain DNS over UDP/TCP, DNS over TLS or DNS over HTTPS. The whole point of
+// the tool is often that the local resolver or path is unreliable, so
+// internal lookups don't rely on the system resolver when one is configured.
+//
+// Upstreams are given as:
+//
+//	1.1.1.1 | 1.1.1.1:53 | udp://1.1.1.1:53   DNS over UDP (TCP on truncation)
+//	tcp://1.1.1.1:53                          DNS over TCP
+//	tls://1.1.1.1 | tls://dns.google:853      DNS over TLS
+//	https://cloudflare-dns.com/dns-query      DNS over HTTPS
+//
+// When the upstream is named by host name, bootstrap IPs are used to reach
+// it so that no system DNS lookup is needed.
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/netguard"
+)
+
+// DefaultTimeout bounds a single exchange when the context has no deadline.
+const DefaultTimeout = 5 * time.Second
+
+// Resolver sends DNS queries to one upstream.
+type Resolver struct {
+	scheme    string // udp, tcp, tls or https
+	host      string // upstream host (IP or name)
+	port      string
+	url       string // DoH endpoint
+	bootstrap []netip.Addr
+	client    *http.Client // DoH only
+}
+
+// New parses an upstream spec (see the package doc). bootstrap IPs are used
+// to reach a DoT/DoH upstream given by host name.
+func New(spec string, bootstrap []netip.Addr) (*Resolver, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, errors.New("empty resolver")
+	}
+	if !strings.Contains(spec, "://") {
+		spec = "udp://" + spec
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Resolver{scheme: u.Scheme, host: u.Hostname(), port: u.Port(), bootstrap: bootstrap}
+	if r.host == "" {
+		return nil, fmt.Errorf("resolver %q: missing host", spec)
+	}
+	switch r.scheme {
+	case "udp", "tcp":
+		if r.port == "" {
+			r.port = "53"
+		}
+	case "tls":
+		if r.port == "" {
+			r.port = "853"
+		}
+	case "https":
+		if r.port == "" {
+			r.port = "443"
+		}
+		r.url = u.String()
+		r.client = &http.Client{
+			Transport: &http.Transport{
+				Proxy:             nil, // same as the probers: always connect directly
+				DialContext:       r.dialUpstream,
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   30 * time.Second,
+			},
+		}
+	default:
+		return nil, fmt.Errorf("resolver %q: unsupported scheme %q (udp, tcp, tls, https)", spec, r.scheme)
+	}
+	return r, nil
+}
+
+// String returns the upstream in spec form.
+func (r *Resolver) String() string {
+	if r.scheme == "https" {
+		return r.url
+	}
+	return r.scheme + "://" + net.JoinHostPort(r.host, r.port)
+}
+
+// Exchange sends a packed DNS query and returns the packed response.
+func (r *Resolver) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultTimeout)
+		defer cancel()
+	}
+
+	switch r.scheme {
+	case "udp":
+		resp, err := r.exchangeUDP(ctx, query)
+		if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 { // TC bit
+			return r.exchangeStream(ctx, "tcp", query)
+		}
+		return resp, err
+	case "https":
+		return r.exchangeHTTPS(ctx, query)
+	default:
+		return r.exchangeStream(ctx, r.scheme, query)
+	}
+}
+
+// Query sends a query for name/qtype and returns the parsed response.
+func (r *Resolver) Query(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	n, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	var idBuf [2]byte
+	_, _ = rand.Read(idBuf[:])
+	id := binary.BigEndian.Uint16(idBuf[:])
+	if r.scheme == "https" {
+		id = 0 // RFC 8484: use ID 0 for cache friendliness
+	}
+
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: n, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := r.Exchange(ctx, packed)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp dnsmessage.Message
+	if err := resp.Unpack(raw); err != nil {
+		return nil, err
+	}
+	if resp.ID != id {
+		return nil, errors.New("dns: mismatched response id")
+	}
+	if resp.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("dns: %s for %s", resp.RCode, name)
+	}
+	return &resp, nil
+}
+
+// LookupAddrs returns the IPv4 and IPv6 addresses of host.
+func (r *Resolver) LookupAddrs(ctx context.Context, host string) ([]netip.Addr, error) {
+	if a, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{a}, nil
+	}
+
+	var addrs []netip.Addr
+	var firstErr error
+	for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		msg, err := r.Query(ctx, host, t)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, ans := range msg.Answers {
+			switch b := ans.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, netip.AddrFrom4(b.A))
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, netip.AddrFrom16(b.AAAA))
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("dns: no addresses for %s", host)
+		}
+		return nil, firstErr
+	}
+	return addrs, nil
+}
+
+// DialContext dials addr, resolving its host name through r rather than the
+// system resolver.
+func (r *Resolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupAddrs(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return dialAny(ctx, network, ips, port)
+}
+
+// InstallDefault makes http.DefaultTransport resolve host names through r,
+// covering HTTP clients that don't build their own transport (the DNS
+// provider API clients).
+func (r *Resolver) InstallDefault() {
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		t = t.Clone()
+		t.DialContext = r.DialContext
+		http.DefaultTransport = t
+	}
+}
+
+// upstreamAddrs returns the IPs to reach the upstream at.
+func (r *Resolver) upstreamAddrs(ctx context.Context) ([]netip.Addr, error) {
+	if a, err := netip.ParseAddr(r.host); err == nil {
+		return []netip.Addr{a}, nil
+	}
+	if len(r.bootstrap) > 0 {
+		return r.bootstrap, nil
+	}
+	// No bootstrap: fall back to the system resolver for the upstream only.
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", r.host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve upstream %s (set bootstrap IPs to avoid system DNS): %w", r.host, err)
+	}
+	return ips, nil
+}
+
+// dialUpstream connects to the upstream, ignoring the address the HTTP
+// transport asks for (it is always the DoH host).
+func (r *Resolver) dialUpstream(ctx context.Context, network, _ string) (net.Conn, error) {
+	ips, err := r.upstreamAddrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dialAny(ctx, network, ips, r.port)
+}
+
+func (r *Resolver) exchangeUDP(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := r.dialUpstream(ctx, "udp", "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// exchangeStream performs a length-prefixed exchange over TCP or TLS.
+func (r *Resolver) exchangeStream(ctx context.Context, scheme string, query []byte) ([]byte, error) {
+	conn, err := r.dialUpstream(ctx, "tcp", "")
+	if err != nil {
+		return nil, err
+	}
+	if scheme == "tls" {
+		tc := tls.Client(conn, &tls.Config{ServerName: r.host, MinVersion: tls.VersionTLS12})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	defer func() { _ = conn.Close() }()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (r *Resolver) exchangeHTTPS(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+}
+
+// dialAny dials ips in order and returns the first connection that succeeds.
+func dialAny(ctx context.Context, network string, ips []netip.Addr, port string) (net.Conn, error) {
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := netguard.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no addresses to dial")
+	}
+	return nil, lastErr
+}
+
+// ParseBootstrap parses a comma-separated list of bootstrap IPs.
+func ParseBootstrap(s string) ([]netip.Addr, error) {
+	var out []netip.Addr
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		a, err := netip.ParseAddr(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap IP %q", f)
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
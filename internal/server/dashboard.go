@@ -0,0 +1,22 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The dashboard is a single static page that polls the JSON API; it needs
+// nothing beyond a browser, not even network access to a CDN.
+//
+//go:embed web
+var webFS embed.FS
+
+// dashboard serves the web UI at /.
+func dashboard() http.Handler {
+	sub, err := fs.Sub(webFS, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServerFS(sub)
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+// DefaultStaleAfter is how long the scan loop may go without progress before
+// /healthz reports it as wedged.
+const DefaultStaleAfter = 2 * time.Minute
+
+// health tracks scan loop liveness for /healthz and /readyz.
+type health struct {
+	interval   time.Duration
+	staleAfter time.Duration
+
+	runStart time.Time
+	runEnd   time.Time
+	lastErr  string
+	lastOK   time.Time // carried over from previous runs' engines
+}
+
+// SetHealth configures liveness checking: interval is the pause between runs
+// (0 for a single run) and staleAfter how long the loop may go without
+// progress (0 uses DefaultStaleAfter).
+func (s *Server) SetHealth(interval, staleAfter time.Duration) {
+	if staleAfter <= 0 {
+		staleAfter = DefaultStaleAfter
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.health.interval = interval
+	s.health.staleAfter = staleAfter
+}
+
+// RunStarted records the start of a scan run.
+func (s *Server) RunStarted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.health.runStart = time.Now()
+}
+
+// RunFinished records the end of a scan run and its error, if any.
+func (s *Server) RunFinished(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.health.runEnd = time.Now()
+	s.health.lastErr = ""
+	if err != nil {
+		s.health.lastErr = err.Error()
+	}
+	if s.eng != nil {
+		s.health.lastOK = latest(s.health.lastOK, s.eng.LastOK())
+	}
+}
+
+type healthResponse struct {
+	Status    string     `json:"status"`
+	Reason    string     `json:"reason,omitempty"`
+	Running   bool       `json:"running"`
+	LastProbe *time.Time `json:"last_probe,omitempty"`
+	LastOK    *time.Time `json:"last_ok,omitempty"`
+	LastRun   *time.Time `json:"last_run_end,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// check evaluates liveness at now. The loop is considered wedged when the
+// engine is searching but no probe has completed for staleAfter, or when the
+// next periodic run is overdue by more than staleAfter.
+func (s *Server) check(now time.Time) (resp healthResponse, alive bool) {
+	s.mu.RLock()
+	h := s.health
+	eng := s.eng
+	s.mu.RUnlock()
+
+	var lastProbe time.Time
+	lastOK := h.lastOK
+	if eng != nil {
+		lastProbe = eng.LastProbe()
+		lastOK = latest(lastOK, eng.LastOK())
+	}
+
+	resp = healthResponse{
+		Status:    "ok",
+		Running:   h.runStart.After(h.runEnd),
+		LastProbe: timePtr(lastProbe),
+		LastOK:    timePtr(lastOK),
+		LastRun:   timePtr(h.runEnd),
+		LastError: h.lastErr,
+	}
+
+	switch {
+	case resp.Running && eng != nil && eng.Running():
+		if active := latest(h.runStart, lastProbe); now.Sub(active) > h.staleAfter {
+			resp.Reason = "no probe completed since " + active.Format(time.RFC3339)
+		}
+	case !resp.Running && h.interval > 0 && !h.runEnd.IsZero():
+		if now.Sub(h.runEnd) > h.interval+h.staleAfter {
+			resp.Reason = "next run overdue since " + h.runEnd.Add(h.interval).Format(time.RFC3339)
+		}
+	}
+	if resp.Reason != "" {
+		resp.Status = "stalled"
+		return resp, false
+	}
+	return resp, true
+}
+
+// handleHealthz handles GET /healthz: 200 while the scan loop makes progress,
+// 503 once it looks wedged.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	resp, alive := s.check(time.Now())
+	status := http.StatusOK
+	if !alive {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+// handleReadyz handles GET /readyz: 200 once a probe has succeeded, i.e.
+// results are available, and the loop is alive.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	resp, alive := s.check(time.Now())
+	status := http.StatusOK
+	switch {
+	case !alive:
+		status = http.StatusServiceUnavailable
+	case resp.LastOK == nil:
+		resp.Status = "starting"
+		resp.Reason = "no successful probe yet"
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+func latest(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
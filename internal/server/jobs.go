@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+)
+
+// JobSpec describes a search submitted with POST /api/jobs. Unset fields
+// take the daemon's command-line values.
+type JobSpec struct {
+	SNI    string   `json:"sni"`
+	Host   string   `json:"host,omitempty"`
+	CIDRs  []string `json:"cidrs,omitempty"`
+	Budget int      `json:"budget,omitempty"`
+	Top    int      `json:"top,omitempty"`
+}
+
+// JobBuilder turns a job spec into an engine ready to run and its request.
+// It is expected to set engine.Config.Shared so jobs share one probe pool
+// and negative cache.
+type JobBuilder func(spec JobSpec) (*engine.Engine, engine.Request, error)
+
+// Job states.
+const (
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+// maxFinishedJobs is how many finished jobs are kept for GET /api/jobs.
+const maxFinishedJobs = 32
+
+type job struct {
+	ID       int        `json:"id"`
+	Spec     JobSpec    `json:"spec"`
+	State    string     `json:"state"`
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	Completed int64              `json:"completed"`
+	Budget    int64              `json:"budget"`
+	Top       []engine.TopResult `json:"top,omitempty"`
+
+	eng    *engine.Engine
+	final  engine.TreeDump // the tree once finished
+	cancel context.CancelFunc
+}
+
+// jobTable holds the jobs submitted through the API.
+type jobTable struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	build  JobBuilder
+	nextID int
+	jobs   []*job
+}
+
+// SetJobBuilder enables the /api/jobs endpoints, which run searches
+// concurrently with the main one (and each other) until the server's
+// context is done.
+func (s *Server) SetJobBuilder(fn JobBuilder) {
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	s.jobs.build = fn
+}
+
+// start runs spec in the background and returns its job ID.
+func (t *jobTable) start(spec JobSpec) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.build == nil {
+		return 0, errors.New("jobs are not enabled")
+	}
+	if t.ctx == nil {
+		return 0, errors.New("server not started")
+	}
+	eng, req, err := t.build(spec)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithCancel(t.ctx)
+	t.nextID++
+	j := &job{ID: t.nextID, Spec: spec, State: JobRunning, Started: time.Now(), eng: eng, cancel: cancel}
+	t.jobs = append(t.jobs, j)
+	t.prune()
+
+	go func() {
+		res, err := eng.Run(ctx, req)
+		cancel()
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		now := time.Now()
+		j.Finished = &now
+		j.Completed, j.Budget = eng.Progress()
+		j.final = eng.TreeSnapshot()
+		j.eng = nil
+		switch {
+		case err == nil:
+			j.State = JobDone
+			j.Top = res.Top
+		case errors.Is(err, context.Canceled):
+			j.State = JobCanceled
+		default:
+			j.State = JobFailed
+			j.Error = err.Error()
+		}
+	}()
+	return j.ID, nil
+}
+
+// prune drops the oldest finished jobs beyond maxFinishedJobs. Callers hold
+// t.mu.
+func (t *jobTable) prune() {
+	finished := 0
+	for _, j := range t.jobs {
+		if j.State != JobRunning {
+			finished++
+		}
+	}
+	t.jobs = slices.DeleteFunc(t.jobs, func(j *job) bool {
+		if finished > maxFinishedJobs && j.State != JobRunning {
+			finished--
+			return true
+		}
+		return false
+	})
+}
+
+// snapshot returns a copy of the job with id, with the progress of a
+// running job filled in.
+func (t *jobTable) snapshot(id int) (job, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, j := range t.jobs {
+		if j.ID == id {
+			return j.view(), true
+		}
+	}
+	return job{}, false
+}
+
+// view copies j for output. Callers hold the table lock.
+func (j *job) view() job {
+	v := *j
+	if j.eng != nil {
+		v.Completed, v.Budget = j.eng.Progress()
+		v.Top = j.eng.Top()
+	}
+	return v
+}
+
+func (t *jobTable) list() []job {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]job, len(t.jobs))
+	for i, j := range t.jobs {
+		out[i] = j.view()
+		out[i].Top = nil
+	}
+	return out
+}
+
+// tree returns the search tree of the job with id.
+func (t *jobTable) tree(id int) (engine.TreeDump, bool) {
+	t.mu.Lock()
+	var j *job
+	for _, jj := range t.jobs {
+		if jj.ID == id {
+			j = jj
+		}
+	}
+	if j == nil {
+		t.mu.Unlock()
+		return engine.TreeDump{}, false
+	}
+	eng, final := j.eng, j.final
+	t.mu.Unlock()
+	// Snapshotting walks the whole tree; don't hold up the table for it.
+	if eng != nil {
+		return eng.TreeSnapshot(), true
+	}
+	return final, true
+}
+
+func (t *jobTable) cancel(id int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, j := range t.jobs {
+		if j.ID == id {
+			j.cancel()
+			return true
+		}
+	}
+	return false
+}
+
+// handleStartJob handles POST /api/jobs {"sni": "a.example.com", ...}.
+func (s *Server) handleStartJob(w http.ResponseWriter, r *http.Request) {
+	var spec JobSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	id, err := s.jobs.start(spec)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]int{"id": id})
+}
+
+// handleListJobs handles GET /api/jobs.
+func (s *Server) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.jobs.list())
+}
+
+// handleGetJob handles GET /api/jobs/{id}, including the results so far
+// (the final ones once finished).
+func (s *Server) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	j, ok := s.jobs.snapshot(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("no such job"))
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
+}
+
+// handleCancelJob handles DELETE /api/jobs/{id}.
+func (s *Server) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !s.jobs.cancel(id) {
+		writeError(w, http.StatusNotFound, errors.New("no such job"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"canceled": true})
+}
@@ -0,0 +1,234 @@
+// Package server exposes a small HTTP API for observing and steering searches
+// while they run (used by --serve, typically together with --interval).
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/cidr"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+)
+
+// Server serves the control API for the currently running engine.
+type Server struct {
+	addr string
+
+	mu       sync.RWMutex
+	eng      *engine.Engine
+	health   health
+	reloader func() error
+
+	jobs jobTable
+}
+
+// New creates a server that will listen on addr (e.g. "127.0.0.1:8080").
+func New(addr string) *Server {
+	return &Server{addr: addr, health: health{staleAfter: DefaultStaleAfter}}
+}
+
+// SetEngine sets the engine the API operates on (nil between runs).
+func (s *Server) SetEngine(e *engine.Engine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eng = e
+}
+
+// SetReloader sets the function POST /api/reload calls to re-read the
+// config file.
+func (s *Server) SetReloader(fn func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reloader = fn
+}
+
+func (s *Server) engine() *engine.Engine {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.eng
+}
+
+// Start starts listening in the background. The server shuts down when ctx
+// is done. Listen errors are returned synchronously.
+func (s *Server) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.jobs.mu.Lock()
+	s.jobs.ctx = ctx
+	s.jobs.mu.Unlock()
+
+	srv := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(sctx)
+	}()
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	return nil
+}
+
+// Handler returns the HTTP handler for the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/status", s.handleStatus)
+	mux.HandleFunc("GET /api/tree", s.handleTree)
+	mux.HandleFunc("GET /api/top", s.handleTop)
+	mux.HandleFunc("POST /api/roots", s.handleAddRoots)
+	mux.HandleFunc("DELETE /api/prefix", s.handleRemovePrefix)
+	mux.HandleFunc("POST /api/reload", s.handleReload)
+	mux.HandleFunc("POST /api/jobs", s.handleStartJob)
+	mux.HandleFunc("GET /api/jobs", s.handleListJobs)
+	mux.HandleFunc("GET /api/jobs/{id}", s.handleGetJob)
+	mux.HandleFunc("GET /api/jobs/{id}/tree", s.handleJobTree)
+	mux.HandleFunc("DELETE /api/jobs/{id}", s.handleCancelJob)
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	mux.Handle("GET /", dashboard())
+	return mux
+}
+
+type statusResponse struct {
+	Running   bool  `json:"running"`
+	Completed int64 `json:"completed"`
+	Budget    int64 `json:"budget"`
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	var resp statusResponse
+	if e := s.engine(); e != nil {
+		resp.Running = e.Running()
+		resp.Completed, resp.Budget = e.Progress()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleTop handles GET /api/top, the best results of the main search so
+// far (before download tests). The array is written one row at a time,
+// so a huge --top is not encoded in memory first.
+func (s *Server) handleTop(w http.ResponseWriter, r *http.Request) {
+	var top []engine.TopResult
+	if e := s.engine(); e != nil {
+		top = e.Top()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	bw := bufio.NewWriterSize(w, 64<<10)
+	enc := json.NewEncoder(bw)
+	sep := "["
+	for _, row := range top {
+		if _, err := bw.WriteString(sep); err != nil {
+			return
+		}
+		if err := enc.Encode(row); err != nil {
+			return
+		}
+		sep = ","
+	}
+	if sep == "[" {
+		_, _ = bw.WriteString("[")
+	}
+	_, _ = bw.WriteString("]\n")
+	_ = bw.Flush()
+}
+
+type addRootsRequest struct {
+	CIDRs []string `json:"cidrs"`
+}
+
+// handleAddRoots handles POST /api/roots {"cidrs": ["1.1.0.0/16", ...]}.
+func (s *Server) handleAddRoots(w http.ResponseWriter, r *http.Request) {
+	var req addRootsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	prefixes, err := cidr.ParseCIDRs(req.CIDRs)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	e := s.engine()
+	if e == nil {
+		writeError(w, http.StatusConflict, engine.ErrNotRunning)
+		return
+	}
+	added, err := e.AddRoots(prefixes)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"added": added})
+}
+
+// handleRemovePrefix handles DELETE /api/prefix?prefix=1.1.1.0/24.
+func (s *Server) handleRemovePrefix(w http.ResponseWriter, r *http.Request) {
+	p, err := netip.ParsePrefix(r.URL.Query().Get("prefix"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	e := s.engine()
+	if e == nil {
+		writeError(w, http.StatusConflict, engine.ErrNotRunning)
+		return
+	}
+	removed, err := e.RemovePrefix(p)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"removed": removed})
+}
+
+// handleReload handles POST /api/reload: re-read the config file and apply it.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	fn := s.reloader
+	s.mu.RUnlock()
+	if fn == nil {
+		writeError(w, http.StatusConflict, errors.New("no config file to reload (start with --config)"))
+		return
+	}
+	if err := fn(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"reloaded": true})
+}
+
+func statusFor(err error) int {
+	if errors.Is(err, engine.ErrNotRunning) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, engine.ErrRootOverlap) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
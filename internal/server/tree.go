@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/bandit"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+)
+
+// treeNode is one prefix of the search tree in the shape D3's hierarchy
+// layouts expect: leaves carry a value (their samples), inner nodes have
+// children and are sized by the sum of theirs.
+type treeNode struct {
+	Name        string  `json:"name"`
+	Prefix      string  `json:"prefix,omitempty"`
+	Label       string  `json:"label,omitempty"`
+	Depth       int     `json:"depth"`
+	Samples     int     `json:"samples"`
+	Successes   int     `json:"successes"`
+	SuccessRate float64 `json:"success_rate"`
+	// ScoreMS is the mean latency of the prefix's successful probes, 0
+	// before the first.
+	ScoreMS float64 `json:"score_ms"`
+	Value   int     `json:"value,omitempty"`
+
+	Children []treeNode `json:"children,omitempty"`
+}
+
+// treeView is the response of the tree endpoints.
+type treeView struct {
+	Running   bool     `json:"running"`
+	Completed int64    `json:"completed"`
+	Budget    int64    `json:"budget"`
+	Nodes     int      `json:"nodes"`
+	Tree      treeNode `json:"tree"`
+}
+
+// newTreeView converts a tree dump into its hierarchical view, under a
+// synthetic root holding the search's root prefixes.
+func newTreeView(d engine.TreeDump) treeView {
+	root := treeNode{Name: "root"}
+	for _, r := range d.Roots {
+		c := newTreeNode(r, 1)
+		root.Samples += c.Samples
+		root.Successes += c.Successes
+		root.Children = append(root.Children, c)
+	}
+	if root.Samples > 0 {
+		root.SuccessRate = float64(root.Successes) / float64(root.Samples)
+	}
+	return treeView{Running: d.Running, Completed: d.Completed, Budget: d.Budget, Nodes: d.Nodes, Tree: root}
+}
+
+func newTreeNode(s bandit.NodeSnapshot, depth int) treeNode {
+	n := treeNode{
+		Name:        s.Prefix.String(),
+		Prefix:      s.Prefix.String(),
+		Label:       s.Label,
+		Depth:       depth,
+		Samples:     s.Samples,
+		Successes:   s.Successes,
+		SuccessRate: s.SuccessRate,
+		ScoreMS:     s.MeanLatency,
+	}
+	if len(s.Children) == 0 {
+		// A treemap cell needs an area even before the first sample.
+		n.Value = max(s.Samples, 1)
+		return n
+	}
+	for _, c := range s.Children {
+		n.Children = append(n.Children, newTreeNode(c, depth+1))
+	}
+	return n
+}
+
+// handleTree handles GET /api/tree, the tree of the main search.
+func (s *Server) handleTree(w http.ResponseWriter, r *http.Request) {
+	e := s.engine()
+	if e == nil {
+		writeError(w, http.StatusNotFound, errors.New("no search yet"))
+		return
+	}
+	writeJSON(w, http.StatusOK, newTreeView(e.TreeSnapshot()))
+}
+
+// handleJobTree handles GET /api/jobs/{id}/tree: the live tree of a running
+// job, or the final one of a finished job.
+func (s *Server) handleJobTree(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	d, ok := s.jobs.tree(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("no such job"))
+		return
+	}
+	writeJSON(w, http.StatusOK, newTreeView(d))
+}
@@ -0,0 +1,155 @@
+// Package sign signs and verifies result files with ed25519, so result lists
+// passed between machines can be authenticated before they are applied.
+//
+// Keys are PEM encoded (PKCS#8 private keys, PKIX public keys), the same
+// format produced by `openssl genpkey -algorithm ed25519`. Signatures are
+// stored base64 encoded in a detached "<file>.sig" next to the signed file.
+package sign
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SigSuffix is appended to a file name to form its signature file name.
+const SigSuffix = ".sig"
+
+// ErrBadSignature is returned when a signature does not match the file.
+var ErrBadSignature = errors.New("signature verification failed")
+
+// GenerateKey creates a new key pair and writes the private key to privPath
+// (mode 0600) and the public key to pubPath.
+func GenerateKey(privPath, pubPath string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0o644)
+}
+
+// LoadPrivateKey reads a PEM encoded ed25519 private key.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: expected PRIVATE KEY, got %s", path, block.Type)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	priv, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+	return priv, nil
+}
+
+// LoadPublicKey reads a PEM encoded ed25519 public key. A private key file is
+// accepted too, in which case its public half is returned.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		k, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		pub, ok := k.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an ed25519 key", path)
+		}
+		return pub, nil
+	case "PRIVATE KEY":
+		priv, err := LoadPrivateKey(path)
+		if err != nil {
+			return nil, err
+		}
+		return priv.Public().(ed25519.PublicKey), nil
+	default:
+		return nil, fmt.Errorf("%s: expected PUBLIC KEY, got %s", path, block.Type)
+	}
+}
+
+// SignFile signs the contents of path and writes the signature to
+// path+SigSuffix. It returns the signature file path.
+func SignFile(priv ed25519.PrivateKey, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sig := ed25519.Sign(priv, data)
+	sigPath := path + SigSuffix
+	if err := os.WriteFile(sigPath, []byte(base64.StdEncoding.EncodeToString(sig)+"\n"), 0o644); err != nil {
+		return "", err
+	}
+	return sigPath, nil
+}
+
+// VerifyFile checks the signature in sigPath (path+SigSuffix if empty)
+// against the contents of path.
+func VerifyFile(pub ed25519.PublicKey, path, sigPath string) error {
+	if sigPath == "" {
+		sigPath = path + SigSuffix
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	raw, err := os.ReadFile(sigPath)
+	if err != nil {
+		return err
+	}
+	err = Verify(pub, data, raw)
+	if err != nil && !errors.Is(err, ErrBadSignature) {
+		return fmt.Errorf("%s: %w", sigPath, err)
+	}
+	return err
+}
+
+// Verify checks data against sig, the contents of a signature file.
+func Verify(pub ed25519.PublicKey, data, sig []byte) error {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return err
+	}
+	if len(raw) != ed25519.SignatureSize || !ed25519.Verify(pub, data, raw) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	return block, nil
+}
@@ -0,0 +1,406 @@
+// Package speedtest runs the download tests that follow a search: it picks
+// the IPs to test, runs the tests with bounded parallelism over one shared
+// prober, and backs off when the speed test endpoint rate limits us.
+package speedtest
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/probe"
+)
+
+type Config struct {
+	Download probe.DownloadConfig
+
+	// Parallel is the number of downloads run at once. Parallel downloads
+	// compete for the same link, so the default of 1 gives the most
+	// comparable speeds.
+	Parallel int
+	// Retries is how many times a rate-limited download is retried after
+	// backing off.
+	Retries int
+	// Confirm is how many more attempts a failed or suspiciously slow
+	// download gets before its IP is recorded as bad; the best attempt is
+	// kept. A download is suspiciously slow at under half the median speed
+	// of the downloads that succeeded so far.
+	Confirm int
+	// UniqueColo tests only the best ranked IP of each colo. Tests of IPs
+	// in the same colo mostly measure the local link a second time.
+	UniqueColo bool
+
+	// Throttle, if set, charges each attempt against its bandwidth ceiling.
+	Throttle *probe.Throttle
+
+	// OnTest, if set, is called by Run with the 1-based rank and the
+	// updated row as each test finishes. It is called from the download
+	// goroutines.
+	OnTest func(rank int, res engine.TopResult)
+
+	// Verbose enables per-download output to stderr.
+	Verbose bool
+}
+
+// Runner runs download tests. All tests share one prober, so connections to
+// an IP are reused across tests, and one backoff, so a rate-limited endpoint
+// pauses every subsequent download, not just the one that hit it.
+type Runner struct {
+	cfg     Config
+	dlp     *probe.DownloadProber
+	backoff probe.Backoff
+
+	mu     sync.Mutex
+	speeds []float64       // Mbps of the successful downloads so far
+	took   []time.Duration // durations of the finished tests so far
+}
+
+// slowRatio is the fraction of the median speed below which a download is
+// retried to confirm it.
+const slowRatio = 0.5
+
+func New(cfg Config) *Runner {
+	if cfg.Parallel <= 0 {
+		cfg.Parallel = 1
+	}
+	if cfg.Retries < 0 {
+		cfg.Retries = 0
+	}
+	if cfg.Confirm < 0 {
+		cfg.Confirm = 0
+	}
+	dlp := probe.NewDownloadProber(cfg.Download)
+	cfg.Download.Timeout = dlp.Timeout()
+	return &Runner{cfg: cfg, dlp: dlp}
+}
+
+// Close releases the connections kept for reuse.
+func (r *Runner) Close() {
+	r.dlp.Close()
+}
+
+// Test runs a download test of ip. A failed or suspiciously slow download
+// is retried up to Config.Confirm times and the best attempt is returned,
+// with Attempts set to the number of attempts made.
+func (r *Runner) Test(ctx context.Context, ip netip.Addr) probe.DownloadResult {
+	start := time.Now()
+	best := r.attempt(ctx, ip)
+	attempts := 1
+	for ; attempts <= r.cfg.Confirm && ctx.Err() == nil && r.doubtful(best); attempts++ {
+		if r.cfg.Verbose {
+			fmt.Fprintf(os.Stderr, "download: ip=%s ok=%v mbps=%.2f, retrying to confirm\n", ip.String(), best.OK, best.Mbps)
+		}
+		if dr := r.attempt(ctx, ip); betterAttempt(dr, best) {
+			best = dr
+		}
+	}
+	best.Attempts = attempts
+	r.mu.Lock()
+	if best.OK {
+		r.speeds = append(r.speeds, best.Mbps)
+	}
+	if ctx.Err() == nil {
+		r.took = append(r.took, time.Since(start))
+	}
+	r.mu.Unlock()
+	return best
+}
+
+// Estimate returns how long a download test is expected to take: the mean
+// of the tests so far, or the download timeout before the first one.
+func (r *Runner) Estimate() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.took) == 0 {
+		return r.cfg.Download.Timeout
+	}
+	var sum time.Duration
+	for _, d := range r.took {
+		sum += d
+	}
+	return sum / time.Duration(len(r.took))
+}
+
+// Parallel returns the number of download tests run at once.
+func (r *Runner) Parallel() int {
+	return r.cfg.Parallel
+}
+
+// doubtful reports whether dr failed or is suspiciously slow.
+func (r *Runner) doubtful(dr probe.DownloadResult) bool {
+	if !dr.OK {
+		return dr.Error != "canceled"
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.speeds) < 2 {
+		return false
+	}
+	return dr.Mbps < slowRatio*median(r.speeds)
+}
+
+// betterAttempt reports whether attempt a beats b: a success beats a
+// failure, then the faster download wins.
+func betterAttempt(a, b probe.DownloadResult) bool {
+	if a.OK != b.OK {
+		return a.OK
+	}
+	return a.Mbps > b.Mbps
+}
+
+func median(xs []float64) float64 {
+	s := slices.Clone(xs)
+	slices.Sort(s)
+	n := len(s)
+	if n%2 == 1 {
+		return s[n/2]
+	}
+	return (s[n/2-1] + s[n/2]) / 2
+}
+
+// attempt runs one download test of ip, backing off and retrying if the
+// speed test endpoint rate limits us.
+func (r *Runner) attempt(ctx context.Context, ip netip.Addr) probe.DownloadResult {
+	var dr probe.DownloadResult
+	for attempt := 0; attempt <= r.cfg.Retries; attempt++ {
+		if err := r.backoff.Wait(ctx); err != nil {
+			return canceled(ip)
+		}
+		if err := r.cfg.Throttle.WaitBytes(ctx, r.dlp.Bytes()); err != nil {
+			return canceled(ip)
+		}
+
+		dctx, dcancel := context.WithTimeout(ctx, r.cfg.Download.Timeout)
+		dr = r.dlp.Download(dctx, ip)
+		dcancel()
+
+		if !dr.RateLimited {
+			r.backoff.Reset()
+			return dr
+		}
+		pause := r.backoff.Trigger(dr.RetryAfter)
+		if r.cfg.Verbose {
+			fmt.Fprintf(os.Stderr, "download: ip=%s rate limited (status=%d), backing off %s\n", ip.String(), dr.Status, pause)
+		}
+	}
+	return dr
+}
+
+func canceled(ip netip.Addr) probe.DownloadResult {
+	return probe.DownloadResult{IP: ip, Error: "canceled", When: time.Now()}
+}
+
+// Run tests the first n results of top (all of them if n exceeds len(top))
+// and records the outcome on each. Results keep their order.
+func (r *Runner) Run(ctx context.Context, top []engine.TopResult, n int) {
+	r.RunBy(ctx, top, n, time.Time{})
+}
+
+// RunBy is Run with a deadline (zero for none): a test is only started if
+// the time left covers the Estimate of one, and is cut off at the deadline.
+// It returns the number of tests skipped for lack of time.
+//
+// IPs sharing a colo are tested as far apart as possible (see order), and
+// with Config.UniqueColo only the first of each colo is tested.
+func (r *Runner) RunBy(ctx context.Context, top []engine.TopResult, n int, deadline time.Time) int {
+	n = min(n, len(top))
+	if n <= 0 {
+		return 0
+	}
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	var skipped atomic.Int64
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(r.cfg.Parallel, n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				res := &top[i]
+				if !deadline.IsZero() && !r.fits(time.Until(deadline)) {
+					skipped.Add(1)
+					if r.cfg.Verbose {
+						fmt.Fprintf(os.Stderr, "download: rank=%d ip=%s skipped, not enough time left\n", i+1, res.IP.String())
+					}
+					continue
+				}
+				dr := r.Test(ctx, res.IP)
+				Apply(res, dr)
+				if r.cfg.OnTest != nil {
+					r.cfg.OnTest(i+1, *res)
+				}
+				if r.cfg.Verbose {
+					fmt.Fprintf(os.Stderr, "download: rank=%d ip=%s ok=%v mbps=%.2f ms=%d bytes=%d err=%s\n",
+						i+1, res.IP.String(), dr.OK, dr.Mbps, dr.TotalMS, dr.Bytes, dr.Error)
+				}
+			}
+		}()
+	}
+	for _, i := range r.order(top[:n]) {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return int(skipped.Load())
+}
+
+// order returns the indexes of top in the order to test them: round-robin
+// over the colos, each in rank order, so back-to-back tests hit different
+// POPs. IPs with an unknown colo count as colos of their own. With
+// Config.UniqueColo only the first round is kept.
+func (r *Runner) order(top []engine.TopResult) []int {
+	var colos []string
+	byColo := make(map[string][]int)
+	for i, res := range top {
+		key := res.Colo
+		if key == "" {
+			key = "#" + res.IP.String()
+		}
+		if _, ok := byColo[key]; !ok {
+			colos = append(colos, key)
+		}
+		byColo[key] = append(byColo[key], i)
+	}
+
+	out := make([]int, 0, len(top))
+	for round := 0; len(out) < len(top); round++ {
+		if round > 0 && r.cfg.UniqueColo {
+			break
+		}
+		for _, c := range colos {
+			if idx := byColo[c]; round < len(idx) {
+				out = append(out, idx[round])
+			}
+		}
+	}
+	if r.cfg.Verbose && len(out) < len(top) {
+		fmt.Fprintf(os.Stderr, "download: skipping %d IPs in already tested colos\n", len(top)-len(out))
+	}
+	return out
+}
+
+// fits reports whether a download test is expected to finish in left. The
+// first test always gets its chance, since there is nothing to go by yet.
+func (r *Runner) fits(left time.Duration) bool {
+	r.mu.Lock()
+	measured := len(r.took) > 0
+	r.mu.Unlock()
+	if !measured {
+		return left > 0
+	}
+	return r.Estimate() <= left
+}
+
+// Apply records a download test outcome on res.
+func Apply(res *engine.TopResult, dr probe.DownloadResult) {
+	res.DownloadOK = dr.OK
+	res.DownloadBytes = dr.Bytes
+	res.DownloadMS = dr.TotalMS
+	res.DownloadMbps = dr.Mbps
+	res.DownloadError = dr.Error
+	res.DownloadAttempts = dr.Attempts
+	res.TLSUnverified = res.TLSUnverified || dr.TLSUnverified
+}
+
+// Merge deduplicates results by IP and returns the best n as ranked by
+// Rank. For an IP seen twice it keeps the successful download, then the
+// faster one, then the lower score.
+func Merge(results []engine.TopResult, n int, latencyWeight float64) []engine.TopResult {
+	byIP := make(map[netip.Addr]engine.TopResult, len(results))
+	for _, r := range results {
+		existing, ok := byIP[r.IP]
+		if !ok || better(r, existing) {
+			byIP[r.IP] = r
+		}
+	}
+
+	merged := make([]engine.TopResult, 0, len(byIP))
+	for _, r := range results {
+		if r, ok := byIP[r.IP]; ok {
+			merged = append(merged, r)
+			delete(byIP, r.IP)
+		}
+	}
+	Rank(merged, latencyWeight)
+
+	if len(merged) > n {
+		merged = merged[:n]
+	}
+	return merged
+}
+
+// Rank sorts results by a combined score, best first, and records it as
+// RankScore. Latency and download speed are each scaled to (0, 1] against
+// the best of results, and latencyWeight (clamped to [0, 1]) weighs the
+// former against the latter: 1 ranks by latency alone, 0 by speed alone.
+// IPs without a successful download get no speed credit, so without any
+// download tests the order is the latency order.
+func Rank(results []engine.TopResult, latencyWeight float64) {
+	latencyWeight = max(0, min(1, latencyWeight))
+
+	var bestScore, bestMbps float64
+	for _, r := range results {
+		if r.ScoreMS > 0 && (bestScore == 0 || r.ScoreMS < bestScore) {
+			bestScore = r.ScoreMS
+		}
+		if r.DownloadOK {
+			bestMbps = max(bestMbps, r.DownloadMbps)
+		}
+	}
+
+	for i := range results {
+		r := &results[i]
+		latency := 1.0
+		if r.ScoreMS > 0 {
+			latency = bestScore / r.ScoreMS
+		}
+		speed := 0.0
+		if r.DownloadOK && bestMbps > 0 {
+			speed = r.DownloadMbps / bestMbps
+		}
+		r.RankScore = latencyWeight*latency + (1-latencyWeight)*speed
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].RankScore > results[j].RankScore
+	})
+}
+
+// ScoreOrder returns the IPs of results ordered by probe score alone, the
+// ranking before Rank took download speed into account.
+func ScoreOrder(results []engine.TopResult) []netip.Addr {
+	sorted := slices.Clone(results)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ScoreMS < sorted[j].ScoreMS
+	})
+	ips := make([]netip.Addr, len(sorted))
+	for i, r := range sorted {
+		ips[i] = r.IP
+	}
+	return ips
+}
+
+// better reports whether r should replace existing for the same IP.
+func better(r, existing engine.TopResult) bool {
+	switch {
+	case r.DownloadOK && !existing.DownloadOK:
+		return true
+	case r.DownloadOK && existing.DownloadOK:
+		return r.DownloadMbps > existing.DownloadMbps
+	case !r.DownloadOK && !existing.DownloadOK:
+		return r.ScoreMS < existing.ScoreMS
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+package speedtest
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/engine"
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/probe"
+)
+
+// edge is a speed test endpoint serving every IP from one local server.
+// Each IP has a delay before its body and a list of statuses it answers
+// with before it starts answering 200.
+type edge struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	conns    map[string]netip.Addr // IP dialed, by the client's local address
+	delay    map[netip.Addr]time.Duration
+	statuses map[netip.Addr][]int
+	requests map[netip.Addr]int
+}
+
+func newEdge(t *testing.T) *edge {
+	e := &edge{
+		conns:    make(map[string]netip.Addr),
+		delay:    make(map[netip.Addr]time.Duration),
+		statuses: make(map[netip.Addr][]int),
+		requests: make(map[netip.Addr]int),
+	}
+	e.srv = httptest.NewTLSServer(http.HandlerFunc(e.serve))
+	t.Cleanup(e.srv.Close)
+	return e
+}
+
+func (e *edge) serve(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	ip := e.conns[r.RemoteAddr]
+	e.requests[ip]++
+	delay := e.delay[ip]
+	status := http.StatusOK
+	if s := e.statuses[ip]; len(s) > 0 {
+		status, e.statuses[ip] = s[0], s[1:]
+	}
+	e.mu.Unlock()
+
+	if status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "0")
+	}
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	n, _ := strconv.Atoi(r.URL.Query().Get("bytes"))
+	time.Sleep(delay)
+	_, _ = w.Write(make([]byte, n))
+}
+
+// dial connects to the local server whatever the address, remembering
+// which IP was asked for.
+func (e *edge) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, e.srv.Listener.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	e.conns[c.LocalAddr().String()] = ap.Addr()
+	e.mu.Unlock()
+	return c, nil
+}
+
+func (e *edge) config() probe.DownloadConfig {
+	return probe.DownloadConfig{
+		Timeout:  2 * time.Second,
+		Bytes:    64 << 10,
+		SNI:      "example.com",
+		HostName: "example.com",
+		RootCAs:  e.srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs,
+		Dial:     e.dial,
+	}
+}
+
+var (
+	fastIP = netip.MustParseAddr("198.18.0.1")
+	slowIP = netip.MustParseAddr("198.18.0.2")
+	badIP  = netip.MustParseAddr("198.18.0.3")
+)
+
+func TestRunnerTest(t *testing.T) {
+	e := newEdge(t)
+	e.delay[slowIP] = 150 * time.Millisecond
+	e.statuses[badIP] = []int{http.StatusInternalServerError}
+
+	r := New(Config{Download: e.config(), Confirm: 1})
+	defer r.Close()
+	ctx := context.Background()
+
+	if got, want := r.Estimate(), 2*time.Second; got != want {
+		t.Fatalf("Estimate before any test = %s, want the timeout %s", got, want)
+	}
+
+	fast := r.Test(ctx, fastIP)
+	slow := r.Test(ctx, slowIP)
+	if !fast.OK || !slow.OK {
+		t.Fatalf("downloads failed: fast=%+v slow=%+v", fast, slow)
+	}
+	if fast.Bytes != 64<<10 || fast.Attempts != 1 {
+		t.Errorf("fast: bytes=%d attempts=%d, want %d and 1", fast.Bytes, fast.Attempts, 64<<10)
+	}
+	if fast.Mbps <= slow.Mbps {
+		t.Errorf("fast IP measured %.2f Mbps, not more than the slow one's %.2f", fast.Mbps, slow.Mbps)
+	}
+
+	// A failure is confirmed with a second attempt, which succeeds here.
+	bad := r.Test(ctx, badIP)
+	if !bad.OK || bad.Attempts != 2 {
+		t.Errorf("failed download: ok=%v attempts=%d, want a successful second attempt", bad.OK, bad.Attempts)
+	}
+
+	est := r.Estimate()
+	if est < 50*time.Millisecond || est >= 2*time.Second {
+		t.Errorf("Estimate after three tests (one of them taking 150ms) = %s", est)
+	}
+}
+
+func TestRunnerRateLimit(t *testing.T) {
+	e := newEdge(t)
+	e.statuses[fastIP] = []int{http.StatusTooManyRequests}
+
+	r := New(Config{Download: e.config(), Retries: 1})
+	defer r.Close()
+
+	dr := r.Test(context.Background(), fastIP)
+	if !dr.OK {
+		t.Fatalf("download after a rate limit failed: %+v", dr)
+	}
+	if n := e.requests[fastIP]; n != 2 {
+		t.Errorf("%d requests, want the rate-limited one and a retry", n)
+	}
+}
+
+func TestRunOrder(t *testing.T) {
+	e := newEdge(t)
+	r := New(Config{Download: e.config(), UniqueColo: true})
+	defer r.Close()
+
+	top := []engine.TopResult{{IP: fastIP, ScoreMS: 10}, {IP: slowIP, ScoreMS: 20}, {IP: badIP, ScoreMS: 30}}
+	top[0].Colo, top[1].Colo, top[2].Colo = "SJC", "SJC", "LAX"
+	r.Run(context.Background(), top, len(top))
+
+	if !top[0].DownloadOK || !top[2].DownloadOK {
+		t.Errorf("best IP of each colo not tested: %+v", top)
+	}
+	if top[1].DownloadAttempts != 0 || e.requests[slowIP] != 0 {
+		t.Errorf("second IP of SJC tested despite UniqueColo")
+	}
+}
+
+func TestRank(t *testing.T) {
+	rows := func() []engine.TopResult {
+		return []engine.TopResult{
+			{IP: fastIP, ScoreMS: 100, DownloadOK: true, DownloadMbps: 10},
+			{IP: slowIP, ScoreMS: 50, DownloadOK: true, DownloadMbps: 5},
+			{IP: badIP, ScoreMS: 40},
+		}
+	}
+	for _, tc := range []struct {
+		weight float64
+		want   []netip.Addr
+	}{
+		{1, []netip.Addr{badIP, slowIP, fastIP}},   // latency only
+		{0, []netip.Addr{fastIP, slowIP, badIP}},   // speed only
+		{0.5, []netip.Addr{fastIP, slowIP, badIP}}, // 0.7, 0.65, 0.5
+		{7, []netip.Addr{badIP, slowIP, fastIP}},   // clamped to 1
+	} {
+		got := rows()
+		Rank(got, tc.weight)
+		for i, ip := range tc.want {
+			if got[i].IP != ip {
+				t.Errorf("weight %v: rank %d is %s, want %s", tc.weight, i+1, got[i].IP, ip)
+			}
+		}
+		if tc.weight == 0.5 && got[0].RankScore != 0.7 {
+			t.Errorf("weight 0.5: best RankScore = %v, want 0.7", got[0].RankScore)
+		}
+	}
+
+	// Without download tests the order is the latency order.
+	plain := []engine.TopResult{{IP: fastIP, ScoreMS: 30}, {IP: slowIP, ScoreMS: 20}}
+	Rank(plain, 0.3)
+	if plain[0].IP != slowIP {
+		t.Errorf("without downloads %s ranks first, want the lower latency %s", plain[0].IP, slowIP)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	results := []engine.TopResult{
+		{IP: fastIP, ScoreMS: 30},
+		{IP: slowIP, ScoreMS: 20, DownloadOK: true, DownloadMbps: 5},
+		{IP: fastIP, ScoreMS: 40, DownloadOK: true, DownloadMbps: 8},
+		{IP: slowIP, ScoreMS: 25, DownloadOK: true, DownloadMbps: 6},
+		{IP: badIP, ScoreMS: 50},
+		{IP: badIP, ScoreMS: 45},
+	}
+	merged := Merge(results, 2, 0) // by speed
+	if len(merged) != 2 {
+		t.Fatalf("Merge kept %d results, want 2", len(merged))
+	}
+	// fastIP keeps its successful download, slowIP its faster one.
+	if merged[0].IP != fastIP || merged[0].DownloadMbps != 8 {
+		t.Errorf("first = %s %.0f Mbps, want %s with 8 Mbps", merged[0].IP, merged[0].DownloadMbps, fastIP)
+	}
+	if merged[1].IP != slowIP || merged[1].DownloadMbps != 6 {
+		t.Errorf("second = %s %.0f Mbps, want %s with 6 Mbps", merged[1].IP, merged[1].DownloadMbps, slowIP)
+	}
+
+	all := Merge(results, 10, 1)
+	if len(all) != 3 {
+		t.Fatalf("Merge kept %d IPs, want 3", len(all))
+	}
+	for _, r := range all {
+		if r.IP == badIP && r.ScoreMS != 45 {
+			t.Errorf("without downloads %s kept score %v, want the lower 45", badIP, r.ScoreMS)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Package state manages a state directory holding the cache, per-run result
+// files and logs, so the tool can run unattended (e.g. from a systemd timer)
+// while other services read the most recent result from a fixed path.
+//
+// Layout:
+//
+//	<dir>/cache.json           IP cache
+//	<dir>/latest.json          symlink to the newest results/*.json
+//	<dir>/latest.json.sig      symlink to its signature (with --sign-key)
+//	<dir>/results/<ts>.json    full response of each run
+//	<dir>/logs/<ts>.log        stderr of each invocation
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/atomicfile"
+)
+
+const (
+	// DefaultKeep is the default number of result and log files retained.
+	DefaultKeep = 10
+
+	// LatestName is the name of the symlink pointing at the newest result.
+	LatestName = "latest.json"
+
+	cacheName  = "cache.json"
+	resultsDir = "results"
+	logsDir    = "logs"
+
+	// timeLayout sorts lexically in chronological order.
+	timeLayout = "20060102T150405Z"
+)
+
+// Dir is a state directory.
+type Dir struct {
+	path string
+	keep int
+
+	// Sign, if set, signs each saved result file and returns the signature
+	// file path; latest.json.sig then points at the newest signature.
+	Sign func(path string) (string, error)
+}
+
+// Open creates (if needed) and returns the state directory at path, keeping
+// the newest keep result and log files (keep <= 0 uses DefaultKeep).
+func Open(path string, keep int) (*Dir, error) {
+	if path == "" {
+		return nil, fmt.Errorf("state dir path is empty")
+	}
+	if keep <= 0 {
+		keep = DefaultKeep
+	}
+	for _, sub := range []string{resultsDir, logsDir} {
+		if err := os.MkdirAll(filepath.Join(path, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &Dir{path: path, keep: keep}, nil
+}
+
+// Path returns the state directory path.
+func (d *Dir) Path() string { return d.path }
+
+// CachePath returns the path of the IP cache file.
+func (d *Dir) CachePath() string { return filepath.Join(d.path, cacheName) }
+
+// LatestPath returns the path of the latest-result symlink.
+func (d *Dir) LatestPath() string { return filepath.Join(d.path, LatestName) }
+
+// SaveResult writes v as indented JSON to results/<ts>.json, repoints
+// latest.json at it and prunes old results. Readers of latest.json never see
+// a partially written file.
+func (d *Dir) SaveResult(v any, when time.Time) (string, error) {
+	name := when.UTC().Format(timeLayout) + ".json"
+	path := filepath.Join(d.path, resultsDir, name)
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := atomicfile.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return "", err
+	}
+
+	if d.Sign != nil {
+		sigPath, err := d.Sign(path)
+		if err != nil {
+			return "", err
+		}
+		if err := replaceSymlink(filepath.Join(resultsDir, filepath.Base(sigPath)), d.LatestPath()+".sig"); err != nil {
+			return "", err
+		}
+	}
+	if err := replaceSymlink(filepath.Join(resultsDir, name), d.LatestPath()); err != nil {
+		return "", err
+	}
+
+	return path, d.prune(resultsDir, ".json")
+}
+
+// ResultFile is a run result saved in a state directory.
+type ResultFile struct {
+	Path string
+	When time.Time
+}
+
+// ListResults returns the results saved in the state directory at path,
+// oldest first. Unlike Open it does not create the directory.
+func ListResults(path string) ([]ResultFile, error) {
+	entries, err := os.ReadDir(filepath.Join(path, resultsDir))
+	if err != nil {
+		return nil, err
+	}
+	var out []ResultFile
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		when, err := time.Parse(timeLayout, strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			continue // not ours
+		}
+		out = append(out, ResultFile{Path: filepath.Join(path, resultsDir, name), When: when})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].When.Before(out[j].When) })
+	return out, nil
+}
+
+// replaceSymlink points link at target, swapping via rename so readers never
+// see the link missing.
+func replaceSymlink(target, link string) error {
+	tmp := link + ".tmp"
+	_ = os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// TeeStderr copies everything written to os.Stderr into logs/<ts>.log as
+// well, and prunes old logs. The returned function restores os.Stderr and
+// flushes the log; call it before exiting.
+func (d *Dir) TeeStderr(when time.Time) (func(), error) {
+	name := when.UTC().Format(timeLayout) + ".log"
+	f, err := os.OpenFile(filepath.Join(d.path, logsDir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.prune(logsDir, ".log"); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	orig := os.Stderr
+	os.Stderr = w
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(io.MultiWriter(orig, f), r)
+	}()
+
+	return func() {
+		os.Stderr = orig
+		_ = w.Close()
+		<-done
+		_ = r.Close()
+		_ = f.Close()
+	}, nil
+}
+
+// prune removes all but the newest d.keep files with suffix in sub, along
+// with their signatures.
+func (d *Dir) prune(sub, suffix string) error {
+	dir := filepath.Join(d.path, sub)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), suffix) {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) <= d.keep {
+		return nil
+	}
+	sort.Strings(names)
+	for _, n := range names[:len(names)-d.keep] {
+		for _, p := range []string{n, n + ".sig"} {
+			if err := os.Remove(filepath.Join(dir, p)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package store
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redis keeps values in a Redis server under a common key prefix. It
+// speaks just enough of the protocol for AUTH, SELECT, GET and SET over a
+// single connection, redialed after errors.
+type Redis struct {
+	addr     string
+	tls      bool
+	password string
+	db       int
+	prefix   string
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+const redisTimeout = 10 * time.Second
+
+func openRedis(u *url.URL) (*Redis, error) {
+	r := &Redis{
+		addr:   u.Host,
+		tls:    strings.EqualFold(u.Scheme, "rediss"),
+		prefix: "mcis:",
+	}
+	if r.addr == "" {
+		return nil, errors.New("state backend: redis URL needs a host")
+	}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("state backend: invalid redis db %q", db)
+		}
+		r.db = n
+	}
+	if p, ok := u.Query()["prefix"]; ok {
+		r.prefix = p[0]
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.dial(); err != nil {
+		return nil, fmt.Errorf("state backend: %w", err)
+	}
+	return r, nil
+}
+
+// dial connects and authenticates. Callers hold r.mu.
+func (r *Redis) dial() error {
+	d := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if r.tls {
+		host, _, _ := net.SplitHostPort(r.addr)
+		conn, err = tls.DialWithDialer(d, "tcp", r.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = d.Dial("tcp", r.addr)
+	}
+	if err != nil {
+		return err
+	}
+	r.conn, r.rd = conn, bufio.NewReader(conn)
+
+	if r.password != "" {
+		if _, err := r.do("AUTH", r.password); err != nil {
+			r.drop()
+			return err
+		}
+	}
+	if r.db != 0 {
+		if _, err := r.do("SELECT", strconv.Itoa(r.db)); err != nil {
+			r.drop()
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Redis) drop() {
+	if r.conn != nil {
+		_ = r.conn.Close()
+		r.conn, r.rd = nil, nil
+	}
+}
+
+// call runs a command, redialing first if the connection was dropped.
+func (r *Redis) call(args ...string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		if err := r.dial(); err != nil {
+			return nil, err
+		}
+	}
+	v, err := r.do(args...)
+	var re redisError
+	if err != nil && !errors.As(err, &re) {
+		r.drop()
+	}
+	return v, err
+}
+
+// redisError is an error reply; the connection stays usable.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// errNil marks a nil bulk reply.
+var errNil = errors.New("redis: nil")
+
+// do sends one command and reads its reply. Callers hold r.mu.
+func (r *Redis) do(args ...string) ([]byte, error) {
+	_ = r.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(r.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	line, err := r.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad reply %q", line)
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r.rd, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+func (r *Redis) Get(key string) ([]byte, error) {
+	v, err := r.call("GET", r.prefix+key)
+	if errors.Is(err, errNil) {
+		return nil, ErrNotFound
+	}
+	return v, err
+}
+
+func (r *Redis) Put(key string, data []byte) error {
+	_, err := r.call("SET", r.prefix+key, string(data))
+	return err
+}
+
+func (r *Redis) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.drop()
+	return nil
+}
+
+func (r *Redis) String() string {
+	scheme := "redis"
+	if r.tls {
+		scheme = "rediss"
+	}
+	return fmt.Sprintf("%s://%s/%d (prefix %q)", scheme, r.addr, r.db, r.prefix)
+}
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	_ "modernc.org/sqlite" // pure Go driver, so builds stay CGO_ENABLED=0
+)
+
+// SQLite keeps values in a table of a local SQLite database file, which
+// several mcis processes on one host (or on a shared volume) can use at
+// once.
+type SQLite struct {
+	path string
+	db   *sql.DB
+}
+
+// sqliteBusyTimeout is how long a write waits for another process holding
+// the database lock.
+const sqliteBusyTimeout = 10 * time.Second
+
+func openSQLite(u *url.URL) (*SQLite, error) {
+	// sqlite:///abs/path.db and sqlite:rel/path.db
+	path := u.Opaque
+	if path == "" {
+		path = u.Host + u.Path
+	}
+	if path == "" {
+		return nil, errors.New("state backend: sqlite URL needs a database path")
+	}
+	s, err := OpenSQLite(path)
+	if err != nil {
+		return nil, fmt.Errorf("state backend: %w", err)
+	}
+	return s, nil
+}
+
+// OpenSQLite opens (creating it if needed) the SQLite database at path.
+func OpenSQLite(path string) (*SQLite, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)",
+		url.PathEscape(path), sqliteBusyTimeout.Milliseconds())
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS kv (
+		key     TEXT PRIMARY KEY,
+		value   BLOB NOT NULL,
+		updated INTEGER NOT NULL
+	)`); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS runs (
+		id       INTEGER PRIMARY KEY AUTOINCREMENT,
+		finished INTEGER NOT NULL,
+		value    BLOB NOT NULL
+	)`); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &SQLite{path: path, db: db}, nil
+}
+
+func (s *SQLite) Get(key string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow(`SELECT value FROM kv WHERE key = ?`, key).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *SQLite) Put(key string, data []byte) error {
+	_, err := s.db.Exec(`INSERT INTO kv (key, value, updated) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, updated = excluded.updated`,
+		key, data, time.Now().Unix())
+	return err
+}
+
+// Run is the results of one search kept in the run history.
+type Run struct {
+	When time.Time
+	Data []byte
+}
+
+// AddRun appends the results of a search that finished at when to the run
+// history, keeping only the newest keep runs (all of them if keep <= 0).
+func (s *SQLite) AddRun(when time.Time, data []byte, keep int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.Exec(`INSERT INTO runs (finished, value) VALUES (?, ?)`, when.UnixMilli(), data); err != nil {
+		return err
+	}
+	if keep > 0 {
+		if _, err := tx.Exec(`DELETE FROM runs WHERE id NOT IN
+			(SELECT id FROM runs ORDER BY id DESC LIMIT ?)`, keep); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Runs returns the run history, oldest first.
+func (s *SQLite) Runs() ([]Run, error) {
+	rows, err := s.db.Query(`SELECT finished, value FROM runs ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var runs []Run
+	for rows.Next() {
+		var ms int64
+		var r Run
+		if err := rows.Scan(&ms, &r.Data); err != nil {
+			return nil, err
+		}
+		r.When = time.UnixMilli(ms)
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLite) String() string {
+	return "sqlite:" + s.path
+}
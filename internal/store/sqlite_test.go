@@ -0,0 +1,72 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	b, err := Open("sqlite://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get("cache"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of a missing key: err = %v, want ErrNotFound", err)
+	}
+	if err := b.Put("cache", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put("cache", []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The value survives reopening, here through the relative form.
+	t.Chdir(filepath.Dir(path))
+	b, err = Open("sqlite:state.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = b.Close() }()
+	data, err := b.Get("cache")
+	if err != nil || string(data) != "two" {
+		t.Fatalf("Get after reopening = %q, %v; want \"two\"", data, err)
+	}
+	if !Local("sqlite:state.db") || Local("redis://localhost") {
+		t.Error("Local: sqlite must count as local and redis as remote")
+	}
+}
+
+func TestSQLiteRuns(t *testing.T) {
+	s, err := OpenSQLite(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+
+	start := time.UnixMilli(1_700_000_000_000)
+	for i, v := range []string{"a", "b", "c", "d"} {
+		if err := s.AddRun(start.Add(time.Duration(i)*time.Hour), []byte(v), 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runs, err := s.Runs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	for _, r := range runs {
+		got += string(r.Data)
+	}
+	if got != "bcd" {
+		t.Fatalf("runs = %q, want the newest 3 oldest first (\"bcd\")", got)
+	}
+	if !runs[0].When.Equal(start.Add(time.Hour)) {
+		t.Errorf("first run at %v, want %v", runs[0].When, start.Add(time.Hour))
+	}
+}
@@ -0,0 +1,84 @@
+// Package store abstracts where the cache and the latest results are kept,
+// so a fleet of hosts can share them through a central server instead of
+// each keeping its own files.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ErrNotFound is returned by Backend.Get for a key that was never stored.
+var ErrNotFound = errors.New("not found")
+
+// Backend stores opaque values by key.
+type Backend interface {
+	Get(key string) ([]byte, error)
+	Put(key string, data []byte) error
+	Close() error
+
+	// String describes the backend for log messages, without secrets.
+	String() string
+}
+
+// Open opens the backend described by spec:
+//
+//	file                              local files; keys are file paths
+//	redis://[:password@]host:port[/db][?prefix=mcis:]
+//	rediss://...                      Redis over TLS
+//	sqlite:///abs/path.db             SQLite database file (sqlite:rel/path.db)
+//
+// An empty spec is the file backend.
+func Open(spec string) (Backend, error) {
+	if spec == "" || spec == "file" {
+		return File{}, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("state backend: %w", err)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "redis", "rediss":
+		return openRedis(u)
+	case "sqlite", "sqlite3":
+		return openSQLite(u)
+	default:
+		return nil, fmt.Errorf("state backend: unknown scheme %q (want file, redis or sqlite)", u.Scheme)
+	}
+}
+
+// Local reports whether the backend described by spec keeps its data on
+// this host (file or SQLite), so using it needs no network.
+func Local(spec string) bool {
+	if spec == "" || spec == "file" {
+		return true
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return false
+	}
+	s := strings.ToLower(u.Scheme)
+	return s == "sqlite" || s == "sqlite3"
+}
+
+// File keeps each value in the file named by its key.
+type File struct{}
+
+func (File) Get(key string) ([]byte, error) {
+	data, err := os.ReadFile(key)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (File) Put(key string, data []byte) error {
+	return os.WriteFile(key, data, 0o600)
+}
+
+func (File) Close() error { return nil }
+
+func (File) String() string { return "file" }
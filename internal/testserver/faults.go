@@ -0,0 +1,147 @@
+package testserver
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Fault kinds.
+const (
+	// FaultTimeout leaves connections and requests unanswered.
+	FaultTimeout = "timeout"
+	// FaultLatency adds Fault.Latency to every round trip.
+	FaultLatency = "latency"
+	// FaultRateLimit answers requests with 429 and a Retry-After.
+	FaultRateLimit = "ratelimit"
+)
+
+// Fault is a burst of misbehaviour injected into a running server, from
+// Start to Start+Duration after Inject, on the addresses in Prefix (all
+// of them if it is zero).
+type Fault struct {
+	Kind     string
+	Start    time.Duration
+	Duration time.Duration
+	Prefix   netip.Prefix
+
+	// Latency is the delay FaultLatency adds (default 500ms), and the
+	// Retry-After FaultRateLimit sends (default 1s).
+	Latency time.Duration
+}
+
+func (f Fault) String() string {
+	s := fmt.Sprintf("%s@%s+%s", f.Kind, f.Start, f.Duration)
+	if f.Latency > 0 {
+		s += "=" + f.Latency.String()
+	}
+	if f.Prefix.IsValid() {
+		s += "/" + f.Prefix.String()
+	}
+	return s
+}
+
+// ParseFaults parses a comma-separated list of faults, each written
+// kind@start+duration[=latency][/prefix], e.g.
+// "timeout@3s+2s,latency@6s+2s=300ms,ratelimit@9s+1s/198.18.0.0/16".
+func ParseFaults(spec string) ([]Fault, error) {
+	var faults []Fault
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		f, err := parseFault(item)
+		if err != nil {
+			return nil, fmt.Errorf("fault %q: %w", item, err)
+		}
+		faults = append(faults, f)
+	}
+	return faults, nil
+}
+
+func parseFault(s string) (Fault, error) {
+	var f Fault
+	kind, rest, ok := strings.Cut(s, "@")
+	if !ok {
+		return f, fmt.Errorf("want kind@start+duration")
+	}
+	switch kind {
+	case FaultTimeout, FaultLatency, FaultRateLimit:
+		f.Kind = kind
+	default:
+		return f, fmt.Errorf("unknown kind %q (want %s, %s or %s)", kind, FaultTimeout, FaultLatency, FaultRateLimit)
+	}
+	if timing, prefix, ok := strings.Cut(rest, "/"); ok {
+		p, err := netip.ParsePrefix(prefix)
+		if err != nil {
+			return f, err
+		}
+		f.Prefix, rest = p.Masked(), timing
+	}
+	if timing, latency, ok := strings.Cut(rest, "="); ok {
+		d, err := time.ParseDuration(latency)
+		if err != nil || d <= 0 {
+			return f, fmt.Errorf("invalid latency %q", latency)
+		}
+		f.Latency, rest = d, timing
+	}
+	start, dur, ok := strings.Cut(rest, "+")
+	if !ok {
+		return f, fmt.Errorf("want kind@start+duration")
+	}
+	var err error
+	if f.Start, err = time.ParseDuration(start); err != nil || f.Start < 0 {
+		return f, fmt.Errorf("invalid start %q", start)
+	}
+	if f.Duration, err = time.ParseDuration(dur); err != nil || f.Duration <= 0 {
+		return f, fmt.Errorf("invalid duration %q", dur)
+	}
+	return f, nil
+}
+
+// Event is one injected fault hitting a connection or request.
+type Event struct {
+	// At is the time since Inject.
+	At   time.Duration `json:"at_ns"`
+	Kind string        `json:"kind"`
+	IP   netip.Addr    `json:"ip"`
+}
+
+// Inject schedules faults, timed from now, replacing any injected before,
+// and clears the event log.
+func (s *Server) Inject(faults ...Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = faults
+	s.injected = time.Now()
+	s.events = nil
+}
+
+// Events returns the log of injected faults, oldest first.
+func (s *Server) Events() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Event(nil), s.events...)
+}
+
+// fault returns the fault of kind active for ip now, logging it, and
+// whether there is one. Called with s.mu held.
+func (s *Server) fault(kind string, ip netip.Addr) (Fault, bool) {
+	if len(s.faults) == 0 {
+		return Fault{}, false
+	}
+	at := time.Since(s.injected)
+	for _, f := range s.faults {
+		if f.Kind != kind || at < f.Start || at >= f.Start+f.Duration {
+			continue
+		}
+		if f.Prefix.IsValid() && !f.Prefix.Contains(ip) {
+			continue
+		}
+		s.events = append(s.events, Event{At: at, Kind: kind, IP: ip})
+		return f, true
+	}
+	return Fault{}, false
+}
@@ -0,0 +1,363 @@
+// Package testserver is a fake CDN edge for exercising the search without
+// a network: one local HTTPS server answering /cdn-cgi/trace (and
+// /__down for download tests) for any number of made-up IPs, each with a
+// latency and loss profile of its own. Probes reach it through Dial,
+// which takes the place of the probe dialer (probe.Config.Dial) and
+// applies the profile of the address dialed: the connect and each round
+// trip are delayed by its latency, lost connections hang until the probe
+// gives up, and refused ones fail right away. Bursts of timeouts, latency
+// spikes and rate limiting can be injected mid-run (see Inject), and are
+// logged for checking how the search coped.
+package testserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Profile is how the addresses of a Rule behave.
+type Profile struct {
+	// Latency is the round-trip time of the path, added to the connect
+	// and to every request/response exchange; Jitter adds up to as much
+	// again at random, drawn per connection.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Loss is the share of connections that are never answered, so the
+	// probe times out.
+	Loss float64
+
+	// Refuse makes every connection fail with "connection refused".
+	Refuse bool
+
+	// Status is the HTTP status answered (0 = 200); RetryAfter is sent
+	// along with a 429.
+	Status     int
+	RetryAfter time.Duration
+
+	// Colo is the data center the trace reports (default "SJC").
+	Colo string
+}
+
+// Rule gives the addresses in Prefix a Profile, on Port only if it is not
+// 0. The most specific rule matching an address wins, one with a port
+// before one without.
+type Rule struct {
+	Prefix  netip.Prefix
+	Port    uint16
+	Profile Profile
+}
+
+// Server is a running fake edge.
+type Server struct {
+	rules []Rule
+	ln    net.Listener
+	srv   *http.Server
+	ca    *authority
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	conns map[string]link // by the client side's local address
+	dials map[netip.Addr]int
+
+	// Injected faults (see faults.go)
+	faults   []Fault
+	injected time.Time
+	events   []Event
+}
+
+// link is a dialed connection as the server sees it.
+type link struct {
+	ip      netip.Addr
+	profile Profile
+}
+
+// New starts a fake edge serving rules; addresses no rule matches do not
+// answer, like unused address space. seed makes the losses and jitter
+// reproducible (0 = time-based).
+func New(seed int64, rules ...Rule) (*Server, error) {
+	ca, err := newAuthority()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	s := &Server{
+		rules: make([]Rule, len(rules)),
+		ln:    ln,
+		ca:    ca,
+		rng:   rand.New(rand.NewSource(seed)),
+		conns: make(map[string]link),
+		dials: make(map[netip.Addr]int),
+	}
+	for i, r := range rules {
+		r.Prefix = r.Prefix.Masked()
+		s.rules[i] = r
+	}
+	// Most specific first.
+	sort.SliceStable(s.rules, func(i, j int) bool {
+		a, b := s.rules[i], s.rules[j]
+		if a.Prefix.Bits() != b.Prefix.Bits() {
+			return a.Prefix.Bits() > b.Prefix.Bits()
+		}
+		return a.Port != 0 && b.Port == 0
+	})
+
+	s.srv = &http.Server{
+		Handler:           http.HandlerFunc(s.serve),
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig: &tls.Config{
+			GetCertificate: ca.certificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		},
+		ConnState: func(c net.Conn, st http.ConnState) {
+			if st == http.StateClosed || st == http.StateHijacked {
+				s.mu.Lock()
+				delete(s.conns, c.RemoteAddr().String())
+				s.mu.Unlock()
+			}
+		},
+	}
+	go func() { _ = s.srv.ServeTLS(ln, "", "") }()
+	return s, nil
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+// RootCAs returns the pool the server's certificates verify against
+// (probe.Config.RootCAs).
+func (s *Server) RootCAs() *x509.CertPool {
+	return s.ca.pool
+}
+
+// Dials returns how many connections were dialed to each address.
+func (s *Server) Dials() map[netip.Addr]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[netip.Addr]int, len(s.dials))
+	for ip, n := range s.dials {
+		out[ip] = n
+	}
+	return out
+}
+
+// profile returns the profile of ip:port and whether a rule matched.
+func (s *Server) profile(ip netip.Addr, port uint16) (Profile, bool) {
+	for _, r := range s.rules {
+		if r.Prefix.Contains(ip) && (r.Port == 0 || r.Port == port) {
+			return r.Profile, true
+		}
+	}
+	return Profile{}, false
+}
+
+// Dial connects to the fake edge as if to addr (an IP and port), with the
+// profile of that address. It has the signature of probe.DialFunc.
+func (s *Server) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("testserver: %w", err)
+	}
+	ip := ap.Addr().Unmap()
+	p, ok := s.profile(ip, ap.Port())
+
+	s.mu.Lock()
+	s.dials[ip]++
+	lost := !ok || s.rng.Float64() < p.Loss
+	rtt := p.Latency
+	if p.Jitter > 0 {
+		rtt += time.Duration(s.rng.Int63n(int64(p.Jitter)))
+	}
+	if ok && !p.Refuse {
+		if _, hit := s.fault(FaultTimeout, ip); hit {
+			lost = true
+		} else if f, hit := s.fault(FaultLatency, ip); hit {
+			rtt += spike(f)
+		}
+	}
+	s.mu.Unlock()
+
+	switch {
+	case lost:
+		<-ctx.Done()
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+	case p.Refuse:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+	}
+	if err := sleep(ctx, rtt); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", s.ln.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.conns[c.LocalAddr().String()] = link{ip: ip, profile: p}
+	s.mu.Unlock()
+	return &delayedConn{Conn: c, remote: net.TCPAddrFromAddrPort(ap), rtt: rtt, closed: make(chan struct{})}, nil
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	// Dial registers a connection before handing it out, so it is known
+	// by the time a request arrives on it.
+	s.mu.Lock()
+	l, ok := s.conns[r.RemoteAddr]
+	var timeout, limited, slow bool
+	var f Fault
+	if ok {
+		_, timeout = s.fault(FaultTimeout, l.ip)
+		if !timeout {
+			f, limited = s.fault(FaultRateLimit, l.ip)
+		}
+		if !timeout && !limited {
+			f, slow = s.fault(FaultLatency, l.ip)
+		}
+	}
+	s.mu.Unlock()
+	p := l.profile
+	switch {
+	case !ok:
+		http.Error(w, "unknown connection", http.StatusInternalServerError)
+		return
+	case timeout:
+		<-r.Context().Done()
+		return
+	case limited:
+		retry := f.Latency
+		if retry <= 0 {
+			retry = time.Second
+		}
+		p.Status, p.RetryAfter = http.StatusTooManyRequests, retry
+	case slow:
+		if sleep(r.Context(), spike(f)) != nil {
+			return
+		}
+	}
+	if p.Status != 0 && p.Status != http.StatusOK {
+		if p.Status == http.StatusTooManyRequests && p.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(p.RetryAfter.Round(time.Second)/time.Second)))
+		}
+		http.Error(w, http.StatusText(p.Status), p.Status)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/__down":
+		n, _ := strconv.ParseInt(r.URL.Query().Get("bytes"), 10, 64)
+		w.Header().Set("Content-Length", strconv.FormatInt(max(n, 0), 10))
+		buf := make([]byte, 32<<10)
+		for n > 0 {
+			k, err := w.Write(buf[:min(n, int64(len(buf)))])
+			if err != nil {
+				return
+			}
+			n -= int64(k)
+		}
+	default:
+		colo := p.Colo
+		if colo == "" {
+			colo = "SJC"
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Server", "cloudflare")
+		fmt.Fprintf(w, "fl=1f1\nh=%s\nip=127.0.0.1\nts=%.3f\nvisit_scheme=https\nuag=%s\ncolo=%s\nsliver=none\nhttp=%s\nloc=US\ntls=TLSv1.3\nsni=plaintext\nwarp=off\ngateway=off\nrbi=off\nkex=X25519\n",
+			r.Host, float64(time.Now().UnixMilli())/1000, r.UserAgent(), colo, protoName(r))
+	}
+}
+
+func protoName(r *http.Request) string {
+	if r.ProtoMajor == 2 {
+		return "http/2"
+	}
+	return "http/1.1"
+}
+
+// delayedConn is the client side of a connection to the fake edge. It
+// reports the fake address as its remote address and delays the first
+// read after each write by the round-trip time, so a TLS handshake or a
+// request costs one round trip, as on a real path.
+type delayedConn struct {
+	net.Conn
+	remote net.Addr
+	rtt    time.Duration
+
+	mu      sync.Mutex
+	pending bool
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (c *delayedConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *delayedConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.pending = true
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *delayedConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	wait := c.pending
+	c.pending = false
+	c.mu.Unlock()
+	if wait && c.rtt > 0 {
+		t := time.NewTimer(c.rtt)
+		select {
+		case <-t.C:
+		case <-c.closed:
+			t.Stop()
+			return 0, net.ErrClosed
+		}
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *delayedConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// spike returns the latency a FaultLatency adds.
+func spike(f Fault) time.Duration {
+	if f.Latency > 0 {
+		return f.Latency
+	}
+	return 500 * time.Millisecond
+}
+
+// sleep waits for d, or returns the error of ctx if it ends first.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
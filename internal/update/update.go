@@ -0,0 +1,305 @@
+// Package update checks GitHub releases for a newer mcis and replaces the
+// running binary with it. Release assets are the archives the release
+// workflow publishes, "mcis-<tag>-<goos>-<goarch>.tar.gz" (.zip on
+// Windows), each with a .sha256 checksum and, when the release is signed,
+// an ed25519 .sig signature (see internal/sign) next to it.
+package update
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/zhaiiker/montecarlo-ip-searcher/internal/sign"
+)
+
+// DefaultRepo is the GitHub repository releases are looked up in.
+const DefaultRepo = "zhaiiker/montecarlo-ip-searcher"
+
+// APIBase is the GitHub API endpoint.
+var APIBase = "https://api.github.com"
+
+// maxArchive bounds the size of a downloaded release archive.
+const maxArchive = 256 << 20
+
+// ErrNoAsset is returned when a release has no archive for the platform.
+var ErrNoAsset = errors.New("release has no build for this platform")
+
+// ErrNoChecksum is returned when a release archive has no SHA-256
+// checksum; such an archive is never installed.
+var ErrNoChecksum = errors.New("release archive has no SHA-256 checksum")
+
+// ErrNoSignature is returned when a signature is required but the release
+// archive has none.
+var ErrNoSignature = errors.New("release archive is not signed")
+
+// Release is a published GitHub release.
+type Release struct {
+	Tag    string  `json:"tag_name"`
+	URL    string  `json:"html_url"`
+	Assets []Asset `json:"assets"`
+}
+
+// Asset is a file attached to a release.
+type Asset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+	Size int64  `json:"size"`
+}
+
+// Latest returns the latest release of repo ("owner/name").
+func Latest(ctx context.Context, client *http.Client, repo string) (Release, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, APIBase+"/repos/"+repo+"/releases/latest", nil)
+	if err != nil {
+		return Release{}, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return Release{}, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return Release{}, fmt.Errorf("github releases: %s", resp.Status)
+	}
+	var r Release
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return Release{}, fmt.Errorf("github releases: %w", err)
+	}
+	return r, nil
+}
+
+// Archive returns the release archive for goos/goarch with its SHA-256
+// checksum file and, if published, its signature file.
+func (r Release) Archive(goos, goarch string) (archive, sum Asset, sig *Asset, err error) {
+	suffix := "-" + goos + "-" + goarch + ".tar.gz"
+	if goos == "windows" {
+		suffix = "-" + goos + "-" + goarch + ".zip"
+	}
+	for _, a := range r.Assets {
+		if strings.HasSuffix(a.Name, suffix) {
+			archive = a
+			break
+		}
+	}
+	if archive.Name == "" {
+		return Asset{}, Asset{}, nil, fmt.Errorf("%w (%s/%s)", ErrNoAsset, goos, goarch)
+	}
+	for _, a := range r.Assets {
+		switch a.Name {
+		case archive.Name + ".sha256":
+			sum = a
+		case archive.Name + sign.SigSuffix:
+			sig = &a
+		}
+	}
+	if sum.Name == "" {
+		return Asset{}, Asset{}, nil, fmt.Errorf("%s: %w", archive.Name, ErrNoChecksum)
+	}
+	return archive, sum, sig, nil
+}
+
+// Download fetches archive and checks it against the SHA-256 checksum
+// published with it. If pub is set the archive must also carry a valid
+// signature by that key.
+func Download(ctx context.Context, client *http.Client, archive, sum Asset, sig *Asset, pub ed25519.PublicKey) ([]byte, error) {
+	if pub != nil && sig == nil {
+		return nil, fmt.Errorf("%s: %w", archive.Name, ErrNoSignature)
+	}
+	data, err := fetch(ctx, client, archive.URL, maxArchive)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", archive.Name, err)
+	}
+	want, err := fetch(ctx, client, sum.URL, 1<<10)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", sum.Name, err)
+	}
+	fields := strings.Fields(string(want))
+	got := sha256.Sum256(data)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], hex.EncodeToString(got[:])) {
+		return nil, fmt.Errorf("%s: checksum mismatch", archive.Name)
+	}
+	if pub != nil {
+		s, err := fetch(ctx, client, sig.URL, 1<<10)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", sig.Name, err)
+		}
+		if err := sign.Verify(pub, data, s); err != nil {
+			return nil, fmt.Errorf("%s: %w", sig.Name, err)
+		}
+	}
+	return data, nil
+}
+
+func fetch(ctx context.Context, client *http.Client, url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errors.New("too large")
+	}
+	return data, nil
+}
+
+// Extract returns the file named binary (at any depth) from a release
+// archive, a .zip if zipped is set and a .tar.gz otherwise.
+func Extract(data []byte, zipped bool, binary string) ([]byte, error) {
+	if zipped {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			if path.Base(f.Name) != binary || f.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer func() { _ = rc.Close() }()
+			return io.ReadAll(io.LimitReader(rc, maxArchive))
+		}
+		return nil, fmt.Errorf("archive has no %s", binary)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("archive has no %s", binary)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag == tar.TypeReg && path.Base(h.Name) == binary {
+			return io.ReadAll(io.LimitReader(tr, maxArchive))
+		}
+	}
+}
+
+// Replace swaps the executable at exe for bin. The new file is written next
+// to it and renamed over it, so a failed update leaves the old binary in
+// place. Windows cannot overwrite a running executable, so there the old one
+// is first moved aside to exe+".old".
+func Replace(exe string, bin []byte) error {
+	info, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(exe), "."+filepath.Base(exe)+".new-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer func() { _ = os.Remove(tmpPath) }()
+	if _, err := tmp.Write(bin); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, info.Mode().Perm()|0o111); err != nil {
+		return err
+	}
+
+	old := exe + ".old"
+	_ = os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, exe); err != nil {
+		_ = os.Rename(old, exe)
+		return err
+	}
+	// Windows keeps the running binary locked; it is removed next time.
+	_ = os.Remove(old)
+	return nil
+}
+
+// Newer reports whether version tag a is newer than b. Tags are compared as
+// dotted numbers with an optional "v" prefix; anything after "-" or "+" is
+// ignored. A version that doesn't parse (such as "dev") is older than any
+// that does.
+func Newer(a, b string) bool {
+	va, okA := parse(a)
+	vb, okB := parse(b)
+	switch {
+	case !okA:
+		return false
+	case !okB:
+		return true
+	}
+	for i := 0; i < max(len(va), len(vb)); i++ {
+		var x, y int
+		if i < len(va) {
+			x = va[i]
+		}
+		if i < len(vb) {
+			y = vb[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+// IsRelease reports whether v is a release version, as opposed to a
+// development build.
+func IsRelease(v string) bool {
+	_, ok := parse(v)
+	return ok
+}
+
+func parse(v string) ([]int, bool) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	if v == "" {
+		return nil, false
+	}
+	var out []int
+	for _, p := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		out = append(out, n)
+	}
+	return out, true
+}
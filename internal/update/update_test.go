@@ -0,0 +1,67 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDownload(t *testing.T) {
+	const name = "mcis-v1.2.3-linux-amd64.tar.gz"
+	archive := []byte("release archive")
+	digest := sha256.Sum256(archive)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"/" + name:             string(archive),
+		"/" + name + ".sha256": hex.EncodeToString(digest[:]) + "  " + name + "\n",
+		"/" + name + ".sig":    base64.StdEncoding.EncodeToString(ed25519.Sign(priv, archive)) + "\n",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(data))
+	}))
+	defer srv.Close()
+
+	asset := func(n string) Asset { return Asset{Name: n, URL: srv.URL + "/" + n} }
+	rel := Release{Assets: []Asset{asset(name), asset(name + ".sha256"), asset(name + ".sig")}}
+	a, sum, sig, err := rel.Archive("linux", "amd64")
+	if err != nil || sig == nil {
+		t.Fatalf("Archive: sig=%v err=%v", sig, err)
+	}
+	ctx := context.Background()
+
+	if _, err := Download(ctx, srv.Client(), a, sum, sig, pub); err != nil {
+		t.Fatalf("signed download: %v", err)
+	}
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := Download(ctx, srv.Client(), a, sum, sig, other); err == nil {
+		t.Error("download signed by another key accepted")
+	}
+	if _, err := Download(ctx, srv.Client(), a, sum, nil, pub); !errors.Is(err, ErrNoSignature) {
+		t.Errorf("unsigned download with a key: err = %v, want ErrNoSignature", err)
+	}
+
+	files["/"+name] = "tampered archive"
+	if _, err := Download(ctx, srv.Client(), a, sum, sig, nil); err == nil {
+		t.Error("archive not matching its checksum accepted")
+	}
+
+	rel.Assets = rel.Assets[:1]
+	if _, _, _, err := rel.Archive("linux", "amd64"); !errors.Is(err, ErrNoChecksum) {
+		t.Errorf("Archive without a checksum: err = %v, want ErrNoChecksum", err)
+	}
+}